@@ -5,5 +5,7 @@ mkdir dist
 export GO111MODULE=on
 go build -o dist/shoreline shoreline.go
 go build -o dist/user-roles tools/user-roles.go
+go build -o dist/duplicate-users ./tools/duplicate-users
+go build -o dist/migrations ./tools/migrations
 cp start.sh dist/
 cp env.sh dist/
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net/http"
@@ -20,6 +21,7 @@ import (
 	"github.com/tidepool-org/go-common/clients/highwater"
 	"github.com/tidepool-org/go-common/clients/mongo"
 	"github.com/tidepool-org/shoreline/user"
+	"github.com/tidepool-org/shoreline/user/mailer"
 	"github.com/tidepool-org/shoreline/user/marketo"
 )
 
@@ -109,6 +111,11 @@ func main() {
 		config.User.Marketo.Timeout = parsedTimeout
 	}
 
+	smtpPassword, found := os.LookupEnv("SMTP_PASSWORD")
+	if found {
+		config.User.Mailer.SMTP.Password = smtpPassword
+	}
+
 	salt, found := os.LookupEnv("SALT")
 	if found {
 		config.User.Salt = salt
@@ -163,6 +170,27 @@ func main() {
 		marketoConfig.Set(1)
 	}
 
+	if err := config.User.RoleRegistry().Validate(); err != nil {
+		logger.Fatal("Roles config is invalid: ", err)
+	}
+	if err := config.User.Terms.Validate(); err != nil {
+		logger.Fatal("Terms config is invalid: ", err)
+	}
+	if err := config.User.Consents.Validate(); err != nil {
+		logger.Fatal("Consents config is invalid: ", err)
+	}
+	if err := config.User.Custodial.Validate(config.User.RoleRegistry()); err != nil {
+		logger.Fatal("Custodial config is invalid: ", err)
+	}
+	if err := config.User.SignupDomains.Validate(config.User.RoleRegistry()); err != nil {
+		logger.Fatal("Signup domains config is invalid: ", err)
+	} else if err := config.User.SignupDomains.LoadDisposableDomains(); err != nil {
+		logger.Fatal("Unable to load disposable domains: ", err)
+	}
+	if err := config.User.ValidateRegistrationMode(); err != nil {
+		logger.Fatal("Registration mode is invalid: ", err)
+	}
+
 	clientStore := user.NewMongoStoreClient(&config.Mongo)
 	defer clientStore.Disconnect()
 	clientStore.EnsureIndexes()
@@ -182,6 +210,19 @@ func main() {
 
 	userapi.AttachPerms(permsClient)
 
+	if config.User.Mailer.Type != "" {
+		if userMailer, err := mailer.New(config.User.Mailer); err != nil {
+			logger.Println("WARNING: Mailer config is invalid", err)
+		} else {
+			logger.Print("attaching mailer")
+			userapi.AttachMailer(userMailer)
+		}
+	}
+
+	purgerContext, stopPurger := context.WithCancel(context.Background())
+	defer stopPurger()
+	go userapi.RunDeletionPurger(purgerContext)
+
 	/*
 	 * Serve it up and publish
 	 */
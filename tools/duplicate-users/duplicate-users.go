@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	TidepoolServerName   = "x-tidepool-server-name"
+	TidepoolServerSecret = "x-tidepool-server-secret"
+	TidepoolSessionToken = "x-tidepool-session-token"
+)
+
+type admin struct {
+	client *http.Client
+	secret string
+	host   string
+	token  string
+}
+
+type duplicateAccount struct {
+	UserID         string   `json:"userid"`
+	Username       string   `json:"username,omitempty"`
+	Emails         []string `json:"emails,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	Verified       bool     `json:"verified"`
+	PasswordExists bool     `json:"passwordExists"`
+	CreatedTime    string   `json:"createdTime,omitempty"`
+	DeletedTime    string   `json:"deletedTime,omitempty"`
+	SuspendedTime  string   `json:"suspendedTime,omitempty"`
+}
+
+type duplicateReport struct {
+	Email          string              `json:"email"`
+	SurvivorUserID string              `json:"survivorUserId"`
+	Users          []*duplicateAccount `json:"users"`
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "Duplicate Users"
+	app.Usage = "Find and merge users sharing a username or email"
+	app.Version = "0.0.1"
+
+	const environmentUsage = "Target environment (one of: \"prd\", \"stg\", \"dev\", \"local\")"
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "find",
+			ShortName: "f",
+			Usage:     "Report the users sharing each duplicate username or email, the suggested survivor first",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "env",
+					Usage: environmentUsage,
+				},
+			},
+			Action: findDuplicates,
+		},
+		{
+			Name:      "merge",
+			ShortName: "m",
+			Usage:     "Merge a user into a surviving user",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "survivor",
+					Usage: "User id of the surviving user",
+				},
+				cli.StringFlag{
+					Name:  "merged",
+					Usage: "User id of the user to merge into the survivor",
+				},
+				cli.StringFlag{
+					Name:  "env",
+					Usage: environmentUsage,
+				},
+			},
+			Action: mergeUser,
+		},
+		{
+			Name:      "resolve",
+			ShortName: "r",
+			Usage:     "Merge the users sharing each duplicate username or email into the suggested survivor",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "email",
+					Usage: "Only resolve this duplicate username or email",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Print the merges without making them",
+				},
+				cli.StringFlag{
+					Name:  "env",
+					Usage: environmentUsage,
+				},
+			},
+			Action: resolveDuplicates,
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+func die(err error) {
+	fmt.Println("ERROR:", err)
+	os.Exit(1)
+}
+
+func findDuplicates(c *cli.Context) {
+	if a, err := NewAdmin(c.String("env")); err != nil {
+		die(err)
+	} else if reports, err := a.GetDuplicates(); err != nil {
+		die(err)
+	} else {
+		for _, report := range reports {
+			dump(report)
+		}
+	}
+}
+
+func mergeUser(c *cli.Context) {
+	if a, err := NewAdmin(c.String("env")); err != nil {
+		die(err)
+	} else if user, err := a.MergeUser(c.String("survivor"), c.String("merged")); err != nil {
+		die(err)
+	} else {
+		dump(user)
+	}
+}
+
+// resolveDuplicates merges the other users of each duplicate into its suggested survivor. Deleted
+// users, which cannot be merged, and users already merged by an earlier duplicate are skipped. So that
+// no user is merged after surviving a merge, a duplicate whose survivor was merged, or which includes the
+// survivor of an earlier duplicate, is re-targeted to that survivor, and one including the survivors of
+// several earlier duplicates is skipped, to be merged by hand.
+func resolveDuplicates(c *cli.Context) {
+	a, err := NewAdmin(c.String("env"))
+	if err != nil {
+		die(err)
+	}
+	reports, err := a.GetDuplicates()
+	if err != nil {
+		die(err)
+	}
+
+	merged := map[string]string{}
+	survivors := map[string]bool{}
+	for _, report := range reports {
+		if email := c.String("email"); email != "" && email != report.Email {
+			continue
+		}
+
+		survivorID := report.SurvivorUserID
+		for merged[survivorID] != "" {
+			survivorID = merged[survivorID]
+		}
+		earlierSurvivorIDs := []string{}
+		if survivors[survivorID] {
+			earlierSurvivorIDs = append(earlierSurvivorIDs, survivorID)
+		}
+		for _, user := range report.Users {
+			if user.UserID != survivorID && survivors[user.UserID] {
+				earlierSurvivorIDs = append(earlierSurvivorIDs, user.UserID)
+			}
+		}
+		if len(earlierSurvivorIDs) > 1 {
+			fmt.Printf("SKIP: %s users %v survived earlier merges\n", report.Email, earlierSurvivorIDs)
+			continue
+		} else if len(earlierSurvivorIDs) == 1 {
+			survivorID = earlierSurvivorIDs[0]
+		}
+		if survivorID != report.SurvivorUserID {
+			fmt.Printf("RETARGET: %s survivor %s to %s\n", report.Email, report.SurvivorUserID, survivorID)
+		}
+
+		for _, user := range report.Users {
+			if user.UserID == survivorID || merged[user.UserID] != "" {
+				continue
+			} else if user.DeletedTime != "" {
+				fmt.Printf("SKIP: %s user %s is deleted\n", report.Email, user.UserID)
+				continue
+			}
+
+			fmt.Printf("MERGE: %s user %s into %s\n", report.Email, user.UserID, survivorID)
+			if !c.Bool("dry-run") {
+				if _, err := a.MergeUser(survivorID, user.UserID); err != nil {
+					die(err)
+				}
+			}
+			merged[user.UserID] = survivorID
+			survivors[survivorID] = true
+		}
+	}
+}
+
+func NewAdmin(env string) (*admin, error) {
+	if secret := os.Getenv("SERVER_SECRET"); secret == "" {
+		return nil, errors.New("Environment variable SERVER_SECRET not specified")
+	} else if host, err := envToHost(env); err != nil {
+		return nil, err
+	} else {
+		return &admin{secret: secret, client: &http.Client{}, host: host}, nil
+	}
+}
+
+func (a *admin) LoginAsServer() error {
+	if a.token != "" {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", a.urlWithHost("/auth/serverlogin"), nil)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error creating new server login request: %s", err.Error()))
+	}
+
+	req.Header.Add(TidepoolServerName, "DUPLICATE_USERS")
+	req.Header.Add(TidepoolServerSecret, a.secret)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error sending server login request: %s", err.Error()))
+	} else if res.StatusCode != http.StatusOK {
+		body := &bytes.Buffer{}
+		body.ReadFrom(res.Body)
+		return errors.New(fmt.Sprintf("Unexpected response status code from server login request: [%d] %s", res.StatusCode, body))
+	}
+
+	a.token = res.Header.Get(TidepoolSessionToken)
+	if a.token == "" {
+		return errors.New("No session token returned from server login request")
+	}
+	return nil
+}
+
+func (a *admin) GetDuplicates() ([]*duplicateReport, error) {
+	if err := a.LoginAsServer(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", a.urlWithHost("/auth/users/duplicates"), nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating new get duplicates request: %s", err.Error()))
+	}
+
+	req.Header.Add(TidepoolSessionToken, a.token)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error sending get duplicates request: %s", err.Error()))
+	} else if res.StatusCode != http.StatusOK {
+		body := &bytes.Buffer{}
+		body.ReadFrom(res.Body)
+		return nil, errors.New(fmt.Sprintf("Unexpected response status code from get duplicates request: [%d] %s", res.StatusCode, body))
+	}
+
+	var reports []*duplicateReport
+	if err := json.NewDecoder(res.Body).Decode(&reports); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error decoding JSON from get duplicates request: %s", err.Error()))
+	}
+	return reports, nil
+}
+
+func (a *admin) MergeUser(survivorUserID string, mergedUserID string) (map[string]interface{}, error) {
+	if survivorUserID == "" {
+		return nil, errors.New("Survivor not specified")
+	} else if mergedUserID == "" {
+		return nil, errors.New("Merged user not specified")
+	}
+
+	if err := a.LoginAsServer(); err != nil {
+		return nil, err
+	}
+
+	requestBody := &bytes.Buffer{}
+	if err := json.NewEncoder(requestBody).Encode(map[string]string{"mergedUserId": mergedUserID}); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error encoding JSON for merge user request: %s", err.Error()))
+	}
+
+	url := fmt.Sprintf("/auth/user/%s/merge", survivorUserID)
+	req, err := http.NewRequest("POST", a.urlWithHost(url), requestBody)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating new merge user request: %s", err.Error()))
+	}
+
+	req.Header.Add(TidepoolSessionToken, a.token)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error sending merge user request: %s", err.Error()))
+	} else if res.StatusCode != http.StatusOK {
+		body := &bytes.Buffer{}
+		body.ReadFrom(res.Body)
+		return nil, errors.New(fmt.Sprintf("Unexpected response status code from merge user request: [%d] %s", res.StatusCode, body))
+	}
+
+	var user map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error decoding JSON from merge user request: %s", err.Error()))
+	}
+	return user, nil
+}
+
+func (a *admin) urlWithHost(path string) string {
+	return fmt.Sprintf("%s%s", a.host, path)
+}
+
+func envToHost(env string) (string, error) {
+	switch env {
+	case "prd":
+		return "https://api.tidepool.org", nil
+	case "int":
+		return "https://int-api.tidepool.org", nil
+	case "stg":
+		return "https://stg-api.tidepool.org", nil
+	case "dev":
+		return "https://dev-api.tidepool.org", nil
+	case "dev-clinic":
+		return "https://dev-clinic-api.tidepool.org", nil
+	case "local":
+		return "http://localhost:8009", nil
+	case "":
+		return "", errors.New("Environment not specified")
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid environment: %s", env))
+	}
+}
+
+func dump(model interface{}) {
+	if dump, err := json.Marshal(model); err != nil {
+		fmt.Printf("Error dumping: %s\n", err.Error())
+	} else {
+		fmt.Printf("%s\n", dump)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	TidepoolServerName   = "x-tidepool-server-name"
+	TidepoolServerSecret = "x-tidepool-server-secret"
+	TidepoolSessionToken = "x-tidepool-session-token"
+)
+
+type admin struct {
+	client *http.Client
+	secret string
+	host   string
+	token  string
+}
+
+type migrationResult struct {
+	Name      string            `json:"name"`
+	DryRun    bool              `json:"dryRun"`
+	Migrated  []string          `json:"migrated"`
+	Conflicts []json.RawMessage `json:"conflicts,omitempty"`
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "Migrations"
+	app.Usage = "Backfill records stored before a change"
+	app.Version = "0.0.1"
+
+	app.Commands = []cli.Command{
+		{
+			Name:      "run",
+			ShortName: "r",
+			Usage:     "Run a migration, or report what it would change with --dry-run",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of the migration",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Report the records the migration would change without changing them",
+				},
+				cli.StringFlag{
+					Name:  "env",
+					Usage: "Target environment (one of: \"prd\", \"stg\", \"dev\", \"local\")",
+				},
+			},
+			Action: runMigration,
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+func die(err error) {
+	fmt.Println("ERROR:", err)
+	os.Exit(1)
+}
+
+func runMigration(c *cli.Context) {
+	if a, err := NewAdmin(c.String("env")); err != nil {
+		die(err)
+	} else if result, err := a.RunMigration(c.String("name"), c.Bool("dry-run")); err != nil {
+		die(err)
+	} else {
+		for _, conflict := range result.Conflicts {
+			fmt.Printf("CONFLICT: %s\n", conflict)
+		}
+		for _, id := range result.Migrated {
+			fmt.Printf("MIGRATED: %s\n", id)
+		}
+		fmt.Printf("%s migrated %d records (dry run %t)\n", result.Name, len(result.Migrated), result.DryRun)
+	}
+}
+
+func NewAdmin(env string) (*admin, error) {
+	if secret := os.Getenv("SERVER_SECRET"); secret == "" {
+		return nil, errors.New("Environment variable SERVER_SECRET not specified")
+	} else if host, err := envToHost(env); err != nil {
+		return nil, err
+	} else {
+		return &admin{secret: secret, client: &http.Client{}, host: host}, nil
+	}
+}
+
+func (a *admin) LoginAsServer() error {
+	if a.token != "" {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", a.urlWithHost("/auth/serverlogin"), nil)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error creating new server login request: %s", err.Error()))
+	}
+
+	req.Header.Add(TidepoolServerName, "MIGRATIONS")
+	req.Header.Add(TidepoolServerSecret, a.secret)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error sending server login request: %s", err.Error()))
+	} else if res.StatusCode != http.StatusOK {
+		body := &bytes.Buffer{}
+		body.ReadFrom(res.Body)
+		return errors.New(fmt.Sprintf("Unexpected response status code from server login request: [%d] %s", res.StatusCode, body))
+	}
+
+	a.token = res.Header.Get(TidepoolSessionToken)
+	if a.token == "" {
+		return errors.New("No session token returned from server login request")
+	}
+	return nil
+}
+
+func (a *admin) RunMigration(name string, dryRun bool) (*migrationResult, error) {
+	if name == "" {
+		return nil, errors.New("Migration not specified")
+	}
+
+	if err := a.LoginAsServer(); err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("/auth/migrations/%s?dryRun=%s", url.PathEscape(name), strconv.FormatBool(dryRun))
+	req, err := http.NewRequest("POST", a.urlWithHost(path), nil)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating new run migration request: %s", err.Error()))
+	}
+
+	req.Header.Add(TidepoolSessionToken, a.token)
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error sending run migration request: %s", err.Error()))
+	} else if res.StatusCode != http.StatusOK {
+		body := &bytes.Buffer{}
+		body.ReadFrom(res.Body)
+		return nil, errors.New(fmt.Sprintf("Unexpected response status code from run migration request: [%d] %s", res.StatusCode, body))
+	}
+
+	result := &migrationResult{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error decoding JSON from run migration request: %s", err.Error()))
+	}
+	return result, nil
+}
+
+func (a *admin) urlWithHost(path string) string {
+	return fmt.Sprintf("%s%s", a.host, path)
+}
+
+func envToHost(env string) (string, error) {
+	switch env {
+	case "prd":
+		return "https://api.tidepool.org", nil
+	case "int":
+		return "https://int-api.tidepool.org", nil
+	case "stg":
+		return "https://stg-api.tidepool.org", nil
+	case "dev":
+		return "https://dev-api.tidepool.org", nil
+	case "dev-clinic":
+		return "https://dev-clinic-api.tidepool.org", nil
+	case "local":
+		return "http://localhost:8009", nil
+	case "":
+		return "", errors.New("Environment not specified")
+	default:
+		return "", errors.New(fmt.Sprintf("Invalid environment: %s", env))
+	}
+}
@@ -45,7 +45,7 @@ func main() {
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "role",
-					Usage: "Role to search for (one of: \"clinic\")",
+					Usage: "Role to search for (see GET /roles)",
 				},
 				cli.StringFlag{
 					Name:  "env",
@@ -65,7 +65,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "role",
-					Usage: "Role to add to the user (one of: \"clinic\")",
+					Usage: "Role to add to the user (see GET /roles)",
 				},
 				cli.StringFlag{
 					Name:  "env",
@@ -85,7 +85,7 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "role",
-					Usage: "Role to remove from the user (one of: \"clinic\")",
+					Usage: "Role to remove from the user (see GET /roles)",
 				},
 				cli.StringFlag{
 					Name:  "env",
@@ -17,6 +17,7 @@ import (
 	"github.com/tidepool-org/go-common/clients"
 	"github.com/tidepool-org/go-common/clients/highwater"
 	"github.com/tidepool-org/go-common/clients/status"
+	"github.com/tidepool-org/shoreline/user/mailer"
 	"github.com/tidepool-org/shoreline/user/marketo"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -43,16 +44,33 @@ type (
 		perms          clients.Gatekeeper
 		logger         *log.Logger
 		marketoManager marketo.Manager
+		mailer         mailer.Mailer
 	}
 	ApiConfig struct {
-		ServerSecret         string         `json:"serverSercret"`
-		TokenConfigs         []TokenConfig  `json:"tokenConfigs"` // the first token config is used for encoding new tokens
-		LongTermKey          string         `json:"longTermKey"`
-		LongTermDaysDuration int            `json:"longTermDaysDuration"`
-		Salt                 string         `json:"salt"`
-		VerificationSecret   string         `json:"verificationSecret"`
-		ClinicDemoUserID     string         `json:"clinicDemoUserId"`
-		Marketo              marketo.Config `json:"marketo"`
+		ServerSecret                 string          `json:"serverSercret"`
+		TokenConfigs                 []TokenConfig   `json:"tokenConfigs"` // the first token config is used for encoding new tokens
+		LongTermKey                  string          `json:"longTermKey"`
+		LongTermDaysDuration         int             `json:"longTermDaysDuration"`
+		Salt                         string          `json:"salt"`
+		VerificationSecret           string          `json:"verificationSecret"`
+		ClinicDemoUserID             string          `json:"clinicDemoUserId"`
+		Marketo                      marketo.Config  `json:"marketo"`
+		DeletionGracePeriodDays      int             `json:"deletionGracePeriodDays"`
+		DeletionPurgeMode            string          `json:"deletionPurgeMode"` // one of "remove" (default) or "anonymize"
+		DeletionPurgeIntervalMinutes int             `json:"deletionPurgeIntervalMinutes"`
+		DeletionMaxAttempts          int             `json:"deletionMaxAttempts"`
+		Mailer                       mailer.Config   `json:"mailer"`
+		ConfirmationURL              string          `json:"confirmationUrl"` // links in emails are {confirmationUrl}/{type}/{token}
+		ConfirmationDurationHours    int             `json:"confirmationDurationHours"`
+		VerificationResendLimit      int             `json:"verificationResendLimit"`
+		Roles                        RoleRegistry    `json:"roles"` // defaults to DefaultRoleRegistry
+		Terms                        TermsDocuments  `json:"terms"`
+		Consents                     ConsentTypes    `json:"consents"`
+		Custodial                    CustodialPolicy `json:"custodial"`
+		MergeTransitionDays          int             `json:"mergeTransitionDays"` // how long GET /user resolves merged users to their survivors
+		SignupDomains                DomainPolicy    `json:"signupDomains"`
+		RegistrationMode             string          `json:"registrationMode"` // one of "open" (default), "invitation" or "code"
+		TrustedProxies               []string        `json:"trustedProxies"`   // addresses or CIDR networks of the proxies whose X-Forwarded-For is read
 	}
 	varsHandler func(http.ResponseWriter, *http.Request, map[string]string)
 )
@@ -65,33 +83,82 @@ const (
 	TP_SERVER_SECRET = "x-tidepool-server-secret"
 	TP_SESSION_TOKEN = "x-tidepool-session-token"
 
-	STATUS_NO_USR_DETAILS        = "No user details were given"
-	STATUS_INVALID_USER_DETAILS  = "Invalid user details were given"
-	STATUS_USER_NOT_FOUND        = "User not found"
-	STATUS_ERR_FINDING_USR       = "Error finding user"
-	STATUS_ERR_CREATING_USR      = "Error creating the user"
-	STATUS_ERR_UPDATING_USR      = "Error updating user"
-	STATUS_USR_ALREADY_EXISTS    = "User already exists"
-	STATUS_ERR_GENERATING_TOKEN  = "Error generating the token"
-	STATUS_ERR_UPDATING_TOKEN    = "Error updating token"
-	STATUS_MISSING_USR_DETAILS   = "Not all required details were given"
-	STATUS_ERROR_UPDATING_PW     = "Error updating password"
-	STATUS_MISSING_ID_PW         = "Missing id and/or password"
-	STATUS_NO_MATCH              = "No user matched the given details"
-	STATUS_NOT_VERIFIED          = "The user hasn't verified this account yet"
-	STATUS_NO_TOKEN_MATCH        = "No token matched the given details"
-	STATUS_PW_WRONG              = "Wrong password"
-	STATUS_ERR_SENDING_EMAIL     = "Error sending email"
-	STATUS_NO_TOKEN              = "No x-tidepool-session-token was found"
-	STATUS_SERVER_TOKEN_REQUIRED = "A server token is required"
-	STATUS_AUTH_HEADER_REQUIRED  = "Authorization header is required"
-	STATUS_AUTH_HEADER_INVALID   = "Authorization header is invalid"
-	STATUS_GETSTATUS_ERR         = "Error checking service status"
-	STATUS_UNAUTHORIZED          = "Not authorized for requested operation"
-	STATUS_NO_QUERY              = "A query must be specified"
-	STATUS_PARAMETER_UNKNOWN     = "Unknown query parameter"
-	STATUS_ONE_QUERY_PARAM       = "Only one query parameter is allowed"
-	STATUS_INVALID_ROLE          = "The role specified is invalid"
+	STATUS_NO_USR_DETAILS          = "No user details were given"
+	STATUS_INVALID_USER_DETAILS    = "Invalid user details were given"
+	STATUS_USER_NOT_FOUND          = "User not found"
+	STATUS_ERR_FINDING_USR         = "Error finding user"
+	STATUS_ERR_CREATING_USR        = "Error creating the user"
+	STATUS_ERR_UPDATING_USR        = "Error updating user"
+	STATUS_USR_ALREADY_EXISTS      = "User already exists"
+	STATUS_ERR_GENERATING_TOKEN    = "Error generating the token"
+	STATUS_ERR_UPDATING_TOKEN      = "Error updating token"
+	STATUS_MISSING_USR_DETAILS     = "Not all required details were given"
+	STATUS_ERROR_UPDATING_PW       = "Error updating password"
+	STATUS_MISSING_ID_PW           = "Missing id and/or password"
+	STATUS_NO_MATCH                = "No user matched the given details"
+	STATUS_NOT_VERIFIED            = "The user hasn't verified this account yet"
+	STATUS_NO_TOKEN_MATCH          = "No token matched the given details"
+	STATUS_PW_WRONG                = "Wrong password"
+	STATUS_ERR_SENDING_EMAIL       = "Error sending email"
+	STATUS_NO_TOKEN                = "No x-tidepool-session-token was found"
+	STATUS_SERVER_TOKEN_REQUIRED   = "A server token is required"
+	STATUS_AUTH_HEADER_REQUIRED    = "Authorization header is required"
+	STATUS_AUTH_HEADER_INVALID     = "Authorization header is invalid"
+	STATUS_GETSTATUS_ERR           = "Error checking service status"
+	STATUS_UNAUTHORIZED            = "Not authorized for requested operation"
+	STATUS_NO_QUERY                = "A query must be specified"
+	STATUS_PARAMETER_UNKNOWN       = "Unknown query parameter"
+	STATUS_ONE_QUERY_PARAM         = "Only one query parameter is allowed"
+	STATUS_INVALID_ROLE            = "The role specified is invalid"
+	STATUS_USER_NOT_DELETED        = "User is not marked deleted"
+	STATUS_DELETION_EXPIRED        = "The deletion grace period has expired"
+	STATUS_ERR_DELETION_JOB        = "Error updating deletion job"
+	STATUS_ERR_FINDING_JOBS        = "Error finding deletion jobs"
+	STATUS_MISSING_DELETION_REASON = "A reason and requester are required to delete a user"
+	STATUS_ERR_EXPORTING_USR       = "Error exporting user"
+	STATUS_INVALID_CONFIRMATION    = "The confirmation token is invalid or has expired"
+	STATUS_CONFIRMATION_NOT_FOUND  = "No unused confirmation matched the given token"
+	STATUS_ERR_CONFIRMING          = "Error confirming token"
+	STATUS_MAILER_NOT_CONFIGURED   = "Sending email is not configured"
+	STATUS_TOO_MANY_REQUESTS       = "Too many requests, try again later"
+	STATUS_EMAIL_NOT_FOUND         = "The user does not have the given email"
+	STATUS_PRIMARY_EMAIL           = "The primary email cannot be removed"
+	STATUS_EMAIL_NOT_VERIFIED      = "The email has not been verified"
+	STATUS_EMAIL_ALREADY_VERIFIED  = "The email is already verified"
+	STATUS_INVALID_SEARCH          = "The search parameters are invalid"
+	STATUS_REVISION_MISMATCH       = "The user was modified since the given revision"
+	STATUS_USER_MODIFIED           = "The user was modified concurrently, try again"
+	STATUS_INVALID_AUDIT_QUERY     = "The audit query parameters are invalid"
+	STATUS_ERR_FINDING_AUDIT       = "Error finding audit events"
+	STATUS_USER_SUSPENDED          = "User is suspended"
+	STATUS_USER_NOT_SUSPENDED      = "User is not suspended"
+	STATUS_CONSENT_TYPE_NOT_FOUND  = "Consent type not found"
+	STATUS_USER_NOT_CUSTODIAL      = "User is not custodial"
+	STATUS_CUSTODIAN_NOT_FOUND     = "Custodian not found"
+	STATUS_CUSTODIAN_NOT_ALLOWED   = "The custodian is not allowed to have custodial users"
+	STATUS_CUSTODIAL_LIMIT_REACHED = "The custodian has the most custodial users allowed"
+	STATUS_USER_MERGED             = "User is already merged"
+	STATUS_CLINIC_NOT_MERGEABLE    = "A clinic user cannot be merged into another user"
+	STATUS_MERGED_PASSWORD         = "A user with a password cannot be merged into a user without one"
+	STATUS_ERR_MERGING_USR         = "Error merging users"
+	STATUS_DOMAIN_NOT_ALLOWED      = "The email domain is not allowed to sign up"
+	STATUS_DISPOSABLE_EMAIL        = "Disposable email addresses are not allowed to sign up"
+	STATUS_DOMAIN_NOT_FOR_ROLE     = "The email domain is not allowed to sign up with the requested roles"
+	STATUS_SIGNUP_CODE_REQUIRED    = "A signup code is required to sign up"
+	STATUS_SIGNUP_CODE_INVALID     = "The signup code is invalid, expired or used up"
+	STATUS_SIGNUP_CODE_NOT_FOUND   = "Signup code not found"
+	STATUS_INVALID_CODE_DETAILS    = "Invalid signup code details were given"
+	STATUS_ERR_FINDING_SIGNUP_CODE = "Error finding signup code"
+	STATUS_ERR_ADDING_SIGNUP_CODE  = "Error adding signup code"
+	STATUS_ERR_REMOVING_CODE       = "Error removing signup code"
+	STATUS_DOMAIN_NOT_FOUND        = "Organization domain not found"
+	STATUS_INVALID_DOMAIN_DETAILS  = "Invalid organization domain details were given"
+	STATUS_ERR_FINDING_DOMAINS     = "Error finding organization domains"
+	STATUS_ERR_UPDATING_DOMAINS    = "Error updating organization domains"
+	STATUS_ERR_FINDING_CONSENTS    = "Error finding consents"
+	STATUS_ERR_RECORDING_CONSENT   = "Error recording consent"
+	STATUS_MIGRATION_NOT_FOUND     = "Migration not found"
+	STATUS_ERR_MIGRATING           = "Error running migration"
 )
 
 func InitApi(cfg ApiConfig, logger *log.Logger, store Storage, metrics highwater.Client, manager marketo.Manager) *Api {
@@ -108,22 +175,66 @@ func (a *Api) AttachPerms(perms clients.Gatekeeper) {
 	a.perms = perms
 }
 
+func (a *Api) AttachMailer(m mailer.Mailer) {
+	a.mailer = m
+}
+
 func (a *Api) SetHandlers(prefix string, rtr *mux.Router) {
 	rtr.Handle("/metrics", promhttp.Handler())
 
 	rtr.HandleFunc("/status", a.GetStatus).Methods("GET")
 
-	rtr.HandleFunc("/users", a.GetUsers).Methods("GET")
+	rtr.Handle("/users", a.requirePermissions(http.HandlerFunc(a.GetUsers))).Methods("GET")
+	rtr.Handle("/users/search", a.requirePermissions(http.HandlerFunc(a.SearchUsers), PERMISSION_SEARCH_USERS)).Methods("GET")
+	rtr.HandleFunc("/users/lookup", a.LookupUsers).Methods("POST")
+	rtr.Handle("/users/duplicates", a.requirePermissions(http.HandlerFunc(a.GetDuplicateUsers))).Methods("GET")
+
+	rtr.Handle("/audit", a.requirePermissions(http.HandlerFunc(a.GetAuditEvents))).Methods("GET")
+
+	rtr.Handle("/migrations/{name}", a.requirePermissions(varsHandler(a.RunMigration))).Methods("POST")
+
+	rtr.HandleFunc("/roles", a.GetRoles).Methods("GET")
+	rtr.HandleFunc("/terms", a.GetTerms).Methods("GET")
+	rtr.HandleFunc("/consents", a.GetConsentTypes).Methods("GET")
+
+	rtr.Handle("/signup/codes", a.requirePermissions(http.HandlerFunc(a.CreateSignupCode))).Methods("POST")
+	rtr.Handle("/signup/codes", a.requirePermissions(http.HandlerFunc(a.GetSignupCodes))).Methods("GET")
+	rtr.Handle("/signup/codes/{code}", a.requirePermissions(varsHandler(a.RemoveSignupCode))).Methods("DELETE")
+
+	rtr.Handle("/organizations/domains", a.requirePermissions(http.HandlerFunc(a.GetOrganizationDomains))).Methods("GET")
+	rtr.Handle("/organizations/domains/{domain}", a.requirePermissions(varsHandler(a.UpdateOrganizationDomain))).Methods("PUT")
+	rtr.Handle("/organizations/domains/{domain}", a.requirePermissions(varsHandler(a.RemoveOrganizationDomain))).Methods("DELETE")
 
 	rtr.Handle("/user", varsHandler(a.GetUserInfo)).Methods("GET")
 	rtr.Handle("/user/{userid}", varsHandler(a.GetUserInfo)).Methods("GET")
 
 	rtr.HandleFunc("/user", a.CreateUser).Methods("POST")
+	rtr.HandleFunc("/user/verify/resend", a.ResendVerification).Methods("POST")
+	rtr.Handle("/user/verify/{token}", varsHandler(a.VerifyEmail)).Methods("POST")
+	rtr.Handle("/user/email/confirm/{token}", varsHandler(a.ConfirmEmailChange)).Methods("POST")
+	rtr.Handle("/user/email/revert/{token}", varsHandler(a.RevertEmailChange)).Methods("POST")
+	rtr.Handle("/user/claim/{token}", varsHandler(a.ClaimCustodialUser)).Methods("POST")
 	rtr.Handle("/user", varsHandler(a.UpdateUser)).Methods("PUT")
 	rtr.Handle("/user/{userid}", varsHandler(a.UpdateUser)).Methods("PUT")
 	rtr.Handle("/user/{userid}", varsHandler(a.DeleteUser)).Methods("DELETE")
+	rtr.Handle("/user/{userid}/restore", varsHandler(a.RestoreUser)).Methods("POST")
+	rtr.Handle("/user/{userid}/deletion", a.requirePermissions(varsHandler(a.GetDeletionJobs))).Methods("GET")
+	rtr.Handle("/user/{userid}/suspend", a.requirePermissions(varsHandler(a.SuspendUser), PERMISSION_SUSPEND_USERS)).Methods("POST")
+	rtr.Handle("/user/{userid}/unsuspend", a.requirePermissions(varsHandler(a.UnsuspendUser), PERMISSION_SUSPEND_USERS)).Methods("POST")
+	rtr.Handle("/user/{userid}/export", varsHandler(a.ExportUser)).Methods("GET")
+	rtr.Handle("/user/{userid}/consents", varsHandler(a.GetUserConsents)).Methods("GET")
+	rtr.Handle("/user/{userid}/consents/{type}", varsHandler(a.GrantUserConsent)).Methods("POST")
+	rtr.Handle("/user/{userid}/consents/{type}", varsHandler(a.RevokeUserConsent)).Methods("DELETE")
+	rtr.Handle("/user/{userid}/emails", varsHandler(a.AddUserEmail)).Methods("POST")
+	rtr.Handle("/user/{userid}/emails/{email}", varsHandler(a.RemoveUserEmail)).Methods("DELETE")
+	rtr.Handle("/user/{userid}/emails/{email}/verify", varsHandler(a.SendUserEmailVerification)).Methods("POST")
+	rtr.Handle("/user/{userid}/emails/{email}/primary", varsHandler(a.SetPrimaryEmail)).Methods("POST")
 
 	rtr.Handle("/user/{userid}/user", varsHandler(a.CreateCustodialUser)).Methods("POST")
+	rtr.Handle("/user/{userid}/claim", varsHandler(a.SendClaimInvitation)).Methods("POST")
+	rtr.Handle("/user/{userid}/custodial", varsHandler(a.GetCustodialUsers)).Methods("GET")
+	rtr.Handle("/user/{userid}/custodian", varsHandler(a.TransferCustody)).Methods("POST")
+	rtr.Handle("/user/{userid}/merge", a.requirePermissions(varsHandler(a.MergeUsers))).Methods("POST")
 
 	rtr.HandleFunc("/login", a.Login).Methods("POST")
 	rtr.HandleFunc("/login", a.RefreshSession).Methods("GET")
@@ -158,20 +269,15 @@ func (a *Api) GetStatus(res http.ResponseWriter, req *http.Request) {
 // GetUsers returns all users
 // status: 200
 // status: 400 STATUS_NO_QUERY, STATUS_PARAMETER_UNKNOWN
-// status: 401 STATUS_SERVER_TOKEN_REQUIRED
+// status: 401 STATUS_UNAUTHORIZED
 // status: 500 STATUS_ERR_FINDING_USR
 func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
-	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
-		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
-
-	} else if !tokenData.IsServer {
-		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
-
-	} else if len(req.URL.Query()) == 0 {
+	tokenData := authorizedTokenData(req)
+	if len(req.URL.Query()) == 0 {
 		a.sendError(res, http.StatusBadRequest, STATUS_NO_QUERY)
 
-	} else if role := req.URL.Query().Get("role"); role != "" && !IsValidRole(role) {
+	} else if role := req.URL.Query().Get("role"); role != "" && !a.ApiConfig.RoleRegistry().IsValid(role) {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_ROLE)
 
 	} else if userIds := strings.Split(req.URL.Query().Get("id"), ","); len(userIds[0]) > 0 && role != "" {
@@ -179,6 +285,7 @@ func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 
 	} else {
 		var users []*User
+		var err error
 		switch {
 		case role != "":
 			if users, err = a.Store.WithContext(req.Context()).FindUsersByRole(role); err != nil {
@@ -196,16 +303,128 @@ func (a *Api) GetUsers(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// CreateUser creates a new user
+// SearchUsers returns a page of users matching the filters in the query, ordered by the sort
+// parameter, along with the total number of matching users and the cursor of the next page.
+// termsAccepted filters by whether users accepted the current terms. Requires a server token or
+// the searchUsers permission.
+// status: 200 UserSearchResults
+// status: 400 STATUS_INVALID_SEARCH
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) SearchUsers(res http.ResponseWriter, req *http.Request) {
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	tokenData := authorizedTokenData(req)
+	if search, err := ParseUserSearch(req.URL.Query()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SEARCH, err)
+
+	} else if search.Role != "" && !a.ApiConfig.RoleRegistry().IsValid(search.Role) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SEARCH, UserSearch_error_role_invalid)
+
+	} else if err := search.ResolveTerms(a.ApiConfig.Terms, time.Now()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_SEARCH, err)
+
+	} else if users, err := a.Store.WithContext(req.Context()).SearchUsers(search); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if total, err := a.Store.WithContext(req.Context()).CountUsers(search); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		results := &UserSearchResults{Users: []interface{}{}, Total: total}
+		if len(users) > search.Limit {
+			users = users[:search.Limit]
+			results.NextCursor = search.NextCursor(users).Encode()
+		}
+		for _, user := range users {
+			results.Users = append(results.Users, a.asSerializableUser(user, true))
+		}
+		a.logMetric("searchusers", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+		sendModelAsRes(res, results)
+	}
+}
+
+// LookupUsers returns the users for up to 500 ids and/or emails in the body, keyed by the given id
+// or email, along with the ids and emails that were not found. Users other than servers only find
+// themselves and the custodial users they are custodian of; all others are misses.
+// status: 200 UserLookupResults
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) LookupUsers(res http.ResponseWriter, req *http.Request) {
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if lookup, err := ParseUserLookup(req.Body); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+
+	} else if err := lookup.Validate(); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+
+	} else if found, err := a.lookupUsers(a.Store.WithContext(req.Context()), lookup); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		results := &UserLookupResults{Users: map[string]interface{}{}, Misses: []string{}}
+		for _, key := range append(lookup.IDs, lookup.Emails...) {
+			if user := found[key]; user != nil && (tokenData.IsServer || (isLookupVisible(tokenData, user) && !user.IsDeleted())) {
+				results.Users[key] = a.asSerializableUser(user, tokenData.IsServer)
+			} else {
+				results.Misses = append(results.Misses, key)
+			}
+		}
+		a.logMetric("lookupusers", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+		sendModelAsRes(res, results)
+	}
+}
+
+// GetAuditEvents returns a page of audit events matching the query, newest first, along with the
+// cursor of the next page
+// status: 200 AuditResults
+// status: 400 STATUS_INVALID_AUDIT_QUERY
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_AUDIT
+func (a *Api) GetAuditEvents(res http.ResponseWriter, req *http.Request) {
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if query, err := ParseAuditQuery(req.URL.Query()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_AUDIT_QUERY, err)
+
+	} else if events, err := a.Store.WithContext(req.Context()).FindAuditEvents(query); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_AUDIT, err)
+
+	} else {
+		results := &AuditResults{Events: events}
+		if len(events) > query.Limit {
+			results.Events = events[:query.Limit]
+			last := results.Events[query.Limit-1]
+			results.NextCursor = (&AuditCursor{Time: last.Time, ID: last.ID}).Encode()
+		}
+		a.logMetric("getauditevents", sessionToken, map[string]string{"server": "true"})
+		sendModelAsRes(res, results)
+	}
+}
+
+// CreateUser creates a new user. The roles of organization domains are granted once the user verifies
+// its email, not when the verification secret marks it verified.
 // status: 201 User
 // status: 400 STATUS_MISSING_USR_DETAILS
+// status: 403 STATUS_DOMAIN_NOT_ALLOWED
+// status: 403 STATUS_DISPOSABLE_EMAIL
+// status: 403 STATUS_DOMAIN_NOT_FOR_ROLE
+// status: 403 STATUS_SIGNUP_CODE_REQUIRED, STATUS_SIGNUP_CODE_INVALID
 // status: 409 STATUS_USR_ALREADY_EXISTS
-// status: 500 STATUS_ERR_GENERATING_TOKEN
+// status: 500 STATUS_ERR_GENERATING_TOKEN, STATUS_ERR_FINDING_SIGNUP_CODE
 func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 	if newUserDetails, err := ParseNewUserDetails(req.Body); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
 	} else if err := newUserDetails.Validate(); err != nil { // TODO: Fix this duplicate work!
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+	} else if err := newUserDetails.ValidateRoles(a.ApiConfig.RoleRegistry()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+	} else if domainCheck := a.ApiConfig.SignupDomains.Check(append([]string{*newUserDetails.Username}, newUserDetails.Emails...), newUserDetails.Roles); domainCheck.Status != "" {
+		a.sendError(res, http.StatusForbidden, domainCheck.Status, domainCheck.Domain)
+	} else if signupCode, ok := a.findSignupCode(res, req, newUserDetails); !ok {
+		return
 	} else if newUser, err := NewUser(newUserDetails, a.ApiConfig.Salt); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
 	} else if existingUser, err := a.Store.WithContext(req.Context()).FindUsers(newUser); err != nil {
@@ -219,24 +438,52 @@ func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 			newUser.EmailVerified = true
 			a.logger.Printf("User email %s contains %v, setting email verified to %v", newUser.Username, a.ApiConfig.VerificationSecret, newUser.EmailVerified)
 		}
-		if err := a.Store.WithContext(req.Context()).UpsertUser(newUser); err != nil {
+		if len(domainCheck.ReviewRoles) > 0 {
+			newUser.WithholdRoles(domainCheck.ReviewRoles)
+			a.logger.Printf("Withheld roles %v of user %s from %s pending review", domainCheck.ReviewRoles, newUser.Id, domainCheck.Domain)
+		}
+		if signupCode != nil && len(signupCode.Roles) > 0 {
+			// Roles preassigned by a signup code are granted without review
+			newUser.Roles = append(newUser.Roles, signupCode.Roles...)
+			newUser.ReviewRoles = removeStrings(newUser.ReviewRoles, signupCode.Roles)
+		}
+		newUser.Roles = a.ApiConfig.RoleRegistry().Expand(newUser.Roles)
+		newUser.MarkCreated(newUser.Id, time.Now())
+		if signupCode != nil {
+			if usedCode, err := a.Store.WithContext(req.Context()).UseSignupCode(signupCode.Code, time.Now()); err != nil {
+				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_SIGNUP_CODE, err)
+				return
+			} else if usedCode == nil {
+				a.sendError(res, http.StatusForbidden, STATUS_SIGNUP_CODE_INVALID)
+				return
+			}
+		}
+		if err := a.Store.WithContext(req.Context()).UpsertUser(newUser); err == ErrUserIdentityConflict {
+			a.releaseSignupCode(a.Store.WithContext(req.Context()), signupCode)
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err != nil {
+			a.releaseSignupCode(a.Store.WithContext(req.Context()), signupCode)
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
 			return
 		}
-		if newUser.IsClinic() {
-			if a.ApiConfig.ClinicDemoUserID != "" {
-				if _, err := a.perms.SetPermissions(newUser.Id, a.ApiConfig.ClinicDemoUserID, clients.Permissions{"view": clients.Allowed}); err != nil {
-					a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
-					return
-				}
+		if !newUser.EmailVerified {
+			// The user can ask for the verification email to be resent, so a failure here does not fail the signup
+			if err := a.sendVerificationEmail(a.Store.WithContext(req.Context()), newUser, newUser.Email(), time.Now()); err != nil {
+				a.logger.Printf("Error sending verification email to user %s: %s", newUser.Id, err)
 			}
 		}
+		a.shareClinicDemo(nil, newUser)
 
 		tokenData := TokenData{DurationSecs: extractTokenDuration(req), UserId: newUser.Id, IsServer: false}
 		tokenConfig := a.ApiConfig.TokenConfigs[0]
 		if sessionToken, err := CreateSessionTokenAndSave(&tokenData, tokenConfig, a.Store.WithContext(req.Context())); err != nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN, err)
 		} else {
+			a.auditEvent(req, AUDIT_EVENT_USER_CREATED, newUser.Id, newUser.Id)
+			if len(newUser.ReviewRoles) > 0 {
+				a.auditEvent(req, AUDIT_EVENT_SIGNUP_REVIEW, newUser.Id, newUser.Id)
+			}
 			a.logMetricForUser(newUser.Id, "usercreated", sessionToken.ID, map[string]string{"server": "false"})
 			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
 			a.sendUserWithStatus(res, newUser, http.StatusCreated, false)
@@ -244,10 +491,277 @@ func (a *Api) CreateUser(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// CreateCustodialUser creates a new custodial user
+// VerifyEmail marks one of the user's email addresses verified using a token sent by sendVerificationEmail.
+// Each token may only be used once, and only while the user still has the email address.
+// status: 200 User
+// status: 400 STATUS_INVALID_CONFIRMATION
+// status: 404 STATUS_CONFIRMATION_NOT_FOUND, STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_CONFIRMING, STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) VerifyEmail(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if confirmation, user := a.useConfirmationToken(res, req, vars["token"], CONFIRMATION_TYPE_EMAIL_VERIFICATION); user == nil {
+		return
+
+	} else if !user.HasEmail(confirmation.Email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, "Email address has changed since the token was issued")
+
+	} else if user.HasVerifiedEmail(confirmation.Email) {
+		a.sendUser(res, user, false)
+
+	} else {
+		originalUser := user.DeepClone()
+		user.MarkEmailVerified(confirmation.Email)
+		organizationDomains := a.grantOrganizationRoles(a.Store.WithContext(req.Context()), user, confirmation.Email)
+		user.MarkModified(user.Id, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+		a.shareClinicDemo(originalUser, user)
+
+		if user.IsPrimaryEmail(confirmation.Email) {
+			a.updateMarketoForEmail(a.Store.WithContext(req.Context()), originalUser, user)
+		}
+		a.auditEvent(req, AUDIT_EVENT_EMAIL_VERIFIED, user.Id, user.Id)
+		a.auditOrganizationRoles(req, user.Id, originalUser.Roles, user, organizationDomains)
+		a.logger.Printf("Verified email for user %s", user.Id)
+		a.sendUser(res, user, false)
+	}
+}
+
+// ConfirmEmailChange replaces the user's username with its pending email using a token sent to the
+// pending email by sendEmailChangeEmails
+// status: 200 User
+// status: 400 STATUS_INVALID_CONFIRMATION
+// status: 403 STATUS_DOMAIN_NOT_ALLOWED, STATUS_DISPOSABLE_EMAIL, STATUS_DOMAIN_NOT_FOR_ROLE
+// status: 404 STATUS_CONFIRMATION_NOT_FOUND, STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USR_ALREADY_EXISTS, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_CONFIRMING, STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) ConfirmEmailChange(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if confirmation, user := a.useConfirmationToken(res, req, vars["token"], CONFIRMATION_TYPE_EMAIL_CHANGE); user == nil {
+		return
+
+	} else if !SameEmail(user.PendingEmail, confirmation.Email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, "Pending email has changed since the token was issued")
+
+	} else if !a.checkEmailDomains(res, user, []string{confirmation.Email}, user.Roles) {
+		return
+
+	} else if taken, err := a.emailTakenByOtherUser(req, user, confirmation.Email); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if taken {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else {
+		originalUser := user.DeepClone()
+		user.ChangeEmail(user.PendingEmail)
+		user.EmailVerified = true
+		organizationDomains := a.grantOrganizationRoles(a.Store.WithContext(req.Context()), user, user.Username)
+		user.MarkModified(user.Id, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+		a.shareClinicDemo(originalUser, user)
+
+		a.updateMarketoForEmail(a.Store.WithContext(req.Context()), originalUser, user)
+		a.auditEvent(req, AUDIT_EVENT_EMAIL_CHANGED, user.Id, user.Id)
+		a.auditOrganizationRoles(req, user.Id, originalUser.Roles, user, organizationDomains)
+		a.logger.Printf("Changed email for user %s", user.Id)
+		a.sendUser(res, user, false)
+	}
+}
+
+// RevertEmailChange restores the user's email address to the address a revert token was sent to by
+// sendEmailChangeEmails, whether or not the change was confirmed, and revokes all of the user's tokens
+// status: 200 User
+// status: 400 STATUS_INVALID_CONFIRMATION
+// status: 404 STATUS_CONFIRMATION_NOT_FOUND, STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USR_ALREADY_EXISTS, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_CONFIRMING, STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) RevertEmailChange(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if confirmation, user := a.useConfirmationToken(res, req, vars["token"], CONFIRMATION_TYPE_EMAIL_REVERT); user == nil {
+		return
+
+	} else if taken, err := a.emailTakenByOtherUser(req, user, confirmation.Email); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if taken {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else {
+		originalUser := user.DeepClone()
+		user.ChangeEmail(confirmation.Email)
+		user.EmailVerified = true
+		user.MarkModified(user.Id, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+
+		if err := a.Store.WithContext(req.Context()).RemoveTokensForUser(user.Id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+
+		if originalUser.Username != user.Username {
+			a.updateMarketoForEmail(a.Store.WithContext(req.Context()), originalUser, user)
+		}
+		a.auditEvent(req, AUDIT_EVENT_EMAIL_CHANGE_REVERTED, user.Id, user.Id)
+		a.logger.Printf("Reverted email change for user %s", user.Id)
+		a.sendUser(res, user, false)
+	}
+}
+
+// useConfirmationToken verifies a confirmation token of the given type, marks its confirmation used
+// and returns the confirmation and its user. If either is invalid an error response is sent and the
+// returned user is nil.
+func (a *Api) useConfirmationToken(res http.ResponseWriter, req *http.Request, token string, confirmationType string) (*Confirmation, *User) {
+	if claims, err := ParseConfirmationToken(token, confirmationType, a.ApiConfig.ServerSecret); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, err)
+
+	} else if confirmation, err := a.Store.WithContext(req.Context()).UseConfirmation(claims.Id, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CONFIRMING, err)
+
+	} else if confirmation == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_CONFIRMATION_NOT_FOUND)
+
+	} else if confirmation.Type != confirmationType || confirmation.UserID != claims.Subject || confirmation.Email != claims.Email {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, "Token does not match confirmation")
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: confirmation.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else {
+		return confirmation, user
+	}
+	return nil, nil
+}
+
+// findConfirmationToken verifies a confirmation token of the given type without marking its confirmation
+// used, and returns the unused confirmation and its user, so that the caller can check the request before
+// using the confirmation. If either is invalid an error response is sent and the returned user is nil.
+func (a *Api) findConfirmationToken(res http.ResponseWriter, req *http.Request, token string, confirmationType string) (*Confirmation, *User) {
+	var confirmation *Confirmation
+	if claims, err := ParseConfirmationToken(token, confirmationType, a.ApiConfig.ServerSecret); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, err)
+
+	} else if confirmations, err := a.Store.WithContext(req.Context()).FindConfirmationsForUser(claims.Subject, confirmationType); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CONFIRMING, err)
+
+	} else if confirmation = findUnusedConfirmation(confirmations, claims.Id); confirmation == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_CONFIRMATION_NOT_FOUND)
+
+	} else if confirmation.Email != claims.Email {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CONFIRMATION, "Token does not match confirmation")
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: confirmation.UserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else {
+		return confirmation, user
+	}
+	return nil, nil
+}
+
+// findUnusedConfirmation returns the confirmation with the id if it is unused, or nil
+func findUnusedConfirmation(confirmations []*Confirmation, id string) *Confirmation {
+	for _, confirmation := range confirmations {
+		if confirmation.ID == id && confirmation.UsedTime == "" {
+			return confirmation
+		}
+	}
+	return nil
+}
+
+// emailTakenByOtherUser reports whether a user other than the given user has the email address
+func (a *Api) emailTakenByOtherUser(req *http.Request, user *User, email string) (bool, error) {
+	results, err := a.Store.WithContext(req.Context()).FindUsers(&User{Username: email, Emails: []string{email}})
+	if err != nil {
+		return false, err
+	}
+	for _, result := range results {
+		if result.Id != user.Id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// updateMarketoForEmail updates the user's Marketo lead after a change to its email address or verification
+func (a *Api) updateMarketoForEmail(store Storage, originalUser *User, updatedUser *User) {
+	if updatedUser.EmailVerified && updatedUser.TermsAccepted != "" && a.marketingConsented(store, updatedUser) {
+		if a.marketoManager != nil && a.marketoManager.IsAvailable() {
+			a.marketoManager.UpdateListMembershipForUser(originalUser, updatedUser)
+		} else {
+			failedMarketoUploadCount.Inc()
+		}
+	}
+}
+
+// ResendVerification sends a new verification email to an unverified user, given the email
+// address in the body. So as not to reveal whether an account exists, it accepts the request
+// for unknown or already verified addresses without sending anything.
+// status: 202
+// status: 400 STATUS_MISSING_USR_DETAILS
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_SENDING_EMAIL
+// status: 501 STATUS_MAILER_NOT_CONFIGURED
+func (a *Api) ResendVerification(res http.ResponseWriter, req *http.Request) {
+	if a.mailer == nil {
+		a.sendError(res, http.StatusNotImplemented, STATUS_MAILER_NOT_CONFIGURED)
+
+	} else if email := NormalizeEmail(getGivenDetail(req)["email"]); email == "" {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_USR_DETAILS)
+
+	} else if results, err := a.Store.WithContext(req.Context()).FindUsers(&User{Username: email, Emails: []string{email}}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if len(results) != 1 || results[0].HasVerifiedEmail(email) || results[0].IsDeleted() {
+		res.WriteHeader(http.StatusAccepted)
+
+	} else if allowed, err := a.verificationResendAllowed(a.Store.WithContext(req.Context()), results[0].Id, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if !allowed {
+		a.sendError(res, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS)
+
+	} else if err := a.sendVerificationEmail(a.Store.WithContext(req.Context()), results[0], email, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_SENDING_EMAIL, err)
+
+	} else {
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// CreateCustodialUser creates a new custodial user, if the custodial policy allows the custodian another
 // status: 201 User
 // status: 400 STATUS_MISSING_USR_DETAILS
 // status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_CUSTODIAN_NOT_ALLOWED, STATUS_CUSTODIAL_LIMIT_REACHED
+// status: 404 STATUS_CUSTODIAN_NOT_FOUND
 // status: 409 STATUS_USR_ALREADY_EXISTS
 // status: 500 STATUS_ERR_GENERATING_TOKEN
 func (a *Api) CreateCustodialUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
@@ -266,30 +780,48 @@ func (a *Api) CreateCustodialUser(res http.ResponseWriter, req *http.Request, va
 	} else if newCustodialUser, err := NewCustodialUser(newCustodialUserDetails, a.ApiConfig.Salt); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
 
+	} else if custodian := a.findCustodian(res, req, custodianUserID); custodian == nil {
+		return
+
+	} else if !a.enforceCustodialPolicy(res, req, custodian, newCustodialUserDetails) {
+		return
+
 	} else if existingCustodialUser, err := a.Store.WithContext(req.Context()).FindUsers(newCustodialUser); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
 
 	} else if len(existingCustodialUser) != 0 {
 		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
 
-	} else if err := a.Store.WithContext(req.Context()).UpsertUser(newCustodialUser); err != nil {
-		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
-
 	} else {
-		permissions := clients.Permissions{"custodian": clients.Allowed, "view": clients.Allowed, "upload": clients.Allowed}
-		if _, err := a.perms.SetPermissions(custodianUserID, newCustodialUser.Id, permissions); err != nil {
+		newCustodialUser.CustodianUserID = custodianUserID
+		newCustodialUser.MarkCreated(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(newCustodialUser); err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
+			return
+		}
+
+		if _, err := a.perms.SetPermissions(custodianUserID, newCustodialUser.Id, a.custodianPermissions()); err != nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_CREATING_USR, err)
 		} else {
+			a.auditEvent(req, AUDIT_EVENT_USER_CREATED, tokenData.UserId, newCustodialUser.Id)
 			a.logMetricForUser(newCustodialUser.Id, "custodialusercreated", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
 			a.sendUserWithStatus(res, newCustodialUser, http.StatusCreated, tokenData.IsServer)
 		}
 	}
 }
 
-// UpdateUser updates a user
+// UpdateUser updates a user. If an If-Match header is given, it must match the ETag of the
+// user's current revision. Roles and emailVerified may only be updated by server tokens and
+// users whose roles grant the editRoles and verifyEmail permissions, who may update them for
+// any user. New emails are checked against the signup domain policy.
 // status: 200
 // status: 400 STATUS_INVALID_USER_DETAILS
+// status: 403 STATUS_DOMAIN_NOT_ALLOWED, STATUS_DISPOSABLE_EMAIL, STATUS_DOMAIN_NOT_FOR_ROLE
 // status: 409 STATUS_USR_ALREADY_EXISTS
+// status: 412 STATUS_REVISION_MISMATCH
 // status: 500 STATUS_ERR_FINDING_USR
 // status: 500 STATUS_ERR_UPDATING_USR
 func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
@@ -304,6 +836,9 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 	} else if err := updateUserDetails.Validate(); err != nil {
 		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
 
+	} else if err := updateUserDetails.ValidateRoles(a.ApiConfig.RoleRegistry()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, err)
+
 	} else if originalUser, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: firstStringNotEmpty(vars["userid"], tokenData.UserId)}); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 
@@ -313,15 +848,24 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 	} else if permissions, err := a.tokenUserHasRequestedPermissions(tokenData, originalUser.Id, clients.Permissions{"root": clients.Allowed, "custodian": clients.Allowed}); err != nil {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 
-	} else if len(permissions) == 0 {
+	} else if authorized, err := a.authorize(req.Context(), tokenData, updateUserDetails.AdministrativePermissions(a.ApiConfig.RoleRegistry(), originalUser.Roles)...); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if !authorized {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
 
-	} else if (updateUserDetails.Roles != nil || updateUserDetails.EmailVerified != nil) && !tokenData.IsServer {
+	} else if len(permissions) == 0 && !updateUserDetails.IsAdministrative() {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
 
 	} else if (updateUserDetails.Password != nil || updateUserDetails.TermsAccepted != nil) && permissions["root"] == nil {
 		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User does not have permissions")
 
+	} else if updateUserDetails.TermsVersion != nil && a.ApiConfig.Terms.Find(*updateUserDetails.TermsVersion) == nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_terms_version_invalid)
+
+	} else if !ifMatchRevision(req.Header.Get("If-Match"), originalUser.Revision) {
+		a.sendError(res, http.StatusPreconditionFailed, STATUS_REVISION_MISMATCH)
+
 	} else {
 		updatedUser := originalUser.DeepClone()
 
@@ -338,6 +882,14 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 				dupCheck.Emails = updatedUser.Emails
 			}
 
+			roles := originalUser.Roles
+			if updateUserDetails.Roles != nil {
+				roles = a.ApiConfig.RoleRegistry().Expand(updateUserDetails.Roles)
+			}
+			if !a.checkEmailDomains(res, originalUser, append([]string{updatedUser.Username}, updatedUser.Emails...), roles) {
+				return
+			}
+
 			if results, err := a.Store.WithContext(req.Context()).FindUsers(dupCheck); err != nil {
 				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 				return
@@ -352,30 +904,67 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
 				return
 			}
+			updatedUser.CustodianUserID = ""
 		}
 
 		if updateUserDetails.Roles != nil {
-			updatedUser.Roles = updateUserDetails.Roles
+			updatedUser.Roles = a.ApiConfig.RoleRegistry().Expand(updateUserDetails.Roles)
+			updatedUser.ReviewRoles = removeStrings(updatedUser.ReviewRoles, updatedUser.Roles)
 		}
 
 		if updateUserDetails.TermsAccepted != nil {
 			updatedUser.TermsAccepted = *updateUserDetails.TermsAccepted
+			if updateUserDetails.TermsVersion != nil {
+				updatedUser.AcceptTerms(*updateUserDetails.TermsVersion, *updateUserDetails.TermsAccepted)
+			} else if current := a.ApiConfig.Terms.Current(time.Now()); current != nil {
+				updatedUser.AcceptTerms(current.Version, *updateUserDetails.TermsAccepted)
+			}
 		}
 
 		if updateUserDetails.EmailVerified != nil {
 			updatedUser.EmailVerified = *updateUserDetails.EmailVerified
 		}
+		var organizationDomains []string
+		if updatedUser.EmailVerified && !originalUser.EmailVerified && updateUserDetails.Roles == nil {
+			organizationDomains = a.grantOrganizationRoles(a.Store.WithContext(req.Context()), updatedUser, updatedUser.Username)
+		}
 
-		if err := a.Store.WithContext(req.Context()).UpsertUser(updatedUser); err != nil {
+		updatedUser.PruneVerifiedEmails()
+
+		// When shoreline sends email, a change of email by anyone but a server is staged as a pending
+		// email and only replaces the username once confirmed from the new address
+		stageEmail := a.mailer != nil && !tokenData.IsServer && updatedUser.Username != originalUser.Username
+		if stageEmail {
+			updatedUser.PendingEmail = updatedUser.Username
+			updatedUser.Username = originalUser.Username
+			updatedUser.Emails = originalUser.Emails
+		} else if a.mailer != nil && !tokenData.IsServer && !reflect.DeepEqual(updatedUser.Emails, originalUser.Emails) {
+			a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, "Emails may only change along with the username")
+			return
+		}
+
+		updatedUser.MarkModified(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(updatedUser); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusPreconditionFailed, STATUS_REVISION_MISMATCH, err)
+		} else if err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+		} else if err != nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
 		} else {
+			if stageEmail {
+				if err := a.sendEmailChangeEmails(a.Store.WithContext(req.Context()), updatedUser, time.Now()); err != nil {
+					a.logger.Printf("Error sending email change emails to user %s: %s", updatedUser.Id, err)
+				}
+			}
+
 			if len(originalUser.PwHash) == 0 && len(updatedUser.PwHash) != 0 {
 				if err := a.removeUserPermissions(updatedUser.Id, clients.Permissions{"custodian": clients.Allowed}); err != nil {
 					a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
 				}
 			}
+			a.shareClinicDemo(originalUser, updatedUser)
 
-			if updatedUser.EmailVerified && updatedUser.TermsAccepted != "" {
+			if updatedUser.EmailVerified && updatedUser.TermsAccepted != "" && a.marketingConsented(a.Store.WithContext(req.Context()), updatedUser) {
 				if a.marketoManager != nil && a.marketoManager.IsAvailable() {
 					if updateUserDetails.EmailVerified != nil || updateUserDetails.TermsAccepted != nil {
 						a.marketoManager.CreateListMembershipForUser(updatedUser)
@@ -386,15 +975,19 @@ func (a *Api) UpdateUser(res http.ResponseWriter, req *http.Request, vars map[st
 					failedMarketoUploadCount.Inc()
 				}
 			}
+			a.auditUserUpdate(req, tokenData.UserId, originalUser, updatedUser, organizationDomains)
 			a.logMetricForUser(updatedUser.Id, "userupdated", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+			res.Header().Set("ETag", revisionETag(updatedUser.Revision))
 			a.sendUser(res, updatedUser, tokenData.IsServer)
 		}
 	}
 }
 
-// GetUserInfo returns user info
+// GetUserInfo returns user info, with the ETag of the user's revision. A user merged into another
+// resolves to the survivor during the merge transition period.
 // status: 200
 // status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
 // status: 500 STATUS_ERR_FINDING_USR
 func (a *Api) GetUserInfo(res http.ResponseWriter, req *http.Request, vars map[string]string) {
 	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
@@ -420,6 +1013,15 @@ func (a *Api) GetUserInfo(res http.ResponseWriter, req *http.Request, vars map[s
 		} else if result := results[0]; result == nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, "Found user is nil")
 
+		} else if result, err := a.resolveMergedUser(req.Context(), result); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+		} else if result == nil {
+			a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+		} else if result.IsDeleted() && !tokenData.IsServer {
+			a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
 		} else if permissions, err := a.tokenUserHasRequestedPermissions(tokenData, result.Id, clients.Permissions{"root": clients.Allowed, "custodian": clients.Allowed}); err != nil {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 
@@ -428,66 +1030,455 @@ func (a *Api) GetUserInfo(res http.ResponseWriter, req *http.Request, vars map[s
 
 		} else {
 			a.logMetricForUser(user.Id, "getuserinfo", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+			res.Header().Set("ETag", revisionETag(result.Revision))
 			a.sendUser(res, result, tokenData.IsServer)
 		}
 	}
 }
 
-func (a *Api) DeleteUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+// ExportUser returns everything shoreline holds for a user as a JSON attachment. Only the
+// user, or a server token, may export the user.
+// status: 200 UserExport
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_EXPORTING_USR
+func (a *Api) ExportUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
 
-	td, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN))
+	} else if userID := vars["userid"]; !tokenData.IsServer && tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
 
-	if err != nil {
-		a.logger.Println(http.StatusUnauthorized, err.Error())
-		res.WriteHeader(http.StatusUnauthorized)
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || (user.IsDeleted() && !tokenData.IsServer) {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if export, err := a.exportUser(a.Store.WithContext(req.Context()), user, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_EXPORTING_USR, err)
+
+	} else {
+		a.auditEvent(req, AUDIT_EVENT_USER_EXPORTED, tokenData.UserId, user.Id)
+		a.logMetricForUser(user.Id, "exportuser", sessionToken, map[string]string{"server": strconv.FormatBool(tokenData.IsServer)})
+		res.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=\"user-%s.json\"", user.Id))
+		sendModelAsRes(res, export)
+	}
+}
+
+// AddUserEmail adds a secondary email, given in the body, to a user and sends a verification email to it
+// status: 200 User
+// status: 400 STATUS_MISSING_USR_DETAILS, STATUS_INVALID_USER_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_DOMAIN_NOT_ALLOWED, STATUS_DISPOSABLE_EMAIL, STATUS_DOMAIN_NOT_FOR_ROLE
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USR_ALREADY_EXISTS, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) AddUserEmail(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else if email := NormalizeEmail(getGivenDetail(req)["email"]); email == "" {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_USR_DETAILS)
+
+	} else if !IsValidEmail(email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_emails_invalid)
+
+	} else if user.HasEmail(email) {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else if !a.checkEmailDomains(res, user, []string{email}, user.Roles) {
+		return
+
+	} else if taken, err := a.emailTakenByOtherUser(req, user, email); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if taken {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else {
+		user.AddEmail(email)
+		user.MarkModified(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+
+		if err := a.sendVerificationEmail(a.Store.WithContext(req.Context()), user, email, time.Now()); err != nil {
+			a.logger.Printf("Error sending verification email to user %s: %s", user.Id, err)
+		}
+		a.sendUser(res, user, tokenData.IsServer)
+	}
+}
+
+// RemoveUserEmail removes a secondary email from a user
+// status: 200 User
+// status: 400 STATUS_PRIMARY_EMAIL
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_EMAIL_NOT_FOUND
+// status: 409 STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) RemoveUserEmail(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
 		return
+
+	} else if email := vars["email"]; !user.HasEmail(email) {
+		a.sendError(res, http.StatusNotFound, STATUS_EMAIL_NOT_FOUND)
+
+	} else if user.IsPrimaryEmail(email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_PRIMARY_EMAIL)
+
+	} else {
+		user.RemoveEmail(email)
+		user.MarkModified(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+
+		a.sendUser(res, user, tokenData.IsServer)
 	}
+}
+
+// SendUserEmailVerification sends a verification email to one of a user's unverified emails
+// status: 202
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_EMAIL_NOT_FOUND
+// status: 409 STATUS_EMAIL_ALREADY_VERIFIED
+// status: 429 STATUS_TOO_MANY_REQUESTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_SENDING_EMAIL
+// status: 501 STATUS_MAILER_NOT_CONFIGURED
+func (a *Api) SendUserEmailVerification(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if a.mailer == nil {
+		a.sendError(res, http.StatusNotImplemented, STATUS_MAILER_NOT_CONFIGURED)
+
+	} else if _, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else if email := vars["email"]; !user.HasEmail(email) {
+		a.sendError(res, http.StatusNotFound, STATUS_EMAIL_NOT_FOUND)
+
+	} else if user.HasVerifiedEmail(email) {
+		a.sendError(res, http.StatusConflict, STATUS_EMAIL_ALREADY_VERIFIED)
+
+	} else if allowed, err := a.verificationResendAllowed(a.Store.WithContext(req.Context()), user.Id, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if !allowed {
+		a.sendError(res, http.StatusTooManyRequests, STATUS_TOO_MANY_REQUESTS)
+
+	} else if err := a.sendVerificationEmail(a.Store.WithContext(req.Context()), user, email, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_SENDING_EMAIL, err)
 
-	var id string
-	if td.IsServer == true {
-		id = vars["userid"]
-		a.logger.Println("operating as server")
 	} else {
-		id = td.UserId
+		res.WriteHeader(http.StatusAccepted)
 	}
+}
 
-	pw := getGivenDetail(req)["password"]
+// SetPrimaryEmail makes one of a user's secondary emails its primary email, which is the username
+// used to log in and the address Marketo and notifications use. Only server tokens may make an
+// unverified email primary.
+// status: 200 User
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_EMAIL_NOT_VERIFIED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_EMAIL_NOT_FOUND
+// status: 409 STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) SetPrimaryEmail(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
 
-	if id != "" && pw != "" {
+	} else if email := vars["email"]; !user.HasEmail(email) {
+		a.sendError(res, http.StatusNotFound, STATUS_EMAIL_NOT_FOUND)
 
-		var err error
-		toDelete := &User{Id: id}
+	} else if !tokenData.IsServer && !user.HasVerifiedEmail(email) {
+		a.sendError(res, http.StatusForbidden, STATUS_EMAIL_NOT_VERIFIED)
 
-		if err = toDelete.HashPassword(pw, a.ApiConfig.Salt); err == nil {
-			if err = a.Store.WithContext(req.Context()).RemoveUser(toDelete); err == nil {
+	} else if user.IsPrimaryEmail(email) {
+		a.sendUser(res, user, tokenData.IsServer)
 
-				if td.IsServer {
-					a.logMetricForUser(id, "deleteuser", req.Header.Get(TP_SESSION_TOKEN), map[string]string{"server": "true"})
-				} else {
-					a.logMetric("deleteuser", req.Header.Get(TP_SESSION_TOKEN), map[string]string{"server": "false"})
-				}
-				//cleanup if any
-				if td.IsServer == false {
-					a.Store.WithContext(req.Context()).RemoveTokenByID(req.Header.Get(TP_SESSION_TOKEN))
-				}
-				//all good
-				res.WriteHeader(http.StatusAccepted)
+	} else {
+		originalUser := user.DeepClone()
+		user.SetPrimaryEmail(email)
+		user.MarkModified(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+
+		a.updateMarketoForEmail(a.Store.WithContext(req.Context()), originalUser, user)
+		a.logger.Printf("Changed primary email for user %s", user.Id)
+		a.sendUser(res, user, tokenData.IsServer)
+	}
+}
+
+// findSelfOrServerUser authenticates the request's session token, which must belong to the user or a
+// server, and returns the token data and the user. If either is invalid an error response is sent and
+// the returned user is nil.
+func (a *Api) findSelfOrServerUser(res http.ResponseWriter, req *http.Request, userID string) (*TokenData, *User) {
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if !tokenData.IsServer && tokenData.UserId != userID {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else {
+		return tokenData, user
+	}
+	return nil, nil
+}
+
+// findAdministeredUser returns the token data of a request authorized by requirePermissions and the
+// user. If the user is not found an error response is sent and the returned user is nil.
+func (a *Api) findAdministeredUser(res http.ResponseWriter, req *http.Request, userID string) (*TokenData, *User) {
+	tokenData := authorizedTokenData(req)
+	if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: userID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else {
+		return tokenData, user
+	}
+	return nil, nil
+}
+
+// SuspendUser suspends a user, who may no longer log in, and revokes all of the user's tokens.
+// Requires a server token or the suspendUsers permission.
+// status: 200 User
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) SuspendUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findAdministeredUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else {
+		// A user already suspended only has its tokens revoked again
+		if !user.IsSuspended() {
+			user.MarkSuspended(tokenData.UserId, time.Now())
+			user.MarkModified(tokenData.UserId, time.Now())
+			if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserRevisionConflict {
+				a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+				return
+			} else if err != nil {
+				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
 				return
 			}
+			a.auditEvent(req, AUDIT_EVENT_USER_SUSPENDED, tokenData.UserId, user.Id)
 		}
-		a.logger.Println(http.StatusInternalServerError, err.Error())
-		res.WriteHeader(http.StatusInternalServerError)
+
+		if err := a.Store.WithContext(req.Context()).RemoveTokensForUser(user.Id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+
+		a.logger.Printf("User %s suspended by %s", user.Id, tokenData.UserId)
+		a.sendUser(res, user, true)
+	}
+}
+
+// UnsuspendUser lifts the suspension of a user. Requires a server token or the suspendUsers permission.
+// status: 200 User
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_NOT_SUSPENDED, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) UnsuspendUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findAdministeredUser(res, req, vars["userid"]); user == nil {
 		return
+
+	} else if !user.IsSuspended() {
+		a.sendError(res, http.StatusConflict, STATUS_USER_NOT_SUSPENDED)
+
+	} else {
+		user.Unsuspend()
+		user.MarkModified(tokenData.UserId, time.Now())
+		if err := a.Store.WithContext(req.Context()).UpsertUser(user); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+		} else {
+			a.auditEvent(req, AUDIT_EVENT_USER_UNSUSPENDED, tokenData.UserId, user.Id)
+			a.logger.Printf("User %s unsuspended by %s", user.Id, tokenData.UserId)
+			a.sendUser(res, user, true)
+		}
+	}
+}
+
+// DeleteUser marks a user as deleted, revokes all of the user's tokens and schedules a
+// deletion job. The user may be restored until the deletion grace period expires, after
+// which the job clears the user's permissions and Marketo lead and purges the user.
+// Users deleting their own account must give their password; server tokens instead
+// delete by id and must give the reason for, and requester of, the deletion.
+// status: 202
+// status: 400 STATUS_MISSING_DELETION_REASON
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_MISSING_ID_PW, STATUS_PW_WRONG
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR, STATUS_ERR_UPDATING_TOKEN, STATUS_ERR_DELETION_JOB
+func (a *Api) DeleteUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	sessionToken := req.Header.Get(TP_SESSION_TOKEN)
+	if tokenData, err := a.authenticateSessionToken(req.Context(), sessionToken); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if id, details := deleteUserID(tokenData, vars), getGivenDetail(req); id == "" || (!tokenData.IsServer && details["password"] == "") {
+		a.sendError(res, http.StatusForbidden, STATUS_MISSING_ID_PW)
+
+	} else if tokenData.IsServer && (strings.TrimSpace(details["reason"]) == "" || strings.TrimSpace(details["requester"]) == "") {
+		a.sendError(res, http.StatusBadRequest, STATUS_MISSING_DELETION_REASON)
+
+	} else if toDelete, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: id}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if toDelete == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if !tokenData.IsServer && !toDelete.PasswordsMatch(details["password"], a.ApiConfig.Salt) {
+		a.sendError(res, http.StatusForbidden, STATUS_PW_WRONG)
+
+	} else {
+		// A user already marked deleted only has its tokens revoked again, so that a
+		// partially failed deletion can be retried
+		if !toDelete.IsDeleted() {
+			toDelete.MarkDeleted(tokenData.UserId, time.Now())
+			toDelete.MarkModified(tokenData.UserId, time.Now())
+			if err := a.Store.WithContext(req.Context()).UpsertUser(toDelete); err == ErrUserRevisionConflict {
+				a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+				return
+			} else if err != nil {
+				a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+				return
+			}
+		}
+
+		if err := a.Store.WithContext(req.Context()).RemoveTokensForUser(toDelete.Id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+
+		request := &DeletionRequest{Requester: toDelete.Id, ActorUserID: tokenData.UserId}
+		if tokenData.IsServer {
+			request.Reason = strings.TrimSpace(details["reason"])
+			request.Requester = strings.TrimSpace(details["requester"])
+		}
+
+		if _, err := a.scheduleDeletionJob(a.Store.WithContext(req.Context()), toDelete, request, time.Now()); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_DELETION_JOB, err)
+			return
+		}
+
+		a.auditEvent(req, AUDIT_EVENT_USER_DELETED, tokenData.UserId, toDelete.Id)
+		if tokenData.IsServer {
+			a.logger.Printf("User %s deleted by %s on behalf of %s: %s", toDelete.Id, tokenData.UserId, request.Requester, request.Reason)
+			a.logMetricForUser(id, "deleteuser", sessionToken, map[string]string{"server": "true"})
+		} else {
+			a.logMetric("deleteuser", sessionToken, map[string]string{"server": "false"})
+		}
+		res.WriteHeader(http.StatusAccepted)
 	}
-	a.logger.Println(http.StatusForbidden, STATUS_MISSING_ID_PW)
-	sendModelAsResWithStatus(res, status.NewStatus(http.StatusForbidden, STATUS_MISSING_ID_PW), http.StatusForbidden)
-	return
 }
 
+// RestoreUser restores a deleted user within the deletion grace period. The request
+// must either use a server token or carry the user's credentials in the Authorization header.
+// status: 200 User
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_NOT_DELETED, STATUS_USER_MODIFIED
+// status: 410 STATUS_DELETION_EXPIRED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR, STATUS_ERR_DELETION_JOB
+func (a *Api) RestoreUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN))
+	isServer := err == nil && tokenData.IsServer
+	_, password := unpackAuth(req.Header.Get("Authorization"))
+
+	if !isServer && password == "" {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Server token or user credentials required")
+
+	} else if toRestore, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if toRestore == nil || toRestore.PurgedTime != "" {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if !isServer && !toRestore.PasswordsMatch(password, a.ApiConfig.Salt) {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "Passwords do not match")
+
+	} else if !toRestore.IsDeleted() {
+		a.sendError(res, http.StatusConflict, STATUS_USER_NOT_DELETED)
+
+	} else if !toRestore.IsRestorable(a.ApiConfig.DeletionGracePeriod(), time.Now()) {
+		a.sendError(res, http.StatusGone, STATUS_DELETION_EXPIRED)
+
+	} else if err := a.cancelDeletionJobs(a.Store.WithContext(req.Context()), toRestore.Id, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_DELETION_JOB, err)
+
+	} else {
+		toRestore.Restore()
+		if isServer {
+			toRestore.MarkModified(tokenData.UserId, time.Now())
+		} else {
+			toRestore.MarkModified(toRestore.Id, time.Now())
+		}
+		if err := a.Store.WithContext(req.Context()).UpsertUser(toRestore); err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+		} else {
+			a.auditEvent(req, AUDIT_EVENT_USER_RESTORED, toRestore.ModifiedUserID, toRestore.Id)
+			a.logger.Printf("Restored deleted user %s", toRestore.Id)
+			a.sendUser(res, toRestore, isServer)
+		}
+	}
+}
+
+// GetDeletionJobs returns the deletion jobs for a user, most recent first
+// status: 200 []DeletionJob
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_JOBS
+func (a *Api) GetDeletionJobs(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if jobs, err := a.Store.WithContext(req.Context()).FindDeletionJobsForUser(vars["userid"]); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_JOBS, err)
+
+	} else {
+		sendModelAsRes(res, jobs)
+	}
+}
+
+func deleteUserID(tokenData *TokenData, vars map[string]string) string {
+	if tokenData.IsServer {
+		return vars["userid"]
+	}
+	return tokenData.UserId
+}
+
+// Login returns the user, with the current terms in termsRequired if the user has not accepted them
 // status: 200 TP_SESSION_TOKEN,
 // status: 400 STATUS_MISSING_ID_PW
 // status: 401 STATUS_NO_MATCH
-// status: 403 STATUS_NOT_VERIFIED
+// status: 403 STATUS_NOT_VERIFIED, STATUS_USER_SUSPENDED
 // status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_TOKEN
 func (a *Api) Login(res http.ResponseWriter, req *http.Request) {
 	if user, password := unpackAuth(req.Header.Get("Authorization")); user == nil {
@@ -497,20 +1488,29 @@ func (a *Api) Login(res http.ResponseWriter, req *http.Request) {
 		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
 
 	} else if len(results) != 1 {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, "", "noMatch", map[string]string{"username": user.Username})
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, fmt.Sprintf("Found %d users matching %#v", len(results), user))
 
 	} else if result := results[0]; result == nil {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, "", "noMatch", map[string]string{"username": user.Username})
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, "Found user is nil")
 
 	} else if result.IsDeleted() {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, result.Id, "deleted", map[string]string{"username": user.Username})
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, "User is marked deleted")
 
 	} else if !result.PasswordsMatch(password, a.ApiConfig.Salt) {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, result.Id, "wrongPassword", map[string]string{"username": user.Username})
 		a.sendError(res, http.StatusUnauthorized, STATUS_NO_MATCH, "Passwords do not match")
 
 	} else if !result.IsEmailVerified(a.ApiConfig.VerificationSecret) {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, result.Id, "notVerified", map[string]string{"username": user.Username})
 		a.sendError(res, http.StatusForbidden, STATUS_NOT_VERIFIED)
 
+	} else if result.IsSuspended() {
+		a.auditFailure(req, AUDIT_EVENT_LOGIN_FAILED, result.Id, "suspended", map[string]string{"username": user.Username})
+		a.sendError(res, http.StatusForbidden, STATUS_USER_SUSPENDED)
+
 	} else {
 		tokenData := &TokenData{DurationSecs: extractTokenDuration(req), UserId: result.Id}
 		tokenConfig := a.ApiConfig.TokenConfigs[0]
@@ -518,9 +1518,14 @@ func (a *Api) Login(res http.ResponseWriter, req *http.Request) {
 			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
 
 		} else {
+			a.auditEvent(req, AUDIT_EVENT_LOGIN, result.Id, result.Id)
 			a.logMetric("userlogin", sessionToken.ID, nil)
 			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
-			a.sendUser(res, result, false)
+			serializable := a.asSerializableUser(result, false).(map[string]interface{})
+			if terms := a.requiredTerms(result, time.Now()); terms != nil {
+				serializable["termsRequired"] = terms
+			}
+			sendModelAsRes(res, serializable)
 		}
 	}
 }
@@ -549,11 +1554,13 @@ func (a *Api) ServerLogin(res http.ResponseWriter, req *http.Request) {
 			sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
 			return
 		} else {
+			a.auditEvent(req, AUDIT_EVENT_SERVER_LOGIN, server, "")
 			a.logMetricAsServer("serverlogin", sessionToken.ID, nil)
 			res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
 			return
 		}
 	}
+	a.auditFailure(req, AUDIT_EVENT_SERVER_LOGIN_FAILED, "", "wrongSecret", map[string]string{"server": server})
 	a.logger.Println(http.StatusUnauthorized, STATUS_PW_WRONG)
 	sendModelAsResWithStatus(res, status.NewStatus(http.StatusUnauthorized, STATUS_PW_WRONG), http.StatusUnauthorized)
 	return
@@ -588,6 +1595,7 @@ func (a *Api) RefreshSession(res http.ResponseWriter, req *http.Request) {
 		sendModelAsResWithStatus(res, status.NewStatus(http.StatusInternalServerError, STATUS_ERR_GENERATING_TOKEN), http.StatusInternalServerError)
 		return
 	} else {
+		a.auditEvent(req, AUDIT_EVENT_TOKEN_REFRESH, td.UserId, td.UserId)
 		res.Header().Set(TP_SESSION_TOKEN, sessionToken.ID)
 		sendModelAsRes(res, td)
 		return
@@ -645,6 +1653,8 @@ func (a *Api) Logout(res http.ResponseWriter, req *http.Request) {
 		if err := a.Store.WithContext(req.Context()).RemoveTokenByID(id); err != nil {
 			//silently fail but still log it
 			a.logger.Println("Logout was unable to delete token", err.Error())
+		} else if td, err := UnpackSessionTokenAndVerify(id, a.ApiConfig.TokenConfigs...); err == nil {
+			a.auditEvent(req, AUDIT_EVENT_LOGOUT, td.UserId, td.UserId)
 		}
 	}
 	//otherwise all good
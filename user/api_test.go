@@ -17,10 +17,12 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tidepool-org/go-common/clients"
 	"github.com/tidepool-org/go-common/clients/highwater"
+	"github.com/tidepool-org/shoreline/user/mailer"
 	"github.com/tidepool-org/shoreline/user/marketo"
 )
 
@@ -150,6 +152,12 @@ func (U *MockManager) CreateListMembershipForUser(newUser marketo.User) {
 }
 func (U *MockManager) UpdateListMembershipForUser(oldUser marketo.User, newUser marketo.User) {
 
+}
+func (U *MockManager) RemoveListMembershipForUser(user marketo.User) error {
+	return nil
+}
+func (U *MockManager) FindLead(email string) (int, bool, error) {
+	return 0, false, nil
 }
 func (U *MockManager) IsAvailable() bool {
 	return false
@@ -158,6 +166,56 @@ func NewTestManager() marketo.Manager {
 	return &MockManager{}
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// creating a recording Mailer
+type RecordingMailer struct {
+	Messages []*mailer.Message
+	Error    error
+}
+
+func (m *RecordingMailer) Send(message *mailer.Message) error {
+	m.Messages = append(m.Messages, message)
+	return m.Error
+}
+
+func attachRecordingMailer() *RecordingMailer {
+	recordingMailer := &RecordingMailer{}
+	responsableShoreline.AttachMailer(recordingMailer)
+	return recordingMailer
+}
+
+func detachRecordingMailer() {
+	responsableShoreline.AttachMailer(nil)
+}
+
+// setTestConfig changes the API config for the duration of the test
+func setTestConfig(t *testing.T, change func(config *ApiConfig)) {
+	original := responsableShoreline.ApiConfig
+	change(&responsableShoreline.ApiConfig)
+	t.Cleanup(func() { responsableShoreline.ApiConfig = original })
+}
+
+var testRoles = RoleRegistry{
+	{Name: "clinic", SelfAssignable: true},
+	{Name: "clinician", SelfAssignable: true, Implies: []string{"clinic"}},
+	{Name: "support", Permissions: []string{PERMISSION_SEARCH_USERS}},
+	{Name: "roleEditor", Permissions: []string{PERMISSION_EDIT_ROLES}},
+	{Name: "admin", Permissions: []string{PERMISSION_EDIT_ROLES, PERMISSION_VERIFY_EMAIL, PERMISSION_SUSPEND_USERS, PERMISSION_SEARCH_USERS}},
+}
+
+var testCustodialPolicy = CustodialPolicy{
+	Permissions:        []string{"custodian", "view"},
+	CustodianRoles:     []string{"clinic"},
+	EmailRequiredRoles: []string{"clinic"},
+	MaxPerCustodian:    2,
+}
+
+var testDomainPolicy = DomainPolicy{
+	BlockedDomains:  []string{"blocked.co"},
+	BlockDisposable: true,
+	RoleRules:       []DomainRoleRule{{"clinic", SIGNUP_RULE_REVIEW}},
+}
+
 func createAuthorization(t *testing.T, email string, password string) string {
 	return fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", email, password))))
 }
@@ -329,6 +387,102 @@ func expectResponsablesEmpty(t *testing.T) {
 		if len(responsableStore.RemoveTokenByIDResponses) > 0 {
 			t.Logf("RemoveTokenByIDResponses still available")
 		}
+		if len(responsableStore.RemoveTokensForUserResponses) > 0 {
+			t.Logf("RemoveTokensForUserResponses still available")
+		}
+		if len(responsableStore.UpsertDeletionJobResponses) > 0 {
+			t.Logf("UpsertDeletionJobResponses still available")
+		}
+		if len(responsableStore.FindDeletionJobsForUserResponses) > 0 {
+			t.Logf("FindDeletionJobsForUserResponses still available")
+		}
+		if len(responsableStore.ClaimDeletionJobDueResponses) > 0 {
+			t.Logf("ClaimDeletionJobDueResponses still available")
+		}
+		if len(responsableStore.FindTokensForUserResponses) > 0 {
+			t.Logf("FindTokensForUserResponses still available")
+		}
+		if len(responsableStore.AddConfirmationResponses) > 0 {
+			t.Logf("AddConfirmationResponses still available")
+		}
+		if len(responsableStore.UseConfirmationResponses) > 0 {
+			t.Logf("UseConfirmationResponses still available")
+		}
+		if len(responsableStore.FindConfirmationsForUserResponses) > 0 {
+			t.Logf("FindConfirmationsForUserResponses still available")
+		}
+		if len(responsableStore.SearchUsersResponses) > 0 {
+			t.Logf("SearchUsersResponses still available")
+		}
+		if len(responsableStore.CountUsersResponses) > 0 {
+			t.Logf("CountUsersResponses still available")
+		}
+		if len(responsableStore.FindUsersWithEmailsResponses) > 0 {
+			t.Logf("FindUsersWithEmailsResponses still available")
+		}
+		if len(responsableStore.FindAuditEventsResponses) > 0 {
+			t.Logf("FindAuditEventsResponses still available")
+		}
+		if len(responsableStore.AddConsentRecordResponses) > 0 {
+			t.Logf("AddConsentRecordResponses still available")
+		}
+		if len(responsableStore.FindConsentRecordsResponses) > 0 {
+			t.Logf("FindConsentRecordsResponses still available")
+		}
+		if len(responsableStore.FindUsersByCustodianResponses) > 0 {
+			t.Logf("FindUsersByCustodianResponses still available")
+		}
+		if len(responsableStore.FindDuplicateEmailsResponses) > 0 {
+			t.Logf("FindDuplicateEmailsResponses still available")
+		}
+		if len(responsableStore.AddSignupCodeResponses) > 0 {
+			t.Logf("AddSignupCodeResponses still available")
+		}
+		if len(responsableStore.FindSignupCodeResponses) > 0 {
+			t.Logf("FindSignupCodeResponses still available")
+		}
+		if len(responsableStore.FindSignupCodesResponses) > 0 {
+			t.Logf("FindSignupCodesResponses still available")
+		}
+		if len(responsableStore.UseSignupCodeResponses) > 0 {
+			t.Logf("UseSignupCodeResponses still available")
+		}
+		if len(responsableStore.ReleaseSignupCodeResponses) > 0 {
+			t.Logf("ReleaseSignupCodeResponses still available")
+		}
+		if len(responsableStore.RemoveSignupCodeResponses) > 0 {
+			t.Logf("RemoveSignupCodeResponses still available")
+		}
+		if len(responsableStore.UpsertOrganizationDomainResponses) > 0 {
+			t.Logf("UpsertOrganizationDomainResponses still available")
+		}
+		if len(responsableStore.FindOrganizationDomainsResponses) > 0 {
+			t.Logf("FindOrganizationDomainsResponses still available")
+		}
+		if len(responsableStore.RemoveOrganizationDomainResponses) > 0 {
+			t.Logf("RemoveOrganizationDomainResponses still available")
+		}
+		if len(responsableStore.RecordIdentitiesResponses) > 0 {
+			t.Logf("RecordIdentitiesResponses still available")
+		}
+		if len(responsableStore.RemoveConfirmationsForUserResponses) > 0 {
+			t.Logf("RemoveConfirmationsForUserResponses still available")
+		}
+		if len(responsableStore.RemoveConsentRecordsResponses) > 0 {
+			t.Logf("RemoveConsentRecordsResponses still available")
+		}
+		if len(responsableStore.RemoveSignupCodesForEmailsResponses) > 0 {
+			t.Logf("RemoveSignupCodesForEmailsResponses still available")
+		}
+		if len(responsableStore.AnonymizeAuditEventsResponses) > 0 {
+			t.Logf("AnonymizeAuditEventsResponses still available")
+		}
+		if len(responsableStore.RecordConfirmationExpiriesResponses) > 0 {
+			t.Logf("RecordConfirmationExpiriesResponses still available")
+		}
+		if len(responsableStore.ReleaseDeletionJobResponses) > 0 {
+			t.Logf("ReleaseDeletionJobResponses still available")
+		}
 		responsableStore.Reset()
 		t.Fail()
 	}
@@ -487,7 +641,7 @@ func FindUsersWithIds(t *testing.T, userIds []string) {
 		t.Fatal(err)
 	}
 
-	shoreline.GetUsers(rr, r)
+	shoreline.requirePermissions(http.HandlerFunc(shoreline.GetUsers)).ServeHTTP(rr, r)
 
 	rs := rr.Result()
 
@@ -547,1211 +701,3294 @@ func Test_GetUsers_Error_FindUsersByRoleSuccess(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func Test_CreateUser_Error_MissingBody(t *testing.T) {
-	response := performRequest(t, "POST", "/user")
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
-}
+func Test_SearchUsers_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_CreateUser_Error_MalformedBody(t *testing.T) {
-	response := performRequestBody(t, "POST", "/user", "{")
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search?email=a", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_CreateUser_Error_MissingUserDetails(t *testing.T) {
-	response := performRequestBody(t, "POST", "/user", "{}")
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
-}
+func Test_SearchUsers_Error_InvalidSearch(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_CreateUser_Error_InvalidUserDetails(t *testing.T) {
-	response := performRequestBody(t, "POST", "/user", "{\"username\": \"a\"}")
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search?sort=id", headers)
+	expectErrorResponse(t, response, 400, "The search parameters are invalid")
 }
 
-func Test_CreateUser_Error_ErrorFindingUsers(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{nil, errors.New("ERROR")}}
+func Test_SearchUsers_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co", CreatedTime: "2016-01-01T00:00:00+00:00"}, {Id: "2222222222", Username: "b@z.co", SuspendedTime: "2016-01-02T00:00:00+00:00"}}, nil}}
+	responsableStore.CountUsersResponses = []CountUsersResponse{{5, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
-	response := performRequestBody(t, "POST", "/user", body)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search?email=a&limit=1", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"users":      []interface{}{map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "emailVerified": false, "passwordExists": false}},
+		"total":      float64(5),
+		"nextCursor": (&UserSearchCursor{Sort: "createdTime", Value: "2016-01-01T00:00:00+00:00", UserID: "1111111111"}).Encode(),
+	})
 }
 
-func Test_CreateUser_Error_ConflictingEmail(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{}}, nil}}
+func Test_SearchUsers_Error_UnknownRole(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
-	response := performRequestBody(t, "POST", "/user", body)
-	expectErrorResponse(t, response, 409, "User already exists")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search?role=support", headers)
+	expectErrorResponse(t, response, 400, "The search parameters are invalid")
 }
 
-func Test_CreateUser_Error_ErrorUpsertingUser(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+func Test_GetRoles_Success_Default(t *testing.T) {
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
-	response := performRequestBody(t, "POST", "/user", body)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	response := performRequest(t, "GET", "/roles")
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"name": "clinic", "description": "Clinic or clinician account", "selfAssignable": true},
+	})
 }
 
-func Test_CreateUser_Error_ErrorSettingPermissions(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+func Test_GetRoles_Success_Configured(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"roles\": [\"clinic\"]}"
-	response := performRequestBody(t, "POST", "/user", body)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	response := performRequest(t, "GET", "/roles")
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"name": "clinic", "selfAssignable": true},
+		map[string]interface{}{"name": "clinician", "selfAssignable": true, "implies": []interface{}{"clinic"}},
+		map[string]interface{}{"name": "support", "selfAssignable": false, "permissions": []interface{}{"searchUsers"}},
+		map[string]interface{}{"name": "roleEditor", "selfAssignable": false, "permissions": []interface{}{"editRoles"}},
+		map[string]interface{}{"name": "admin", "selfAssignable": false, "permissions": []interface{}{"editRoles", "verifyEmail", "suspendUsers", "searchUsers"}},
+	})
 }
 
-func Test_CreateUser_Error_ErrorAddingToken(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+func Test_SearchUsers_Error_RoleWithoutPermission(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Roles: []string{"clinic"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
-	response := performRequestBody(t, "POST", "/user", body)
-	expectErrorResponse(t, response, 500, "Error generating the token")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_CreateUser_Success(t *testing.T) {
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
-	responsableStore.AddTokenResponses = []error{nil}
+func Test_SearchUsers_Success_RoleWithPermission(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Roles: []string{"support"}}, nil}}
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{{Id: "2222222222", Username: "b@z.co"}}, nil}}
+	responsableStore.CountUsersResponses = []CountUsersResponse{{1, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"roles\": [\"clinic\"]}"
-	response := performRequestBody(t, "POST", "/user", body)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}})
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"users": []interface{}{map[string]interface{}{"userid": "2222222222", "username": "b@z.co", "emailVerified": false, "passwordExists": false}},
+		"total": float64(1),
+	})
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_SearchUsers_Error_SuspendedRoleWithPermission(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Roles: []string{"support"}, SuspendedTime: "2016-01-01T00:00:00+00:00"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_CreateCustodialUser_Error_MissingSessionToken(t *testing.T) {
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
-	response := performRequestBody(t, "POST", "/user/abcdef1234/user", body)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/search", headers)
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_CreateCustodialUser_Error_TokenNotFound(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, nil}}
+func Test_SearchUsers_Error_TermsUnconfigured(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/1234567890/user", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestHeaders(t, "GET", "/users/search?termsAccepted=false", headers)
+	expectErrorResponse(t, response, 400, "The search parameters are invalid")
 }
 
-func Test_CreateCustodialUser_Error_MismatchUserIds(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_GetTerms_Success(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments })
+	defer expectResponsablesEmpty(t)
+
+	response := performRequest(t, "GET", "/terms")
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"current": map[string]interface{}{"version": "2", "url": "https://example.com/terms/2", "effectiveTime": "2017-01-01T00:00:00Z"},
+		"documents": []interface{}{
+			map[string]interface{}{"version": "1", "url": "https://example.com/terms/1", "effectiveTime": "2016-01-01T00:00:00Z"},
+			map[string]interface{}{"version": "2", "url": "https://example.com/terms/2", "effectiveTime": "2017-01-01T00:00:00Z"},
+			map[string]interface{}{"version": "3", "url": "https://example.com/terms/3", "effectiveTime": "2099-01-01T00:00:00Z"},
+		},
+	})
+}
+
+func Test_GetAuditEvents_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/1234567890/user", body, headers)
+	response := performRequestHeaders(t, "GET", "/audit", headers)
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_CreateCustodialUser_Error_MissingDetails(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_GetAuditEvents_Error_InvalidQuery(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := ""
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	response := performRequestHeaders(t, "GET", "/audit?limit=0", headers)
+	expectErrorResponse(t, response, 400, "The audit query parameters are invalid")
 }
 
-func Test_CreateCustodialUser_Error_InvalidDetails(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_GetAuditEvents_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindAuditEventsResponses = []FindAuditEventsResponse{{[]*AuditEvent{
+		{ID: "2", Type: AUDIT_EVENT_LOGIN, Time: "2016-01-02T00:00:00+00:00", ActorUserID: "1111111111", TargetUserID: "1111111111"},
+		{ID: "1", Type: AUDIT_EVENT_LOGIN_FAILED, Time: "2016-01-01T00:00:00+00:00", TargetUserID: "1111111111", Reason: "wrongPassword"},
+	}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a\", \"emails\": [\"a\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	response := performRequestHeaders(t, "GET", "/audit?userId=1111111111&limit=1", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"events":     []interface{}{map[string]interface{}{"id": "2", "type": "login", "time": "2016-01-02T00:00:00+00:00", "actorUserId": "1111111111", "targetUserId": "1111111111"}},
+		"nextCursor": (&AuditCursor{Time: "2016-01-02T00:00:00+00:00", ID: "2"}).Encode(),
+	})
 }
 
-func Test_CreateCustodialUser_Error_FindUsersError(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_RunMigration_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	response := performRequestHeaders(t, "POST", "/migrations/deletionJobs", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_CreateCustodialUser_Error_FindUsersDuplicate(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_RunMigration_Error_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 409, "User already exists")
+	response := performRequestHeaders(t, "POST", "/migrations/unknown", headers)
+	expectErrorResponse(t, response, 404, "Migration not found")
 }
 
-func Test_CreateCustodialUser_Error_UpsertUserError(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_RunMigration_Success_DeletionJobsDryRun(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{{Id: "1111111111", DeletedTime: "2016-01-01T00:00:00+00:00"}}, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{}, nil}}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	response := performRequestHeaders(t, "POST", "/migrations/deletionJobs?dryRun=true", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"name": "deletionJobs", "dryRun": true, "migrated": []interface{}{"1111111111"}})
+	if len(responsableStore.AuditEvents) != 0 {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_CreateCustodialUser_Error_SetPermissionsError(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_RunMigration_Success_DeletionJobs(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{
+		{Id: "1111111111", DeletedTime: "2016-01-01T00:00:00+00:00"},
+		{Id: "2222222222", DeletedTime: "2016-01-01T00:00:00+00:00"},
+		{Id: "3333333333", DeletedTime: "2016-01-01T00:00:00+00:00", PurgedTime: "2016-02-01T00:00:00+00:00"},
+	}, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{}, nil}, {[]*DeletionJob{}, nil}, {[]*DeletionJob{{ID: "job", UserID: "2222222222", State: DELETION_JOB_STATE_FAILED}}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	expectErrorResponse(t, response, 500, "Error creating the user")
+	response := performRequestHeaders(t, "POST", "/migrations/deletionJobs", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"name": "deletionJobs", "dryRun": false, "migrated": []interface{}{"1111111111"}})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_MIGRATION_RUN || responsableStore.AuditEvents[0].Details["migrated"] != "1" {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_CreateCustodialUser_Success_Anonymous(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_LookupUsers_Error_MissingKeys(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{})
+	response := performRequestBodyHeaders(t, "POST", "/users/lookup", "{\"ids\": [], \"emails\": [\" \"]}", headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func Test_CreateCustodialUser_Success_Anonymous_Server(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", true, tokenDuration)
+func Test_LookupUsers_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.FindUsersWithIdsResponses = []FindUsersWithIdsResponse{{[]*User{{Id: "1111111111", Username: "a@z.co"}}, nil}}
+	responsableStore.FindUsersWithEmailsResponses = []FindUsersResponse{{[]*User{{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co", "c@z.co"}}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/0000000000/user", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"passwordExists": false})
+	response := performRequestBodyHeaders(t, "POST", "/users/lookup", "{\"ids\": [\"1111111111\", \"3333333333\"], \"emails\": [\"C@z.co\"]}", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"users": map[string]interface{}{
+			"1111111111": map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "emailVerified": false, "passwordExists": false},
+			"C@z.co":     map[string]interface{}{"userid": "2222222222", "username": "b@z.co", "emails": []interface{}{"b@z.co", "c@z.co"}, "emailVerified": false, "passwordExists": false},
+		},
+		"misses": []interface{}{"3333333333"},
+	})
 }
 
-func Test_CreateCustodialUser_Success_Known(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_LookupUsers_Success_User(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.FindUsersWithIdsResponses = []FindUsersWithIdsResponse{{[]*User{{Id: "1111111111", Username: "a@z.co"}, {Id: "2222222222", CustodianUserID: "1111111111"}, {Id: "3333333333", Username: "c@z.co"}, {Id: "4444444444", CustodianUserID: "5555555555"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
+	response := performRequestBodyHeaders(t, "POST", "/users/lookup", "{\"ids\": [\"1111111111\", \"2222222222\", \"3333333333\", \"4444444444\"]}", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	users, _ := successResponse["users"].(map[string]interface{})
+	misses, _ := successResponse["misses"].([]interface{})
+	if len(users)+len(misses) != 4 || len(misses) != 2 || users["1111111111"] == nil || users["2222222222"] == nil {
+		t.Fatalf("Unexpected lookup results: %#v", successResponse)
+	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_GetDuplicateUsers_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_UpdateUser_Error_MissingSessionToken(t *testing.T) {
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
-	response := performRequestBody(t, "PUT", "/user/1111111111", body)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/users/duplicates", headers)
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_UpdateUser_Error_MissingDetails(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_GetDuplicateUsers_Error_FindDuplicateEmailsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindDuplicateEmailsResponses = []FindDuplicateEmailsResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	body := ""
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	response := performRequestHeaders(t, "GET", "/users/duplicates", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
 }
 
-func Test_UpdateUser_Error_InvalidDetails(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_GetDuplicateUsers_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindDuplicateEmailsResponses = []FindDuplicateEmailsResponse{{[]*DuplicateEmail{{Email: "a@z.co", UserIDs: []string{"1111111111", "2222222222"}}, {Email: "b@z.co", UserIDs: []string{"2222222222", "3333333333"}}}, nil}}
+	responsableStore.FindUsersWithIdsResponses = []FindUsersWithIdsResponse{{[]*User{
+		{Id: "1111111111", Username: "a@z.co", CreatedTime: "2016-01-02T00:00:00+00:00"},
+		{Id: "2222222222", Username: "A@z.co", Emails: []string{"A@z.co", "b@z.co"}, EmailVerified: true, PwHash: "hash", CreatedTime: "2016-01-03T00:00:00+00:00"},
+	}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a\", \"emails\": [\"a\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 400, "Invalid user details were given")
+	response := performRequestHeaders(t, "GET", "/users/duplicates", headers)
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"email": "a@z.co", "survivorUserId": "2222222222", "users": []interface{}{
+			map[string]interface{}{"userid": "2222222222", "username": "A@z.co", "emails": []interface{}{"A@z.co", "b@z.co"}, "verified": true, "passwordExists": true, "createdTime": "2016-01-03T00:00:00+00:00"},
+			map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "verified": false, "passwordExists": false, "createdTime": "2016-01-02T00:00:00+00:00"},
+		}},
+	})
 }
 
-func Test_UpdateUser_Error_FindUsersError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_CreateSignupCode_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	response := performRequestBodyHeaders(t, "POST", "/signup/codes", "{}", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_UpdateUser_Error_FindUsersMissing(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_CreateSignupCode_Error_InvalidDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestBodyHeaders(t, "POST", "/signup/codes", "{\"roles\": [\"unknown\"]}", headers)
+	expectErrorResponse(t, response, 400, "Invalid signup code details were given")
 }
 
-func Test_UpdateUser_Error_PermissionsError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_CreateSignupCode_Error_AddSignupCodeError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	responsableStore.AddSignupCodeResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	response := performRequestBodyHeaders(t, "POST", "/signup/codes", "{}", headers)
+	expectErrorResponse(t, response, 500, "Error adding signup code")
 }
 
-func Test_UpdateUser_Error_NoPermissions(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_CreateSignupCode_Success_Invitation(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.AddSignupCodeResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestBodyHeaders(t, "POST", "/signup/codes", "{\"email\": \"a@z.co\", \"roles\": [\"clinic\"], \"durationHours\": 24}", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "code", `\A[A-Z2-7]{26}\z`, true)
+	expectElementMatch(t, successResponse, "createdTime", `\A\d{4}-\d{2}-\d{2}T`, true)
+	expectElementMatch(t, successResponse, "expiresTime", `\A\d{4}-\d{2}-\d{2}T`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"email": "a@z.co", "roles": []interface{}{"clinic"}, "maxUses": float64(1), "uses": float64(0), "createdUserId": "0000000000"})
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "a@z.co" || !strings.Contains(recordingMailer.Messages[0].Body, "/signup/") {
+		t.Fatalf("Unexpected invitation emails: %#v", recordingMailer.Messages)
+	}
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_SIGNUP_CODE_CREATED {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_UpdateUser_Error_UnauthorizedRoles_User(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+func Test_GetSignupCodes_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindSignupCodesResponses = []FindSignupCodesResponse{{[]*SignupCode{{Code: "code", MaxUses: 2, Uses: 1, CreatedTime: "2020-01-01T00:00:00+00:00", ExpiresTime: "2020-01-08T00:00:00+00:00"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestHeaders(t, "GET", "/signup/codes", headers)
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"code": "code", "maxUses": float64(2), "uses": float64(1), "createdTime": "2020-01-01T00:00:00+00:00", "expiresTime": "2020-01-08T00:00:00+00:00"},
+	})
 }
 
-func Test_UpdateUser_Error_UnauthorizedRoles_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_RemoveSignupCode_Error_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{nil, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestHeaders(t, "DELETE", "/signup/codes/code", headers)
+	expectErrorResponse(t, response, 404, "Signup code not found")
 }
 
-func Test_UpdateUser_Error_UnauthorizedEmailVerified_User(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+func Test_RemoveSignupCode_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{&SignupCode{Code: "code", CreatedTime: "2020-01-01T00:00:00+00:00", ExpiresTime: "2020-01-08T00:00:00+00:00"}, nil}}
+	responsableStore.RemoveSignupCodeResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestHeaders(t, "DELETE", "/signup/codes/code", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"code": "code", "maxUses": float64(0), "uses": float64(0), "createdTime": "2020-01-01T00:00:00+00:00", "expiresTime": "2020-01-08T00:00:00+00:00"})
 }
 
-func Test_UpdateUser_Error_UnauthorizedEmailVerified_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_GetOrganizationDomains_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	response := performRequestHeaders(t, "GET", "/organizations/domains", headers)
 	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_UpdateUser_Error_UnauthorizedPassword_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_GetOrganizationDomains_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{{Domain: "z.co", Organization: "Z Clinic", Roles: []string{"clinic"}, ModifiedTime: "2020-01-01T00:00:00+00:00"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestHeaders(t, "GET", "/organizations/domains", headers)
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"domain": "z.co", "organization": "Z Clinic", "roles": []interface{}{"clinic"}, "modifiedTime": "2020-01-01T00:00:00+00:00"},
+	})
 }
 
-func Test_UpdateUser_Error_UnauthorizedTermsAccepted_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_UpdateOrganizationDomain_Error_InvalidDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	response := performRequestBodyHeaders(t, "PUT", "/organizations/domains/z.co", "{\"roles\": [\"unknown\"]}", headers)
+	expectErrorResponse(t, response, 400, "Invalid organization domain details were given")
 }
 
-func Test_UpdateUser_Error_FindUserDuplicateError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_UpdateOrganizationDomain_Error_UpsertOrganizationDomainError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	responsableStore.UpsertOrganizationDomainResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	response := performRequestBodyHeaders(t, "PUT", "/organizations/domains/z.co", "{\"roles\": [\"clinic\"]}", headers)
+	expectErrorResponse(t, response, 500, "Error updating organization domains")
 }
 
-func Test_UpdateUser_Error_FindUserDuplicateFound(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_UpdateOrganizationDomain_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1234567890"}}, nil}}
+	responsableStore.UpsertOrganizationDomainResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 409, "User already exists")
+	response := performRequestBodyHeaders(t, "PUT", "/organizations/domains/Z.CO", "{\"organization\": \" Z Clinic \", \"roles\": [\"clinic\"]}", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "modifiedTime", `\A\d{4}-\d{2}-\d{2}T`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"domain": "z.co", "organization": "Z Clinic", "roles": []interface{}{"clinic"}, "modifiedUserId": "0000000000"})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_DOMAIN_UPDATED {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_UpdateUser_Error_UpsertUserError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+func Test_RemoveOrganizationDomain_Error_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{{Domain: "y.co", Roles: []string{"clinic"}}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error updating user")
+	response := performRequestHeaders(t, "DELETE", "/organizations/domains/z.co", headers)
+	expectErrorResponse(t, response, 404, "Organization domain not found")
 }
 
-func Test_UpdateUser_Error_RemoveCustodians_UsersInGroupError(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+func Test_RemoveOrganizationDomain_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, errors.New("ERROR")}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{{Domain: "z.co", Roles: []string{"clinic"}, ModifiedTime: "2020-01-01T00:00:00+00:00"}}, nil}}
+	responsableStore.RemoveOrganizationDomainResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
 	headers := http.Header{}
 	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error updating user")
+	response := performRequestHeaders(t, "DELETE", "/organizations/domains/Z.CO", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"domain": "z.co", "roles": []interface{}{"clinic"}, "modifiedTime": "2020-01-01T00:00:00+00:00"})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_DOMAIN_REMOVED {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_UpdateUser_Error_RemoveCustodians_SetPermissionsError(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+func Test_CreateUser_Error_MissingBody(t *testing.T) {
+	response := performRequest(t, "POST", "/user")
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_CreateUser_Error_MalformedBody(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user", "{")
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_CreateUser_Error_MissingUserDetails(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user", "{}")
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_CreateUser_Error_InvalidUserDetails(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user", "{\"username\": \"a\"}")
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_CreateUser_Error_ErrorFindingUsers(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	expectErrorResponse(t, response, 500, "Error updating user")
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 500, "Error creating the user")
 }
 
-func Test_UpdateUser_Success_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
+func Test_CreateUser_Error_ConflictingEmail(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 409, "User already exists")
 }
 
-func Test_UpdateUser_Success_UserFromUrl(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+func Test_CreateUser_Error_ErrorUpsertingUser(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 500, "Error creating the user")
 }
 
-func Test_UpdateUser_Success_UserFromToken(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+func Test_CreateUser_Error_IdentityConflict(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
-	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{ErrUserIdentityConflict}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 409, "User already exists")
 }
 
-func Test_UpdateUser_Success_Server_WithoutPassword(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+func Test_CreateUser_Success_VerificationSecretGrantsNoOrganizationRoles(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.VerificationSecret = "+skip" })
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"], \"emailVerified\": true, \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	body := "{\"username\": \"a+skip@mail.z.co\", \"emails\": [\"a+skip@mail.z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": false})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a+skip@mail.z.co"}, "username": "a+skip@mail.z.co"})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_USER_CREATED {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_UpdateUser_Success_Server_WithPassword(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+func Test_CreateUser_Error_ErrorAddingToken(t *testing.T) {
 	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	responsableStore.UpsertUserResponses = []error{nil}
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"roles\": [\"clinic\"], \"emailVerified\": true, \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 500, "Error generating the token")
+}
+
+func Test_CreateUser_Success(t *testing.T) {
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"roles\": [\"clinic\"]}"
+	response := performRequestBody(t, "POST", "/user", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}})
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_CreateUser_Error_DomainNotAllowed(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	defer expectResponsablesEmpty(t)
 
-func Test_GetUserInfo_Error_MissingSessionToken(t *testing.T) {
-	response := performRequest(t, "GET", "/user/1111111111")
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\", \"a@Mail.Blocked.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 403, "The email domain is not allowed to sign up")
 }
 
-func Test_GetUserInfo_Error_FindUsersError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+func Test_CreateUser_Error_DisposableEmail(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	body := "{\"username\": \"a@mailinator.com\", \"emails\": [\"a@mailinator.com\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 403, "Disposable email addresses are not allowed to sign up")
 }
 
-func Test_GetUserInfo_Error_FindUsersMissing(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+func Test_CreateUser_Error_DomainNotForRole(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) {
+		config.SignupDomains = DomainPolicy{RoleRules: []DomainRoleRule{{"clinic", SIGNUP_RULE_REJECT}}}
+	})
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	expectErrorResponse(t, response, 404, "User not found")
+	body := "{\"username\": \"a@gmail.com\", \"emails\": [\"a@gmail.com\"], \"password\": \"12345678\", \"roles\": [\"clinic\"]}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 403, "The email domain is not allowed to sign up with the requested roles")
 }
 
-func Test_GetUserInfo_Error_FindUsersNil(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+func Test_CreateUser_Success_RoleReview(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	body := "{\"username\": \"a@gmail.com\", \"emails\": [\"a@gmail.com\"], \"password\": \"12345678\", \"roles\": [\"clinic\"]}"
+	response := performRequestBody(t, "POST", "/user", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@gmail.com"}, "username": "a@gmail.com", "reviewRoles": []interface{}{"clinic"}})
+	if len(responsableStore.AuditEvents) != 2 || responsableStore.AuditEvents[1].Type != AUDIT_EVENT_SIGNUP_REVIEW {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
 }
 
-func Test_GetUserInfo_Error_PermissionsError(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+func Test_CreateUser_Error_SignupCodeRequired(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.RegistrationMode = REGISTRATION_MODE_CODE })
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 403, "A signup code is required to sign up")
 }
 
-func Test_GetUserInfo_Error_NoPermissions(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed}, nil}}
+func Test_CreateUser_Error_ErrorFindingSignupCode(t *testing.T) {
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"signupCode\": \"code\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 500, "Error finding signup code")
 }
 
-func Test_GetUserInfo_Success_User(t *testing.T) {
-	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
+func Test_CreateUser_Error_SignupCodeInvalid(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.RegistrationMode = REGISTRATION_MODE_INVITATION })
+	expiresTime := time.Now().Add(time.Hour).UTC().Format(TimestampFormat)
+	for _, signupCode := range []*SignupCode{
+		nil,
+		{Code: "code", Email: "b@z.co", ExpiresTime: expiresTime},
+		{Code: "code", Email: "a@z.co", MaxUses: 1, Uses: 1, ExpiresTime: expiresTime},
+		{Code: "code", Email: "a@z.co", ExpiresTime: "2020-01-01T00:00:00+00:00"},
+		{Code: "code", ExpiresTime: expiresTime},
+	} {
+		responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{signupCode, nil}}
+
+		body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"signupCode\": \"code\"}"
+		response := performRequestBody(t, "POST", "/user", body)
+		expectErrorResponse(t, response, 403, "The signup code is invalid, expired or used up")
+		expectResponsablesEmpty(t)
+	}
+}
+
+func Test_CreateUser_Error_SignupCodeUsedConcurrently(t *testing.T) {
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{&SignupCode{Code: "code", MaxUses: 1, ExpiresTime: time.Now().Add(time.Hour).UTC().Format(TimestampFormat)}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UseSignupCodeResponses = []UseSignupCodeResponse{{nil, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"signupCode\": \"code\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 403, "The signup code is invalid, expired or used up")
 }
 
-func Test_GetUserInfo_Success_Custodian(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+func Test_CreateUser_Error_ErrorUpsertingUserReleasesSignupCode(t *testing.T) {
+	signupCode := &SignupCode{Code: "code", MaxUses: 1, ExpiresTime: time.Now().Add(time.Hour).UTC().Format(TimestampFormat)}
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{signupCode, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UseSignupCodeResponses = []UseSignupCodeResponse{{signupCode, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	responsableStore.ReleaseSignupCodeResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"signupCode\": \"code\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 500, "Error creating the user")
 }
 
-func Test_GetUserInfo_Success_Server(t *testing.T) {
-	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
+func Test_CreateUser_Success_Invitation(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	setTestConfig(t, func(config *ApiConfig) { config.RegistrationMode = REGISTRATION_MODE_INVITATION })
+	signupCode := &SignupCode{Code: "code", Email: "A@gmail.com", Roles: []string{"clinic"}, MaxUses: 1, ExpiresTime: time.Now().Add(time.Hour).UTC().Format(TimestampFormat)}
+	responsableStore.FindSignupCodeResponses = []FindSignupCodeResponse{{signupCode, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UseSignupCodeResponses = []UseSignupCodeResponse{{signupCode, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
-	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	body := "{\"username\": \"a@gmail.com\", \"emails\": [\"a@gmail.com\"], \"password\": \"12345678\", \"roles\": [\"clinic\"], \"signupCode\": \"code\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
 	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@gmail.com"}, "username": "a@gmail.com", "roles": []interface{}{"clinic"}})
 }
 
-////////////////////////////////////////////////////////////////////////////////
-
-func TestDeleteUser_StatusForbidden_WhenNoPw(t *testing.T) {
-	request, _ := http.NewRequest("DELETE", "/", nil)
-	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+func Test_CreateUser_Error_RoleNotSelfAssignable(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"roles\": [\"support\"]}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
 
-	shoreline.DeleteUser(response, request, noParams)
+func Test_CreateUser_Success_ImpliedRoles(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusForbidden {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusForbidden, response.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\", \"roles\": [\"clinician\"]}"
+	response := performRequestBody(t, "POST", "/user", body)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinician", "clinic"}})
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_CreateUser_Success_SendsVerificationEmail(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddConfirmationResponses = []error{nil}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	if string(body) != `{"code":403,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectSuccessResponseWithJSONMap(t, response, 201)
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "a@z.co" || !strings.Contains(recordingMailer.Messages[0].Body, "/verify/") {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
 	}
 }
 
-func TestDeleteUser_StatusForbidden_WhenEmptyPw(t *testing.T) {
-
-	var jsonData = []byte(`{"password": ""}`)
-	request, _ := http.NewRequest("DELETE", "/", bytes.NewBuffer(jsonData))
-	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+func Test_CreateUser_Success_VerificationEmailError(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddConfirmationResponses = []error{errors.New("ERROR")}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}"
+	response := performRequestBody(t, "POST", "/user", body)
+	expectSuccessResponseWithJSONMap(t, response, 201)
+	if len(recordingMailer.Messages) != 0 {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
+	}
+}
 
-	shoreline.DeleteUser(response, request, noParams)
+////////////////////////////////////////////////////////////////////////////////
 
-	if response.Code != http.StatusForbidden {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusForbidden, response.Code)
+func createConfirmationToken(t *testing.T, confirmation *Confirmation) string {
+	token, err := confirmation.SignedToken(fakeConfig.ServerSecret)
+	if err != nil {
+		t.Fatalf("Error creating confirmation token: %#v", err)
 	}
+	return token
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func createVerificationConfirmation(t *testing.T) *Confirmation {
+	return createConfirmation(t, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "a@z.co")
+}
 
-	if string(body) != `{"code":403,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+func createConfirmation(t *testing.T, confirmationType string, email string) *Confirmation {
+	confirmation, err := NewConfirmation(confirmationType, "1111111111", email, time.Hour, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating confirmation: %#v", err)
 	}
+	return confirmation
 }
 
-func TestDeleteUser_Failure(t *testing.T) {
+func Test_VerifyEmail_Error_InvalidToken(t *testing.T) {
+	response := performRequest(t, "POST", "/user/verify/not-a-token")
+	expectErrorResponse(t, response, 400, "The confirmation token is invalid or has expired")
+}
 
-	var jsonData = []byte(`{"password": "92ggh38"}`)
-	req, _ := http.NewRequest("DELETE", "/", bytes.NewBuffer(jsonData))
-	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	resp := httptest.NewRecorder()
+func Test_VerifyEmail_Error_ConfirmationNotFound(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shorelineFails.SetHandlers("", rtr)
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 404, "No unused confirmation matched the given token")
+}
 
-	shorelineFails.DeleteUser(resp, req, noParams)
+func Test_VerifyEmail_Error_EmailChanged(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "b@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if resp.Code != http.StatusUnauthorized {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
-	}
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 400, "The confirmation token is invalid or has expired")
 }
 
-func TestDeleteUser_StatusAccepted(t *testing.T) {
+func Test_VerifyEmail_Error_UpsertUserError(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	var jsonData = []byte(`{"password": "123youknoWm3"}`)
-	request, _ := http.NewRequest("DELETE", "/", bytes.NewBuffer(jsonData))
-	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_VerifyEmail_Error_RevisionConflict(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{ErrUserRevisionConflict}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.DeleteUser(response, request, map[string]string{"userid": user.Id})
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 409, "The user was modified concurrently, try again")
+}
 
-	if response.Code != http.StatusAccepted {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusAccepted, response.Code)
-	}
+func Test_VerifyEmail_Success(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
-func TestDeleteUser_StatusUnauthorized_WhenNoToken(t *testing.T) {
-	request, _ := http.NewRequest("DELETE", "/", nil)
-	response := httptest.NewRecorder()
+func Test_VerifyEmail_Success_SecondaryEmail(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "b@z.co")
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}}
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@z.co", "b@z.co"}, "username": "a@z.co", "verifiedEmails": []interface{}{"b@z.co"}})
+}
 
-	shoreline.DeleteUser(response, request, noParams)
+func Test_VerifyEmail_Success_OrganizationDomain(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, ReviewRoles: []string{"clinic"}}
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{{Domain: "z.co", Roles: []string{"clinic"}}, {Domain: "y.co", Roles: []string{"admin"}}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}})
+	if len(responsableStore.AuditEvents) != 2 || responsableStore.AuditEvents[1].Type != AUDIT_EVENT_ROLES_CHANGED || !reflect.DeepEqual(responsableStore.AuditEvents[1].Details, map[string]string{"from": "", "to": "clinic", "domains": "z.co"}) {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_VerifyEmail_Success_ErrorSharingClinicDemo(t *testing.T) {
+	confirmation := createVerificationConfirmation(t)
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, Roles: []string{"clinic"}}
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-func Test_Login_Error_MissingAuthorization(t *testing.T) {
-	response := performRequest(t, "POST", "/login")
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+	response := performRequest(t, "POST", "/user/verify/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}})
 }
 
-func Test_Login_Error_EmptyAuthorization(t *testing.T) {
-	headers := http.Header{}
-	headers.Add("Authorization", "")
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+func Test_ConfirmEmailChange_Error_WrongTokenType(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_REVERT, "b@z.co")
+
+	response := performRequest(t, "POST", "/user/email/confirm/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 400, "The confirmation token is invalid or has expired")
 }
 
-func Test_Login_Error_InvalidAuthorization(t *testing.T) {
-	authorization := createAuthorization(t, "", "")
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+func Test_ConfirmEmailChange_Error_PendingEmailChanged(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_CHANGE, "b@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PendingEmail: "c@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequest(t, "POST", "/user/email/confirm/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 400, "The confirmation token is invalid or has expired")
 }
 
-func Test_Login_Error_FindUsersError(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+func Test_ConfirmEmailChange_Error_DisposableEmail(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_CHANGE, "b@mailinator.com")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PendingEmail: "b@mailinator.com"}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	response := performRequest(t, "POST", "/user/email/confirm/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 403, "Disposable email addresses are not allowed to sign up")
 }
 
-func Test_Login_Error_FindUsersMissing(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+func Test_ConfirmEmailChange_Error_EmailTaken(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_CHANGE, "b@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PendingEmail: "b@z.co"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "2222222222", Username: "b@z.co"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequest(t, "POST", "/user/email/confirm/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 409, "User already exists")
 }
 
-func Test_Login_Error_FindUsersNil(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+func Test_ConfirmEmailChange_Success(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_CHANGE, "b@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PendingEmail: "b@z.co"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequest(t, "POST", "/user/email/confirm/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"b@z.co"}, "username": "b@z.co"})
 }
 
-func Test_Login_Error_NoPassword(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+func Test_RevertEmailChange_Error_RemoveTokensError(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_REVERT, "a@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "b@z.co", Emails: []string{"b@z.co"}}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequest(t, "POST", "/user/email/revert/"+createConfirmationToken(t, confirmation))
+	expectErrorResponse(t, response, 500, "Error updating token")
 }
 
-func Test_Login_Error_PasswordMismatch(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_RevertEmailChange_Success_Confirmed(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_REVERT, "a@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "b@z.co", Emails: []string{"b@z.co"}}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	response := performRequest(t, "POST", "/user/email/revert/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
-func Test_Login_Error_EmailNotVerified(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_RevertEmailChange_Success_Pending(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_REVERT, "a@z.co")
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PendingEmail: "b@z.co"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+	response := performRequest(t, "POST", "/user/email/revert/"+createConfirmationToken(t, confirmation))
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
-func Test_Login_Error_ErrorCreatingToken(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
-	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
-	defer expectResponsablesEmpty(t)
+func Test_ResendVerification_Error_MailerNotConfigured(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user/verify/resend", "{\"email\": \"a@z.co\"}")
+	expectErrorResponse(t, response, 501, "Sending email is not configured")
+}
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	expectErrorResponse(t, response, 500, "Error updating token")
+func Test_ResendVerification_Error_MissingEmail(t *testing.T) {
+	attachRecordingMailer()
+	defer detachRecordingMailer()
+
+	response := performRequestBody(t, "POST", "/user/verify/resend", "{}")
+	expectErrorResponse(t, response, 400, "Not all required details were given")
 }
 
-func Test_Login_Success(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
-	responsableStore.AddTokenResponses = []error{nil}
+func Test_ResendVerification_Error_TooManyRequests(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	recent := createVerificationConfirmation(t)
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co"}}, nil}}
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{recent, recent, recent}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	response := performRequestBody(t, "POST", "/user/verify/resend", "{\"email\": \"a@z.co\"}")
+	expectErrorResponse(t, response, 429, "Too many requests, try again later")
+	if len(recordingMailer.Messages) != 0 {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
 	}
 }
 
-func Test_Login_Success_Password_Complex(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "`-=[]\\;',./~!@#$%^&*)(_+}{|\":<>?`¡™£¢∞§¶•ª–≠‘“æ…÷≥”’")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "80464ae775ca97187d29bc4b3e391e959947138a", EmailVerified: true}}, nil}}
-	responsableStore.AddTokenResponses = []error{nil}
+func Test_ResendVerification_Success_UnknownEmail(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login", headers)
-	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
-	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
-	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	response := performRequestBody(t, "POST", "/user/verify/resend", "{\"email\": \"a@z.co\"}")
+	expectSuccessResponse(t, response, 202)
+	if len(recordingMailer.Messages) != 0 {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
-
-func TestServerLogin_StatusBadRequest_WhenNoNameOrSecret(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	response := httptest.NewRecorder()
-
-	shoreline.SetHandlers("", rtr)
-
-	shoreline.ServerLogin(response, request)
+func Test_ResendVerification_Success(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	old, _ := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "a@z.co", time.Hour, time.Now().Add(-2*time.Hour))
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", Username: "a@z.co"}}, nil}}
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{old, old, old}, nil}}
+	responsableStore.AddConfirmationResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	response := performRequestBody(t, "POST", "/user/verify/resend", "{\"email\": \"a@z.co\"}")
+	expectSuccessResponse(t, response, 202)
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "a@z.co" {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
 	}
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+////////////////////////////////////////////////////////////////////////////////
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
-	}
+func Test_CreateCustodialUser_Error_MissingSessionToken(t *testing.T) {
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	response := performRequestBody(t, "POST", "/user/abcdef1234/user", body)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func TestServerLogin_StatusBadRequest_WhenNoName(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+func Test_CreateCustodialUser_Error_TokenNotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1234567890/user", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_CreateCustodialUser_Error_MismatchUserIds(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1234567890/user", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_CreateCustodialUser_Error_MissingDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
-	}
+	body := ""
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func TestServerLogin_StatusBadRequest_WhenNoSecret(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	response := httptest.NewRecorder()
+func Test_CreateCustodialUser_Error_InvalidDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	body := "{\"username\": \"a\", \"emails\": [\"a\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_CreateCustodialUser_Error_FindUsersError(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusBadRequest {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 500, "Error creating the user")
+}
 
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_CreateCustodialUser_Error_FindUsersDuplicate(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 409, "User already exists")
 }
 
-func TestServerLogin_StatusOK(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/serverlogin", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+func Test_CreateCustodialUser_Error_UpsertUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 500, "Error creating the user")
+}
 
-	shoreline.ServerLogin(response, request)
+func Test_CreateCustodialUser_Error_SetPermissionsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 500, "Error creating the user")
+}
 
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatal("The session token should have been set")
-	}
+func Test_CreateCustodialUser_Success_Anonymous(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
 
+	body := "{}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"custodianUserId": "abcdef1234"})
 }
 
-func TestServerLogin_Failure(t *testing.T) {
-	req, _ := http.NewRequest("POST", "/", nil)
-	req.Header.Set(TP_SERVER_NAME, "shoreline")
-	req.Header.Set(TP_SERVER_SECRET, theSecret)
-	resp := httptest.NewRecorder()
-
-	shorelineFails.SetHandlers("", rtr)
-
-	shorelineFails.ServerLogin(resp, req)
+func Test_CreateCustodialUser_Success_Anonymous_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if resp.Code != http.StatusInternalServerError {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusInternalServerError, resp.Code)
-	}
+	body := "{}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/0000000000/user", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"custodianUserId": "0000000000", "passwordExists": false})
 }
 
-func TestServerLogin_StatusUnauthorized_WhenSecretWrong(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, "wrong secret")
-	response := httptest.NewRecorder()
-
-	shoreline.SetHandlers("", rtr)
-
-	shoreline.ServerLogin(response, request)
-
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
-	}
-
-	body, _ := ioutil.ReadAll(response.Body)
+func Test_CreateCustodialUser_Success_Known(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if string(body) != `{"code":401,"reason":"Wrong password"}` {
-		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_PW_WRONG)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"custodianUserId": "abcdef1234", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
-////////////////////////////////////////////////////////////////////////////////
-
-func TestRefreshSession_StatusUnauthorized_WithNoToken(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
-	response := httptest.NewRecorder()
-
-	shoreline.SetHandlers("", rtr)
-
-	shoreline.RefreshSession(response, request)
+func Test_CreateCustodialUser_Error_CustodianNotAllowed(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Custodial = testCustodialPolicy })
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "abcdef1234", Username: "b@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 403, "The custodian is not allowed to have custodial users")
 }
 
-func TestRefreshSession_StatusUnauthorized_WithWrongToken(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
-	request.Header.Set(TP_SESSION_TOKEN, "not this token")
-	response := httptest.NewRecorder()
-
-	shoreline.SetHandlers("", rtr)
-
-	shoreline.RefreshSession(response, request)
+func Test_CreateCustodialUser_Error_EmailRequired(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Custodial = testCustodialPolicy })
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "abcdef1234", Username: "b@z.co", Roles: []string{"clinic"}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", "{}", headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func TestRefreshSession_StatusOK(t *testing.T) {
-
-	shoreline.SetHandlers("", rtr)
-
-	refreshRequest, _ := http.NewRequest("GET", "/", nil)
-	refreshRequest.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
-
-	shoreline.RefreshSession(response, refreshRequest)
-
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
-
-	tokenString := response.Header().Get(TP_SESSION_TOKEN)
-
-	if tokenString == "" {
-		t.Fatal("A session token should have been returned")
-	}
-
-	if response.Body == nil {
-		t.Fatal("A Body should have been returned")
-	}
-
-	body, _ := ioutil.ReadAll(response.Body)
-
-	var tokenData TokenData
-	_ = json.Unmarshal(body, &tokenData)
+func Test_CreateCustodialUser_Error_LimitReached(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Custodial = testCustodialPolicy })
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "abcdef1234", Username: "b@z.co", Roles: []string{"clinic"}}, nil}}
+	responsableStore.FindUsersByCustodianResponses = []FindUsersResponse{{[]*User{{Id: "1111111111"}, {Id: "2222222222"}}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if tokenData.UserId != user.Id {
-		t.Fatalf("should have had a user id of `%v` but was %v", user.Id, tokenData.UserId)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	expectErrorResponse(t, response, 403, "The custodian has the most custodial users allowed")
 }
 
-func TestRefreshSession_Failure(t *testing.T) {
-
-	shorelineFails.SetHandlers("", rtr)
-
-	req, _ := http.NewRequest("GET", "/", nil)
-	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	resp := httptest.NewRecorder()
-
-	shorelineFails.RefreshSession(resp, req)
+func Test_CreateCustodialUser_Success_Policy(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Custodial = testCustodialPolicy })
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "abcdef1234", Username: "b@z.co", Roles: []string{"clinic"}}, nil}}
+	responsableStore.FindUsersByCustodianResponses = []FindUsersResponse{{[]*User{{Id: "1111111111"}, {Id: "2222222222", DeletedTime: "2016-01-01T00:00:00+00:00"}}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if resp.Code != http.StatusUnauthorized {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
-	}
+	body := "{\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/abcdef1234/user", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 201)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"custodianUserId": "abcdef1234", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func Test_LongTermLogin_Error_MissingAuthorization(t *testing.T) {
-	response := performRequest(t, "POST", "/login/thelongtermkey")
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+func Test_UpdateUser_Error_MissingSessionToken(t *testing.T) {
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	response := performRequestBody(t, "PUT", "/user/1111111111", body)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_LongTermLogin_Error_EmptyAuthorization(t *testing.T) {
-	headers := http.Header{}
-	headers.Add("Authorization", "")
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
-}
+func Test_UpdateUser_Error_MissingDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-func Test_LongTermLogin_Error_InvalidAuthorization(t *testing.T) {
-	authorization := createAuthorization(t, "", "")
+	body := ""
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 400, "Missing id and/or password")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func Test_LongTermLogin_Error_FindUsersError(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+func Test_UpdateUser_Error_InvalidDetails(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a\", \"emails\": [\"a\"]}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 500, "Error finding user")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
 }
 
-func Test_LongTermLogin_Error_FindUsersMissing(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+func Test_UpdateUser_Error_FindUsersError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
 }
 
-func Test_LongTermLogin_Error_FindUsersNil(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+func Test_UpdateUser_Error_FindUsersMissing(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_LongTermLogin_Error_NoPassword(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+func Test_UpdateUser_Error_PermissionsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
 }
 
-func Test_LongTermLogin_Error_PasswordMismatch(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_UpdateUser_Error_NoPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true, \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 401, "No user matched the given details")
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_LongTermLogin_Error_EmailNotVerified(t *testing.T) {
-	authorization := createAuthorization(t, "a@b.co", "password")
-	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+func Test_UpdateUser_Error_UnauthorizedRoles_User(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
 	defer expectResponsablesEmpty(t)
 
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"]}}"
 	headers := http.Header{}
-	headers.Add("Authorization", authorization)
-	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
-	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
-}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_UnauthorizedRoles_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_UnauthorizedEmailVerified_User(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_UnauthorizedEmailVerified_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"emailVerified\": true}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_UnauthorizedPassword_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_UnauthorizedTermsAccepted_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_FindUserDuplicateError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_UpdateUser_Error_FindUserDuplicateFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1234567890"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 409, "User already exists")
+}
+
+func Test_UpdateUser_Error_DomainNotAllowed(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\", \"a@blocked.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 403, "The email domain is not allowed to sign up")
+}
+
+func Test_UpdateUser_Error_UpsertUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UpdateUser_Error_RemoveCustodians_UsersInGroupError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UpdateUser_Error_RemoveCustodians_SetPermissionsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"12345678\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_UpdateUser_Success_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
+}
+
+func Test_UpdateUser_Success_UserFromUrl(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+}
+
+func Test_UpdateUser_Success_UsernameChangeIsPending(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, PwHash: "xyz"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddConfirmationResponses = []error{nil, nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"b@z.co\", \"emails\": [\"b@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "pendingEmail": "b@z.co"})
+	if len(recordingMailer.Messages) != 2 || recordingMailer.Messages[0].To != "b@z.co" || recordingMailer.Messages[1].To != "a@z.co" {
+		t.Fatalf("Unexpected email change emails: %#v", recordingMailer.Messages)
+	}
+}
+
+func Test_UpdateUser_Error_IfMatchMismatch(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Revision: 4}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	headers.Add("If-Match", `"3"`)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 412, "The user was modified since the given revision")
+}
+
+func Test_UpdateUser_Error_RevisionConflict(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Revision: 4}, nil}}
+	responsableStore.UpsertUserResponses = []error{ErrUserRevisionConflict}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	headers.Add("If-Match", `"4"`)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 412, "The user was modified since the given revision")
+}
+
+func Test_UpdateUser_Error_IdentityConflict(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{ErrUserIdentityConflict}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"b@z.co\", \"emails\": [\"b@z.co\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 409, "User already exists")
+}
+
+func Test_UpdateUser_Success_UserFromToken(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+}
+
+func Test_UpdateUser_Success_Server_WithoutPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"roles\": [\"clinic\"], \"emailVerified\": true, \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": false})
+}
+
+func Test_UpdateUser_Success_Server_EmailVerifiedOrganizationDomain(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{{Domain: "z.co", Roles: []string{"clinic"}}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"emailVerified\": true}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "passwordExists": false})
+	if len(responsableStore.AuditEvents) != 2 || responsableStore.AuditEvents[1].Type != AUDIT_EVENT_ROLES_CHANGED || !reflect.DeepEqual(responsableStore.AuditEvents[1].Details, map[string]string{"from": "", "to": "clinic", "domains": "z.co"}) {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
+}
+
+func Test_UpdateUser_Error_Server_UnknownRole(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"researcher\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_UpdateUser_Success_Server_RoleNotSelfAssignable(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"support\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"support"}, "passwordExists": false})
+}
+
+func Test_UpdateUser_Success_Admin_OtherUserRoles(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}, {&User{Id: "0000000000", Roles: []string{"admin"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"clinician\"], \"emailVerified\": true}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinician", "clinic"}})
+}
+
+func Test_UpdateUser_Success_Server_ReviewedRoles(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@gmail.com", Emails: []string{"a@gmail.com"}, ReviewRoles: []string{"clinic"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@gmail.com"}, "username": "a@gmail.com", "roles": []interface{}{"clinic"}, "passwordExists": false})
+}
+
+func Test_UpdateUser_Error_Admin_OtherUserUsername(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}, {&User{Id: "0000000000", Roles: []string{"admin"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"b@z.co\", \"roles\": [\"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_RoleWithoutPermission(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}, {&User{Id: "0000000000", Roles: []string{"support"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"admin\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Error_GrantRoleWithoutItsPermissions(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}, {&User{Id: "0000000000", Roles: []string{"roleEditor"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"admin\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_UpdateUser_Success_RoleEditor_KeepsRoleWithoutItsPermissions(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, Roles: []string{"support"}}, nil}, {&User{Id: "0000000000", Roles: []string{"roleEditor"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"roles\": [\"support\", \"clinic\"]}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"support", "clinic"}})
+}
+
+func Test_UpdateUser_Error_UnknownTermsVersion(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"termsAccepted\": \"2016-01-01T01:23:45-08:00\", \"termsVersion\": \"4\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
+
+func Test_UpdateUser_Success_TermsAcceptedCurrentVersion(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAcceptances: []*TermsAcceptance{{Version: "1", AcceptedTime: "2016-01-01T00:00:00+00:00"}}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"termsAccepted\": \"2017-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"userid":        "1111111111",
+		"username":      "a@z.co",
+		"emails":        []interface{}{"a@z.co"},
+		"emailVerified": false,
+		"termsAccepted": "2017-01-01T01:23:45-08:00",
+		"termsAcceptances": []interface{}{
+			map[string]interface{}{"version": "1", "acceptedTime": "2016-01-01T00:00:00+00:00"},
+			map[string]interface{}{"version": "2", "acceptedTime": "2017-01-01T01:23:45-08:00"},
+		},
+	})
+}
+
+func Test_UpdateUser_Success_Server_WithPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}, {clients.Permissions{"view": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	body := "{\"updates\": {\"username\": \"a@z.co\", \"emails\": [\"a@z.co\"], \"password\": \"newpassword\", \"roles\": [\"clinic\"], \"emailVerified\": true, \"termsAccepted\": \"2016-01-01T01:23:45-08:00\"}}"
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "PUT", "/user/1111111111", body, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "roles": []interface{}{"clinic"}, "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_GetUserInfo_Error_MissingSessionToken(t *testing.T) {
+	response := performRequest(t, "GET", "/user/1111111111")
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_GetUserInfo_Error_FindUsersError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_GetUserInfo_Error_FindUsersMissing(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_GetUserInfo_Error_FindUsersNil(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_GetUserInfo_Error_PermissionsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_GetUserInfo_Error_NoPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_GetUserInfo_Success_User(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+}
+
+func Test_GetUserInfo_Success_ETag(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Revision: 7}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "username": "a@z.co", "revision": float64(7)})
+	if etag := response.Header().Get("ETag"); etag != `"7"` {
+		t.Fatalf("Unexpected ETag: %s", etag)
+	}
+}
+
+func Test_GetUserInfo_Success_MergedUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "2222222222"}}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "2222222222", Username: "a@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "2222222222", "emailVerified": false, "username": "a@z.co", "passwordExists": false})
+}
+
+func Test_GetUserInfo_Success_MergedUserChain(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "2222222222"}}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{
+		{&User{Id: "2222222222", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "3333333333"}, nil},
+		{&User{Id: "3333333333", Username: "a@z.co"}, nil},
+	}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "3333333333", "emailVerified": false, "username": "a@z.co", "passwordExists": false})
+}
+
+func Test_GetUserInfo_Error_MergedUserCycle(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "2222222222"}}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "2222222222", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "1111111111"}, nil}, {&User{Id: "1111111111", MergedTime: time.Now().UTC().Format(TimestampFormat), MergedUserID: "2222222222"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_GetUserInfo_Error_MergedUserTransitionExpired(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "1111111111", MergedTime: "2016-01-01T00:00:00+00:00", MergedUserID: "2222222222"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_GetUserInfo_Success_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+}
+
+func Test_GetUserInfo_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", EmailVerified: true, PwHash: "xyz", Hash: "123"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00", "passwordExists": true})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestDeleteUser_StatusForbidden_WhenNoPw(t *testing.T) {
+	request, _ := http.NewRequest("DELETE", "/", nil)
+	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.DeleteUser(response, request, noParams)
+
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusForbidden, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":403,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestDeleteUser_StatusForbidden_WhenEmptyPw(t *testing.T) {
+
+	var jsonData = []byte(`{"password": ""}`)
+	request, _ := http.NewRequest("DELETE", "/", bytes.NewBuffer(jsonData))
+	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.DeleteUser(response, request, noParams)
+
+	if response.Code != http.StatusForbidden {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusForbidden, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":403,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestDeleteUser_Failure(t *testing.T) {
+
+	var jsonData = []byte(`{"password": "92ggh38"}`)
+	req, _ := http.NewRequest("DELETE", "/", bytes.NewBuffer(jsonData))
+	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.SetHandlers("", rtr)
+
+	shorelineFails.DeleteUser(resp, req, noParams)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
+	}
+}
+
+func TestDeleteUser_StatusUnauthorized_WhenNoToken(t *testing.T) {
+	request, _ := http.NewRequest("DELETE", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.DeleteUser(response, request, noParams)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func Test_ExportUser_Error_Unauthorized(t *testing.T) {
+	sessionToken := createSessionToken(t, "2222222222", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/export", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_ExportUser_Error_UserNotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/export", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_ExportUser_Error_FindTokensForUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/export", headers)
+	expectErrorResponse(t, response, 500, "Error exporting user")
+}
+
+func Test_ExportUser_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, Private: map[string]*IdHashPair{"meta": {Id: "0000000000", Hash: "secret"}}}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	expired := &SessionToken{ID: "expired", UserID: "1111111111", ExpiresAt: time.Now().Add(-time.Hour)}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindTokensForUserResponses = []FindTokensResponse{{[]*SessionToken{sessionToken, expired}, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{}, nil}}
+	responsableStore.FindAuditEventsResponses = []FindAuditEventsResponse{{[]*AuditEvent{{ID: "1", Type: AUDIT_EVENT_LOGIN, TargetUserID: "1111111111"}}, nil}}
+	responsableStore.FindConsentRecordsResponses = []FindConsentRecordsResponse{{[]*ConsentRecord{{ID: "1", UserID: "1111111111", Type: "research", Version: "1", Granted: true}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/export", headers)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	if disposition := response.Header().Get("Content-Disposition"); disposition != `attachment; filename="user-1111111111.json"` {
+		t.Fatalf("Unexpected content disposition: %s", disposition)
+	}
+	body := response.Body.String()
+	for _, secret := range []string{existing.PwHash, "secret", sessionToken.ID} {
+		if strings.Contains(body, secret) {
+			t.Fatalf("Export contains secret %s: %s", secret, body)
+		}
+	}
+	var export UserExport
+	if err := json.Unmarshal([]byte(body), &export); err != nil {
+		t.Fatalf("Error decoding response body: %s", err)
+	}
+	if export.User == nil || export.User.Id != "1111111111" || !export.PasswordExists {
+		t.Fatalf("Unexpected exported user: %#v", export)
+	}
+	if !reflect.DeepEqual(export.Private, []string{"meta"}) || len(export.Sessions) != 1 || len(export.AuditEvents) != 1 || len(export.Consents) != 1 || export.Marketo == nil || !export.Marketo.Enabled {
+		t.Fatalf("Unexpected export: %s", body)
+	}
+}
+
+func Test_SuspendUser_Error_NotAuthorized(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/suspend", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_SuspendUser_Success_Admin(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Roles = testRoles })
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "0000000000", Roles: []string{"admin"}}, nil}, {&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/suspend", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "suspendedTime", `\A\d{4}-\d{2}-\d{2}T`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "emailVerified": false, "passwordExists": false, "suspendedUserId": "0000000000"})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_USER_SUSPENDED || responsableStore.AuditEvents[0].ActorUserID != "0000000000" {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
+}
+
+func Test_SuspendUser_Error_RevisionConflict(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	responsableStore.UpsertUserResponses = []error{ErrUserRevisionConflict}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/suspend", headers)
+	expectErrorResponse(t, response, 409, "The user was modified concurrently, try again")
+}
+
+func Test_UnsuspendUser_Error_NotSuspended(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unsuspend", headers)
+	expectErrorResponse(t, response, 409, "User is not suspended")
+}
+
+func Test_UnsuspendUser_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", SuspendedTime: "2016-01-01T00:00:00+00:00", SuspendedUserID: "0000000000"}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/unsuspend", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "emailVerified": false, "passwordExists": false})
+}
+
+func Test_AddUserEmail_Error_OtherUser(t *testing.T) {
+	sessionToken := createSessionToken(t, "2222222222", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/emails", "{\"email\": \"b@z.co\"}", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_AddUserEmail_Error_DomainNotAllowed(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@blocked.co", Emails: []string{"a@blocked.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/emails", "{\"email\": \"b@Mail.Blocked.co\"}", headers)
+	expectErrorResponse(t, response, 403, "The email domain is not allowed to sign up")
+}
+
+func Test_AddUserEmail_Error_EmailTaken(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "2222222222", Username: "b@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/emails", "{\"email\": \"b@z.co\"}", headers)
+	expectErrorResponse(t, response, 409, "User already exists")
+}
+
+func Test_AddUserEmail_Success(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AddConfirmationResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/emails", "{\"email\": \"b@z.co\"}", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co", "b@z.co"}, "username": "a@z.co"})
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "b@z.co" {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
+	}
+}
+
+func Test_RemoveUserEmail_Error_PrimaryEmail(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/emails/a@z.co", headers)
+	expectErrorResponse(t, response, 400, "The primary email cannot be removed")
+}
+
+func Test_RemoveUserEmail_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}, VerifiedEmails: []string{"b@z.co"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/emails/b@z.co", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": false, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
+}
+
+func Test_SendUserEmailVerification_Error_MailerNotConfigured(t *testing.T) {
+	response := performRequest(t, "POST", "/user/1111111111/emails/b@z.co/verify")
+	expectErrorResponse(t, response, 501, "Sending email is not configured")
+}
+
+func Test_SendUserEmailVerification_Success(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}}, nil}}
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{}, nil}}
+	responsableStore.AddConfirmationResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/emails/b@z.co/verify", headers)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "b@z.co" {
+		t.Fatalf("Unexpected verification emails: %#v", recordingMailer.Messages)
+	}
+}
+
+func Test_SetPrimaryEmail_Error_NotVerified(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}, EmailVerified: true}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/emails/b@z.co/primary", headers)
+	expectErrorResponse(t, response, 403, "The email has not been verified")
+}
+
+func Test_SetPrimaryEmail_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co", "b@z.co"}, EmailVerified: true, VerifiedEmails: []string{"b@z.co"}}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/emails/b@z.co/primary", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"b@z.co", "a@z.co"}, "username": "b@z.co", "verifiedEmails": []interface{}{"a@z.co"}})
+}
+
+func Test_DeleteUser_Error_FindUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_DeleteUser_Error_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{nil, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 404, "User not found")
+}
+
+func Test_DeleteUser_Error_PasswordMismatch(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "xyz"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 403, "Wrong password")
+}
+
+func Test_DeleteUser_Error_UpsertUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+}
+
+func Test_DeleteUser_Error_RemoveTokensForUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 500, "Error updating token")
+}
+
+func Test_DeleteUser_Error_UpsertDeletionJobError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectErrorResponse(t, response, 500, "Error updating deletion job")
+}
+
+func Test_DeleteUser_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectSuccessResponse(t, response, 202)
+	if !existing.IsDeleted() || existing.DeletedUserID != "1111111111" {
+		t.Fatalf("User was not marked deleted: %#v", existing)
+	}
+}
+
+func Test_DeleteUser_Success_AlreadyDeleted(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{{ID: "0000000000", UserID: "1111111111", State: DELETION_JOB_STATE_PENDING}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"password\": \"12345678\"}", headers)
+	expectSuccessResponse(t, response, 202)
+	if existing.DeletedTime != "2016-01-01T01:23:45+00:00" {
+		t.Fatalf("Deleted time was unexpectedly changed: %#v", existing)
+	}
+}
+
+func Test_DeleteUser_Error_Server_MissingReason(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"requester\": \"support@tidepool.org\"}", headers)
+	expectErrorResponse(t, response, 400, "A reason and requester are required to delete a user")
+}
+
+func Test_DeleteUser_Error_Server_MissingRequester(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"reason\": \"GDPR erasure request\", \"requester\": \"  \"}", headers)
+	expectErrorResponse(t, response, 400, "A reason and requester are required to delete a user")
+}
+
+func Test_DeleteUser_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	job := &DeletionJob{ID: "0000000000", UserID: "1111111111", State: DELETION_JOB_STATE_PENDING, Request: &DeletionRequest{Requester: "1111111111", ActorUserID: "1111111111"}}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{job}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "DELETE", "/user/1111111111", "{\"reason\": \"GDPR erasure request\", \"requester\": \"a@z.co\"}", headers)
+	expectSuccessResponse(t, response, 202)
+	if !existing.IsDeleted() || existing.DeletedUserID != "shoreline" {
+		t.Fatalf("User was not marked deleted: %#v", existing)
+	}
+	if job.Request.Reason != "GDPR erasure request" || job.Request.Requester != "a@z.co" || job.Request.ActorUserID != "shoreline" {
+		t.Fatalf("Deletion request was not recorded: %#v", job.Request)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_RestoreUser_Error_Unauthorized(t *testing.T) {
+	response := performRequest(t, "POST", "/user/1111111111/restore")
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_RestoreUser_Error_PasswordMismatch(t *testing.T) {
+	existing := &User{Id: "1111111111", Username: "a@z.co", DeletedTime: time.Now().UTC().Format(TimestampFormat)}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", createAuthorization(t, "a@z.co", "87654321"))
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_RestoreUser_Error_NotDeleted(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	expectErrorResponse(t, response, 409, "User is not marked deleted")
+}
+
+func Test_RestoreUser_Error_GracePeriodExpired(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	expectErrorResponse(t, response, 410, "The deletion grace period has expired")
+}
+
+func Test_RestoreUser_Error_CancelDeletionJobError(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", DeletedTime: time.Now().UTC().Format(TimestampFormat)}, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	expectErrorResponse(t, response, 500, "Error updating deletion job")
+}
+
+func Test_RestoreUser_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, DeletedTime: time.Now().UTC().Format(TimestampFormat), DeletedUserID: "1111111111"}
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{{ID: "0000000000", UserID: "1111111111", State: DELETION_JOB_STATE_PENDING}}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "passwordExists": false})
+}
+
+func Test_RestoreUser_Success_Credentials(t *testing.T) {
+	existing := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, DeletedTime: time.Now().UTC().Format(TimestampFormat), DeletedUserID: "1111111111"}
+	existing.HashPassword("12345678", fakeConfig.Salt)
+	responsableStore.FindUserResponses = []FindUserResponse{{existing, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{{ID: "0000000000", UserID: "1111111111", State: DELETION_JOB_STATE_PENDING}}, nil}}
+	responsableStore.UpsertDeletionJobResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", createAuthorization(t, "a@z.co", "12345678"))
+	response := performRequestHeaders(t, "POST", "/user/1111111111/restore", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co"})
+	if existing.IsDeleted() {
+		t.Fatalf("User was not restored: %#v", existing)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_GetDeletionJobs_Error_ServerTokenRequired(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/deletion", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
+
+func Test_GetDeletionJobs_Error_FindDeletionJobsForUserError(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/deletion", headers)
+	expectErrorResponse(t, response, 500, "Error finding deletion jobs")
+}
+
+func Test_GetDeletionJobs_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindDeletionJobsForUserResponses = []FindDeletionJobsResponse{{[]*DeletionJob{{ID: "0000000000", UserID: "1111111111", State: DELETION_JOB_STATE_PENDING, Steps: []*DeletionStep{{Name: DELETION_STEP_REVOKE_TOKENS, State: DELETION_STEP_STATE_PENDING}}}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/deletion", headers)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
+	}
+	var jobs []*DeletionJob
+	if err := json.NewDecoder(response.Body).Decode(&jobs); err != nil {
+		t.Fatalf("Error decoding response body: %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].State != DELETION_JOB_STATE_PENDING || len(jobs[0].Steps) != 1 {
+		t.Fatalf("Unexpected deletion jobs: %#v", jobs)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_Login_Error_MissingAuthorization(t *testing.T) {
+	response := performRequest(t, "POST", "/login")
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_Login_Error_EmptyAuthorization(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Authorization", "")
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_Login_Error_InvalidAuthorization(t *testing.T) {
+	authorization := createAuthorization(t, "", "")
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_Login_Error_FindUsersError(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_Login_Error_FindUsersMissing(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Error_FindUsersNil(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Error_NoPassword(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Error_PasswordMismatch(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_Login_Error_PasswordMismatch_Audited(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	headers.Add("X-Request-Id", "request")
+	headers.Add("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+	if len(responsableStore.AuditEvents) != 1 {
+		t.Fatalf("Unexpected audit events: %#v", responsableStore.AuditEvents)
+	}
+	event := responsableStore.AuditEvents[0]
+	if event.Type != AUDIT_EVENT_LOGIN_FAILED || event.TargetUserID != "1111111111" || event.Reason != "wrongPassword" || event.Details["username"] != "a@b.co" || event.IP != "" || event.RequestID != "request" {
+		t.Fatalf("Unexpected audit event: %#v", event)
+	}
+}
+
+func Test_Login_Error_EmailNotVerified(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+}
+
+func Test_Login_Error_Suspended(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, SuspendedTime: "2016-01-01T00:00:00+00:00"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 403, "User is suspended")
+}
+
+func Test_Login_Success_TermsRequired(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments })
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, TermsAcceptances: []*TermsAcceptance{{Version: "1", AcceptedTime: "2016-01-01T00:00:00+00:00"}}}}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if termsRequired, ok := successResponse["termsRequired"].(map[string]interface{}); !ok || termsRequired["version"] != "2" {
+		t.Fatalf("Unexpected terms required: %#v", successResponse)
+	}
+}
+
+func Test_Login_Success_TermsAccepted(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments })
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, TermsAcceptances: []*TermsAcceptance{{Version: "2", AcceptedTime: "2017-01-01T00:00:00+00:00"}}}}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if _, ok := successResponse["termsRequired"]; ok {
+		t.Fatalf("Unexpected terms required: %#v", successResponse)
+	}
+}
+
+func Test_Login_Success_LegacyTermsAccepted(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Terms = termsDocuments[1:2] })
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true, TermsAccepted: "2015-06-01T00:00:00+00:00"}}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if _, ok := successResponse["termsRequired"]; ok {
+		t.Fatalf("Unexpected terms required: %#v", successResponse)
+	}
+}
+
+func Test_Login_Error_ErrorCreatingToken(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.AddTokenResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	expectErrorResponse(t, response, 500, "Error updating token")
+}
+
+func Test_Login_Success(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5", EmailVerified: true}}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+func Test_Login_Success_Password_Complex(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "`-=[]\\;',./~!@#$%^&*)(_+}{|\":<>?`¡™£¢∞§¶•ª–≠‘“æ…÷≥”’")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, TermsAccepted: "2016-01-01T01:23:45-08:00", PwHash: "80464ae775ca97187d29bc4b3e391e959947138a", EmailVerified: true}}, nil}}
+	responsableStore.AddTokenResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectElementMatch(t, successResponse, "userid", `\A[0-9a-f]{10}\z`, true)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"emailVerified": true, "emails": []interface{}{"a@z.co"}, "username": "a@z.co", "termsAccepted": "2016-01-01T01:23:45-08:00"})
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatalf("Missing expected %s header", TP_SESSION_TOKEN)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestServerLogin_StatusBadRequest_WhenNoNameOrSecret(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusBadRequest_WhenNoName(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusBadRequest_WhenNoSecret(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusBadRequest, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":400,"reason":"Missing id and/or password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_MISSING_ID_PW)
+	}
+}
+
+func TestServerLogin_StatusOK(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/serverlogin", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatal("The session token should have been set")
+	}
+
+}
+
+func TestServerLogin_Failure(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(TP_SERVER_NAME, "shoreline")
+	req.Header.Set(TP_SERVER_SECRET, theSecret)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.SetHandlers("", rtr)
+
+	shorelineFails.ServerLogin(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusInternalServerError, resp.Code)
+	}
+}
+
+func TestServerLogin_StatusUnauthorized_WhenSecretWrong(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, "wrong secret")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.ServerLogin(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	if string(body) != `{"code":401,"reason":"Wrong password"}` {
+		t.Fatalf("Message given [%s] expected [%s] ", string(body), STATUS_PW_WRONG)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestRefreshSession_StatusUnauthorized_WithNoToken(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.RefreshSession(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func TestRefreshSession_StatusUnauthorized_WithWrongToken(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.Header.Set(TP_SESSION_TOKEN, "not this token")
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.RefreshSession(response, request)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+func TestRefreshSession_StatusOK(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+
+	refreshRequest, _ := http.NewRequest("GET", "/", nil)
+	refreshRequest.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.RefreshSession(response, refreshRequest)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	tokenString := response.Header().Get(TP_SESSION_TOKEN)
+
+	if tokenString == "" {
+		t.Fatal("A session token should have been returned")
+	}
+
+	if response.Body == nil {
+		t.Fatal("A Body should have been returned")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	var tokenData TokenData
+	_ = json.Unmarshal(body, &tokenData)
+
+	if tokenData.UserId != user.Id {
+		t.Fatalf("should have had a user id of `%v` but was %v", user.Id, tokenData.UserId)
+	}
+}
+
+func TestRefreshSession_Failure(t *testing.T) {
+
+	shorelineFails.SetHandlers("", rtr)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.RefreshSession(resp, req)
+
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusUnauthorized, resp.Code)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func Test_LongTermLogin_Error_MissingAuthorization(t *testing.T) {
+	response := performRequest(t, "POST", "/login/thelongtermkey")
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_EmptyAuthorization(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("Authorization", "")
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_InvalidAuthorization(t *testing.T) {
+	authorization := createAuthorization(t, "", "")
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 400, "Missing id and/or password")
+}
+
+func Test_LongTermLogin_Error_FindUsersError(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 500, "Error finding user")
+}
+
+func Test_LongTermLogin_Error_FindUsersMissing(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_FindUsersNil(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{nil}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_NoPassword(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_PasswordMismatch(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "MISMATCH")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 401, "No user matched the given details")
+}
+
+func Test_LongTermLogin_Error_EmailNotVerified(t *testing.T) {
+	authorization := createAuthorization(t, "a@b.co", "password")
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{&User{Id: "1111111111", PwHash: "d1fef52139b0d120100726bcb43d5cc13d41e4b5"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add("Authorization", authorization)
+	response := performRequestHeaders(t, "POST", "/login/thelongtermkey", headers)
+	expectErrorResponse(t, response, 403, "The user hasn't verified this account yet")
+}
 
 func Test_LongTermLogin_Error_ErrorCreatingToken(t *testing.T) {
 	authorization := createAuthorization(t, "a@b.co", "password")
@@ -1784,502 +4021,1085 @@ func Test_LongTermLogin_Success(t *testing.T) {
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func TestHasServerToken_True(t *testing.T) {
+func TestHasServerToken_True(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+
+	//login as server
+	svrLoginRequest, _ := http.NewRequest("POST", "/", nil)
+	svrLoginRequest.Header.Set(TP_SERVER_NAME, "shoreline")
+	svrLoginRequest.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerLogin(response, svrLoginRequest)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get(TP_SESSION_TOKEN) == "" {
+		t.Fatal("The session token should have been set")
+	}
+
+	if hasServerToken(response.Header().Get(TP_SESSION_TOKEN), shoreline.ApiConfig.TokenConfigs[0]) == false {
+		t.Fatal("The token should have been a valid server token")
+	}
+}
+
+func TestServerCheckToken_StatusOK(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	//step 1 - login as server
+	request, _ := http.NewRequest("POST", "/serverlogin", nil)
+	request.Header.Set(TP_SERVER_NAME, "shoreline")
+	request.Header.Set(TP_SERVER_SECRET, theSecret)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerLogin(response, request)
+
+	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+
+	if svrTokenToUse == "" {
+		t.Fatalf("we expected to get a token back from login")
+	}
+
+	//step 2 - do the check
+	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
+	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
+	checkTokenResponse := httptest.NewRecorder()
+
+	shoreline.ServerCheckToken(checkTokenResponse, checkTokenRequest, map[string]string{"token": svrTokenToUse})
+
+	if checkTokenResponse.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
+	}
+
+	if checkTokenResponse.Header().Get("content-type") != "application/json" {
+		t.Fatal("the resp should be json")
+	}
+
+	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+
+	var tokenData TokenData
+	_ = json.Unmarshal(body, &tokenData)
+
+	t.Log("token data returned ", tokenData)
+
+	if tokenData.UserId != "shoreline" {
+		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
+	}
+
+	if tokenData.IsServer != true {
+		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
+	}
+}
+
+func TestServerCheckToken_StatusUnauthorized_WhenNoSvrToken(t *testing.T) {
+
+	//the api
+
+	shoreline.SetHandlers("", rtr)
+
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.ServerCheckToken(response, request, noParams)
+
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestLogout_StatusOK_WhenNoToken(t *testing.T) {
+	request, _ := http.NewRequest("POST", "/", nil)
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.Logout(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+}
+
+func TestLogout_StatusOK(t *testing.T) {
+
+	shoreline.SetHandlers("", rtr)
+	//now logout with valid token
+	request, _ := http.NewRequest("POST", "/", nil)
+	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	response := httptest.NewRecorder()
+
+	shoreline.Logout(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+}
+
+func TestLogout_Failure(t *testing.T) {
+
+	shorelineFails.SetHandlers("", rtr)
+	//now logout with valid token
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
+	resp := httptest.NewRecorder()
+
+	shorelineFails.Logout(resp, req)
+
+	//StatusOK beccuse we `try` and delete the token but the return of that
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected [%v] and got [%v]", http.StatusOK, resp.Code)
+	}
+}
+
+func TestAnonymousIdHashPair_StatusOK(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	values := request.URL.Query()
+	values.Add("one", "somestuff")
+	values.Add("two", "some more stuff")
+	request.URL.RawQuery = values.Encode()
+
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.AnonymousIdHashPair(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get("content-type") != "application/json" {
+		t.Fatal("the resp should be json")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	var anonIDHashPair AnonIdHashPair
+	_ = json.Unmarshal(body, &anonIDHashPair)
+
+	if anonIDHashPair.Name != "" {
+		t.Fatalf("should have no name but was %v", anonIDHashPair.Name)
+	}
+	if anonIDHashPair.Id == "" {
+		t.Fatalf("should have an Id but was %v", anonIDHashPair.Id)
+	}
+	if anonIDHashPair.Hash == "" {
+		t.Fatalf("should have an Hash but was %v", anonIDHashPair.Hash)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestAnonymousIdHashPair_StatusOK_EvenWhenNoURLParams(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/", nil)
+
+	response := httptest.NewRecorder()
+
+	shoreline.SetHandlers("", rtr)
+
+	shoreline.AnonymousIdHashPair(response, request)
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	}
+
+	if response.Header().Get("content-type") != "application/json" {
+		t.Fatal("the resp should be json")
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+
+	var anonIDHashPair AnonIdHashPair
+	_ = json.Unmarshal(body, &anonIDHashPair)
+
+	if anonIDHashPair.Name != "" {
+		t.Fatalf("should have no name but was %v", anonIDHashPair.Name)
+	}
+	if anonIDHashPair.Id == "" {
+		t.Fatalf("should have an Id but was %v", anonIDHashPair.Id)
+	}
+	if anonIDHashPair.Hash == "" {
+		t.Fatalf("should have an Hash but was %v", anonIDHashPair.Hash)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+func TestAnonIdHashPair_InBulk(t *testing.T) {
 
 	shoreline.SetHandlers("", rtr)
 
-	//login as server
-	svrLoginRequest, _ := http.NewRequest("POST", "/", nil)
-	svrLoginRequest.Header.Set(TP_SERVER_NAME, "shoreline")
-	svrLoginRequest.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+	// we ask for 100 AnonymousIdHashPair to be created
+	//NOTE: while we can run more locally travis doesn't like it so 100 should be good enough
+	ask := make([]AnonIdHashPair, 100)
+	var generated []AnonIdHashPair
 
-	shoreline.ServerLogin(response, svrLoginRequest)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+	for _, hash := range ask {
+		wg.Add(1)
+		go func(hash AnonIdHashPair) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/", nil)
+			res := httptest.NewRecorder()
+			shoreline.AnonymousIdHashPair(res, req)
+			body, _ := ioutil.ReadAll(res.Body)
+			json.Unmarshal(body, &hash)
+			mutex.Lock()
+			generated = append(generated, hash)
+			mutex.Unlock()
+		}(hash)
 
-	if response.Header().Get(TP_SESSION_TOKEN) == "" {
-		t.Fatal("The session token should have been set")
 	}
+	wg.Wait()
 
-	if hasServerToken(response.Header().Get(TP_SESSION_TOKEN), shoreline.ApiConfig.TokenConfigs[0]) == false {
-		t.Fatal("The token should have been a valid server token")
-	}
-}
+	// need a more elogent way for this
+	id1 := generated[1].Id
+	matches1 := 0
 
-func TestServerCheckToken_StatusOK(t *testing.T) {
+	id33 := generated[33].Id
+	matches33 := 0
 
-	//the api
+	for i := range generated {
+		if id1 == generated[i].Id {
+			matches1++
+		}
+		if id33 == generated[i].Id {
+			matches33++
+		}
+	}
 
-	shoreline.SetHandlers("", rtr)
+	if matches1 > 1 || matches33 > 1 {
+		t.Log("id: ", id1, "has ", matches1, "matches")
+		t.Log("id: ", id33, "has ", matches33, "matches")
+		t.Fatal("Hashed Ids should be unique")
+	}
 
-	//step 1 - login as server
-	request, _ := http.NewRequest("POST", "/serverlogin", nil)
-	request.Header.Set(TP_SERVER_NAME, "shoreline")
-	request.Header.Set(TP_SERVER_SECRET, theSecret)
-	response := httptest.NewRecorder()
+}
 
-	shoreline.ServerLogin(response, request)
+////////////////////////////////////////////////////////////////////////////////
 
-	svrTokenToUse := response.Header().Get(TP_SESSION_TOKEN)
+func Test_AuthenticateSessionToken_Missing(t *testing.T) {
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), "")
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "Session token is empty" {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if tokenData != nil {
+		t.Fatalf("Unexpected token data returned: %#v", tokenData)
+	}
+}
 
-	if svrTokenToUse == "" {
-		t.Fatalf("we expected to get a token back from login")
+func Test_AuthenticateSessionToken_Invalid(t *testing.T) {
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), "xyz")
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "token contains an invalid number of segments" {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if tokenData != nil {
+		t.Fatalf("Unexpected token data returned: %#v", tokenData)
 	}
+}
 
-	//step 2 - do the check
-	checkTokenRequest, _ := http.NewRequest("GET", "/", nil)
-	checkTokenRequest.Header.Set(TP_SESSION_TOKEN, svrTokenToUse)
-	checkTokenResponse := httptest.NewRecorder()
+func Test_AuthenticateSessionToken_Expired(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, -3600)
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "Token is expired" {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if tokenData != nil {
+		t.Fatalf("Unexpected token data returned: %#v", tokenData)
+	}
+}
 
-	shoreline.ServerCheckToken(checkTokenResponse, checkTokenRequest, map[string]string{"token": svrTokenToUse})
+func Test_AuthenticateSessionToken_NotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, errors.New("NOT FOUND")}}
+	defer expectResponsablesEmpty(t)
 
-	if checkTokenResponse.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, checkTokenResponse.Code)
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "NOT FOUND" {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if tokenData != nil {
+		t.Fatalf("Unexpected token data returned: %#v", tokenData)
 	}
+}
 
-	if checkTokenResponse.Header().Get("content-type") != "application/json" {
-		t.Fatal("the resp should be json")
+func Test_AuthenticateSessionToken_Success_User(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if tokenData == nil {
+		t.Fatalf("Missing expected token data")
 	}
+	if tokenData.UserId != "abcdef1234" {
+		t.Fatalf("Unexpected token user id: %s", tokenData.UserId)
+	}
+	if tokenData.IsServer {
+		t.Fatalf("Unexpected server token")
+	}
+	if tokenData.DurationSecs != tokenDuration {
+		t.Fatalf("Unexpected token duration: %v", tokenData.DurationSecs)
+	}
+}
 
-	body, _ := ioutil.ReadAll(checkTokenResponse.Body)
+func Test_AuthenticateSessionToken_Success_Server(t *testing.T) {
+	sessionToken := createSessionToken(t, "abcdef1234", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	var tokenData TokenData
-	_ = json.Unmarshal(body, &tokenData)
+	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if tokenData == nil {
+		t.Fatalf("Missing expected token data")
+	}
+	if tokenData.UserId != "abcdef1234" {
+		t.Fatalf("Unexpected token user id: %s", tokenData.UserId)
+	}
+	if !tokenData.IsServer {
+		t.Fatalf("Unexpected non-server token")
+	}
+	if tokenData.DurationSecs != tokenDuration {
+		t.Fatalf("Unexpected token duration: %v", tokenData.DurationSecs)
+	}
+}
 
-	t.Log("token data returned ", tokenData)
+////////////////////////////////////////////////////////////////////////////////
 
-	if tokenData.UserId != "shoreline" {
-		t.Fatalf("should have had a server id of `shoreline` but was %v", tokenData.UserId)
+func Test_TokenUserHasRequestedPermissions_Server(t *testing.T) {
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: true, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(permissions, requestedPermissions) {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+	}
+}
+
+func Test_TokenUserHasRequestedPermissions_Owner(t *testing.T) {
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "abcdef1234", requestedPermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
 	}
+	if !reflect.DeepEqual(permissions, requestedPermissions) {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+	}
+}
 
-	if tokenData.IsServer != true {
-		t.Fatalf("should have been a server token but was %v", tokenData.IsServer)
+func Test_TokenUserHasRequestedPermissions_GatekeeperError(t *testing.T) {
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "ERROR" {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if len(permissions) != 0 {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
 	}
 }
 
-func TestServerCheckToken_StatusUnauthorized_WhenNoSvrToken(t *testing.T) {
+func Test_TokenUserHasRequestedPermissions_CompleteMismatch(t *testing.T) {
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"y": clients.Allowed, "z": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	//the api
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if len(permissions) != 0 {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+	}
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_TokenUserHasRequestedPermissions_PartialMismatch(t *testing.T) {
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed, "z": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	request, _ := http.NewRequest("GET", "/", nil)
-	response := httptest.NewRecorder()
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(permissions, clients.Permissions{"a": clients.Allowed}) {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+	}
+}
 
-	shoreline.ServerCheckToken(response, request, noParams)
+func Test_TokenUserHasRequestedPermissions_FullMatch(t *testing.T) {
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusUnauthorized {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusUnauthorized, response.Code)
+	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
+	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
+	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(permissions, requestedPermissions) {
+		t.Fatalf("Unexpected permissions returned: %#v", permissions)
 	}
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 
-func TestLogout_StatusOK_WhenNoToken(t *testing.T) {
-	request, _ := http.NewRequest("POST", "/", nil)
-	response := httptest.NewRecorder()
-
-	shoreline.SetHandlers("", rtr)
-
-	shoreline.Logout(response, request)
+func Test_RemoveUserPermissions_Error_UsersInGroupError(t *testing.T) {
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "ERROR" {
+		t.Fatalf("Unexpected error: %#v", err)
 	}
 }
 
-func TestLogout_StatusOK(t *testing.T) {
+func Test_RemoveUserPermissions_Error_SetPermissionsError(t *testing.T) {
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1": {"root": clients.Allowed}, "2": {"a": clients.Allowed, "b": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
-	//now logout with valid token
-	request, _ := http.NewRequest("POST", "/", nil)
-	request.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	response := httptest.NewRecorder()
+	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
+	if err == nil {
+		t.Fatalf("Unexpected success")
+	}
+	if err.Error() != "ERROR" {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+}
 
-	shoreline.Logout(response, request)
+func Test_RemoveUserPermissions_Success(t *testing.T) {
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1": {"root": clients.Allowed}, "2": {"a": clients.Allowed, "b": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
+	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
 	}
 }
 
-func TestLogout_Failure(t *testing.T) {
+func Test_GetConsentTypes_Success(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Consents = consentTypes })
+	defer expectResponsablesEmpty(t)
 
-	shorelineFails.SetHandlers("", rtr)
-	//now logout with valid token
-	req, _ := http.NewRequest("POST", "/", nil)
-	req.Header.Set(TP_SESSION_TOKEN, userToken.ID)
-	resp := httptest.NewRecorder()
+	response := performRequest(t, "GET", "/consents")
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{
+		map[string]interface{}{"name": "research", "description": "Share data for research", "version": "2"},
+		map[string]interface{}{"name": "marketing", "version": "1", "marketing": true},
+	})
+}
 
-	shorelineFails.Logout(resp, req)
+func Test_GetUserConsents_Error_Unauthorized(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
 
-	//StatusOK beccuse we `try` and delete the token but the return of that
-	if resp.Code != http.StatusOK {
-		t.Fatalf("Expected [%v] and got [%v]", http.StatusOK, resp.Code)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/consents", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func TestAnonymousIdHashPair_StatusOK(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
+func Test_GetUserConsents_Error_FindConsentRecordsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindConsentRecordsResponses = []FindConsentRecordsResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-	values := request.URL.Query()
-	values.Add("one", "somestuff")
-	values.Add("two", "some more stuff")
-	request.URL.RawQuery = values.Encode()
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/consents", headers)
+	expectErrorResponse(t, response, 500, "Error finding consents")
+}
 
-	response := httptest.NewRecorder()
+func Test_GetUserConsents_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindConsentRecordsResponses = []FindConsentRecordsResponse{{[]*ConsentRecord{
+		{ID: "1", UserID: "1111111111", Type: "research", Version: "1", Granted: true, Time: "2016-01-01T00:00:00Z", ActorUserID: "1111111111"},
+		{ID: "2", UserID: "1111111111", Type: "research", Version: "1", Granted: false, Time: "2016-02-01T00:00:00Z", ActorUserID: "1111111111"},
+	}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/consents", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	revoked := map[string]interface{}{"id": "2", "userId": "1111111111", "type": "research", "version": "1", "granted": false, "time": "2016-02-01T00:00:00Z", "actorUserId": "1111111111"}
+	expectEqualsMap(t, successResponse, map[string]interface{}{
+		"consents": map[string]interface{}{"research": revoked},
+		"history": []interface{}{
+			map[string]interface{}{"id": "1", "userId": "1111111111", "type": "research", "version": "1", "granted": true, "time": "2016-01-01T00:00:00Z", "actorUserId": "1111111111"},
+			revoked,
+		},
+	})
+}
 
-	shoreline.AnonymousIdHashPair(response, request)
+func Test_GrantUserConsent_Error_ConsentTypeNotFound(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Consents = consentTypes })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/consents/unknown", headers)
+	expectErrorResponse(t, response, 404, "Consent type not found")
+}
 
-	if response.Header().Get("content-type") != "application/json" {
-		t.Fatal("the resp should be json")
-	}
+func Test_GrantUserConsent_Error_AddConsentRecordError(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Consents = consentTypes })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.AddConsentRecordResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
-	body, _ := ioutil.ReadAll(response.Body)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/consents/research", headers)
+	expectErrorResponse(t, response, 500, "Error recording consent")
+}
 
-	var anonIDHashPair AnonIdHashPair
-	_ = json.Unmarshal(body, &anonIDHashPair)
+func Test_GrantUserConsent_Success(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Consents = consentTypes })
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.AddConsentRecordResponses = []error{nil}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-	if anonIDHashPair.Name != "" {
-		t.Fatalf("should have no name but was %v", anonIDHashPair.Name)
-	}
-	if anonIDHashPair.Id == "" {
-		t.Fatalf("should have an Id but was %v", anonIDHashPair.Id)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "POST", "/user/1111111111/consents/research", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if successResponse["type"] != "research" || successResponse["version"] != "2" || successResponse["granted"] != true || successResponse["actorUserId"] != "1111111111" {
+		t.Fatalf("Unexpected consent record: %v", successResponse)
 	}
-	if anonIDHashPair.Hash == "" {
-		t.Fatalf("should have an Hash but was %v", anonIDHashPair.Hash)
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_CONSENT_GRANTED || responsableStore.AuditEvents[0].TargetUserID != "1111111111" {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_RevokeUserConsent_Success_Server(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.Consents = consentTypes })
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", EmailVerified: true, TermsAccepted: "2016-01-01T00:00:00Z"}, nil}}
+	responsableStore.AddConsentRecordResponses = []error{nil}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-func TestAnonymousIdHashPair_StatusOK_EvenWhenNoURLParams(t *testing.T) {
-	request, _ := http.NewRequest("GET", "/", nil)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "DELETE", "/user/1111111111/consents/marketing", headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	if successResponse["type"] != "marketing" || successResponse["granted"] != false || successResponse["actorUserId"] != "shoreline" {
+		t.Fatalf("Unexpected consent record: %v", successResponse)
+	}
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_CONSENT_REVOKED {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
+	}
+}
 
-	response := httptest.NewRecorder()
+func Test_SendClaimInvitation_Error_MailerNotConfigured(t *testing.T) {
+	defer expectResponsablesEmpty(t)
 
-	shoreline.SetHandlers("", rtr)
+	response := performRequestBody(t, "POST", "/user/1111111111/claim", `{"email": "b@z.co"}`)
+	expectErrorResponse(t, response, 501, "Sending email is not configured")
+}
 
-	shoreline.AnonymousIdHashPair(response, request)
+func Test_SendClaimInvitation_Error_NotCustodian(t *testing.T) {
+	attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	if response.Code != http.StatusOK {
-		t.Fatalf("Non-expected status code%v:\n\tbody: %v", http.StatusOK, response.Code)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/claim", `{"email": "b@z.co"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
+}
 
-	if response.Header().Get("content-type") != "application/json" {
-		t.Fatal("the resp should be json")
-	}
+func Test_SendClaimInvitation_Error_NotCustodial(t *testing.T) {
+	attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PwHash: "hash"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	body, _ := ioutil.ReadAll(response.Body)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/claim", `{"email": "b@z.co"}`, headers)
+	expectErrorResponse(t, response, 409, "User is not custodial")
+}
 
-	var anonIDHashPair AnonIdHashPair
-	_ = json.Unmarshal(body, &anonIDHashPair)
+func Test_SendClaimInvitation_Success(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"custodian": clients.Allowed}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.AddConfirmationResponses = []error{nil}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-	if anonIDHashPair.Name != "" {
-		t.Fatalf("should have no name but was %v", anonIDHashPair.Name)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/claim", `{"email": "b@z.co"}`, headers)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected response status code: %d", response.Code)
 	}
-	if anonIDHashPair.Id == "" {
-		t.Fatalf("should have an Id but was %v", anonIDHashPair.Id)
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "b@z.co" || !strings.Contains(recordingMailer.Messages[0].Body, "/claim/") {
+		t.Fatalf("Unexpected messages: %v", recordingMailer.Messages)
 	}
-	if anonIDHashPair.Hash == "" {
-		t.Fatalf("should have an Hash but was %v", anonIDHashPair.Hash)
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_CLAIM_INVITED || responsableStore.AuditEvents[0].ActorUserID != "0000000000" {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_ClaimCustodialUser_Error_InvalidPassword(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	defer expectResponsablesEmpty(t)
 
-func TestAnonIdHashPair_InBulk(t *testing.T) {
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "short"}`)
+	expectErrorResponse(t, response, 400, "Invalid user details were given")
+}
 
-	shoreline.SetHandlers("", rtr)
+func Test_ClaimCustodialUser_Error_WrongTokenType(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "b@z.co")
+	defer expectResponsablesEmpty(t)
 
-	// we ask for 100 AnonymousIdHashPair to be created
-	//NOTE: while we can run more locally travis doesn't like it so 100 should be good enough
-	ask := make([]AnonIdHashPair, 100)
-	var generated []AnonIdHashPair
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 400, "The confirmation token is invalid or has expired")
+}
 
-	var mutex sync.Mutex
-	var wg sync.WaitGroup
+func Test_ClaimCustodialUser_Error_NotCustodial(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", PwHash: "hash"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	for _, hash := range ask {
-		wg.Add(1)
-		go func(hash AnonIdHashPair) {
-			defer wg.Done()
-			req, _ := http.NewRequest("GET", "/", nil)
-			res := httptest.NewRecorder()
-			shoreline.AnonymousIdHashPair(res, req)
-			body, _ := ioutil.ReadAll(res.Body)
-			json.Unmarshal(body, &hash)
-			mutex.Lock()
-			generated = append(generated, hash)
-			mutex.Unlock()
-		}(hash)
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 409, "User is not custodial")
+}
 
-	}
-	wg.Wait()
+func Test_ClaimCustodialUser_Error_ConfirmationUsed(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	confirmation.UsedTime = "2016-01-01T00:00:00Z"
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	// need a more elogent way for this
-	id1 := generated[1].Id
-	matches1 := 0
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 404, "No unused confirmation matched the given token")
+}
 
-	id33 := generated[33].Id
-	matches33 := 0
+func Test_ClaimCustodialUser_Error_DomainNotAllowed(t *testing.T) {
+	setTestConfig(t, func(config *ApiConfig) { config.SignupDomains = testDomainPolicy })
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@blocked.co")
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	defer expectResponsablesEmpty(t)
 
-	for i := range generated {
-		if id1 == generated[i].Id {
-			matches1++
-		}
-		if id33 == generated[i].Id {
-			matches33++
-		}
-	}
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 403, "The email domain is not allowed to sign up")
+}
 
-	if matches1 > 1 || matches33 > 1 {
-		t.Log("id: ", id1, "has ", matches1, "matches")
-		t.Log("id: ", id33, "has ", matches33, "matches")
-		t.Fatal("Hashed Ids should be unique")
-	}
+func Test_ClaimCustodialUser_Error_EmailTakenKeepsConfirmation(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{{Id: "2222222222", Username: "b@z.co"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 409, "User already exists")
+}
+
+func Test_ClaimCustodialUser_Error_UpsertUserErrorRestoresPermissions(t *testing.T) {
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed, "view": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}, {clients.Permissions{"custodian": clients.Allowed, "view": clients.Allowed}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
+	defer expectResponsablesEmpty(t)
 
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	expectErrorResponse(t, response, 500, "Error updating user")
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_ClaimCustodialUser_Success(t *testing.T) {
+	recordingMailer := attachRecordingMailer()
+	defer detachRecordingMailer()
+	confirmation := createConfirmation(t, CONFIRMATION_TYPE_CUSTODIAL_CLAIM, "b@z.co")
+	responsableStore.FindConfirmationsForUserResponses = []FindConfirmationsResponse{{[]*Confirmation{confirmation}, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}, {&User{Id: "0000000000", Username: "a@z.co"}, nil}}
+	responsableStore.FindUsersResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed, "view": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
+	responsableStore.FindOrganizationDomainsResponses = []FindOrganizationDomainsResponse{{[]*OrganizationDomain{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.UseConfirmationResponses = []FindConfirmationResponse{{confirmation, nil}}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-func Test_AuthenticateSessionToken_Missing(t *testing.T) {
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), "")
-	if err == nil {
-		t.Fatalf("Unexpected success")
-	}
-	if err.Error() != "Session token is empty" {
-		t.Fatalf("Unexpected error: %s", err.Error())
+	response := performRequestBody(t, "POST", "/user/claim/"+createConfirmationToken(t, confirmation), `{"password": "12345678"}`)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "emailVerified": true, "emails": []interface{}{"b@z.co"}, "username": "b@z.co"})
+	if len(recordingMailer.Messages) != 1 || recordingMailer.Messages[0].To != "a@z.co" {
+		t.Fatalf("Unexpected messages: %v", recordingMailer.Messages)
 	}
-	if tokenData != nil {
-		t.Fatalf("Unexpected token data returned: %#v", tokenData)
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_USER_CLAIMED {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
 	}
 }
 
-func Test_AuthenticateSessionToken_Invalid(t *testing.T) {
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), "xyz")
-	if err == nil {
-		t.Fatalf("Unexpected success")
-	}
-	if err.Error() != "token contains an invalid number of segments" {
-		t.Fatalf("Unexpected error: %s", err.Error())
-	}
-	if tokenData != nil {
-		t.Fatalf("Unexpected token data returned: %#v", tokenData)
-	}
+func Test_GetCustodialUsers_Error_Unauthorized(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/custodial", headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_AuthenticateSessionToken_Expired(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, -3600)
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
-	if err == nil {
-		t.Fatalf("Unexpected success")
-	}
-	if err.Error() != "Token is expired" {
-		t.Fatalf("Unexpected error: %s", err.Error())
-	}
-	if tokenData != nil {
-		t.Fatalf("Unexpected token data returned: %#v", tokenData)
-	}
+func Test_GetCustodialUsers_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.FindUsersByCustodianResponses = []FindUsersResponse{{[]*User{
+		{Id: "2222222222", CustodianUserID: "1111111111"},
+		{Id: "3333333333", CustodianUserID: "1111111111", DeletedTime: "2016-01-01T00:00:00+00:00"},
+	}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestHeaders(t, "GET", "/user/1111111111/custodial", headers)
+	successResponse := expectSuccessResponseWithJSONArray(t, response, 200)
+	expectEqualsArray(t, successResponse, []interface{}{map[string]interface{}{"userid": "2222222222", "custodianUserId": "1111111111"}})
 }
 
-func Test_AuthenticateSessionToken_NotFound(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
-	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{nil, errors.New("NOT FOUND")}}
+func Test_TransferCustody_Error_NotCustodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
-	if err == nil {
-		t.Fatalf("Unexpected success")
-	}
-	if err.Error() != "NOT FOUND" {
-		t.Fatalf("Unexpected error: %s", err.Error())
-	}
-	if tokenData != nil {
-		t.Fatalf("Unexpected token data returned: %#v", tokenData)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/2222222222/custodian", `{"custodianUserId": "1111111111"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_AuthenticateSessionToken_Success_User(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", false, tokenDuration)
+func Test_TransferCustody_Error_CustodianNotFound(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "2222222222", CustodianUserID: "0000000000"}, nil}, {nil, nil}}
 	defer expectResponsablesEmpty(t)
 
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if tokenData == nil {
-		t.Fatalf("Missing expected token data")
-	}
-	if tokenData.UserId != "abcdef1234" {
-		t.Fatalf("Unexpected token user id: %s", tokenData.UserId)
-	}
-	if tokenData.IsServer {
-		t.Fatalf("Unexpected server token")
-	}
-	if tokenData.DurationSecs != tokenDuration {
-		t.Fatalf("Unexpected token duration: %v", tokenData.DurationSecs)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/2222222222/custodian", `{"custodianUserId": "1111111111"}`, headers)
+	expectErrorResponse(t, response, 404, "Custodian not found")
 }
 
-func Test_AuthenticateSessionToken_Success_Server(t *testing.T) {
-	sessionToken := createSessionToken(t, "abcdef1234", true, tokenDuration)
+func Test_TransferCustody_Error_UpsertUserErrorRestoresPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
 	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "2222222222", CustodianUserID: "0000000000"}, nil}, {&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": responsableShoreline.custodianPermissions()}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{responsableShoreline.custodianPermissions(), nil}, {clients.Permissions{}, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
+	responsableStore.UpsertUserResponses = []error{errors.New("ERROR")}
 	defer expectResponsablesEmpty(t)
 
-	tokenData, err := responsableShoreline.authenticateSessionToken(context.Background(), sessionToken.ID)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if tokenData == nil {
-		t.Fatalf("Missing expected token data")
-	}
-	if tokenData.UserId != "abcdef1234" {
-		t.Fatalf("Unexpected token user id: %s", tokenData.UserId)
-	}
-	if !tokenData.IsServer {
-		t.Fatalf("Unexpected non-server token")
-	}
-	if tokenData.DurationSecs != tokenDuration {
-		t.Fatalf("Unexpected token duration: %v", tokenData.DurationSecs)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/2222222222/custodian", `{"custodianUserId": "1111111111"}`, headers)
+	expectErrorResponse(t, response, 500, "Error updating user")
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 2 || !reflect.DeepEqual(calls[0].Permissions, responsableShoreline.custodianPermissions()) ||
+		calls[1].UserID != "1111111111" || calls[1].GroupID != "2222222222" || len(calls[1].Permissions) != 0 {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_TransferCustody_Success_Custodian(t *testing.T) {
+	sessionToken := createSessionToken(t, "0000000000", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{responsableShoreline.custodianPermissions(), nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "2222222222", CustodianUserID: "0000000000"}, nil}, {&User{Id: "1111111111"}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": responsableShoreline.custodianPermissions()}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{responsableShoreline.custodianPermissions(), nil}, {clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.AuditEvents = nil
+	defer expectResponsablesEmpty(t)
 
-func Test_TokenUserHasRequestedPermissions_Server(t *testing.T) {
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: true, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if !reflect.DeepEqual(permissions, requestedPermissions) {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/2222222222/custodian", `{"custodianUserId": "1111111111"}`, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "2222222222", "custodianUserId": "1111111111"})
+	if len(responsableStore.AuditEvents) != 1 || responsableStore.AuditEvents[0].Type != AUDIT_EVENT_CUSTODY_TRANSFERRED || responsableStore.AuditEvents[0].ActorUserID != "0000000000" {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
 	}
 }
 
-func Test_TokenUserHasRequestedPermissions_Owner(t *testing.T) {
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "abcdef1234", requestedPermissions)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if !reflect.DeepEqual(permissions, requestedPermissions) {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
-	}
+func Test_MergeUsers_Error_NotServer(t *testing.T) {
+	sessionToken := createSessionToken(t, "1111111111", false, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 401, "Not authorized for requested operation")
 }
 
-func Test_TokenUserHasRequestedPermissions_GatekeeperError(t *testing.T) {
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+func Test_MergeUsers_Error_AlreadyMerged(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}, {&User{Id: "2222222222", MergedTime: "2016-01-01T00:00:00+00:00", MergedUserID: "1111111111"}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
-	if err == nil {
-		t.Fatalf("Unexpected success")
-	}
-	if err.Error() != "ERROR" {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if len(permissions) != 0 {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 409, "User is already merged")
 }
 
-func Test_TokenUserHasRequestedPermissions_CompleteMismatch(t *testing.T) {
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"y": clients.Allowed, "z": clients.Allowed}, nil}}
+func Test_MergeUsers_Error_Clinic(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}, {&User{Id: "2222222222", Roles: []string{"clinic"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if len(permissions) != 0 {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 409, "A clinic user cannot be merged into another user")
 }
 
-func Test_TokenUserHasRequestedPermissions_PartialMismatch(t *testing.T) {
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed, "z": clients.Allowed}, nil}}
+func Test_MergeUsers_Error_MergedPassword(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", CustodianUserID: "0000000000"}, nil}, {&User{Id: "2222222222", Username: "b@z.co", PwHash: "hash"}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
-	}
-	if !reflect.DeepEqual(permissions, clients.Permissions{"a": clients.Allowed}) {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
-	}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 409, "A user with a password cannot be merged into a user without one")
 }
 
-func Test_TokenUserHasRequestedPermissions_FullMatch(t *testing.T) {
-	responsableGatekeeper.UserInGroupResponses = []PermissionsResponse{{clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}, nil}}
+func Test_MergeUsers_Error_SetPermissionsErrorRestoresPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PwHash: "hash"}, nil}, {&User{Id: "2222222222"}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"view": clients.Allowed}}, nil}, {clients.UsersPermissions{"0000000000": {"note": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed, "note": clients.Allowed}, nil}, {nil, errors.New("ERROR")}, {clients.Permissions{"note": clients.Allowed}, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
 	defer expectResponsablesEmpty(t)
 
-	tokenData := &TokenData{UserId: "abcdef1234", IsServer: false, DurationSecs: tokenDuration}
-	requestedPermissions := clients.Permissions{"a": clients.Allowed, "b": clients.Allowed}
-	permissions, err := responsableShoreline.tokenUserHasRequestedPermissions(tokenData, "1234567890", requestedPermissions)
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 500, "Error merging users")
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 3 || calls[2].UserID != "0000000000" || calls[2].GroupID != "1111111111" ||
+		!reflect.DeepEqual(calls[2].Permissions, clients.Permissions{"note": clients.Allowed}) {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
-	if !reflect.DeepEqual(permissions, requestedPermissions) {
-		t.Fatalf("Unexpected permissions returned: %#v", permissions)
+}
+
+func Test_MergeUsers_Error_MergedUpsertRestoresPermissions(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PwHash: "hash"}, nil}, {&User{Id: "2222222222"}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1111111111": {"view": clients.Allowed}}, nil}, {clients.UsersPermissions{}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{mergedUserPermissions, nil}, {clients.Permissions{"view": clients.Allowed}, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
+	responsableStore.UpsertUserResponses = []error{ErrUserRevisionConflict}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 409, "The user was modified concurrently, try again")
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 2 || calls[1].UserID != "1111111111" || calls[1].GroupID != "2222222222" ||
+		!reflect.DeepEqual(calls[1].Permissions, clients.Permissions{"view": clients.Allowed}) {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
 }
 
-////////////////////////////////////////////////////////////////////////////////
+func Test_MergeUsers_Error_SetPermissionsError(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", PwHash: "hash"}, nil}, {&User{Id: "2222222222"}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed, "view": clients.Allowed}}, nil}, {clients.UsersPermissions{}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
 
-func Test_RemoveUserPermissions_Error_UsersInGroupError(t *testing.T) {
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, errors.New("ERROR")}}
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 500, "Error merging users")
+}
+
+func Test_MergeUsers_Error_SurvivorUpsertRestoresMerged(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{
+		{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "hash"}, nil},
+		{&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}}, nil},
+	}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, nil}, {clients.UsersPermissions{}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{mergedUserPermissions, nil}, {clients.Permissions{}, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
+	responsableStore.UpsertUserResponses = []error{nil, errors.New("ERROR"), nil}
 	defer expectResponsablesEmpty(t)
 
-	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
-	if err == nil {
-		t.Fatalf("Unexpected success")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 500, "Error merging users")
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 2 || calls[1].UserID != "1111111111" || calls[1].GroupID != "2222222222" || len(calls[1].Permissions) != 0 {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
-	if err.Error() != "ERROR" {
-		t.Fatalf("Unexpected error: %#v", err)
+}
+
+func Test_MergeUsers_Error_SurvivorRevisionConflict(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{
+		{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "hash"}, nil},
+		{&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}}, nil},
 	}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, nil}, {clients.UsersPermissions{}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{mergedUserPermissions, nil}, {clients.Permissions{}, nil}}
+	responsableStore.UpsertUserResponses = []error{nil, ErrUserRevisionConflict, nil}
+	defer expectResponsablesEmpty(t)
+
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectErrorResponse(t, response, 409, "The user was modified concurrently, try again")
 }
 
-func Test_RemoveUserPermissions_Error_SetPermissionsError(t *testing.T) {
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1": {"root": clients.Allowed}, "2": {"a": clients.Allowed, "b": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, errors.New("ERROR")}}
+func Test_MergeUsers_Success(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{
+		{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, PwHash: "hash"}, nil},
+		{&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}, EmailVerified: true, Private: map[string]*IdHashPair{"meta": {Id: "3333333333", Hash: "secret"}}}, nil},
+	}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed, "view": clients.Allowed}}, nil}, {clients.UsersPermissions{}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{"view": clients.Allowed}, nil}, {mergedUserPermissions, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
+	responsableStore.UpsertUserResponses = []error{nil, nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindUsersByCustodianResponses = []FindUsersResponse{{[]*User{}, nil}}
+	responsableStore.AuditEvents = nil
 	defer expectResponsablesEmpty(t)
 
-	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
-	if err == nil {
-		t.Fatalf("Unexpected success")
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	successResponse := expectSuccessResponseWithJSONMap(t, response, 200)
+	expectEqualsMap(t, successResponse, map[string]interface{}{"userid": "1111111111", "username": "a@z.co", "emails": []interface{}{"a@z.co", "b@z.co"}, "verifiedEmails": []interface{}{"b@z.co"}, "emailVerified": true, "passwordExists": true})
+	if len(responsableStore.AuditEvents) != 2 || responsableStore.AuditEvents[1].Type != AUDIT_EVENT_USER_MERGED || responsableStore.AuditEvents[1].TargetUserID != "2222222222" {
+		t.Fatalf("Unexpected audit events: %v", responsableStore.AuditEvents)
 	}
-	if err.Error() != "ERROR" {
-		t.Fatalf("Unexpected error: %#v", err)
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 2 || calls[0].UserID != "0000000000" || calls[0].GroupID != "1111111111" || calls[0].Permissions["custodian"] != nil ||
+		calls[1].UserID != "1111111111" || calls[1].GroupID != "2222222222" || !reflect.DeepEqual(calls[1].Permissions, mergedUserPermissions) {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
 }
 
-func Test_RemoveUserPermissions_Success(t *testing.T) {
-	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1": {"root": clients.Allowed}, "2": {"a": clients.Allowed, "b": clients.Allowed}}, nil}}
-	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+func Test_MergeUsers_Success_TransfersCustody(t *testing.T) {
+	sessionToken := createSessionToken(t, "shoreline", true, tokenDuration)
+	responsableStore.FindTokenByIDResponses = []FindTokenByIDResponse{{sessionToken, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{
+		{&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "hash"}, nil},
+		{&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}, PwHash: "hash"}, nil},
+	}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{
+		{clients.UsersPermissions{}, nil},
+		{clients.UsersPermissions{}, nil},
+		{clients.UsersPermissions{"2222222222": responsableShoreline.custodianPermissions()}, nil},
+	}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{mergedUserPermissions, nil}, {responsableShoreline.custodianPermissions(), nil}, {clients.Permissions{}, nil}}
+	responsableGatekeeper.SetPermissionsCalls = nil
+	responsableStore.UpsertUserResponses = []error{nil, nil, nil}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableStore.FindUsersByCustodianResponses = []FindUsersResponse{{[]*User{{Id: "3333333333", CustodianUserID: "2222222222"}}, nil}}
 	defer expectResponsablesEmpty(t)
 
-	err := responsableShoreline.removeUserPermissions("1", clients.Permissions{"a": clients.Allowed})
-	if err != nil {
-		t.Fatalf("Unexpected error: %#v", err)
+	headers := http.Header{}
+	headers.Add(TP_SESSION_TOKEN, sessionToken.ID)
+	response := performRequestBodyHeaders(t, "POST", "/user/1111111111/merge", `{"mergedUserId": "2222222222"}`, headers)
+	expectSuccessResponseWithJSONMap(t, response, 200)
+	if calls := responsableGatekeeper.SetPermissionsCalls; len(calls) != 3 || calls[0].UserID != "1111111111" || calls[0].GroupID != "2222222222" ||
+		calls[1].UserID != "1111111111" || calls[1].GroupID != "3333333333" ||
+		calls[2].UserID != "2222222222" || calls[2].GroupID != "3333333333" || len(calls[2].Permissions) != 0 {
+		t.Fatalf("Unexpected set permissions calls: %v", calls)
 	}
 }
@@ -0,0 +1,301 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AUDIT_EVENT_LOGIN                 = "login"
+	AUDIT_EVENT_LOGIN_FAILED          = "loginFailed"
+	AUDIT_EVENT_SERVER_LOGIN          = "serverLogin"
+	AUDIT_EVENT_SERVER_LOGIN_FAILED   = "serverLoginFailed"
+	AUDIT_EVENT_TOKEN_REFRESH         = "tokenRefresh"
+	AUDIT_EVENT_LOGOUT                = "logout"
+	AUDIT_EVENT_USER_CREATED          = "userCreated"
+	AUDIT_EVENT_USER_UPDATED          = "userUpdated"
+	AUDIT_EVENT_ROLES_CHANGED         = "rolesChanged"
+	AUDIT_EVENT_USER_DELETED          = "userDeleted"
+	AUDIT_EVENT_USER_RESTORED         = "userRestored"
+	AUDIT_EVENT_USER_SUSPENDED        = "userSuspended"
+	AUDIT_EVENT_USER_UNSUSPENDED      = "userUnsuspended"
+	AUDIT_EVENT_USER_EXPORTED         = "userExported"
+	AUDIT_EVENT_EMAIL_VERIFIED        = "emailVerified"
+	AUDIT_EVENT_EMAIL_CHANGED         = "emailChanged"
+	AUDIT_EVENT_EMAIL_CHANGE_REVERTED = "emailChangeReverted"
+	AUDIT_EVENT_CONSENT_GRANTED       = "consentGranted"
+	AUDIT_EVENT_CLAIM_INVITED         = "claimInvited"
+	AUDIT_EVENT_USER_CLAIMED          = "userClaimed"
+	AUDIT_EVENT_CUSTODY_TRANSFERRED   = "custodyTransferred"
+	AUDIT_EVENT_USER_MERGED           = "userMerged"
+	AUDIT_EVENT_CONSENT_REVOKED       = "consentRevoked"
+	AUDIT_EVENT_SIGNUP_REVIEW         = "signupReviewRequired"
+	AUDIT_EVENT_SIGNUP_CODE_CREATED   = "signupCodeCreated"
+	AUDIT_EVENT_SIGNUP_CODE_REMOVED   = "signupCodeRemoved"
+	AUDIT_EVENT_DOMAIN_UPDATED        = "organizationDomainUpdated"
+	AUDIT_EVENT_DOMAIN_REMOVED        = "organizationDomainRemoved"
+	AUDIT_EVENT_MIGRATION_RUN         = "migrationRun"
+
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+
+	// the header used to correlate audit events with the request that caused them
+	auditRequestIDHeader = "X-Request-Id"
+)
+
+// AuditEvent is an append-only record of a security or account event
+type AuditEvent struct {
+	ID           string            `json:"id" bson:"_id"`
+	Type         string            `json:"type" bson:"type"`
+	Time         string            `json:"time" bson:"time"`
+	ActorUserID  string            `json:"actorUserId,omitempty" bson:"actorUserId,omitempty"` // the token user, or server name, that caused the event
+	TargetUserID string            `json:"targetUserId,omitempty" bson:"targetUserId,omitempty"`
+	IP           string            `json:"ip,omitempty" bson:"ip,omitempty"`
+	UserAgent    string            `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	RequestID    string            `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	Reason       string            `json:"reason,omitempty" bson:"reason,omitempty"` // why a failed event failed
+	Fields       []string          `json:"fields,omitempty" bson:"fields,omitempty"` // the changed user fields
+	Details      map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+}
+
+// AuditQuery is a server query of audit events, newest first, paged by passing the cursor
+// of the previous page
+type AuditQuery struct {
+	Types        []string
+	ActorUserID  string
+	TargetUserID string
+	UserID       string // matches either the actor or the target
+	From         string // timestamps are inclusive lower and exclusive upper bounds
+	To           string
+	Limit        int // no limit if zero
+	Cursor       *AuditCursor
+}
+
+// AuditCursor is the position after the last event of a page of audit events
+type AuditCursor struct {
+	Time string `json:"t"`
+	ID   string `json:"i"`
+}
+
+// AuditResults is a page of audit events
+type AuditResults struct {
+	Events     []*AuditEvent `json:"events"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+var (
+	AuditQuery_error_parameter_unknown = errors.New("Unknown audit query parameter")
+	AuditQuery_error_time_invalid      = errors.New("from and to must be timestamps")
+	AuditQuery_error_limit_invalid     = errors.New("Limit must be between 1 and 1000")
+	AuditQuery_error_cursor_invalid    = errors.New("Cursor is invalid")
+)
+
+// NewAuditEvent returns an event of the given type at now. Its id begins with now in nanoseconds
+// followed by random characters, so that events in the same second sort by id in the order they
+// happened.
+func NewAuditEvent(eventType string, now time.Time) (*AuditEvent, error) {
+	random, err := generateUniqueHash([]string{eventType, now.String()}, 8)
+	if err != nil {
+		return nil, err
+	}
+	id := fmt.Sprintf("%016x%s", now.UnixNano(), random)
+	return &AuditEvent{ID: id, Type: eventType, Time: now.UTC().Format(TimestampFormat)}, nil
+}
+
+// ParseAuditQuery parses an AuditQuery from query parameters
+func ParseAuditQuery(query url.Values) (*AuditQuery, error) {
+	auditQuery := &AuditQuery{Limit: auditDefaultLimit}
+	for key := range query {
+		value := strings.TrimSpace(query.Get(key))
+		switch key {
+		case "type":
+			auditQuery.Types = strings.Split(value, ",")
+		case "actorUserId":
+			auditQuery.ActorUserID = value
+		case "targetUserId":
+			auditQuery.TargetUserID = value
+		case "userId":
+			auditQuery.UserID = value
+		case "from", "to":
+			parsed, err := parseSearchTime(value)
+			if err != nil {
+				return nil, AuditQuery_error_time_invalid
+			}
+			if key == "from" {
+				auditQuery.From = parsed
+			} else {
+				auditQuery.To = parsed
+			}
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > auditMaxLimit {
+				return nil, AuditQuery_error_limit_invalid
+			}
+			auditQuery.Limit = limit
+		case "cursor":
+			cursor, err := DecodeAuditCursor(value)
+			if err != nil {
+				return nil, AuditQuery_error_cursor_invalid
+			}
+			auditQuery.Cursor = cursor
+		default:
+			return nil, AuditQuery_error_parameter_unknown
+		}
+	}
+	return auditQuery, nil
+}
+
+// Encode returns the cursor as an opaque string
+func (c *AuditCursor) Encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// DecodeAuditCursor decodes a cursor returned by Encode
+func DecodeAuditCursor(value string) (*AuditCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &AuditCursor{}
+	if err := json.Unmarshal(decoded, cursor); err != nil {
+		return nil, err
+	}
+	if cursor.Time == "" || cursor.ID == "" {
+		return nil, AuditQuery_error_cursor_invalid
+	}
+	return cursor, nil
+}
+
+// audit records an event caused by the request. Failing to record an event is logged, but does
+// not fail the request.
+func (a *Api) audit(req *http.Request, event *AuditEvent) {
+	event.IP = a.requestIP(req)
+	event.UserAgent = req.UserAgent()
+	event.RequestID = req.Header.Get(auditRequestIDHeader)
+	if err := a.Store.WithContext(req.Context()).AddAuditEvent(event); err != nil {
+		a.logger.Printf("Error recording %s audit event for user %s: %s", event.Type, event.TargetUserID, err)
+	}
+}
+
+// auditEvent records an event of the given type caused by actorUserID to targetUserID
+func (a *Api) auditEvent(req *http.Request, eventType string, actorUserID string, targetUserID string) {
+	if event, err := NewAuditEvent(eventType, time.Now()); err != nil {
+		a.logger.Printf("Error creating %s audit event: %s", eventType, err)
+	} else {
+		event.ActorUserID = actorUserID
+		event.TargetUserID = targetUserID
+		a.audit(req, event)
+	}
+}
+
+// auditFailure records a failed event of the given type, with the reason it failed
+func (a *Api) auditFailure(req *http.Request, eventType string, targetUserID string, reason string, details map[string]string) {
+	if event, err := NewAuditEvent(eventType, time.Now()); err != nil {
+		a.logger.Printf("Error creating %s audit event: %s", eventType, err)
+	} else {
+		event.TargetUserID = targetUserID
+		event.Reason = reason
+		event.Details = details
+		a.audit(req, event)
+	}
+}
+
+// auditUserUpdate records the update of a user, with the names of the changed fields, and a
+// separate roles event if its roles changed, with the organization domains that granted them if any
+func (a *Api) auditUserUpdate(req *http.Request, actorUserID string, originalUser *User, updatedUser *User, organizationDomains []string) {
+	fields := changedUserFields(originalUser, updatedUser)
+	if event, err := NewAuditEvent(AUDIT_EVENT_USER_UPDATED, time.Now()); err != nil {
+		a.logger.Printf("Error creating %s audit event: %s", AUDIT_EVENT_USER_UPDATED, err)
+	} else {
+		event.ActorUserID = actorUserID
+		event.TargetUserID = updatedUser.Id
+		event.Fields = fields
+		a.audit(req, event)
+	}
+
+	if len(organizationDomains) > 0 {
+		a.auditOrganizationRoles(req, actorUserID, originalUser.Roles, updatedUser, organizationDomains)
+	} else if !reflect.DeepEqual(originalUser.Roles, updatedUser.Roles) {
+		if event, err := NewAuditEvent(AUDIT_EVENT_ROLES_CHANGED, time.Now()); err != nil {
+			a.logger.Printf("Error creating %s audit event: %s", AUDIT_EVENT_ROLES_CHANGED, err)
+		} else {
+			event.ActorUserID = actorUserID
+			event.TargetUserID = updatedUser.Id
+			event.Details = map[string]string{"from": strings.Join(originalUser.Roles, ","), "to": strings.Join(updatedUser.Roles, ",")}
+			a.audit(req, event)
+		}
+	}
+}
+
+// changedUserFields returns the bson names of the fields that differ between two versions of a
+// user, ignoring the fields every update changes
+func changedUserFields(originalUser *User, updatedUser *User) []string {
+	fields := []string{}
+	original, updated := reflect.ValueOf(*originalUser), reflect.ValueOf(*updatedUser)
+	userType := original.Type()
+	for index := 0; index < userType.NumField(); index++ {
+		name := strings.Split(userType.Field(index).Tag.Get("bson"), ",")[0]
+		switch name {
+		case "modifiedTime", "modifiedUserId", "revision":
+			continue
+		}
+		if !reflect.DeepEqual(original.Field(index).Interface(), updated.Field(index).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// requestIP returns the client IP of the request. Clients may send X-Forwarded-For with any
+// addresses, so it is only read for requests from a trusted proxy, and from the right: the client
+// is the last address forwarded by a trusted proxy.
+func (a *Api) requestIP(req *http.Request) string {
+	ip := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !a.isTrustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for index := len(forwarded) - 1; index >= 0; index-- {
+		forwardedIP := strings.TrimSpace(forwarded[index])
+		if forwardedIP == "" {
+			break
+		}
+		ip = forwardedIP
+		if !a.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedProxy reports whether the address is a trusted proxy's address or in a trusted proxy network
+func (a *Api) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range a.ApiConfig.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package user
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseAuditQuery_Defaults(t *testing.T) {
+	query, err := ParseAuditQuery(url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if query.Limit != auditDefaultLimit || query.Cursor != nil || len(query.Types) != 0 {
+		t.Fatalf("Unexpected audit query defaults: %#v", query)
+	}
+}
+
+func Test_ParseAuditQuery_Filters(t *testing.T) {
+	cursor := &AuditCursor{Time: "2016-01-01T00:00:00+00:00", ID: "1"}
+	query, err := ParseAuditQuery(url.Values{
+		"type":   {"login,loginFailed"},
+		"userId": {"1111111111"},
+		"from":   {"2016-01-01T01:00:00-08:00"},
+		"limit":  {"10"},
+		"cursor": {cursor.Encode()},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(query.Types, []string{"login", "loginFailed"}) || query.UserID != "1111111111" || query.From != "2016-01-01T09:00:00+00:00" || query.Limit != 10 {
+		t.Fatalf("Unexpected audit query: %#v", query)
+	}
+	if !reflect.DeepEqual(query.Cursor, cursor) {
+		t.Fatalf("Unexpected audit query cursor: %#v", query.Cursor)
+	}
+}
+
+func Test_ParseAuditQuery_Errors(t *testing.T) {
+	for _, test := range []struct {
+		query url.Values
+		err   error
+	}{
+		{url.Values{"to": {"yesterday"}}, AuditQuery_error_time_invalid},
+		{url.Values{"limit": {"1001"}}, AuditQuery_error_limit_invalid},
+		{url.Values{"cursor": {"invalid"}}, AuditQuery_error_cursor_invalid},
+	} {
+		if _, err := ParseAuditQuery(test.query); err != test.err {
+			t.Fatalf("Unexpected error for %v: %v", test.query, err)
+		}
+	}
+}
+
+func Test_ChangedUserFields(t *testing.T) {
+	original := &User{Id: "1111111111", Username: "a@z.co", Roles: []string{"clinic"}, Revision: 1}
+	updated := original.DeepClone()
+	updated.Username = "b@z.co"
+	updated.Roles = nil
+	updated.Revision = 2
+	updated.MarkModified("1111111111", time.Now())
+	if fields := changedUserFields(original, updated); !reflect.DeepEqual(fields, []string{"username", "roles"}) {
+		t.Fatalf("Unexpected changed fields: %v", fields)
+	}
+}
+
+func Test_RequestIP(t *testing.T) {
+	api := &Api{ApiConfig: ApiConfig{TrustedProxies: []string{"10.0.0.3", "10.1.0.0/16"}}}
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		ip         string
+	}{
+		{"10.0.0.3:1234", nil, "10.0.0.3"},
+		{"10.0.0.4:1234", []string{"10.0.0.1"}, "10.0.0.4"},
+		{"10.0.0.3:1234", []string{" 10.0.0.1, 10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.3:1234", []string{"10.0.0.1, 10.0.0.2, 10.1.2.3"}, "10.0.0.2"},
+		{"10.0.0.3:1234", []string{"10.0.0.1", "10.0.0.2"}, "10.0.0.2"},
+		{"10.0.0.3:1234", []string{"10.1.2.3"}, "10.1.2.3"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, forwarded := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", forwarded)
+		}
+		if ip := api.requestIP(req); ip != test.ip {
+			t.Fatalf("Unexpected request ip for %s forwarding %v: %s", test.remoteAddr, test.forwarded, ip)
+		}
+	}
+}
+
+func Test_NewAuditEvent_SortsInOrder(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 999, time.UTC)
+	first, err := NewAuditEvent(AUDIT_EVENT_LOGIN, now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	second, err := NewAuditEvent(AUDIT_EVENT_LOGOUT, now.Add(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first.Time != second.Time || len(first.ID) != 24 || first.ID >= second.ID {
+		t.Fatalf("Unexpected audit events: %#v %#v", first, second)
+	}
+}
@@ -0,0 +1,194 @@
+package user
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+
+	"github.com/tidepool-org/shoreline/user/mailer"
+)
+
+// SendClaimInvitation invites the recipient at the email address given in the body to claim a custodial
+// user, sending a claim token to the address. Only custodians of the user and server tokens may invite.
+// status: 202
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_NOT_CUSTODIAL, STATUS_USR_ALREADY_EXISTS
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_SENDING_EMAIL
+// status: 501 STATUS_MAILER_NOT_CONFIGURED
+func (a *Api) SendClaimInvitation(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if a.mailer == nil {
+		a.sendError(res, http.StatusNotImplemented, STATUS_MAILER_NOT_CONFIGURED)
+
+	} else if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if permissions, err := a.tokenUserHasRequestedPermissions(tokenData, vars["userid"], clients.Permissions{"custodian": clients.Allowed}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if len(permissions) == 0 {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User is not a custodian")
+
+	} else if email := NormalizeEmail(getGivenDetail(req)["email"]); !IsValidEmail(email) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_emails_invalid)
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if user.PwHash != "" {
+		a.sendError(res, http.StatusConflict, STATUS_USER_NOT_CUSTODIAL)
+
+	} else if taken, err := a.emailTakenByOtherUser(req, user, email); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if taken {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else if err := a.sendConfirmationEmail(a.Store.WithContext(req.Context()), CONFIRMATION_TYPE_CUSTODIAL_CLAIM, user.Id, email, "You are invited to claim your account",
+		"An account holding your data was created for you. To take ownership of it, set a password by following this link:\n\n%s", time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_SENDING_EMAIL, err)
+
+	} else {
+		a.auditEvent(req, AUDIT_EVENT_CLAIM_INVITED, tokenData.UserId, user.Id)
+		res.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// ClaimCustodialUser makes a custodial user a real account using a token sent by SendClaimInvitation:
+// the invited email becomes the user's verified username, the password given in the body is set and
+// the custodian permission is removed from its custodians, who are notified. If the user cannot be
+// updated, the custodian permissions are restored. The token is only used once the claim is stored, so
+// a claim that fails can be retried with the same token.
+// status: 200 User
+// status: 400 STATUS_INVALID_USER_DETAILS, STATUS_INVALID_CONFIRMATION
+// status: 403 STATUS_DOMAIN_NOT_ALLOWED, STATUS_DISPOSABLE_EMAIL, STATUS_DOMAIN_NOT_FOR_ROLE
+// status: 404 STATUS_CONFIRMATION_NOT_FOUND, STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_NOT_CUSTODIAL, STATUS_USR_ALREADY_EXISTS, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_CONFIRMING, STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) ClaimCustodialUser(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if password := getGivenDetail(req)["password"]; !IsValidPassword(password) {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, User_error_password_invalid)
+
+	} else if confirmation, user := a.findConfirmationToken(res, req, vars["token"], CONFIRMATION_TYPE_CUSTODIAL_CLAIM); user == nil {
+		return
+
+	} else if a.perms == nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, "Gatekeeper not configured")
+
+	} else if user.PwHash != "" {
+		a.sendError(res, http.StatusConflict, STATUS_USER_NOT_CUSTODIAL)
+
+	} else if !a.checkEmailDomains(res, user, []string{confirmation.Email}, user.Roles) {
+		return
+
+	} else if taken, err := a.emailTakenByOtherUser(req, user, confirmation.Email); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if taken {
+		a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS)
+
+	} else if custodianPermissions, err := a.perms.UsersInGroup(user.Id); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		originalUser := user.DeepClone()
+		user.ChangeEmail(confirmation.Email)
+		user.EmailVerified = true
+		user.CustodianUserID = ""
+		organizationDomains := a.grantOrganizationRoles(a.Store.WithContext(req.Context()), user, user.Username)
+		if err := user.HashPassword(password, a.ApiConfig.Salt); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+		user.MarkModified(user.Id, time.Now())
+
+		custodianIDs, err := a.claimCustodialUser(a.Store.WithContext(req.Context()), user, custodianPermissions)
+		if err == ErrUserIdentityConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USR_ALREADY_EXISTS, err)
+			return
+		} else if err == ErrUserRevisionConflict {
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+			return
+		}
+		if used, err := a.Store.WithContext(req.Context()).UseConfirmation(confirmation.ID, time.Now()); err != nil || used == nil {
+			a.logger.Printf("Error using confirmation %s of claimed user %s: %v", confirmation.ID, user.Id, err)
+		}
+
+		a.shareClinicDemo(originalUser, user)
+		a.notifyCustodians(a.Store.WithContext(req.Context()), user, custodianIDs)
+		a.auditEvent(req, AUDIT_EVENT_USER_CLAIMED, user.Id, user.Id)
+		a.auditOrganizationRoles(req, user.Id, originalUser.Roles, user, organizationDomains)
+		a.logger.Printf("Custodial user %s was claimed", user.Id)
+		a.sendUser(res, user, false)
+	}
+}
+
+// claimCustodialUser removes the custodian permission from the user's custodians and then stores the
+// user, returning the ids of the custodians. Gatekeeper permissions are set one custodian at a time,
+// so the claim is not atomic: if a step fails, the permissions already removed are restored so that
+// the user remains custodial and the claim can be retried. A failed restore is logged; the custodian
+// then holds its other permissions but no longer the custodian permission.
+func (a *Api) claimCustodialUser(store Storage, user *User, usersPermissions clients.UsersPermissions) ([]string, error) {
+	restore := func(custodianIDs []string) {
+		for _, custodianID := range custodianIDs {
+			if _, err := a.perms.SetPermissions(custodianID, user.Id, usersPermissions[custodianID]); err != nil {
+				a.logger.Printf("Error restoring custodian permissions of user %s for user %s: %s", custodianID, user.Id, err)
+			}
+		}
+	}
+
+	custodianIDs := []string{}
+	for userID, permissions := range usersPermissions {
+		if _, ok := permissions["custodian"]; !ok {
+			continue
+		}
+		finalPermissions := make(clients.Permissions)
+		for name, value := range permissions {
+			if name != "custodian" {
+				finalPermissions[name] = value
+			}
+		}
+		if _, err := a.perms.SetPermissions(userID, user.Id, finalPermissions); err != nil {
+			restore(custodianIDs)
+			return nil, err
+		}
+		custodianIDs = append(custodianIDs, userID)
+	}
+
+	if err := store.UpsertUser(user); err != nil {
+		restore(custodianIDs)
+		return nil, err
+	}
+	return custodianIDs, nil
+}
+
+// notifyCustodians emails the custodians of a claimed user that it was claimed. Failing to notify a
+// custodian is logged, but does not fail the claim.
+func (a *Api) notifyCustodians(store Storage, user *User, custodianIDs []string) {
+	if a.mailer == nil {
+		return
+	}
+	for _, custodianID := range custodianIDs {
+		custodian, err := store.FindUser(&User{Id: custodianID})
+		if err != nil || custodian == nil || custodian.Email() == "" {
+			a.logger.Printf("Error finding custodian %s of user %s to notify: %v", custodianID, user.Id, err)
+			continue
+		}
+		if err := a.mailer.Send(&mailer.Message{
+			To:      custodian.Email(),
+			Subject: "An account you care for was claimed",
+			Body:    fmt.Sprintf("The account you created for %s has been claimed. You keep access to its data unless they remove it.", user.Email()),
+		}); err != nil {
+			a.logger.Printf("Error notifying custodian %s of user %s: %s", custodianID, user.Id, err)
+		}
+	}
+}
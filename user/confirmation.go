@@ -0,0 +1,212 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/tidepool-org/shoreline/user/mailer"
+)
+
+const (
+	CONFIRMATION_TYPE_EMAIL_VERIFICATION = "verify"
+	CONFIRMATION_TYPE_EMAIL_CHANGE       = "email"
+	CONFIRMATION_TYPE_EMAIL_REVERT       = "revert"
+	CONFIRMATION_TYPE_CUSTODIAL_CLAIM    = "claim"
+
+	defaultConfirmationDurationHours = 48
+	defaultVerificationResendLimit   = 3
+	verificationResendWindow         = time.Hour
+)
+
+var (
+	Confirmation_error_invalid = errors.New("Confirmation: token is invalid")
+)
+
+// Confirmation is a single-use record of a confirmation token sent to a user by email. The token
+// itself is a JWT signed with the server secret whose id refers to the Confirmation. Confirmations
+// are removed by the store once they expire, used or not.
+type Confirmation struct {
+	ID          string    `json:"id" bson:"_id"`
+	Type        string    `json:"type" bson:"type"`
+	UserID      string    `json:"userId" bson:"userId"`
+	Email       string    `json:"email" bson:"email"`
+	CreatedTime string    `json:"createdTime" bson:"createdTime"`
+	ExpiresTime string    `json:"expiresTime" bson:"expiresTime"`
+	ExpiresAt   time.Time `json:"-" bson:"expiresAt"` // the expiry time as a date, for the store to remove expired confirmations
+	UsedTime    string    `json:"usedTime,omitempty" bson:"usedTime,omitempty"`
+}
+
+// ConfirmationClaims are the claims of a signed confirmation token
+type ConfirmationClaims struct {
+	Type  string `json:"typ"`
+	Email string `json:"eml"`
+	jwt.StandardClaims
+}
+
+// NewConfirmation returns a confirmation of the given type for a user and email address
+func NewConfirmation(confirmationType string, userID string, email string, duration time.Duration, now time.Time) (*Confirmation, error) {
+	if confirmationType == "" || userID == "" || email == "" {
+		return nil, errors.New("Confirmation: type, user id and email are required")
+	}
+
+	id, err := generateUniqueHash([]string{confirmationType, userID, email}, 24)
+	if err != nil {
+		return nil, errors.New("Confirmation: error generating id")
+	}
+
+	return &Confirmation{
+		ID:          id,
+		Type:        confirmationType,
+		UserID:      userID,
+		Email:       email,
+		CreatedTime: now.UTC().Format(TimestampFormat),
+		ExpiresTime: now.Add(duration).UTC().Format(TimestampFormat),
+		ExpiresAt:   now.Add(duration).UTC(),
+	}, nil
+}
+
+// SignedToken returns the confirmation token to send to the user
+func (c *Confirmation) SignedToken(secret string) (string, error) {
+	if secret == "" {
+		return "", errors.New("Confirmation: secret is missing")
+	}
+
+	createdTime, err := time.Parse(TimestampFormat, c.CreatedTime)
+	if err != nil {
+		return "", err
+	}
+	expiresTime, err := time.Parse(TimestampFormat, c.ExpiresTime)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, ConfirmationClaims{
+		Type:  c.Type,
+		Email: c.Email,
+		StandardClaims: jwt.StandardClaims{
+			Id:        c.ID,
+			Subject:   c.UserID,
+			IssuedAt:  createdTime.Unix(),
+			ExpiresAt: expiresTime.Unix(),
+		},
+	})
+	return token.SignedString([]byte(secret))
+}
+
+// ParseConfirmationToken verifies the signature and expiry of a confirmation token of the given type
+func ParseConfirmationToken(token string, confirmationType string, secret string) (*ConfirmationClaims, error) {
+	claims := &ConfirmationClaims{}
+	jwtToken, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, Confirmation_error_invalid
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !jwtToken.Valid || secret == "" {
+		return nil, Confirmation_error_invalid
+	}
+	if claims.Type != confirmationType || claims.Id == "" || claims.Subject == "" {
+		return nil, Confirmation_error_invalid
+	}
+	return claims, nil
+}
+
+// ConfirmationDuration returns how long a confirmation token remains valid
+func (c ApiConfig) ConfirmationDuration() time.Duration {
+	hours := c.ConfirmationDurationHours
+	if hours <= 0 {
+		hours = defaultConfirmationDurationHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// MaxVerificationResends returns how many verification emails may be sent to a user per hour
+func (c ApiConfig) MaxVerificationResends() int {
+	if c.VerificationResendLimit <= 0 {
+		return defaultVerificationResendLimit
+	}
+	return c.VerificationResendLimit
+}
+
+func (a *Api) confirmationLink(confirmationType string, token string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(a.ApiConfig.ConfirmationURL, "/"), confirmationType, token)
+}
+
+// issueConfirmation records a new confirmation for a user and email address and returns its signed token
+func (a *Api) issueConfirmation(store Storage, confirmationType string, userID string, email string, now time.Time) (string, error) {
+	confirmation, err := NewConfirmation(confirmationType, userID, email, a.ApiConfig.ConfirmationDuration(), now)
+	if err != nil {
+		return "", err
+	}
+	token, err := confirmation.SignedToken(a.ApiConfig.ServerSecret)
+	if err != nil {
+		return "", err
+	}
+	if err := store.AddConfirmation(confirmation); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendConfirmationEmail issues a confirmation of the given type for the email address and sends
+// its link in an email. The body is a format string with a single verb for the link.
+func (a *Api) sendConfirmationEmail(store Storage, confirmationType string, userID string, email string, subject string, body string, now time.Time) error {
+	token, err := a.issueConfirmation(store, confirmationType, userID, email, now)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(&mailer.Message{
+		To:      email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, a.confirmationLink(confirmationType, token)) + fmt.Sprintf("\n\nThe link expires in %d hours.", int(a.ApiConfig.ConfirmationDuration().Hours())),
+	})
+}
+
+// sendVerificationEmail sends a verification token for one of the user's email addresses. It does
+// nothing when no mailer is attached, in which case verification is left to other services.
+func (a *Api) sendVerificationEmail(store Storage, user *User, email string, now time.Time) error {
+	if a.mailer == nil {
+		return nil
+	}
+
+	return a.sendConfirmationEmail(store, CONFIRMATION_TYPE_EMAIL_VERIFICATION, user.Id, email, "Verify your email address",
+		"Please verify your email address by following this link:\n\n%s", now)
+}
+
+// sendEmailChangeEmails sends a confirmation for the user's pending email to the new address and, if
+// the user has a current address, a notification to it with a link to revert the change
+func (a *Api) sendEmailChangeEmails(store Storage, user *User, now time.Time) error {
+	if err := a.sendConfirmationEmail(store, CONFIRMATION_TYPE_EMAIL_CHANGE, user.Id, user.PendingEmail, "Confirm your new email address",
+		"Please confirm the change of your account email address to this address by following this link:\n\n%s", now); err != nil {
+		return err
+	}
+
+	if user.Email() == "" {
+		return nil
+	}
+	return a.sendConfirmationEmail(store, CONFIRMATION_TYPE_EMAIL_REVERT, user.Id, user.Email(), "Your account email address is changing",
+		fmt.Sprintf("A change of your account email address to %s was requested. If you did not request this change, follow this link to keep your current address and sign out of all sessions:\n\n%%s", strings.ReplaceAll(user.PendingEmail, "%", "%%")), now)
+}
+
+// verificationResendAllowed reports whether fewer than MaxVerificationResends verification emails
+// were sent to the user in the last hour
+func (a *Api) verificationResendAllowed(store Storage, userID string, now time.Time) (bool, error) {
+	confirmations, err := store.FindConfirmationsForUser(userID, CONFIRMATION_TYPE_EMAIL_VERIFICATION)
+	if err != nil {
+		return false, err
+	}
+
+	windowStart := now.Add(-verificationResendWindow).UTC().Format(TimestampFormat)
+	count := 0
+	for _, confirmation := range confirmations {
+		if confirmation.CreatedTime > windowStart {
+			count++
+		}
+	}
+	return count < a.ApiConfig.MaxVerificationResends(), nil
+}
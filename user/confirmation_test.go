@@ -0,0 +1,71 @@
+package user
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_NewConfirmation_Missing(t *testing.T) {
+	if _, err := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "", time.Hour, time.Now()); err == nil {
+		t.Fatalf("Expected error from NewConfirmation")
+	}
+}
+
+func Test_NewConfirmation(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	confirmation, err := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "a@z.co", time.Hour, now)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewConfirmation: %#v", err)
+	}
+	if confirmation.ExpiresTime != "2020-01-02T04:04:05+00:00" || !confirmation.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Unexpected confirmation expiry: %#v", confirmation)
+	}
+}
+
+func Test_Confirmation_SignedToken_RoundTrip(t *testing.T) {
+	confirmation, err := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "a@z.co", time.Hour, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error from NewConfirmation: %#v", err)
+	}
+	token, err := confirmation.SignedToken("secret")
+	if err != nil {
+		t.Fatalf("Unexpected error from SignedToken: %#v", err)
+	}
+
+	claims, err := ParseConfirmationToken(token, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error from ParseConfirmationToken: %#v", err)
+	}
+	if claims.Id != confirmation.ID || claims.Subject != "1111111111" || claims.Email != "a@z.co" {
+		t.Fatalf("Unexpected claims: %#v", claims)
+	}
+}
+
+func Test_ParseConfirmationToken_Invalid(t *testing.T) {
+	confirmation, _ := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "a@z.co", time.Hour, time.Now())
+	token, _ := confirmation.SignedToken("secret")
+	expiredConfirmation, _ := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "a@z.co", time.Hour, time.Now().Add(-2*time.Hour))
+	expiredToken, _ := expiredConfirmation.SignedToken("secret")
+
+	tests := map[string]struct {
+		token            string
+		confirmationType string
+		secret           string
+	}{
+		"wrong secret": {token, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "other"},
+		"wrong type":   {token, "other", "secret"},
+		"expired":      {expiredToken, CONFIRMATION_TYPE_EMAIL_VERIFICATION, "secret"},
+		"malformed":    {"not-a-token", CONFIRMATION_TYPE_EMAIL_VERIFICATION, "secret"},
+	}
+	for name, test := range tests {
+		if _, err := ParseConfirmationToken(test.token, test.confirmationType, test.secret); err != Confirmation_error_invalid {
+			t.Fatalf("Expected invalid error for %s, got %#v", name, err)
+		}
+	}
+}
+
+func Test_ApiConfig_ConfirmationDuration_Default(t *testing.T) {
+	if duration := (ApiConfig{}).ConfirmationDuration(); duration != 48*time.Hour {
+		t.Fatalf("Unexpected default confirmation duration: %v", duration)
+	}
+}
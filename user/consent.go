@@ -0,0 +1,220 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ConsentType is a kind of consent users may grant and revoke, such as research data sharing
+type ConsentType struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`             // the version of the consent text users currently grant
+	Marketing   bool   `json:"marketing,omitempty"` // whether the consent allows syncing the user to Marketo
+}
+
+// ConsentTypes are the kinds of consent users may grant and revoke
+type ConsentTypes []ConsentType
+
+// ConsentRecord is an append-only record of a user granting or revoking a consent
+type ConsentRecord struct {
+	ID          string `json:"id" bson:"_id"`
+	UserID      string `json:"userId" bson:"userId"`
+	Type        string `json:"type" bson:"type"`
+	Version     string `json:"version" bson:"version"`
+	Granted     bool   `json:"granted" bson:"granted"`
+	Time        string `json:"time" bson:"time"`
+	TimeNanos   int64  `json:"-" bson:"timeNanos,omitempty"`                       // the time in nanoseconds, which orders records within a second
+	ActorUserID string `json:"actorUserId,omitempty" bson:"actorUserId,omitempty"` // the token user, or server name, that recorded the consent
+}
+
+// ConsentResults are the latest record of each consent type, along with all of a user's records
+// in the order they were recorded
+type ConsentResults struct {
+	Consents map[string]*ConsentRecord `json:"consents"`
+	History  []*ConsentRecord          `json:"history"`
+}
+
+var (
+	ConsentTypes_error_name_invalid        = errors.New("Consent type name is invalid")
+	ConsentTypes_error_name_duplicate      = errors.New("Consent type name is defined more than once")
+	ConsentTypes_error_version_invalid     = errors.New("Consent type version is missing")
+	ConsentTypes_error_marketing_duplicate = errors.New("Only one consent type may be for marketing")
+)
+
+// Validate checks that names are valid and unique, that versions are given, and that at most
+// one type is for marketing
+func (c ConsentTypes) Validate() error {
+	names := map[string]bool{}
+	marketing := false
+	for _, consentType := range c {
+		if !IsValidRoleName(consentType.Name) {
+			return ConsentTypes_error_name_invalid
+		} else if names[consentType.Name] {
+			return ConsentTypes_error_name_duplicate
+		} else if consentType.Version == "" {
+			return ConsentTypes_error_version_invalid
+		} else if consentType.Marketing && marketing {
+			return ConsentTypes_error_marketing_duplicate
+		}
+		names[consentType.Name] = true
+		marketing = marketing || consentType.Marketing
+	}
+	return nil
+}
+
+// Find returns the consent type with the given name, or nil if there is none
+func (c ConsentTypes) Find(name string) *ConsentType {
+	for index := range c {
+		if c[index].Name == name {
+			return &c[index]
+		}
+	}
+	return nil
+}
+
+// Marketing returns the consent type for marketing, or nil if there is none
+func (c ConsentTypes) Marketing() *ConsentType {
+	for index := range c {
+		if c[index].Marketing {
+			return &c[index]
+		}
+	}
+	return nil
+}
+
+// NewConsentRecord returns a record of the user granting or revoking the version of the consent
+// type at now, with a random id
+func NewConsentRecord(userID string, consentType *ConsentType, granted bool, now time.Time) (*ConsentRecord, error) {
+	id, err := generateUniqueHash([]string{userID, consentType.Name, now.String()}, 24)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsentRecord{
+		ID:        id,
+		UserID:    userID,
+		Type:      consentType.Name,
+		Version:   consentType.Version,
+		Granted:   granted,
+		Time:      now.UTC().Format(TimestampFormat),
+		TimeNanos: now.UnixNano(),
+	}, nil
+}
+
+// CurrentConsents returns the latest of the records, which are in the order they were recorded,
+// for each consent type
+func CurrentConsents(records []*ConsentRecord) map[string]*ConsentRecord {
+	current := map[string]*ConsentRecord{}
+	for _, record := range records {
+		current[record.Type] = record
+	}
+	return current
+}
+
+// marketingConsented returns whether the user may be synced to Marketo: always if no consent type
+// is for marketing, otherwise only if the user's latest marketing consent record grants it
+func (a *Api) marketingConsented(store Storage, user *User) bool {
+	marketing := a.ApiConfig.Consents.Marketing()
+	if marketing == nil {
+		return true
+	}
+	records, err := store.FindConsentRecords(user.Id)
+	if err != nil {
+		a.logger.Printf("Error finding consents of user %s: %s", user.Id, err)
+		return false
+	}
+	record := CurrentConsents(records)[marketing.Name]
+	return record != nil && record.Granted
+}
+
+// GetConsentTypes returns the kinds of consent users may grant and revoke
+// status: 200 ConsentTypes
+func (a *Api) GetConsentTypes(res http.ResponseWriter, req *http.Request) {
+	consentTypes := a.ApiConfig.Consents
+	if consentTypes == nil {
+		consentTypes = ConsentTypes{}
+	}
+	sendModelAsRes(res, consentTypes)
+}
+
+// GetUserConsents returns the user's current consents and the history of its consent records
+// status: 200 ConsentResults
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_FINDING_CONSENTS
+func (a *Api) GetUserConsents(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if _, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else if records, err := a.Store.WithContext(req.Context()).FindConsentRecords(user.Id); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_CONSENTS, err)
+
+	} else {
+		sendModelAsRes(res, &ConsentResults{Consents: CurrentConsents(records), History: records})
+	}
+}
+
+// GrantUserConsent records the user granting the current version of a consent type
+// status: 200 ConsentRecord
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_CONSENT_TYPE_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_RECORDING_CONSENT
+func (a *Api) GrantUserConsent(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	a.recordUserConsent(res, req, vars, true)
+}
+
+// RevokeUserConsent records the user revoking a consent type
+// status: 200 ConsentRecord
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_CONSENT_TYPE_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_RECORDING_CONSENT
+func (a *Api) RevokeUserConsent(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	a.recordUserConsent(res, req, vars, false)
+}
+
+// recordUserConsent appends a consent record for the user, and adds the user to or removes it
+// from Marketo when the consent is for marketing
+func (a *Api) recordUserConsent(res http.ResponseWriter, req *http.Request, vars map[string]string, granted bool) {
+	consentType := a.ApiConfig.Consents.Find(vars["type"])
+	if tokenData, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else if consentType == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_CONSENT_TYPE_NOT_FOUND)
+
+	} else if record, err := NewConsentRecord(user.Id, consentType, granted, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_RECORDING_CONSENT, err)
+
+	} else {
+		record.ActorUserID = tokenData.UserId
+		if err := a.Store.WithContext(req.Context()).AddConsentRecord(record); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_RECORDING_CONSENT, err)
+			return
+		}
+
+		if consentType.Marketing {
+			a.updateMarketoForConsent(user, granted)
+		}
+		if granted {
+			a.auditEvent(req, AUDIT_EVENT_CONSENT_GRANTED, tokenData.UserId, user.Id)
+		} else {
+			a.auditEvent(req, AUDIT_EVENT_CONSENT_REVOKED, tokenData.UserId, user.Id)
+		}
+		sendModelAsRes(res, record)
+	}
+}
+
+// updateMarketoForConsent adds the user to Marketo when it grants marketing consent, if it would
+// otherwise be synced, and removes it when it revokes marketing consent
+func (a *Api) updateMarketoForConsent(user *User, granted bool) {
+	if granted && !(user.EmailVerified && user.TermsAccepted != "") {
+		return
+	} else if a.marketoManager == nil || !a.marketoManager.IsAvailable() {
+		failedMarketoUploadCount.Inc()
+	} else if granted {
+		a.marketoManager.CreateListMembershipForUser(user)
+	} else if err := a.marketoManager.RemoveListMembershipForUser(user); err != nil {
+		a.logger.Printf("Error removing user %s from Marketo: %s", user.Id, err)
+	}
+}
@@ -0,0 +1,94 @@
+package user
+
+import (
+	"errors"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+var consentTypes = ConsentTypes{
+	{Name: "research", Description: "Share data for research", Version: "2"},
+	{Name: "marketing", Version: "1", Marketing: true},
+}
+
+func Test_ConsentTypes_Validate(t *testing.T) {
+	for _, test := range []struct {
+		consentTypes ConsentTypes
+		err          error
+	}{
+		{nil, nil},
+		{consentTypes, nil},
+		{ConsentTypes{{Name: "Research", Version: "1"}}, ConsentTypes_error_name_invalid},
+		{ConsentTypes{{Name: "research", Version: "1"}, {Name: "research", Version: "2"}}, ConsentTypes_error_name_duplicate},
+		{ConsentTypes{{Name: "research"}}, ConsentTypes_error_version_invalid},
+		{ConsentTypes{{Name: "email", Version: "1", Marketing: true}, {Name: "sms", Version: "1", Marketing: true}}, ConsentTypes_error_marketing_duplicate},
+	} {
+		if err := test.consentTypes.Validate(); err != test.err {
+			t.Fatalf("Unexpected error for %v: %v", test.consentTypes, err)
+		}
+	}
+}
+
+func Test_ConsentTypes_FindAndMarketing(t *testing.T) {
+	if consentType := consentTypes.Find("research"); consentType == nil || consentType.Version != "2" {
+		t.Fatalf("Unexpected consent type: %v", consentType)
+	}
+	if consentType := consentTypes.Find("unknown"); consentType != nil {
+		t.Fatalf("Unexpected consent type: %v", consentType)
+	}
+	if consentType := consentTypes.Marketing(); consentType == nil || consentType.Name != "marketing" {
+		t.Fatalf("Unexpected marketing consent type: %v", consentType)
+	}
+	if consentType := consentTypes[:1].Marketing(); consentType != nil {
+		t.Fatalf("Unexpected marketing consent type: %v", consentType)
+	}
+}
+
+func Test_NewConsentRecord(t *testing.T) {
+	record, err := NewConsentRecord("1111111111", &consentTypes[0], true, time.Date(2016, 1, 1, 0, 0, 0, 5, time.UTC))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if record.ID == "" || record.UserID != "1111111111" || record.Type != "research" || record.Version != "2" || !record.Granted || record.Time != "2016-01-01T00:00:00+00:00" || record.TimeNanos != 1451606400000000005 {
+		t.Fatalf("Unexpected consent record: %#v", record)
+	}
+}
+
+func Test_CurrentConsents(t *testing.T) {
+	records := []*ConsentRecord{
+		{ID: "1", Type: "research", Granted: true},
+		{ID: "2", Type: "marketing", Granted: true},
+		{ID: "3", Type: "research", Granted: false},
+	}
+	current := CurrentConsents(records)
+	if len(current) != 2 || current["research"].ID != "3" || current["marketing"].ID != "2" {
+		t.Fatalf("Unexpected current consents: %v", current)
+	}
+}
+
+func Test_MarketingConsented(t *testing.T) {
+	api := &Api{logger: log.New(os.Stdout, "", 0)}
+	user := &User{Id: "1111111111"}
+	store := &ResponsableMockStoreClient{}
+	if !api.marketingConsented(store, user) {
+		t.Fatalf("Expected marketing to be consented without a marketing consent type")
+	}
+
+	api.ApiConfig.Consents = consentTypes
+	for _, test := range []struct {
+		response  FindConsentRecordsResponse
+		consented bool
+	}{
+		{FindConsentRecordsResponse{[]*ConsentRecord{}, nil}, false},
+		{FindConsentRecordsResponse{[]*ConsentRecord{{Type: "marketing", Granted: true}}, nil}, true},
+		{FindConsentRecordsResponse{[]*ConsentRecord{{Type: "marketing", Granted: true}, {Type: "marketing", Granted: false}}, nil}, false},
+		{FindConsentRecordsResponse{nil, errors.New("ERROR")}, false},
+	} {
+		store.FindConsentRecordsResponses = []FindConsentRecordsResponse{test.response}
+		if consented := api.marketingConsented(store, user); consented != test.consented {
+			t.Fatalf("Unexpected marketing consent for %v: %v", test.response, consented)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+// CustodialPolicy configures which users may be custodians and what they are permitted
+type CustodialPolicy struct {
+	Permissions        []string `json:"permissions"`        // the permissions custodians have for their custodial users, including custodian
+	CustodianRoles     []string `json:"custodianRoles"`     // if given, only users with one of the roles may be custodians
+	EmailRequiredRoles []string `json:"emailRequiredRoles"` // custodians with one of the roles must give an email for new custodial users
+	MaxPerCustodian    int      `json:"maxPerCustodian"`    // the most custodial users a custodian may have, or zero for no limit
+}
+
+var (
+	CustodialPolicy_error_permissions_invalid = errors.New("Custodial permissions must include custodian")
+	CustodialPolicy_error_role_unknown        = errors.New("Custodial policy has an unknown role")
+	CustodialPolicy_error_limit_invalid       = errors.New("Custodial limit must not be negative")
+	CustodialPolicy_error_email_required      = errors.New("An email is required for custodial users of this custodian")
+)
+
+// defaultCustodianPermissions are the permissions of custodians when none are configured
+var defaultCustodianPermissions = []string{"custodian", "view", "upload"}
+
+// Validate checks that the permissions include custodian, that the roles are defined and that the
+// limit is not negative
+func (p CustodialPolicy) Validate(registry RoleRegistry) error {
+	if len(p.Permissions) > 0 && !containsString(p.Permissions, "custodian") {
+		return CustodialPolicy_error_permissions_invalid
+	} else if p.MaxPerCustodian < 0 {
+		return CustodialPolicy_error_limit_invalid
+	}
+	for _, role := range append(append([]string{}, p.CustodianRoles...), p.EmailRequiredRoles...) {
+		if !registry.IsValid(role) {
+			return CustodialPolicy_error_role_unknown
+		}
+	}
+	return nil
+}
+
+// CustodianPermissions returns the permissions custodians have for their custodial users
+func (p CustodialPolicy) CustodianPermissions() clients.Permissions {
+	names := p.Permissions
+	if len(names) == 0 {
+		names = defaultCustodianPermissions
+	}
+	permissions := make(clients.Permissions)
+	for _, name := range names {
+		permissions[name] = clients.Allowed
+	}
+	return permissions
+}
+
+// RestrictsByRole returns whether the custodian's roles must be known to apply the policy
+func (p CustodialPolicy) RestrictsByRole() bool {
+	return len(p.CustodianRoles) > 0 || len(p.EmailRequiredRoles) > 0
+}
+
+// AllowsCustodian returns whether a user with the roles may be a custodian
+func (p CustodialPolicy) AllowsCustodian(roles []string) bool {
+	if len(p.CustodianRoles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if containsString(p.CustodianRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresEmail returns whether a custodian with the roles must give an email for new custodial users
+func (p CustodialPolicy) RequiresEmail(roles []string) bool {
+	for _, role := range roles {
+		if containsString(p.EmailRequiredRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// custodianPermissions returns the permissions a custodian has for its custodial users
+func (a *Api) custodianPermissions() clients.Permissions {
+	return a.ApiConfig.Custodial.CustodianPermissions()
+}
+
+// findCustodian returns the custodian of a new custodial user, which is only looked up when the
+// custodial policy restricts by role. If it is not found an error response is sent and nil is returned.
+func (a *Api) findCustodian(res http.ResponseWriter, req *http.Request, custodianUserID string) *User {
+	if !a.ApiConfig.Custodial.RestrictsByRole() {
+		return &User{Id: custodianUserID}
+	} else if custodian, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: custodianUserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+	} else if custodian == nil || custodian.IsDeleted() || custodian.IsSuspended() {
+		a.sendError(res, http.StatusNotFound, STATUS_CUSTODIAN_NOT_FOUND)
+	} else {
+		return custodian
+	}
+	return nil
+}
+
+// enforceCustodialPolicy checks that the custodian may have another custodial user and, if the details
+// of a new custodial user are given, that they include any required email. If the policy is not met an error response is sent
+// and false is returned. The limit is advisory: the custodial users are counted before the new one is
+// stored, so concurrent requests may exceed it, and only custodial users recording their custodian are
+// counted, which includes those created before custodians were recorded once the custodians migration has run.
+func (a *Api) enforceCustodialPolicy(res http.ResponseWriter, req *http.Request, custodian *User, details *NewCustodialUserDetails) bool {
+	policy := a.ApiConfig.Custodial
+	if policy.RestrictsByRole() && !policy.AllowsCustodian(custodian.Roles) {
+		a.sendError(res, http.StatusForbidden, STATUS_CUSTODIAN_NOT_ALLOWED)
+		return false
+	} else if details != nil && policy.RequiresEmail(custodian.Roles) && details.Username == nil && len(details.Emails) == 0 {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, CustodialPolicy_error_email_required)
+		return false
+	}
+
+	if policy.MaxPerCustodian > 0 {
+		results, err := a.Store.WithContext(req.Context()).FindUsersByCustodian(custodian.Id)
+		if err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+			return false
+		}
+		count := 0
+		for _, result := range results {
+			if !result.IsDeleted() {
+				count++
+			}
+		}
+		if count >= policy.MaxPerCustodian {
+			a.sendError(res, http.StatusForbidden, STATUS_CUSTODIAL_LIMIT_REACHED)
+			return false
+		}
+	}
+	return true
+}
+
+// GetCustodialUsers returns the custodial users the user is the custodian of. Custodial users
+// created before custodians were recorded are returned once the custodians migration has run.
+// status: 200 []User
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) GetCustodialUsers(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, user := a.findSelfOrServerUser(res, req, vars["userid"]); user == nil {
+		return
+
+	} else if results, err := a.Store.WithContext(req.Context()).FindUsersByCustodian(user.Id); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		custodialUsers := []*User{}
+		for _, result := range results {
+			if !result.IsDeleted() {
+				custodialUsers = append(custodialUsers, result)
+			}
+		}
+		a.sendUsers(res, custodialUsers, tokenData.IsServer)
+	}
+}
+
+// TransferCustody makes the user given by custodianUserId in the body the custodian of a custodial
+// user. Only server tokens and custodians of the user may transfer custody, to custodians allowed by
+// the custodial policy. The new custodian is
+// given the custodian permissions before the user is updated, and the previous custodians lose them
+// only after, so a failure never leaves the user without a custodian and the transfer can be retried.
+// status: 200 User
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 403 STATUS_CUSTODIAN_NOT_ALLOWED, STATUS_CUSTODIAL_LIMIT_REACHED
+// status: 404 STATUS_USER_NOT_FOUND, STATUS_CUSTODIAN_NOT_FOUND
+// status: 409 STATUS_USER_NOT_CUSTODIAL, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_UPDATING_USR
+func (a *Api) TransferCustody(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+	} else if permissions, err := a.tokenUserHasRequestedPermissions(tokenData, vars["userid"], clients.Permissions{"custodian": clients.Allowed}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if len(permissions) == 0 {
+		a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, "User is not a custodian")
+
+	} else if custodianUserID := strings.TrimSpace(getGivenDetail(req)["custodianUserId"]); custodianUserID == "" || custodianUserID == vars["userid"] {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, "A custodianUserId other than the user is required")
+
+	} else if user, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if user == nil || user.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if user.PwHash != "" {
+		a.sendError(res, http.StatusConflict, STATUS_USER_NOT_CUSTODIAL)
+
+	} else if custodian, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: custodianUserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if custodian == nil || custodian.IsDeleted() || custodian.IsSuspended() {
+		a.sendError(res, http.StatusNotFound, STATUS_CUSTODIAN_NOT_FOUND)
+
+	} else if custodian.Id != user.CustodianUserID && !a.enforceCustodialPolicy(res, req, custodian, nil) {
+		return
+
+	} else if err := a.transferCustody(a.Store.WithContext(req.Context()), user, custodian.Id, tokenData.UserId); err == ErrUserRevisionConflict {
+		a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+
+	} else if err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_USR, err)
+
+	} else {
+		a.auditEvent(req, AUDIT_EVENT_CUSTODY_TRANSFERRED, tokenData.UserId, user.Id)
+		a.logger.Printf("Transferred custody of user %s to user %s", user.Id, custodian.Id)
+		a.sendUser(res, user, tokenData.IsServer)
+	}
+}
+
+// transferCustody grants the custodian permissions to the new custodian, records it on the user and
+// then removes the custodian permissions from every other custodian of the user. If the user cannot
+// be updated, the new custodian's permissions are restored.
+func (a *Api) transferCustody(store Storage, user *User, custodianUserID string, actorUserID string) error {
+	usersPermissions, err := a.perms.UsersInGroup(user.Id)
+	if err != nil {
+		return err
+	}
+
+	originalPermissions := usersPermissions[custodianUserID]
+	grantedPermissions := make(clients.Permissions)
+	for name, value := range originalPermissions {
+		grantedPermissions[name] = value
+	}
+	for name, value := range a.custodianPermissions() {
+		grantedPermissions[name] = value
+	}
+	if _, err := a.perms.SetPermissions(custodianUserID, user.Id, grantedPermissions); err != nil {
+		return err
+	}
+
+	user.CustodianUserID = custodianUserID
+	user.MarkModified(actorUserID, time.Now())
+	if err := store.UpsertUser(user); err != nil {
+		if _, restoreErr := a.perms.SetPermissions(custodianUserID, user.Id, originalPermissions); restoreErr != nil {
+			a.logger.Printf("Error restoring permissions of user %s for user %s: %s", custodianUserID, user.Id, restoreErr)
+		}
+		return err
+	}
+
+	for userID, permissions := range usersPermissions {
+		if _, ok := permissions["custodian"]; !ok || userID == custodianUserID {
+			continue
+		}
+		finalPermissions := make(clients.Permissions)
+		for name, value := range permissions {
+			if _, ok := a.custodianPermissions()[name]; !ok {
+				finalPermissions[name] = value
+			}
+		}
+		if _, err := a.perms.SetPermissions(userID, user.Id, finalPermissions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
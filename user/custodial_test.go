@@ -0,0 +1,47 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+func Test_CustodialPolicy_Validate(t *testing.T) {
+	for _, test := range []struct {
+		policy CustodialPolicy
+		err    error
+	}{
+		{CustodialPolicy{}, nil},
+		{CustodialPolicy{Permissions: []string{"custodian", "view"}, CustodianRoles: []string{"clinic"}, MaxPerCustodian: 10}, nil},
+		{CustodialPolicy{Permissions: []string{"view"}}, CustodialPolicy_error_permissions_invalid},
+		{CustodialPolicy{MaxPerCustodian: -1}, CustodialPolicy_error_limit_invalid},
+		{CustodialPolicy{EmailRequiredRoles: []string{"unknown"}}, CustodialPolicy_error_role_unknown},
+	} {
+		if err := test.policy.Validate(DefaultRoleRegistry()); err != test.err {
+			t.Fatalf("Unexpected error for %v: %v", test.policy, err)
+		}
+	}
+}
+
+func Test_CustodialPolicy_CustodianPermissions(t *testing.T) {
+	if permissions := (CustodialPolicy{}).CustodianPermissions(); !reflect.DeepEqual(permissions, clients.Permissions{"custodian": clients.Allowed, "view": clients.Allowed, "upload": clients.Allowed}) {
+		t.Fatalf("Unexpected default permissions: %v", permissions)
+	}
+	if permissions := (CustodialPolicy{Permissions: []string{"custodian", "view"}}).CustodianPermissions(); !reflect.DeepEqual(permissions, clients.Permissions{"custodian": clients.Allowed, "view": clients.Allowed}) {
+		t.Fatalf("Unexpected permissions: %v", permissions)
+	}
+}
+
+func Test_CustodialPolicy_Roles(t *testing.T) {
+	policy := CustodialPolicy{CustodianRoles: []string{"clinic"}, EmailRequiredRoles: []string{"clinic"}}
+	if !policy.RestrictsByRole() || !policy.AllowsCustodian([]string{"clinic"}) || policy.AllowsCustodian(nil) {
+		t.Fatalf("Unexpected custodian roles for %v", policy)
+	}
+	if !policy.RequiresEmail([]string{"clinic"}) || policy.RequiresEmail(nil) {
+		t.Fatalf("Unexpected email requirement for %v", policy)
+	}
+	if policy := (CustodialPolicy{}); policy.RestrictsByRole() || !policy.AllowsCustodian(nil) {
+		t.Fatalf("Unexpected custodian roles for %v", policy)
+	}
+}
@@ -0,0 +1,380 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+const (
+	DELETION_PURGE_MODE_REMOVE    = "remove"
+	DELETION_PURGE_MODE_ANONYMIZE = "anonymize"
+
+	DELETION_JOB_STATE_PENDING   = "pending"
+	DELETION_JOB_STATE_COMPLETED = "completed"
+	DELETION_JOB_STATE_FAILED    = "failed"
+	DELETION_JOB_STATE_CANCELLED = "cancelled"
+
+	DELETION_STEP_STATE_PENDING   = "pending"
+	DELETION_STEP_STATE_COMPLETED = "completed"
+	DELETION_STEP_STATE_FAILED    = "failed"
+
+	DELETION_STEP_REVOKE_TOKENS       = "revokeTokens"
+	DELETION_STEP_CLEAR_PERMISSIONS   = "clearPermissions"
+	DELETION_STEP_REMOVE_MARKETO_LEAD = "removeMarketoLead"
+	DELETION_STEP_PURGE_RECORDS       = "purgeRecords"
+	DELETION_STEP_PURGE_USER          = "purgeUser"
+
+	defaultDeletionGracePeriodDays      = 30
+	defaultDeletionPurgeIntervalMinutes = 60
+	defaultDeletionMaxAttempts          = 5
+
+	// how long a purge run holds a deletion job it claimed before other runs may claim it
+	deletionJobLeaseDuration = 15 * time.Minute
+)
+
+// ErrDeletionJobLeaseLost is returned by ReleaseDeletionJob when the job is no longer pending or leased
+// to the owner releasing it, as when it was cancelled or its lease expired and another run claimed it
+var ErrDeletionJobLeaseLost = errors.New("Deletion job lease was lost")
+
+// deletionSteps are run in order; a step is only attempted once all of the steps before it have completed
+var deletionSteps = []string{
+	DELETION_STEP_REVOKE_TOKENS,
+	DELETION_STEP_CLEAR_PERMISSIONS,
+	DELETION_STEP_REMOVE_MARKETO_LEAD,
+	DELETION_STEP_PURGE_RECORDS,
+	DELETION_STEP_PURGE_USER,
+}
+
+// DeletionJob records the removal of a deleted user from shoreline and its dependent systems
+type DeletionJob struct {
+	ID            string           `json:"id" bson:"_id"`
+	UserID        string           `json:"userid" bson:"userId"`
+	State         string           `json:"state" bson:"state"`
+	Steps         []*DeletionStep  `json:"steps" bson:"steps"`
+	Request       *DeletionRequest `json:"request,omitempty" bson:"request,omitempty"`
+	CreatedTime   string           `json:"createdTime" bson:"createdTime"`
+	ScheduledTime string           `json:"scheduledTime" bson:"scheduledTime"`
+	ModifiedTime  string           `json:"modifiedTime,omitempty" bson:"modifiedTime,omitempty"`
+	CompletedTime string           `json:"completedTime,omitempty" bson:"completedTime,omitempty"`
+
+	LeaseOwner       string `json:"-" bson:"leaseOwner,omitempty"`       // the purge run that last claimed the job
+	LeaseExpiresTime string `json:"-" bson:"leaseExpiresTime,omitempty"` // until when the run holds the job, while it runs
+}
+
+// DeletionRequest records who asked for a user to be deleted, and why. Self-service deletions
+// are requested by the user; deletions by server tokens must give the requester and a reason.
+type DeletionRequest struct {
+	Requester   string `json:"requester" bson:"requester"`
+	Reason      string `json:"reason,omitempty" bson:"reason,omitempty"`
+	ActorUserID string `json:"actorUserId" bson:"actorUserId"`
+}
+
+// DeletionStep records the progress of a single step of a deletion job
+type DeletionStep struct {
+	Name          string `json:"name" bson:"name"`
+	State         string `json:"state" bson:"state"`
+	Attempts      int    `json:"attempts" bson:"attempts"`
+	LastError     string `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CompletedTime string `json:"completedTime,omitempty" bson:"completedTime,omitempty"`
+}
+
+// NewDeletionJob returns a pending deletion job for the user scheduled to run at the given time
+func NewDeletionJob(userID string, request *DeletionRequest, scheduled time.Time, now time.Time) (*DeletionJob, error) {
+	if userID == "" {
+		return nil, errors.New("user id is missing")
+	}
+
+	id, err := generateUniqueHash([]string{userID, "deletion"}, 24)
+	if err != nil {
+		return nil, errors.New("deletion job: error generating id")
+	}
+
+	steps := make([]*DeletionStep, len(deletionSteps))
+	for i, name := range deletionSteps {
+		steps[i] = &DeletionStep{Name: name, State: DELETION_STEP_STATE_PENDING}
+	}
+
+	return &DeletionJob{
+		ID:            id,
+		UserID:        userID,
+		State:         DELETION_JOB_STATE_PENDING,
+		Steps:         steps,
+		Request:       request,
+		CreatedTime:   now.UTC().Format(TimestampFormat),
+		ScheduledTime: scheduled.UTC().Format(TimestampFormat),
+	}, nil
+}
+
+// addMissingSteps adds the pending steps added to deletionSteps since the job was created, keeping
+// the steps in the order of deletionSteps
+func (j *DeletionJob) addMissingSteps() {
+	steps := map[string]*DeletionStep{}
+	for _, step := range j.Steps {
+		steps[step.Name] = step
+	}
+
+	j.Steps = make([]*DeletionStep, len(deletionSteps))
+	for i, name := range deletionSteps {
+		if step, ok := steps[name]; ok {
+			j.Steps[i] = step
+		} else {
+			j.Steps[i] = &DeletionStep{Name: name, State: DELETION_STEP_STATE_PENDING}
+		}
+	}
+}
+
+func (j *DeletionJob) IsPending() bool {
+	return j.State == DELETION_JOB_STATE_PENDING
+}
+
+// Cancel stops a pending deletion job from running, for example when its user is restored
+func (j *DeletionJob) Cancel(now time.Time) {
+	j.State = DELETION_JOB_STATE_CANCELLED
+	j.ModifiedTime = now.UTC().Format(TimestampFormat)
+}
+
+// DeletionGracePeriod returns how long a deleted user may be restored before it is purged
+func (c ApiConfig) DeletionGracePeriod() time.Duration {
+	days := c.DeletionGracePeriodDays
+	if days <= 0 {
+		days = defaultDeletionGracePeriodDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DeletionPurgeInterval returns how often the purge worker runs
+func (c ApiConfig) DeletionPurgeInterval() time.Duration {
+	minutes := c.DeletionPurgeIntervalMinutes
+	if minutes <= 0 {
+		minutes = defaultDeletionPurgeIntervalMinutes
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// MaxDeletionAttempts returns how many times a deletion step is attempted before its job is marked failed
+func (c ApiConfig) MaxDeletionAttempts() int {
+	if c.DeletionMaxAttempts <= 0 {
+		return defaultDeletionMaxAttempts
+	}
+	return c.DeletionMaxAttempts
+}
+
+// scheduleDeletionJob ensures a pending deletion job exists for a deleted user. A request with
+// a reason, such as an erasure request handled by support, replaces that of a pending job.
+func (a *Api) scheduleDeletionJob(store Storage, user *User, request *DeletionRequest, now time.Time) (*DeletionJob, error) {
+	jobs, err := store.FindDeletionJobsForUser(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.IsPending() {
+			if request == nil || request.Reason == "" {
+				return job, nil
+			}
+			job.Request = request
+			job.ModifiedTime = now.UTC().Format(TimestampFormat)
+			return job, store.UpsertDeletionJob(job)
+		}
+	}
+
+	deletedTime, err := time.Parse(TimestampFormat, user.DeletedTime)
+	if err != nil {
+		deletedTime = now
+	}
+
+	job, err := NewDeletionJob(user.Id, request, deletedTime.Add(a.ApiConfig.DeletionGracePeriod()), now)
+	if err != nil {
+		return nil, err
+	}
+	return job, store.UpsertDeletionJob(job)
+}
+
+// cancelDeletionJobs cancels every pending deletion job for a restored user
+func (a *Api) cancelDeletionJobs(store Storage, userID string, now time.Time) error {
+	jobs, err := store.FindDeletionJobsForUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.IsPending() {
+			job.Cancel(now)
+			if err := store.UpsertDeletionJob(job); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeDeletedUsers runs every pending deletion job whose grace period has expired. Steps that
+// fail are retried on the next run until MaxDeletionAttempts is reached, when the job is marked failed.
+// Every instance runs the purge worker, so each job is claimed with a lease before it is run, and is
+// run by one instance at a time; a job whose run stopped before releasing it is claimed again once its
+// lease expires.
+func (a *Api) PurgeDeletedUsers(ctx context.Context) error {
+	store := a.Store.WithContext(ctx)
+	now := time.Now()
+
+	leaseOwner, err := generateUniqueHash([]string{"deletion", now.String()}, 24)
+	if err != nil {
+		return errors.New("deletion job: error generating lease owner")
+	}
+
+	for {
+		job, err := store.ClaimDeletionJobDue(now, leaseOwner, time.Now().Add(deletionJobLeaseDuration))
+		if err != nil {
+			return err
+		} else if job == nil {
+			return nil
+		}
+
+		a.runDeletionJob(store, job, now)
+		if err := store.ReleaseDeletionJob(job, leaseOwner); err != nil {
+			a.logger.Printf("Error updating deletion job %s for user %s: %s", job.ID, job.UserID, err)
+		} else {
+			a.logger.Printf("Deletion job %s for user %s is %s", job.ID, job.UserID, job.State)
+		}
+	}
+}
+
+func (a *Api) runDeletionJob(store Storage, job *DeletionJob, now time.Time) {
+	timestamp := now.UTC().Format(TimestampFormat)
+	job.ModifiedTime = timestamp
+
+	user, err := store.FindUser(&User{Id: job.UserID})
+	if err != nil {
+		a.logger.Printf("Error finding user %s for deletion job %s: %s", job.UserID, job.ID, err)
+		return
+	}
+	if user != nil && !user.IsDeleted() {
+		// The user was restored without the job being cancelled
+		job.Cancel(now)
+		return
+	}
+
+	job.addMissingSteps()
+	for _, step := range job.Steps {
+		if step.State == DELETION_STEP_STATE_COMPLETED {
+			continue
+		}
+
+		step.Attempts++
+		if err := a.runDeletionStep(store, step.Name, job.UserID, user, now); err != nil {
+			a.logger.Printf("Error running deletion step %s for user %s: %s", step.Name, job.UserID, err)
+			step.LastError = err.Error()
+			if step.Attempts >= a.ApiConfig.MaxDeletionAttempts() {
+				step.State = DELETION_STEP_STATE_FAILED
+				job.State = DELETION_JOB_STATE_FAILED
+			}
+			return
+		}
+
+		step.State = DELETION_STEP_STATE_COMPLETED
+		step.LastError = ""
+		step.CompletedTime = timestamp
+	}
+
+	job.State = DELETION_JOB_STATE_COMPLETED
+	job.CompletedTime = timestamp
+}
+
+func (a *Api) runDeletionStep(store Storage, name string, userID string, user *User, now time.Time) error {
+	switch name {
+	case DELETION_STEP_REVOKE_TOKENS:
+		return store.RemoveTokensForUser(userID)
+	case DELETION_STEP_CLEAR_PERMISSIONS:
+		return a.clearPermissions(userID)
+	case DELETION_STEP_REMOVE_MARKETO_LEAD:
+		if user == nil || a.marketoManager == nil {
+			return nil
+		} else if !a.marketoManager.IsAvailable() {
+			return errors.New("marketo is not available")
+		}
+		return a.marketoManager.RemoveListMembershipForUser(user)
+	case DELETION_STEP_PURGE_RECORDS:
+		return a.purgeRecords(store, userID, user)
+	case DELETION_STEP_PURGE_USER:
+		if user == nil || user.PurgedTime != "" {
+			return nil
+		}
+		return a.purgeUser(store, user, now)
+	}
+	return errors.New("unknown deletion step " + name)
+}
+
+// clearPermissions removes every permission other users hold on the user's data, such as
+// custodians and shares. Gatekeeper keeps the user's own root permission with the data it guards.
+// Gatekeeper cannot list the accounts a user holds permissions on, so the permissions the deleted
+// user holds on other users' data are not removed. They cannot be used once its tokens are revoked,
+// but remain listed for those users until they remove them.
+func (a *Api) clearPermissions(userID string) error {
+	if a.perms == nil {
+		return errors.New("gatekeeper is not attached")
+	}
+
+	usersPermissions, err := a.perms.UsersInGroup(userID)
+	if err != nil {
+		return err
+	}
+	for otherUserID := range usersPermissions {
+		if otherUserID != userID {
+			if _, err := a.perms.SetPermissions(otherUserID, userID, clients.Permissions{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeRecords removes the records kept for the user other than the user itself: its confirmations,
+// which hold its emails, its consent records and the invitations to its emails. Its audit events are
+// kept, without the IP, user agent and details that may identify it. The user is purged after its
+// records, as its emails are needed to find them; if it is already removed only those recorded by
+// user id are purged.
+func (a *Api) purgeRecords(store Storage, userID string, user *User) error {
+	emails := []string{}
+	if user != nil {
+		for _, email := range append(append([]string{user.Username, user.PendingEmail}, user.Emails...), user.IdentityKeys()...) {
+			if email != "" && !containsString(emails, email) {
+				emails = append(emails, email)
+			}
+		}
+	}
+
+	if err := store.RemoveConfirmationsForUser(userID); err != nil {
+		return err
+	} else if err := store.RemoveConsentRecords(userID); err != nil {
+		return err
+	} else if err := store.RemoveSignupCodesForEmails(emails); err != nil {
+		return err
+	}
+	return store.AnonymizeAuditEvents(userID, emails)
+}
+
+func (a *Api) purgeUser(store Storage, user *User, now time.Time) error {
+	if a.ApiConfig.DeletionPurgeMode == DELETION_PURGE_MODE_ANONYMIZE {
+		return store.UpsertUser(user.Anonymized(now))
+	}
+	return store.RemoveUser(user)
+}
+
+// RunDeletionPurger purges deleted users every DeletionPurgeInterval until the context is done
+func (a *Api) RunDeletionPurger(ctx context.Context) {
+	ticker := time.NewTicker(a.ApiConfig.DeletionPurgeInterval())
+	defer ticker.Stop()
+
+	for {
+		if err := a.PurgeDeletedUsers(ctx); err != nil {
+			a.logger.Printf("Error purging deleted users: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+func Test_ApiConfig_DeletionGracePeriod_Default(t *testing.T) {
+	if gracePeriod := (ApiConfig{}).DeletionGracePeriod(); gracePeriod != 30*24*time.Hour {
+		t.Fatalf("Unexpected default deletion grace period: %v", gracePeriod)
+	}
+}
+
+func Test_ApiConfig_DeletionGracePeriod_Configured(t *testing.T) {
+	if gracePeriod := (ApiConfig{DeletionGracePeriodDays: 7}).DeletionGracePeriod(); gracePeriod != 7*24*time.Hour {
+		t.Fatalf("Unexpected deletion grace period: %v", gracePeriod)
+	}
+}
+
+func Test_ApiConfig_MaxDeletionAttempts_Default(t *testing.T) {
+	if attempts := (ApiConfig{}).MaxDeletionAttempts(); attempts != 5 {
+		t.Fatalf("Unexpected default max deletion attempts: %d", attempts)
+	}
+}
+
+func Test_NewDeletionJob(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	job, err := NewDeletionJob("1111111111", &DeletionRequest{Requester: "1111111111", ActorUserID: "1111111111"}, now.Add(time.Hour), now)
+	if err != nil {
+		t.Fatalf("Unexpected error from NewDeletionJob: %#v", err)
+	}
+	if job.ID == "" || job.UserID != "1111111111" || !job.IsPending() {
+		t.Fatalf("Unexpected deletion job: %#v", job)
+	}
+	if job.CreatedTime != "2020-01-01T00:00:00+00:00" || job.ScheduledTime != "2020-01-01T01:00:00+00:00" {
+		t.Fatalf("Unexpected deletion job times: %#v", job)
+	}
+	if job.Request == nil || job.Request.Requester != "1111111111" {
+		t.Fatalf("Unexpected deletion job request: %#v", job.Request)
+	}
+	if len(job.Steps) != len(deletionSteps) {
+		t.Fatalf("Unexpected deletion job steps: %#v", job.Steps)
+	}
+}
+
+func Test_DeletionJob_AddMissingSteps(t *testing.T) {
+	job := &DeletionJob{Steps: []*DeletionStep{
+		{Name: DELETION_STEP_REVOKE_TOKENS, State: DELETION_STEP_STATE_COMPLETED},
+		{Name: DELETION_STEP_CLEAR_PERMISSIONS, State: DELETION_STEP_STATE_COMPLETED},
+		{Name: DELETION_STEP_REMOVE_MARKETO_LEAD, State: DELETION_STEP_STATE_COMPLETED},
+		{Name: DELETION_STEP_PURGE_USER, State: DELETION_STEP_STATE_PENDING, Attempts: 1},
+	}}
+	job.addMissingSteps()
+	if len(job.Steps) != len(deletionSteps) || job.Steps[3].Name != DELETION_STEP_PURGE_RECORDS || job.Steps[3].State != DELETION_STEP_STATE_PENDING ||
+		job.Steps[4].Name != DELETION_STEP_PURGE_USER || job.Steps[4].Attempts != 1 || job.Steps[0].State != DELETION_STEP_STATE_COMPLETED {
+		t.Fatalf("Unexpected deletion job steps: %#v", job.Steps)
+	}
+}
+
+func Test_NewDeletionJob_MissingUserID(t *testing.T) {
+	if _, err := NewDeletionJob("", nil, time.Now(), time.Now()); err == nil {
+		t.Fatalf("Expected error from NewDeletionJob")
+	}
+}
+
+type availableMarketoManager struct {
+	MockManager
+}
+
+func (m *availableMarketoManager) IsAvailable() bool {
+	return true
+}
+
+func newDeletionTestApi() *Api {
+	api := InitShoreline(fakeConfig, responsableStore, mockMetrics, responsableGatekeeper)
+	api.marketoManager = &availableMarketoManager{}
+	return api
+}
+
+func newTestDeletionJob(t *testing.T) *DeletionJob {
+	job, err := NewDeletionJob("1111111111", nil, time.Now(), time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error from NewDeletionJob: %#v", err)
+	}
+	return job
+}
+
+func Test_PurgeDeletedUsers_Error_ClaimDeletionJobDueError(t *testing.T) {
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{nil, errors.New("ERROR")}}
+	defer expectResponsablesEmpty(t)
+
+	if err := responsableShoreline.PurgeDeletedUsers(context.Background()); err == nil {
+		t.Fatalf("Expected error from PurgeDeletedUsers")
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_Remove(t *testing.T) {
+	api := newDeletionTestApi()
+	job := newTestDeletionJob(t)
+	deleted := &User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{deleted, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"1111111111": {"root": clients.Allowed}, "2222222222": {"custodian": clients.Allowed}}, nil}}
+	responsableGatekeeper.SetPermissionsResponses = []PermissionsResponse{{clients.Permissions{}, nil}}
+	responsableStore.RemoveConfirmationsForUserResponses = []error{nil}
+	responsableStore.RemoveConsentRecordsResponses = []error{nil}
+	responsableStore.RemoveSignupCodesForEmailsResponses = []error{nil}
+	responsableStore.AnonymizeAuditEventsResponses = []error{nil}
+	responsableStore.RemoveUserResponses = []error{nil}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := api.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if job.State != DELETION_JOB_STATE_COMPLETED || job.CompletedTime == "" {
+		t.Fatalf("Deletion job was not completed: %#v", job)
+	}
+	for _, step := range job.Steps {
+		if step.State != DELETION_STEP_STATE_COMPLETED || step.Attempts != 1 {
+			t.Fatalf("Deletion step was not completed: %#v", step)
+		}
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_Anonymize(t *testing.T) {
+	api := newDeletionTestApi()
+	api.ApiConfig.DeletionPurgeMode = DELETION_PURGE_MODE_ANONYMIZE
+	job := newTestDeletionJob(t)
+	deleted := &User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{deleted, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, nil}}
+	responsableStore.RemoveConfirmationsForUserResponses = []error{nil}
+	responsableStore.RemoveConsentRecordsResponses = []error{nil}
+	responsableStore.RemoveSignupCodesForEmailsResponses = []error{nil}
+	responsableStore.AnonymizeAuditEventsResponses = []error{nil}
+	responsableStore.UpsertUserResponses = []error{nil}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := api.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if job.State != DELETION_JOB_STATE_COMPLETED {
+		t.Fatalf("Deletion job was not completed: %#v", job)
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_RetriesFailedStep(t *testing.T) {
+	api := newDeletionTestApi()
+	job := newTestDeletionJob(t)
+	deleted := &User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}, {job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{deleted, nil}, {deleted, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{nil, errors.New("ERROR")}, {clients.UsersPermissions{}, nil}}
+	responsableStore.RemoveConfirmationsForUserResponses = []error{nil}
+	responsableStore.RemoveConsentRecordsResponses = []error{nil}
+	responsableStore.RemoveSignupCodesForEmailsResponses = []error{nil}
+	responsableStore.AnonymizeAuditEventsResponses = []error{nil}
+	responsableStore.RemoveUserResponses = []error{nil}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil, nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := api.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if !job.IsPending() || job.Steps[1].State != DELETION_STEP_STATE_PENDING || job.Steps[1].LastError != "ERROR" {
+		t.Fatalf("Deletion job did not record the failed step: %#v", job.Steps[1])
+	}
+
+	if err := api.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if job.State != DELETION_JOB_STATE_COMPLETED || job.Steps[0].Attempts != 1 || job.Steps[1].Attempts != 2 || job.Steps[1].LastError != "" {
+		t.Fatalf("Deletion job was not completed on retry: %#v", job)
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_FailsAfterMaxAttempts(t *testing.T) {
+	api := InitShoreline(fakeConfig, responsableStore, mockMetrics, responsableGatekeeper)
+	api.ApiConfig.DeletionMaxAttempts = 1
+	job := newTestDeletionJob(t)
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", DeletedTime: "2016-01-01T01:23:45+00:00"}, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{errors.New("ERROR")}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := api.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if job.State != DELETION_JOB_STATE_FAILED || job.Steps[0].State != DELETION_STEP_STATE_FAILED {
+		t.Fatalf("Deletion job was not failed: %#v", job)
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_CancelsRestoredUser(t *testing.T) {
+	job := newTestDeletionJob(t)
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111"}, nil}}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := responsableShoreline.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if job.State != DELETION_JOB_STATE_CANCELLED {
+		t.Fatalf("Deletion job was not cancelled: %#v", job)
+	}
+}
+
+func Test_PurgeDeletedUsers_Success_RetriesUnavailableMarketo(t *testing.T) {
+	job := newTestDeletionJob(t)
+	responsableStore.ClaimDeletionJobDueResponses = []ClaimDeletionJobResponse{{job, nil}, {nil, nil}}
+	responsableStore.FindUserResponses = []FindUserResponse{{&User{Id: "1111111111", Username: "a@z.co", DeletedTime: "2016-01-01T01:23:45+00:00"}, nil}}
+	responsableStore.RemoveTokensForUserResponses = []error{nil}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{}, nil}}
+	responsableStore.ReleaseDeletionJobResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	if err := responsableShoreline.PurgeDeletedUsers(context.Background()); err != nil {
+		t.Fatalf("Unexpected error from PurgeDeletedUsers: %#v", err)
+	}
+	if !job.IsPending() || job.Steps[2].State != DELETION_STEP_STATE_PENDING || job.Steps[2].LastError == "" {
+		t.Fatalf("Deletion job did not record the failed step: %#v", job.Steps[2])
+	}
+}
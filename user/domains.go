@@ -0,0 +1,202 @@
+package user
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	SIGNUP_RULE_REJECT = "reject" // signups with the role from a free mail domain are rejected
+	SIGNUP_RULE_REVIEW = "review" // signups with the role from a free mail domain are created without it, pending review
+)
+
+// DomainPolicy configures which email domains may sign up
+type DomainPolicy struct {
+	AllowedDomains        []string         `json:"allowedDomains"`        // if given, only these domains and their subdomains may sign up
+	BlockedDomains        []string         `json:"blockedDomains"`        // these domains and their subdomains may not sign up
+	BlockDisposable       bool             `json:"blockDisposable"`       // whether disposable email domains may not sign up
+	DisposableDomainsFile string           `json:"disposableDomainsFile"` // a file of disposable domains, one per line, in addition to the bundled ones
+	FreeMailDomains       []string         `json:"freeMailDomains"`       // the free mail domains of role rules, defaults to the bundled ones
+	RoleRules             []DomainRoleRule `json:"roleRules"`
+
+	disposableDomains []string // the domains loaded from DisposableDomainsFile
+}
+
+// DomainRoleRule configures what happens to signups with a role from a free mail domain
+type DomainRoleRule struct {
+	Role     string `json:"role"`
+	FreeMail string `json:"freeMail"` // one of "reject" or "review"
+}
+
+// DomainCheck is the result of checking the emails of a signup against the policy
+type DomainCheck struct {
+	Status      string   // the status of the error response if the signup is rejected, otherwise empty
+	Domain      string   // the domain the signup is rejected or reviewed for
+	ReviewRoles []string // the requested roles withheld pending review
+}
+
+var (
+	DomainPolicy_error_domain_invalid = errors.New("Signup domain policy has an invalid domain")
+	DomainPolicy_error_role_unknown   = errors.New("Signup domain policy has an unknown role")
+	DomainPolicy_error_rule_invalid   = errors.New("Signup domain policy rule must reject or review")
+)
+
+// bundledDisposableDomains are well-known domains of disposable email services
+var bundledDisposableDomains = []string{
+	"10minutemail.com", "33mail.com", "discard.email", "dispostable.com", "fakeinbox.com", "getairmail.com",
+	"getnada.com", "guerrillamail.com", "guerrillamail.net", "guerrillamailblock.com", "harakirimail.com",
+	"mailcatch.com", "maildrop.cc", "mailinator.com", "mailnesia.com", "mintemail.com", "mohmal.com",
+	"mytemp.email", "sharklasers.com", "spamgourmet.com", "temp-mail.org", "tempail.com", "tempmail.com",
+	"tempmailo.com", "tempr.email", "throwawaymail.com", "trashmail.com", "yopmail.com", "emailondeck.com",
+}
+
+// bundledFreeMailDomains are well-known domains of free email services
+var bundledFreeMailDomains = []string{
+	"aol.com", "gmail.com", "googlemail.com", "gmx.com", "gmx.de", "hotmail.com", "icloud.com", "live.com",
+	"mail.com", "mail.ru", "me.com", "msn.com", "outlook.com", "proton.me", "protonmail.com", "qq.com",
+	"yahoo.com", "yandex.ru", "zoho.com",
+}
+
+// Validate checks that the domains are valid, that the rules' roles are defined and that they
+// reject or review
+func (p DomainPolicy) Validate(registry RoleRegistry) error {
+	for _, domain := range append(append(append([]string{}, p.AllowedDomains...), p.BlockedDomains...), p.FreeMailDomains...) {
+		if !IsValidEmail("a@" + domain) {
+			return DomainPolicy_error_domain_invalid
+		}
+	}
+	for _, rule := range p.RoleRules {
+		if !registry.IsValid(rule.Role) {
+			return DomainPolicy_error_role_unknown
+		} else if rule.FreeMail != SIGNUP_RULE_REJECT && rule.FreeMail != SIGNUP_RULE_REVIEW {
+			return DomainPolicy_error_rule_invalid
+		}
+	}
+	return nil
+}
+
+// LoadDisposableDomains reads the disposable domains file, if any, ignoring empty lines and those
+// starting with #, so the bundled domains can be extended without a release
+func (p *DomainPolicy) LoadDisposableDomains() error {
+	if p.DisposableDomainsFile == "" {
+		return nil
+	}
+	file, err := os.Open(p.DisposableDomainsFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	domains := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	p.disposableDomains = domains
+	return nil
+}
+
+// IsDisposable returns whether the domain of the email is a disposable email domain
+func (p DomainPolicy) IsDisposable(email string) bool {
+	domain := emailDomain(email)
+	return matchesDomain(domain, bundledDisposableDomains) || matchesDomain(domain, p.disposableDomains)
+}
+
+// IsFreeMail returns whether the domain of the email is a free mail domain
+func (p DomainPolicy) IsFreeMail(email string) bool {
+	freeMailDomains := p.FreeMailDomains
+	if len(freeMailDomains) == 0 {
+		freeMailDomains = bundledFreeMailDomains
+	}
+	return matchesDomain(emailDomain(email), freeMailDomains)
+}
+
+// Check checks the emails of a signup requesting the roles against the policy
+func (p DomainPolicy) Check(emails []string, roles []string) *DomainCheck {
+	check := &DomainCheck{}
+	for _, email := range emails {
+		domain := emailDomain(email)
+		if len(p.AllowedDomains) > 0 && !matchesDomain(domain, p.AllowedDomains) {
+			return &DomainCheck{Status: STATUS_DOMAIN_NOT_ALLOWED, Domain: domain}
+		} else if matchesDomain(domain, p.BlockedDomains) {
+			return &DomainCheck{Status: STATUS_DOMAIN_NOT_ALLOWED, Domain: domain}
+		} else if p.BlockDisposable && p.IsDisposable(email) {
+			return &DomainCheck{Status: STATUS_DISPOSABLE_EMAIL, Domain: domain}
+		}
+
+		if !p.IsFreeMail(email) {
+			continue
+		}
+		for _, rule := range p.RoleRules {
+			if !containsString(roles, rule.Role) {
+				continue
+			} else if rule.FreeMail == SIGNUP_RULE_REJECT {
+				return &DomainCheck{Status: STATUS_DOMAIN_NOT_FOR_ROLE, Domain: domain}
+			} else if !containsString(check.ReviewRoles, rule.Role) {
+				check.Domain = domain
+				check.ReviewRoles = append(check.ReviewRoles, rule.Role)
+			}
+		}
+	}
+	return check
+}
+
+// checkEmailDomains checks the emails given to a user, other than those it already has, against the
+// signup domain policy, so that the policy is not bypassed by changing emails after signing up. Role
+// rules that review only apply to signups, so only those that reject are enforced. If an email is
+// rejected an error response is sent and false is returned.
+func (a *Api) checkEmailDomains(res http.ResponseWriter, user *User, emails []string, roles []string) bool {
+	newEmails := []string{}
+	for _, email := range emails {
+		if email != "" && !user.HasEmail(email) {
+			newEmails = append(newEmails, email)
+		}
+	}
+	if check := a.ApiConfig.SignupDomains.Check(newEmails, roles); check.Status != "" {
+		a.sendError(res, http.StatusForbidden, check.Status, check.Domain)
+		return false
+	}
+	return true
+}
+
+// removeStrings returns the values other than those to remove, or nil if there are none
+func removeStrings(values []string, remove []string) []string {
+	var remaining []string
+	for _, value := range values {
+		if !containsString(remove, value) {
+			remaining = append(remaining, value)
+		}
+	}
+	return remaining
+}
+
+// emailDomain returns the canonical domain of an email
+func emailDomain(email string) string {
+	if _, domain, ok := splitEmail(CanonicalEmail(email)); ok {
+		return domain
+	}
+	return ""
+}
+
+// matchesDomain returns whether the canonical domain is one of the domains or a subdomain of one
+func matchesDomain(domain string, domains []string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, candidate := range domains {
+		if candidate = emailDomain("a@" + candidate); candidate == "" {
+			continue
+		} else if domain == candidate || strings.HasSuffix(domain, "."+candidate) {
+			return true
+		}
+	}
+	return false
+}
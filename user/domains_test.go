@@ -0,0 +1,106 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_DomainPolicy_Validate(t *testing.T) {
+	for _, test := range []struct {
+		policy DomainPolicy
+		err    error
+	}{
+		{DomainPolicy{}, nil},
+		{DomainPolicy{AllowedDomains: []string{"z.co", "bücher.de"}, BlockedDomains: []string{"xn--bcher-kva.de"}, RoleRules: []DomainRoleRule{{"clinic", SIGNUP_RULE_REVIEW}}}, nil},
+		{DomainPolicy{BlockedDomains: []string{"z"}}, DomainPolicy_error_domain_invalid},
+		{DomainPolicy{FreeMailDomains: []string{"a@z.co"}}, DomainPolicy_error_domain_invalid},
+		{DomainPolicy{RoleRules: []DomainRoleRule{{"unknown", SIGNUP_RULE_REJECT}}}, DomainPolicy_error_role_unknown},
+		{DomainPolicy{RoleRules: []DomainRoleRule{{"clinic", "allow"}}}, DomainPolicy_error_rule_invalid},
+	} {
+		if err := test.policy.Validate(DefaultRoleRegistry()); err != test.err {
+			t.Fatalf("Unexpected error for %v: %v", test.policy, err)
+		}
+	}
+}
+
+func Test_DomainPolicy_Check_Domains(t *testing.T) {
+	policy := DomainPolicy{AllowedDomains: []string{"z.co", "bücher.de"}, BlockedDomains: []string{"blocked.z.co"}}
+	for _, test := range []struct {
+		emails []string
+		status string
+		domain string
+	}{
+		{[]string{"a@z.co", "a@Mail.Z.CO"}, "", ""},
+		{[]string{"a@xn--bcher-kva.de"}, "", ""},
+		{[]string{"a@z.co", "a@y.co"}, STATUS_DOMAIN_NOT_ALLOWED, "y.co"},
+		{[]string{"a@notz.co"}, STATUS_DOMAIN_NOT_ALLOWED, "notz.co"},
+		{[]string{"a@sub.blocked.z.co"}, STATUS_DOMAIN_NOT_ALLOWED, "sub.blocked.z.co"},
+	} {
+		if check := policy.Check(test.emails, nil); check.Status != test.status || check.Domain != test.domain {
+			t.Fatalf("Unexpected check for %v: %#v", test.emails, check)
+		}
+	}
+}
+
+func Test_DomainPolicy_Check_Disposable(t *testing.T) {
+	if check := (DomainPolicy{}).Check([]string{"a@mailinator.com"}, nil); check.Status != "" {
+		t.Fatalf("Unexpected check without blocking disposable domains: %#v", check)
+	}
+	if check := (DomainPolicy{BlockDisposable: true}).Check([]string{"a@z.co", "a@eu.Mailinator.com"}, nil); check.Status != STATUS_DISPOSABLE_EMAIL || check.Domain != "eu.mailinator.com" {
+		t.Fatalf("Unexpected check of disposable domain: %#v", check)
+	}
+}
+
+func Test_DomainPolicy_Check_RoleRules(t *testing.T) {
+	policy := DomainPolicy{RoleRules: []DomainRoleRule{{"clinic", SIGNUP_RULE_REVIEW}}}
+	if check := policy.Check([]string{"a@z.co"}, []string{"clinic"}); check.Status != "" || check.ReviewRoles != nil {
+		t.Fatalf("Unexpected check of clinic domain: %#v", check)
+	}
+	if check := policy.Check([]string{"a@gmail.com"}, nil); check.Status != "" || check.ReviewRoles != nil {
+		t.Fatalf("Unexpected check of free mail without roles: %#v", check)
+	}
+	if check := policy.Check([]string{"a@gmail.com"}, []string{"clinic"}); check.Status != "" || check.Domain != "gmail.com" || !reflect.DeepEqual(check.ReviewRoles, []string{"clinic"}) {
+		t.Fatalf("Unexpected check of reviewed free mail: %#v", check)
+	}
+
+	policy = DomainPolicy{FreeMailDomains: []string{"y.co"}, RoleRules: []DomainRoleRule{{"clinic", SIGNUP_RULE_REJECT}}}
+	if check := policy.Check([]string{"a@gmail.com"}, []string{"clinic"}); check.Status != "" {
+		t.Fatalf("Unexpected check of unconfigured free mail: %#v", check)
+	}
+	if check := policy.Check([]string{"a@z.co", "a@y.co"}, []string{"clinic"}); check.Status != STATUS_DOMAIN_NOT_FOR_ROLE || check.Domain != "y.co" {
+		t.Fatalf("Unexpected check of rejected free mail: %#v", check)
+	}
+}
+
+func Test_DomainPolicy_LoadDisposableDomains(t *testing.T) {
+	file, err := ioutil.TempFile("", "disposable")
+	if err != nil {
+		t.Fatalf("Unexpected error creating file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# Disposable domains\n\nthrowaway.co\n  burner.co  \n")
+	file.Close()
+
+	policy := &DomainPolicy{BlockDisposable: true, DisposableDomainsFile: file.Name()}
+	if err := policy.LoadDisposableDomains(); err != nil {
+		t.Fatalf("Unexpected error loading disposable domains: %v", err)
+	}
+	if !policy.IsDisposable("a@throwaway.co") || !policy.IsDisposable("a@burner.co") || !policy.IsDisposable("a@yopmail.com") || policy.IsDisposable("a@z.co") {
+		t.Fatalf("Unexpected disposable domains: %v", policy.disposableDomains)
+	}
+
+	policy = &DomainPolicy{DisposableDomainsFile: file.Name() + ".missing"}
+	if err := policy.LoadDisposableDomains(); err == nil {
+		t.Fatalf("Expected error loading missing disposable domains")
+	}
+}
+
+func Test_User_WithholdRoles(t *testing.T) {
+	user := &User{Roles: []string{"clinic", "other"}, ReviewRoles: []string{"clinic"}}
+	user.WithholdRoles([]string{"clinic"})
+	if !reflect.DeepEqual(user.Roles, []string{"other"}) || !reflect.DeepEqual(user.ReviewRoles, []string{"clinic"}) {
+		t.Fatalf("Unexpected roles: %v, review roles: %v", user.Roles, user.ReviewRoles)
+	}
+}
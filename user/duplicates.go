@@ -0,0 +1,138 @@
+package user
+
+import (
+	"net/http"
+	"sort"
+)
+
+// DuplicateEmail is a username or email shared by more than one user
+type DuplicateEmail struct {
+	Email   string   `bson:"_id"`
+	UserIDs []string `bson:"userIds"`
+}
+
+// DuplicateAccount describes a user sharing a username or email, with what decides which user survives
+type DuplicateAccount struct {
+	UserID         string   `json:"userid"`
+	Username       string   `json:"username,omitempty"`
+	Emails         []string `json:"emails,omitempty"`
+	Roles          []string `json:"roles,omitempty"`
+	Verified       bool     `json:"verified"`
+	PasswordExists bool     `json:"passwordExists"`
+	CreatedTime    string   `json:"createdTime,omitempty"`
+	DeletedTime    string   `json:"deletedTime,omitempty"`
+	SuspendedTime  string   `json:"suspendedTime,omitempty"`
+}
+
+// DuplicateReport lists the users sharing an email, ordered from the suggested survivor, which the
+// others can be merged into with POST /user/{userid}/merge
+type DuplicateReport struct {
+	Email          string              `json:"email"`
+	SurvivorUserID string              `json:"survivorUserId"`
+	Users          []*DuplicateAccount `json:"users"`
+}
+
+// SortDuplicateUsers orders users sharing the email from the one that should survive a merge: users
+// that are not deleted, then not suspended, then with a password, then that verified the email, then
+// the earliest created. Users created before created times were recorded are the earliest.
+func SortDuplicateUsers(email string, users []*User) {
+	sort.SliceStable(users, func(i, j int) bool {
+		left, right := users[i], users[j]
+		if left.IsDeleted() != right.IsDeleted() {
+			return !left.IsDeleted()
+		} else if left.IsSuspended() != right.IsSuspended() {
+			return !left.IsSuspended()
+		} else if (left.PwHash != "") != (right.PwHash != "") {
+			return left.PwHash != ""
+		} else if left.HasVerifiedEmail(email) != right.HasVerifiedEmail(email) {
+			return left.HasVerifiedEmail(email)
+		} else if left.CreatedTime != right.CreatedTime {
+			return left.CreatedTime < right.CreatedTime
+		}
+		return left.Id < right.Id
+	})
+}
+
+// NewDuplicateReport returns the report of users sharing the email, which are sorted by SortDuplicateUsers
+func NewDuplicateReport(email string, users []*User) *DuplicateReport {
+	SortDuplicateUsers(email, users)
+	report := &DuplicateReport{Email: email, Users: []*DuplicateAccount{}}
+	for _, user := range users {
+		report.Users = append(report.Users, &DuplicateAccount{
+			UserID:         user.Id,
+			Username:       user.Username,
+			Emails:         user.Emails,
+			Roles:          user.Roles,
+			Verified:       user.HasVerifiedEmail(email),
+			PasswordExists: user.PwHash != "",
+			CreatedTime:    user.CreatedTime,
+			DeletedTime:    user.DeletedTime,
+			SuspendedTime:  user.SuspendedTime,
+		})
+	}
+	if len(users) > 0 {
+		report.SurvivorUserID = users[0].Id
+	}
+	return report
+}
+
+// GetDuplicateUsers reports the usernames and emails shared by more than one user, which make
+// logins with them fail, along with the users sharing them and the suggested survivor of a merge
+// status: 200 []DuplicateReport
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_USR
+func (a *Api) GetDuplicateUsers(res http.ResponseWriter, req *http.Request) {
+	if reports, err := a.findDuplicateReports(a.Store.WithContext(req.Context())); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else {
+		sendModelAsRes(res, reports)
+	}
+}
+
+// findDuplicateReports returns the reports of the usernames and emails shared by more than one user
+func (a *Api) findDuplicateReports(store Storage) ([]*DuplicateReport, error) {
+	duplicates, err := store.FindDuplicateEmails()
+	if err != nil {
+		return nil, err
+	}
+	usersByID, err := a.findDuplicateUsers(store, duplicates)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []*DuplicateReport{}
+	for _, duplicate := range duplicates {
+		users := []*User{}
+		for _, userID := range duplicate.UserIDs {
+			if user := usersByID[userID]; user != nil {
+				users = append(users, user)
+			}
+		}
+		if len(users) > 1 {
+			reports = append(reports, NewDuplicateReport(duplicate.Email, users))
+		}
+	}
+	return reports, nil
+}
+
+// findDuplicateUsers returns the users sharing the duplicate emails by id
+func (a *Api) findDuplicateUsers(store Storage, duplicates []*DuplicateEmail) (map[string]*User, error) {
+	ids := []string{}
+	for _, duplicate := range duplicates {
+		ids = append(ids, duplicate.UserIDs...)
+	}
+
+	usersByID := map[string]*User{}
+	if len(ids) == 0 {
+		return usersByID, nil
+	}
+	users, err := store.FindUsersWithIds(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		usersByID[user.Id] = user
+	}
+	return usersByID, nil
+}
@@ -0,0 +1,31 @@
+package user
+
+import (
+	"testing"
+)
+
+func Test_SortDuplicateUsers(t *testing.T) {
+	users := []*User{
+		{Id: "1", Username: "a@z.co", PwHash: "hash", DeletedTime: "2016-01-01T00:00:00+00:00"},
+		{Id: "2", Username: "a@z.co", CreatedTime: "2016-01-01T00:00:00+00:00"},
+		{Id: "3", Username: "a@z.co", PwHash: "hash", CreatedTime: "2016-01-02T00:00:00+00:00"},
+		{Id: "4", Username: "a@z.co", PwHash: "hash", EmailVerified: true, CreatedTime: "2016-01-03T00:00:00+00:00"},
+		{Id: "5", Username: "b@z.co", Emails: []string{"b@z.co", "a@z.co"}, PwHash: "hash", CreatedTime: "2016-01-04T00:00:00+00:00"},
+		{Id: "6", Username: "a@z.co", PwHash: "hash", CreatedTime: "2016-01-02T00:00:00+00:00"},
+	}
+	SortDuplicateUsers("a@z.co", users)
+
+	expected := []string{"4", "3", "6", "5", "2", "1"}
+	for index, user := range users {
+		if user.Id != expected[index] {
+			t.Fatalf("Unexpected user %s at %d, expected order %v", user.Id, index, expected)
+		}
+	}
+}
+
+func Test_NewDuplicateReport(t *testing.T) {
+	report := NewDuplicateReport("a@z.co", []*User{{Id: "1", Username: "a@z.co"}, {Id: "2", Username: "b@z.co", Emails: []string{"b@z.co", "a@z.co"}, VerifiedEmails: []string{"a@z.co"}}})
+	if report.SurvivorUserID != "2" || len(report.Users) != 2 || !report.Users[0].Verified || report.Users[1].Verified {
+		t.Fatalf("Unexpected report: %#v", report)
+	}
+}
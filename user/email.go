@@ -0,0 +1,151 @@
+package user
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	emailMaxLength      = 254
+	emailLocalMaxLength = 64
+	domainLabelMaxSize  = 63
+)
+
+// IsValidEmail returns whether the email is a valid address as RFC 6531 allows, with a UTF-8 local part
+// and a domain of Unicode or Punycode labels, the last of which is a name of at least two letters
+func IsValidEmail(email string) bool {
+	local, domain, ok := splitEmail(norm.NFC.String(email))
+	if !ok || len(local) > emailLocalMaxLength {
+		return false
+	}
+	for _, r := range local {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == utf8.RuneError {
+			return false
+		}
+	}
+
+	unicodeDomain, ok := domainToUnicode(domain)
+	if !ok {
+		return false
+	}
+	labels := strings.Split(unicodeDomain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" {
+			return false
+		}
+		for _, r := range label {
+			if r != '-' && !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+				return false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	if utf8.RuneCountInString(tld) < 2 {
+		return false
+	}
+	for _, r := range tld {
+		if !unicode.IsLetter(r) && !unicode.IsMark(r) {
+			return false
+		}
+	}
+
+	asciiDomain, ok := domainToASCII(unicodeDomain)
+	return ok && len(local)+1+len(asciiDomain) <= emailMaxLength
+}
+
+// NormalizeEmail returns the form in which an email is stored: trimmed, in Unicode normalization
+// form C, with its domain in lower case Unicode rather than Punycode
+func NormalizeEmail(email string) string {
+	email = norm.NFC.String(strings.TrimSpace(email))
+	if local, domain, ok := splitEmail(email); ok {
+		if unicodeDomain, ok := domainToUnicode(domain); ok {
+			return local + "@" + unicodeDomain
+		}
+	}
+	return email
+}
+
+// CanonicalEmail returns the form under which emails are compared: normalized, in lower case, with its
+// domain in Punycode, so that the Unicode and Punycode forms of a domain are the same email
+func CanonicalEmail(email string) string {
+	email = strings.ToLower(NormalizeEmail(email))
+	if local, domain, ok := splitEmail(email); ok {
+		if asciiDomain, ok := domainToASCII(domain); ok {
+			return local + "@" + asciiDomain
+		}
+	}
+	return email
+}
+
+// SameEmail returns whether two emails have the same canonical form
+func SameEmail(email string, other string) bool {
+	return CanonicalEmail(email) == CanonicalEmail(other)
+}
+
+// CanonicalEmails returns the distinct canonical forms of the emails, ignoring empty emails
+func CanonicalEmails(emails []string) []string {
+	canonicals := []string{}
+	for _, email := range emails {
+		if canonical := CanonicalEmail(email); canonical != "" && !containsString(canonicals, canonical) {
+			canonicals = append(canonicals, canonical)
+		}
+	}
+	return canonicals
+}
+
+func normalizeEmails(emails []string) []string {
+	if emails == nil {
+		return nil
+	}
+	normalized := make([]string, len(emails))
+	for index, email := range emails {
+		normalized[index] = NormalizeEmail(email)
+	}
+	return normalized
+}
+
+func normalizeEmailPointer(email *string) *string {
+	if email == nil {
+		return nil
+	}
+	normalized := NormalizeEmail(*email)
+	return &normalized
+}
+
+func splitEmail(email string) (string, string, bool) {
+	at := strings.Index(email, "@")
+	if at <= 0 || at == len(email)-1 || strings.Contains(email[at+1:], "@") {
+		return "", "", false
+	}
+	return email[:at], email[at+1:], true
+}
+
+// domainToUnicode returns the lower case Unicode form of a domain, decoding its Punycode labels
+func domainToUnicode(domain string) (string, bool) {
+	unicodeDomain, err := idna.Lookup.ToUnicode(domain)
+	if err != nil {
+		return "", false
+	}
+	return norm.NFC.String(unicodeDomain), true
+}
+
+// domainToASCII returns the Punycode form of a lower case Unicode domain
+func domainToASCII(domain string) (string, bool) {
+	asciiDomain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", false
+	}
+	for _, label := range strings.Split(asciiDomain, ".") {
+		if len(label) > domainLabelMaxSize {
+			return "", false
+		}
+	}
+	return asciiDomain, true
+}
@@ -0,0 +1,61 @@
+package user
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_IsValidEmail_Internationalized(t *testing.T) {
+	validEmails := []string{"ü@bücher.de", "a@xn--bcher-kva.de", "用户@例え.jp", "a@z.рф", "a@z.xn--p1ai", "Ärzte@Bücher.DE"}
+	for _, validEmail := range validEmails {
+		if !IsValidEmail(validEmail) {
+			t.Fatalf("Valid email %s is unexpectedly invalid", validEmail)
+		}
+	}
+	invalidEmails := []string{"a@xn--zz-!.de", "a@bü_cher.de", "a@z.c1", "a b@z.co", strings.Repeat("a", 65) + "@z.co", "a@" + strings.Repeat("ü", 60) + ".de"}
+	for _, invalidEmail := range invalidEmails {
+		if IsValidEmail(invalidEmail) {
+			t.Fatalf("Invalid email %s is unexpectedly valid", invalidEmail)
+		}
+	}
+}
+
+func Test_NormalizeEmail(t *testing.T) {
+	emails := map[string]string{
+		" A@Z.co ":               "A@z.co",
+		"Ärzte@XN--BCHER-KVA.de": "Ärzte@bücher.de",
+		"ü@bücher.de":          "ü@bücher.de",
+		"invalid":                "invalid",
+	}
+	for email, normalized := range emails {
+		if result := NormalizeEmail(email); result != normalized {
+			t.Fatalf("Unexpected normalization of %s: %s", email, result)
+		}
+	}
+}
+
+func Test_CanonicalEmail(t *testing.T) {
+	emails := map[string]string{
+		"A@Z.co":                 "a@z.co",
+		"Ärzte@Bücher.de":        "ärzte@xn--bcher-kva.de",
+		"ärzte@xn--bcher-kva.DE": "ärzte@xn--bcher-kva.de",
+		"ärzte@bücher.de":      "ärzte@xn--bcher-kva.de",
+	}
+	for email, canonical := range emails {
+		if result := CanonicalEmail(email); result != canonical {
+			t.Fatalf("Unexpected canonical form of %s: %s", email, result)
+		}
+	}
+	if !SameEmail("ärzte@bücher.de", "ÄRZTE@xn--bcher-kva.de") || SameEmail("a@bücher.de", "a@bucher.de") {
+		t.Fatalf("Unexpected comparison of emails")
+	}
+}
+
+func Test_NewUserDetails_ExtractFromJSON_NormalizesEmails(t *testing.T) {
+	details := &NewUserDetails{}
+	if err := details.ExtractFromJSON(strings.NewReader(`{"username": " a@XN--BCHER-KVA.de", "emails": ["a@xn--bcher-kva.de"]}`)); err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	} else if *details.Username != "a@bücher.de" || details.Emails[0] != "a@bücher.de" {
+		t.Fatalf("Unexpected emails: %s, %v", *details.Username, details.Emails)
+	}
+}
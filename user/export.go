@@ -0,0 +1,103 @@
+package user
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// UserExport is a machine-readable archive of everything shoreline holds for a user,
+// returned to fulfil data subject access requests
+type UserExport struct {
+	ExportedTime   string           `json:"exportedTime"`
+	User           *User            `json:"user"`
+	PasswordExists bool             `json:"passwordExists"`
+	Private        []string         `json:"private"`
+	Sessions       []*SessionExport `json:"sessions"`
+	DeletionJobs   []*DeletionJob   `json:"deletionJobs"`
+	AuditEvents    []*AuditEvent    `json:"auditEvents"`
+	Consents       []*ConsentRecord `json:"consents"`
+	Marketo        *MarketoExport   `json:"marketo"`
+}
+
+// SessionExport describes an active session without the token itself
+type SessionExport struct {
+	CreatedTime string `json:"createdTime"`
+	ExpiresTime string `json:"expiresTime"`
+}
+
+// MarketoExport describes the state of a user's Marketo lead
+type MarketoExport struct {
+	Enabled bool   `json:"enabled"`
+	Synced  bool   `json:"synced"`
+	LeadID  int    `json:"leadId,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// exportUser gathers the export for a user. The User is serialized with its json tags,
+// which already exclude the password hash, user hash and private id-hash pairs; only
+// the names of the private id-hash pairs are exported.
+func (a *Api) exportUser(store Storage, user *User, now time.Time) (*UserExport, error) {
+	export := &UserExport{
+		ExportedTime:   now.UTC().Format(TimestampFormat),
+		User:           user,
+		PasswordExists: user.PwHash != "",
+		Private:        []string{},
+		Sessions:       []*SessionExport{},
+	}
+
+	for name := range user.Private {
+		export.Private = append(export.Private, name)
+	}
+	sort.Strings(export.Private)
+
+	tokens, err := store.FindTokensForUser(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		if token.IsServer || (!token.ExpiresAt.IsZero() && token.ExpiresAt.Before(now)) {
+			continue
+		}
+		export.Sessions = append(export.Sessions, &SessionExport{
+			CreatedTime: token.CreatedAt.UTC().Format(TimestampFormat),
+			ExpiresTime: token.ExpiresAt.UTC().Format(TimestampFormat),
+		})
+	}
+
+	if export.DeletionJobs, err = store.FindDeletionJobsForUser(user.Id); err != nil {
+		return nil, err
+	}
+
+	if export.AuditEvents, err = store.FindAuditEvents(&AuditQuery{UserID: user.Id}); err != nil {
+		return nil, err
+	}
+
+	if export.Consents, err = store.FindConsentRecords(user.Id); err != nil {
+		return nil, err
+	}
+
+	export.Marketo = a.exportMarketo(user)
+	return export, nil
+}
+
+// exportMarketo reports whether the user has a Marketo lead. Marketo being unavailable does
+// not fail the export; the error is reported in its place.
+func (a *Api) exportMarketo(user *User) *MarketoExport {
+	if a.marketoManager == nil {
+		return &MarketoExport{}
+	}
+
+	export := &MarketoExport{Enabled: true}
+	if user.Email() == "" {
+		return export
+	} else if !a.marketoManager.IsAvailable() {
+		export.Error = "marketo is not available"
+	} else if leadID, exists, err := a.marketoManager.FindLead(strings.ToLower(user.Email())); err != nil {
+		export.Error = err.Error()
+	} else if exists {
+		export.Synced = true
+		export.LeadID = leadID
+	}
+	return export
+}
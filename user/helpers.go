@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -131,14 +132,59 @@ func (a *Api) asSerializableUser(user *User, isServerRequest bool) interface{} {
 	if len(user.Roles) > 0 {
 		serializable["roles"] = user.Roles
 	}
+	if len(user.ReviewRoles) > 0 {
+		serializable["reviewRoles"] = user.ReviewRoles
+	}
 	if len(user.TermsAccepted) > 0 {
 		serializable["termsAccepted"] = user.TermsAccepted
 	}
+	if len(user.TermsAcceptances) > 0 {
+		serializable["termsAcceptances"] = user.TermsAcceptances
+	}
+	if len(user.PendingEmail) > 0 {
+		serializable["pendingEmail"] = user.PendingEmail
+	}
+	if len(user.VerifiedEmails) > 0 {
+		serializable["verifiedEmails"] = user.VerifiedEmails
+	}
+	if len(user.CustodianUserID) > 0 {
+		serializable["custodianUserId"] = user.CustodianUserID
+	}
+	if user.Revision > 0 {
+		serializable["revision"] = user.Revision
+	}
 	if len(user.Username) > 0 || len(user.Emails) > 0 {
 		serializable["emailVerified"] = user.EmailVerified
 	}
 	if isServerRequest {
 		serializable["passwordExists"] = (user.PwHash != "")
+		if user.IsDeleted() {
+			serializable["deletedTime"] = user.DeletedTime
+		}
+		if user.IsSuspended() {
+			serializable["suspendedTime"] = user.SuspendedTime
+			if user.SuspendedUserID != "" {
+				serializable["suspendedUserId"] = user.SuspendedUserID
+			}
+		}
 	}
 	return serializable
 }
+
+// revisionETag returns the entity tag of a user revision
+func revisionETag(revision int) string {
+	return strconv.Quote(strconv.Itoa(revision))
+}
+
+// ifMatchRevision reports whether an If-Match header, if any, matches a user revision
+func ifMatchRevision(ifMatch string, revision int) bool {
+	if ifMatch = strings.TrimSpace(ifMatch); ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimSpace(tag) == revisionETag(revision) {
+			return true
+		}
+	}
+	return false
+}
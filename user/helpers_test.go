@@ -130,3 +130,27 @@ func Test_AsSerializableUser_PasswordExists_False_NotServer(t *testing.T) {
 		t.Fatalf("Serializable user [%#v] does not match User [%#v] for passwordExists as not server", serializableUser, user)
 	}
 }
+
+func Test_AsSerializableUser_Revision(t *testing.T) {
+	user := &User{Revision: 3}
+	serializableUser := shoreline.asSerializableUser(user, false).(map[string]interface{})
+	if len(serializableUser) != 1 || serializableUser["revision"].(int) != 3 {
+		t.Fatalf("Serializable user [%#v] does not match User [%#v] for revision", serializableUser, user)
+	}
+}
+
+func Test_IfMatchRevision(t *testing.T) {
+	for ifMatch, expected := range map[string]bool{
+		"":         true,
+		"*":        true,
+		`"3"`:      true,
+		`"1", "3"`: true,
+		`"2"`:      false,
+		`W/"3"`:    false,
+		"3":        false,
+	} {
+		if actual := ifMatchRevision(ifMatch, 3); actual != expected {
+			t.Fatalf("If-Match %s should match revision 3: %v", ifMatch, expected)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package user
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrUserIdentityConflict is returned by UpsertUser when the user's username or one of its emails
+// belongs to another user
+var ErrUserIdentityConflict = errors.New("Username or email belongs to another user")
+
+// Identity records that a normalized username or email belongs to a user. Identities are unique, so
+// the store rejects a username or email that belongs to another user even under concurrent updates.
+type Identity struct {
+	Key    string `bson:"key"`
+	UserID string `bson:"userId"`
+}
+
+// NormalizeIdentityKey returns the key of a username or email, its canonical form, under which it is unique
+func NormalizeIdentityKey(email string) string {
+	return CanonicalEmail(email)
+}
+
+// IdentityKeys returns the sorted, distinct keys of the user's username and emails
+func (u *User) IdentityKeys() []string {
+	keys := []string{}
+	for _, email := range append([]string{u.Username}, u.Emails...) {
+		if key := NormalizeIdentityKey(email); key != "" && !containsString(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,19 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_User_IdentityKeys(t *testing.T) {
+	user := &User{Username: " B@z.co", Emails: []string{"b@z.co", "A@Z.co", ""}}
+	if keys := user.IdentityKeys(); !reflect.DeepEqual(keys, []string{"a@z.co", "b@z.co"}) {
+		t.Fatalf("Unexpected identity keys: %v", keys)
+	}
+}
+
+func Test_User_IdentityKeys_Custodial(t *testing.T) {
+	if keys := (&User{Id: "1111111111"}).IdentityKeys(); len(keys) != 0 {
+		t.Fatalf("Unexpected identity keys: %v", keys)
+	}
+}
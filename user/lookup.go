@@ -0,0 +1,98 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+const userLookupMaxKeys = 500
+
+// UserLookup is a request for many users at once, by id and/or email
+type UserLookup struct {
+	IDs    []string `json:"ids"`
+	Emails []string `json:"emails"`
+}
+
+// UserLookupResults maps each requested id or email that was found, and that the requester may
+// see, to its user. All other requested ids and emails are misses.
+type UserLookupResults struct {
+	Users  map[string]interface{} `json:"users"`
+	Misses []string               `json:"misses"`
+}
+
+var (
+	UserLookup_error_keys_missing  = errors.New("At least one id or email is required")
+	UserLookup_error_keys_too_many = errors.New("Too many ids and emails were given")
+)
+
+// ParseUserLookup parses a UserLookup from a JSON body, trimming and dropping empty keys
+func ParseUserLookup(reader io.Reader) (*UserLookup, error) {
+	lookup := &UserLookup{}
+	if reader == nil {
+		return nil, UserLookup_error_keys_missing
+	} else if err := json.NewDecoder(reader).Decode(lookup); err != nil {
+		return nil, err
+	}
+	lookup.IDs = trimmedKeys(lookup.IDs)
+	lookup.Emails = trimmedKeys(lookup.Emails)
+	return lookup, nil
+}
+
+func (l *UserLookup) Validate() error {
+	if count := len(l.IDs) + len(l.Emails); count == 0 {
+		return UserLookup_error_keys_missing
+	} else if count > userLookupMaxKeys {
+		return UserLookup_error_keys_too_many
+	}
+	return nil
+}
+
+func trimmedKeys(keys []string) []string {
+	trimmed := []string{}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			trimmed = append(trimmed, key)
+		}
+	}
+	return trimmed
+}
+
+// lookupUsers finds the users for the lookup's keys and returns the users found for each key
+func (a *Api) lookupUsers(store Storage, lookup *UserLookup) (map[string]*User, error) {
+	found := map[string]*User{}
+	if len(lookup.IDs) > 0 {
+		users, err := store.FindUsersWithIds(lookup.IDs)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			found[user.Id] = user
+		}
+	}
+
+	if len(lookup.Emails) > 0 {
+		users, err := store.FindUsersWithEmails(lookup.Emails)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range lookup.Emails {
+			for _, user := range users {
+				// prefer the user for which the email is primary over any with it as a secondary email
+				if user.IsPrimaryEmail(email) || (found[email] == nil && user.HasEmail(email)) {
+					found[email] = user
+				}
+			}
+		}
+	}
+	return found, nil
+}
+
+// isLookupVisible reports whether the token user may see the user, under the rule GetUserInfo applies:
+// the token user is the user itself or its custodian. Custodians are read from the custodianUserId
+// shoreline records on custodial users rather than from gatekeeper, so a lookup makes no request
+// per found user; creation, custody transfers, claims and merges keep the record current.
+func isLookupVisible(tokenData *TokenData, user *User) bool {
+	return user.Id == tokenData.UserId || (user.CustodianUserID != "" && user.CustodianUserID == tokenData.UserId)
+}
@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	TypeSMTP = "smtp"
+	TypeFile = "file"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(message *Message) error
+}
+
+// Config is the configuration for a Mailer
+type Config struct {
+	Type string     `json:"type"` // one of "smtp" or "file"
+	From string     `json:"from"`
+	SMTP SMTPConfig `json:"smtp"`
+	File FileConfig `json:"file"`
+}
+
+// SMTPConfig is the configuration for sending email through an SMTP server
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// FileConfig is the configuration for writing email to files, for development
+type FileConfig struct {
+	Directory string `json:"directory"`
+}
+
+// Validate checks that the config is complete for its type
+func (c *Config) Validate() error {
+	if c == nil {
+		return errors.New("mailer: config is missing")
+	}
+	switch c.Type {
+	case TypeSMTP:
+		if c.From == "" {
+			return errors.New("mailer: from is missing")
+		}
+		if c.SMTP.Host == "" {
+			return errors.New("mailer: smtp host is missing")
+		}
+		if c.SMTP.Port <= 0 {
+			return errors.New("mailer: smtp port is missing")
+		}
+	case TypeFile:
+		if c.File.Directory == "" {
+			return errors.New("mailer: file directory is missing")
+		}
+	default:
+		return fmt.Errorf("mailer: type %q is not supported", c.Type)
+	}
+	return nil
+}
+
+// New returns the Mailer for the config type
+func New(config Config) (Mailer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Type == TypeFile {
+		return &FileMailer{from: config.From, directory: config.File.Directory}, nil
+	}
+	return &SMTPMailer{from: config.From, config: config.SMTP}, nil
+}
+
+// SMTPMailer sends email through an SMTP server
+type SMTPMailer struct {
+	from   string
+	config SMTPConfig
+}
+
+func (m *SMTPMailer) Send(message *Message) error {
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.config.Username != "" {
+		auth = smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Host)
+	}
+
+	address := fmt.Sprintf("%s:%d", m.config.Host, m.config.Port)
+	if err := smtp.SendMail(address, auth, m.from, []string{message.To}, format(m.from, message)); err != nil {
+		return fmt.Errorf("mailer: could not send email; %s", err)
+	}
+	return nil
+}
+
+// FileMailer writes each email to its own file in a directory, for development
+type FileMailer struct {
+	from      string
+	directory string
+}
+
+func (m *FileMailer) Send(message *Message) error {
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.directory, 0755); err != nil {
+		return fmt.Errorf("mailer: could not create directory; %s", err)
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(message.To))
+	if err := ioutil.WriteFile(filepath.Join(m.directory, name), format(m.from, message), 0644); err != nil {
+		return fmt.Errorf("mailer: could not write email; %s", err)
+	}
+	return nil
+}
+
+func validateMessage(message *Message) error {
+	if message == nil {
+		return errors.New("mailer: message is missing")
+	}
+	if message.To == "" {
+		return errors.New("mailer: recipient is missing")
+	}
+	if strings.ContainsAny(message.To+message.Subject, "\r\n") {
+		return errors.New("mailer: headers must not contain line breaks")
+	}
+	return nil
+}
+
+func format(from string, message *Message) []byte {
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s\r\n", from, message.To, message.Subject, message.Body))
+}
+
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, address)
+}
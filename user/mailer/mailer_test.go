@@ -0,0 +1,76 @@
+package mailer_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tidepool-org/shoreline/user/mailer"
+)
+
+func Test_Config_Validate_Missing(t *testing.T) {
+	var config *mailer.Config
+	if err := config.Validate(); err == nil || err.Error() != "mailer: config is missing" {
+		t.Fatalf("Validate error unexpected: %v", err)
+	}
+}
+
+func Test_Config_Validate_Type_Unsupported(t *testing.T) {
+	config := &mailer.Config{Type: "carrier-pigeon"}
+	if err := config.Validate(); err == nil || err.Error() != `mailer: type "carrier-pigeon" is not supported` {
+		t.Fatalf("Validate error unexpected: %v", err)
+	}
+}
+
+func Test_Config_Validate_SMTP_Host_Missing(t *testing.T) {
+	config := &mailer.Config{Type: mailer.TypeSMTP, From: "noreply@tidepool.org", SMTP: mailer.SMTPConfig{Port: 587}}
+	if err := config.Validate(); err == nil || err.Error() != "mailer: smtp host is missing" {
+		t.Fatalf("Validate error unexpected: %v", err)
+	}
+}
+
+func Test_Config_Validate_SMTP_Valid(t *testing.T) {
+	config := &mailer.Config{Type: mailer.TypeSMTP, From: "noreply@tidepool.org", SMTP: mailer.SMTPConfig{Host: "localhost", Port: 587}}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate returned unexpected error: %s", err)
+	}
+}
+
+func Test_Config_Validate_File_Directory_Missing(t *testing.T) {
+	config := &mailer.Config{Type: mailer.TypeFile}
+	if err := config.Validate(); err == nil || err.Error() != "mailer: file directory is missing" {
+		t.Fatalf("Validate error unexpected: %v", err)
+	}
+}
+
+func Test_FileMailer_Send(t *testing.T) {
+	directory, err := ioutil.TempDir("", "mailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mailer.New(mailer.Config{Type: mailer.TypeFile, From: "noreply@tidepool.org", File: mailer.FileConfig{Directory: directory}})
+	if err != nil {
+		t.Fatalf("New returned unexpected error: %s", err)
+	}
+
+	if err := m.Send(&mailer.Message{To: "a@z.co", Subject: "Verify your email", Body: "Hello"}); err != nil {
+		t.Fatalf("Send returned unexpected error: %s", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(directory, "*a@z.co.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one email file, found %v", files)
+	}
+	content, _ := ioutil.ReadFile(files[0])
+	if !strings.Contains(string(content), "To: a@z.co\r\n") || !strings.Contains(string(content), "Subject: Verify your email\r\n") || !strings.HasSuffix(string(content), "Hello\r\n") {
+		t.Fatalf("Unexpected email content: %s", content)
+	}
+}
+
+func Test_FileMailer_Send_HeaderInjection(t *testing.T) {
+	m, _ := mailer.New(mailer.Config{Type: mailer.TypeFile, File: mailer.FileConfig{Directory: "unused"}})
+	if err := m.Send(&mailer.Message{To: "a@z.co\r\nBcc: b@z.co", Subject: "Verify"}); err == nil {
+		t.Fatal("Send returned successfully when error expected")
+	}
+}
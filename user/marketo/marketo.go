@@ -11,7 +11,10 @@ import (
 	"github.com/SpeakData/minimarketo"
 )
 
-const path = "/rest/v1/leads.json?"
+const (
+	path       = "/rest/v1/leads.json?"
+	deletePath = "/rest/v1/leads/delete.json"
+)
 
 // User interface for Identifying user type. function located in user.go
 type User interface {
@@ -23,6 +26,8 @@ type User interface {
 type Manager interface {
 	CreateListMembershipForUser(newUser User)
 	UpdateListMembershipForUser(oldUser User, newUser User)
+	RemoveListMembershipForUser(user User) error
+	FindLead(email string) (int, bool, error)
 	IsAvailable() bool
 }
 
@@ -62,6 +67,16 @@ type CreateData struct {
 	Input       []Input `json:"input"`
 }
 
+// LeadID identifies a lead by its Marketo ID
+type LeadID struct {
+	ID int `json:"id"`
+}
+
+// DeleteData is the marketo request format to delete leads
+type DeleteData struct {
+	Input []LeadID `json:"input"`
+}
+
 // Connector manages the connection to the client
 type Connector struct {
 	logger *log.Logger
@@ -182,6 +197,39 @@ func (m *Connector) UpdateListMembershipForUser(oldUser User, newUser User) {
 	go m.UpsertListMembership(oldUser, newUser)
 }
 
+// RemoveListMembershipForUser is a synchronous function that deletes the lead for a user, if there is one
+func (m *Connector) RemoveListMembershipForUser(user User) error {
+	m.logger.Printf("RemoveListMembershipForUser %v", user)
+	if user == nil {
+		return errors.New("marketo: user is missing")
+	}
+	email := strings.ToLower(user.Email())
+	if email == "" {
+		return nil
+	}
+	id, exists, err := m.FindLead(email)
+	if err != nil {
+		return fmt.Errorf("marketo: could not find a lead %v", err)
+	}
+	if !exists {
+		return nil
+	}
+	dataInBytes, err := json.Marshal(DeleteData{[]LeadID{{id}}})
+	if err != nil {
+		return err
+	}
+	response, err := m.client.Post(deletePath, dataInBytes)
+	if err != nil {
+		m.logger.Println(err)
+		return fmt.Errorf("marketo: could not get a response %v", err)
+	}
+	if !response.Success {
+		m.logger.Println(response.Errors)
+		return fmt.Errorf("marketo: issue with request %v", response.Errors)
+	}
+	return nil
+}
+
 // UpsertListMembership creates or updates a user depending on if the user already exists or not
 func (m *Connector) UpsertListMembership(oldUser User, newUser User) error {
 	if matchUsers(oldUser, newUser) {
@@ -596,6 +596,78 @@ func Test_CreateListMember(t *testing.T) {
 		t.Error("Expected nil, returned not nil")
 	}
 }
+func Test_RemoveListMembershipForUser(t *testing.T) {
+	getResponseSuccess := `{
+		"requestId":"1000",
+		"result":[{"id":23,"email":"tester@example.com"}],
+		"success":true
+	}`
+	deleteResponseSuccess := `{
+		"requestId":"1000",
+		"result":[{"id":23,"status":"deleted"}],
+		"success":true
+	}`
+	called := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		called++
+		if called == 1 {
+			w.Write([]byte(fmt.Sprintf(authResponseSuccess, token)))
+		}
+		if called == 2 {
+			if r.URL.EscapedPath() != "/rest/v1/leads.json" {
+				t.Errorf("Expected path to be /rest/v1/leads.json, got %s", r.URL.EscapedPath())
+			}
+			if r.Method != "GET" {
+				t.Errorf("Expected 'GET' request, got '%s'", r.Method)
+			}
+			w.Write([]byte(getResponseSuccess))
+		}
+		if called == 3 {
+			if r.URL.EscapedPath() != "/rest/v1/leads/delete.json" {
+				t.Errorf("Expected path to be /rest/v1/leads/delete.json, got %s", r.URL.EscapedPath())
+			}
+			if r.Method != "POST" {
+				t.Errorf("Expected 'POST' request, got '%s'", r.Method)
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			var requestBody marketo.DeleteData
+			if err := json.Unmarshal(body, &requestBody); err != nil {
+				t.Error(err)
+			}
+			if len(requestBody.Input) != 1 || requestBody.Input[0].ID != 23 {
+				t.Errorf("Expected lead 23, got %v", requestBody.Input)
+			}
+			w.Write([]byte(deleteResponseSuccess))
+		}
+	}))
+	defer ts.Close()
+	logger := log.New(ioutil.Discard, "", log.LstdFlags)
+	config := NewTestConfig(t, ts)
+	manager, _ := marketo.NewManager(logger, config)
+	userMock := NewUserMock()
+	userMock.EmailOutputs = []string{"tester@example.com"}
+	if err := manager.RemoveListMembershipForUser(userMock); err != nil {
+		t.Errorf("Expected nil, returned %v", err)
+	}
+	if called != 3 {
+		t.Errorf("Expected 3 requests, got %d", called)
+	}
+}
+
+func Test_RemoveListMembershipForUser_Email_Missing(t *testing.T) {
+	manager := NewTestManagerWithClientMock(t)
+	userMock := NewUserMock()
+	userMock.EmailOutputs = []string{""}
+	if err := manager.RemoveListMembershipForUser(userMock); err != nil {
+		t.Errorf("Expected nil, returned %v", err)
+	}
+}
+
 func Test_FindLead(t *testing.T) {
 	getResponseSuccess := `{
 		"requestId":"1000",
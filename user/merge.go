@@ -0,0 +1,313 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+const defaultMergeTransitionDays = 90
+
+// mergedUserPermissions are given to the survivor for the group of the merged user, the data of which
+// is not moved, so that the survivor can still view and add to it
+var mergedUserPermissions = clients.Permissions{"view": clients.Allowed, "upload": clients.Allowed, "note": clients.Allowed}
+
+// permissionsChange is the permissions a user had for a group before a merge changed them
+type permissionsChange struct {
+	UserID      string
+	GroupID     string
+	Permissions clients.Permissions
+}
+
+// MergeTransitionPeriod returns how long after a merge GET /user resolves the merged user to its survivor
+func (c ApiConfig) MergeTransitionPeriod() time.Duration {
+	days := c.MergeTransitionDays
+	if days <= 0 {
+		days = defaultMergeTransitionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func (u *User) IsMerged() bool {
+	return u.MergedTime != ""
+}
+
+// IsMergeResolvable returns true if the user was merged and is still within the transition period
+func (u *User) IsMergeResolvable(transitionPeriod time.Duration, now time.Time) bool {
+	if !u.IsMerged() || u.MergedUserID == "" {
+		return false
+	} else if mergedTime, err := time.Parse(TimestampFormat, u.MergedTime); err != nil {
+		return false
+	} else {
+		return now.Before(mergedTime.Add(transitionPeriod))
+	}
+}
+
+// MergeFrom adds the emails and private id-hash pairs of merged to the user, keeping their verification
+// state. The user keeps its own username, unless it has none, and its own private pairs of the same
+// name as those of merged, the names of which are returned.
+func (u *User) MergeFrom(merged *User) []string {
+	if u.Username == "" && merged.Username != "" {
+		u.ChangeEmail(merged.Username)
+		u.EmailVerified = merged.EmailVerified
+	}
+	for _, email := range append([]string{merged.Username}, merged.Emails...) {
+		if email == "" {
+			continue
+		}
+		u.AddEmail(email)
+		if merged.HasVerifiedEmail(email) {
+			u.MarkEmailVerified(email)
+		}
+	}
+	u.PruneVerifiedEmails()
+
+	unmerged := []string{}
+	for name, pair := range merged.Private {
+		if _, ok := u.Private[name]; ok {
+			unmerged = append(unmerged, name)
+			continue
+		}
+		if u.Private == nil {
+			u.Private = make(map[string]*IdHashPair)
+		}
+		u.Private[name] = &IdHashPair{Id: pair.Id, Hash: pair.Hash}
+	}
+	sort.Strings(unmerged)
+	return unmerged
+}
+
+// MarkMerged leaves the user as a tombstone pointing to the survivor it was merged into at now,
+// without its password or the emails and private id-hash pairs that were moved to the survivor
+func (u *User) MarkMerged(survivorUserID string, now time.Time) {
+	u.MergedTime = now.UTC().Format(TimestampFormat)
+	u.MergedUserID = survivorUserID
+	u.Username = ""
+	u.Emails = nil
+	u.VerifiedEmails = nil
+	u.PendingEmail = ""
+	u.EmailVerified = false
+	u.PwHash = ""
+	u.Private = nil
+	u.CustodianUserID = ""
+}
+
+// resolveMergedUser returns the survivor of a user merged within the transition period, following
+// survivors that were themselves merged to the end of the chain, nil for a user merged before it or
+// whose chain ends in a deleted or missing user, and otherwise the user itself
+func (a *Api) resolveMergedUser(ctx context.Context, user *User) (*User, error) {
+	visited := map[string]bool{}
+	for user.IsMerged() {
+		if visited[user.Id] || !user.IsMergeResolvable(a.ApiConfig.MergeTransitionPeriod(), time.Now()) {
+			return nil, nil
+		}
+		visited[user.Id] = true
+
+		survivor, err := a.Store.WithContext(ctx).FindUser(&User{Id: user.MergedUserID})
+		if err != nil {
+			return nil, err
+		} else if survivor == nil || survivor.IsDeleted() {
+			return nil, nil
+		}
+		user = survivor
+	}
+	return user, nil
+}
+
+// MergeUsers merges the user given by mergedUserId in the body into the user, which survives: the
+// emails and private id-hash pairs of the merged user are moved to the survivor, users with permissions
+// for the merged user are given the same permissions for the survivor, and the merged user is left as a
+// tombstone without emails or password whose tokens are revoked. Data in the merged user's group is not
+// moved, so its permissions are kept and the survivor is given view, upload and note permissions for it.
+// The tombstone is stored before the survivor, which takes over its emails, and is restored, along with
+// the permissions given, if the survivor cannot be, so a failed merge can be retried.
+//
+// Password hashes are salted with the user id, so the password of the merged user cannot be moved. A
+// user with a password cannot be merged into a survivor without one, as a custodial user is, which would
+// leave the merged emails without a password to log in with; merge the custodial user into it instead.
+//
+// Gatekeeper cannot list the permissions the merged user has for other users, so they are not moved
+// and stay with the tombstone, which can no longer log in. Custody of the custodial users recording the
+// merged user as their custodian is transferred to the survivor. Clinic users, which have permissions
+// for their patients, cannot be merged.
+// status: 200 User
+// status: 400 STATUS_INVALID_USER_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_USER_NOT_FOUND
+// status: 409 STATUS_USER_MERGED, STATUS_CLINIC_NOT_MERGEABLE, STATUS_MERGED_PASSWORD, STATUS_USER_MODIFIED
+// status: 500 STATUS_ERR_FINDING_USR, STATUS_ERR_MERGING_USR, STATUS_ERR_UPDATING_TOKEN
+func (a *Api) MergeUsers(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	tokenData := authorizedTokenData(req)
+	if mergedUserID := strings.TrimSpace(getGivenDetail(req)["mergedUserId"]); mergedUserID == "" || mergedUserID == vars["userid"] {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_USER_DETAILS, "A mergedUserId other than the user is required")
+
+	} else if survivor, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: vars["userid"]}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if survivor == nil || survivor.IsDeleted() || survivor.IsMerged() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if merged, err := a.Store.WithContext(req.Context()).FindUser(&User{Id: mergedUserID}); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+	} else if merged == nil || merged.IsDeleted() {
+		a.sendError(res, http.StatusNotFound, STATUS_USER_NOT_FOUND)
+
+	} else if merged.IsMerged() {
+		a.sendError(res, http.StatusConflict, STATUS_USER_MERGED)
+
+	} else if merged.IsClinic() {
+		a.sendError(res, http.StatusConflict, STATUS_CLINIC_NOT_MERGEABLE)
+
+	} else if merged.PwHash != "" && survivor.PwHash == "" {
+		a.sendError(res, http.StatusConflict, STATUS_MERGED_PASSWORD)
+
+	} else if permissionsChanges, err := a.mergePermissions(survivor, merged); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_MERGING_USR, err)
+
+	} else {
+		now := time.Now()
+		originalSurvivor := survivor.DeepClone()
+		if unmerged := survivor.MergeFrom(merged); len(unmerged) > 0 {
+			a.logger.Printf("Kept private id-hash pairs %v of user %s rather than those of merged user %s", unmerged, survivor.Id, merged.Id)
+		}
+		survivor.MarkModified(tokenData.UserId, now)
+
+		originalMerged := merged.DeepClone()
+		merged.MarkMerged(survivor.Id, now)
+		merged.MarkModified(tokenData.UserId, now)
+		if err := a.Store.WithContext(req.Context()).UpsertUser(merged); err == ErrUserRevisionConflict {
+			a.restorePermissions(permissionsChanges)
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.restorePermissions(permissionsChanges)
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_MERGING_USR, err)
+			return
+		}
+
+		if err := a.Store.WithContext(req.Context()).UpsertUser(survivor); err == ErrUserRevisionConflict {
+			a.restoreMergedUser(a.Store.WithContext(req.Context()), originalMerged, merged.Revision)
+			a.restorePermissions(permissionsChanges)
+			a.sendError(res, http.StatusConflict, STATUS_USER_MODIFIED, err)
+			return
+		} else if err != nil {
+			a.restoreMergedUser(a.Store.WithContext(req.Context()), originalMerged, merged.Revision)
+			a.restorePermissions(permissionsChanges)
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_MERGING_USR, err)
+			return
+		}
+
+		if err := a.Store.WithContext(req.Context()).RemoveTokensForUser(merged.Id); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_TOKEN, err)
+			return
+		}
+		a.transferMergedCustody(a.Store.WithContext(req.Context()), survivor, merged, tokenData.UserId)
+
+		a.auditUserUpdate(req, tokenData.UserId, originalSurvivor, survivor, nil)
+		a.auditEvent(req, AUDIT_EVENT_USER_MERGED, tokenData.UserId, merged.Id)
+		a.logger.Printf("Merged user %s into user %s", merged.Id, survivor.Id)
+		a.sendUser(res, survivor, tokenData.IsServer)
+	}
+}
+
+// restoreMergedUser restores the merged user as it was before a merge whose survivor could not be stored
+func (a *Api) restoreMergedUser(store Storage, original *User, revision int) {
+	original.Revision = revision
+	if err := store.UpsertUser(original); err != nil {
+		a.logger.Printf("Error restoring merged user %s: %s", original.Id, err)
+	}
+}
+
+// transferMergedCustody transfers custody of the custodial users of the merged user to the survivor.
+// The merge is already stored, so a failed transfer is logged, to be retried with
+// POST /user/{userid}/custodian, but does not fail the merge.
+func (a *Api) transferMergedCustody(store Storage, survivor *User, merged *User, actorUserID string) {
+	custodialUsers, err := store.FindUsersByCustodian(merged.Id)
+	if err != nil {
+		a.logger.Printf("Error finding custodial users of merged user %s: %s", merged.Id, err)
+		return
+	}
+	for _, custodialUser := range custodialUsers {
+		if custodialUser.IsDeleted() || custodialUser.PwHash != "" {
+			continue
+		}
+		if err := a.transferCustody(store, custodialUser, survivor.Id, actorUserID); err != nil {
+			a.logger.Printf("Error transferring custody of user %s from merged user %s to user %s: %s", custodialUser.Id, merged.Id, survivor.Id, err)
+		}
+	}
+}
+
+// mergePermissions gives the users with permissions for the merged user the same permissions for the
+// survivor, in addition to any they already have, and the survivor the mergedUserPermissions for the
+// merged user. The custodian permission is not given for a survivor with a password, which is not
+// custodial. The permissions changed are returned, to be restored with restorePermissions if the merge
+// fails, and are restored here if not all of them can be changed.
+func (a *Api) mergePermissions(survivor *User, merged *User) ([]permissionsChange, error) {
+	mergedPermissions, err := a.perms.UsersInGroup(merged.Id)
+	if err != nil {
+		return nil, err
+	}
+	survivorPermissions, err := a.perms.UsersInGroup(survivor.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []permissionsChange{}
+	setPermissions := func(userID string, groupID string, originalPermissions clients.Permissions, permissions clients.Permissions) error {
+		finalPermissions := make(clients.Permissions)
+		for name, value := range originalPermissions {
+			finalPermissions[name] = value
+		}
+		for name, value := range permissions {
+			finalPermissions[name] = value
+		}
+		if len(finalPermissions) == 0 || reflect.DeepEqual(finalPermissions, originalPermissions) {
+			return nil
+		}
+		if _, err := a.perms.SetPermissions(userID, groupID, finalPermissions); err != nil {
+			a.restorePermissions(changes)
+			return err
+		}
+		restoredPermissions := make(clients.Permissions)
+		for name, value := range originalPermissions {
+			restoredPermissions[name] = value
+		}
+		changes = append(changes, permissionsChange{UserID: userID, GroupID: groupID, Permissions: restoredPermissions})
+		return nil
+	}
+
+	for userID, permissions := range mergedPermissions {
+		if userID == merged.Id || userID == survivor.Id {
+			continue
+		}
+		grantedPermissions := make(clients.Permissions)
+		for name, value := range permissions {
+			if name == "custodian" && survivor.PwHash != "" {
+				continue
+			}
+			grantedPermissions[name] = value
+		}
+		if err := setPermissions(userID, survivor.Id, survivorPermissions[userID], grantedPermissions); err != nil {
+			return nil, err
+		}
+	}
+	if err := setPermissions(survivor.Id, merged.Id, mergedPermissions[survivor.Id], mergedUserPermissions); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// restorePermissions restores the permissions changed by a merge that failed
+func (a *Api) restorePermissions(changes []permissionsChange) {
+	for _, change := range changes {
+		if _, err := a.perms.SetPermissions(change.UserID, change.GroupID, change.Permissions); err != nil {
+			a.logger.Printf("Error restoring permissions of user %s for user %s: %s", change.UserID, change.GroupID, err)
+		}
+	}
+}
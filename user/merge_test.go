@@ -0,0 +1,42 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_User_MergeFrom(t *testing.T) {
+	survivor := &User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}, EmailVerified: true, Private: map[string]*IdHashPair{"meta": {Id: "1", Hash: "1"}}}
+	merged := &User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co", "c@z.co"}, EmailVerified: true, Private: map[string]*IdHashPair{"meta": {Id: "2", Hash: "2"}, "other": {Id: "3", Hash: "3"}}}
+	unmerged := survivor.MergeFrom(merged)
+	if !reflect.DeepEqual(unmerged, []string{"meta"}) {
+		t.Fatalf("Unexpected unmerged private pairs: %v", unmerged)
+	}
+	if survivor.Username != "a@z.co" || !reflect.DeepEqual(survivor.Emails, []string{"a@z.co", "b@z.co", "c@z.co"}) || !reflect.DeepEqual(survivor.VerifiedEmails, []string{"b@z.co"}) {
+		t.Fatalf("Unexpected merged emails: %#v", survivor)
+	}
+	if survivor.Private["meta"].Id != "1" || survivor.Private["other"].Id != "3" {
+		t.Fatalf("Unexpected merged private pairs: %#v", survivor.Private)
+	}
+}
+
+func Test_User_MergeFrom_SurvivorWithoutUsername(t *testing.T) {
+	survivor := &User{Id: "1111111111"}
+	survivor.MergeFrom(&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}, EmailVerified: true})
+	if survivor.Username != "b@z.co" || !survivor.EmailVerified || !reflect.DeepEqual(survivor.Emails, []string{"b@z.co"}) {
+		t.Fatalf("Unexpected merged user: %#v", survivor)
+	}
+}
+
+func Test_User_MarkMerged(t *testing.T) {
+	now := time.Now()
+	user := &User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co"}, EmailVerified: true, PwHash: "hash", Private: map[string]*IdHashPair{"meta": {}}}
+	user.MarkMerged("1111111111", now)
+	if !user.IsMerged() || user.MergedUserID != "1111111111" || user.Username != "" || user.Emails != nil || user.PwHash != "" || user.Private != nil {
+		t.Fatalf("Unexpected merged user: %#v", user)
+	}
+	if !user.IsMergeResolvable(time.Hour, now) || user.IsMergeResolvable(time.Hour, now.Add(2*time.Hour)) {
+		t.Fatalf("Unexpected merge resolution for %#v", user)
+	}
+}
@@ -0,0 +1,213 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	MIGRATION_DELETION_JOBS = "deletionJobs"
+	MIGRATION_CUSTODIANS    = "custodians"
+	MIGRATION_IDENTITIES    = "identities"
+	MIGRATION_CONFIRMATIONS = "confirmations"
+)
+
+// Migration backfills records stored before a change, returning the ids of the records it changed,
+// or would change with dryRun. Migrations are safe to run again.
+type Migration func(a *Api, store Storage, dryRun bool, now time.Time) (*MigrationResult, error)
+
+// MigrationResult reports the records a migration changed, or would change with dryRun, and any
+// records it could not migrate
+type MigrationResult struct {
+	Name      string        `json:"name"`
+	DryRun    bool          `json:"dryRun"`
+	Migrated  []string      `json:"migrated"`
+	Conflicts []interface{} `json:"conflicts,omitempty"`
+}
+
+// migrations are run by name with POST /migrations/{name}
+var migrations = map[string]Migration{
+	MIGRATION_DELETION_JOBS: (*Api).migrateDeletionJobs,
+	MIGRATION_CUSTODIANS:    (*Api).migrateCustodians,
+	MIGRATION_IDENTITIES:    (*Api).migrateIdentities,
+	MIGRATION_CONFIRMATIONS: (*Api).migrateConfirmations,
+}
+
+// CustodianConflict is a custodial user whose custodian could not be recorded because it does not have
+// exactly one custodian in gatekeeper
+type CustodianConflict struct {
+	UserID           string   `json:"userId"`
+	CustodianUserIDs []string `json:"custodianUserIds"`
+}
+
+// migrateDeletionJobs schedules a deletion job for every deleted user that is not yet purged and has
+// none, as users deleted before deletion jobs were recorded have, so that the purge worker purges them
+func (a *Api) migrateDeletionJobs(store Storage, dryRun bool, now time.Time) (*MigrationResult, error) {
+	deleted := true
+	users, err := searchAllUsers(store, &UserSearch{Deleted: &deleted})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{Name: MIGRATION_DELETION_JOBS, DryRun: dryRun, Migrated: []string{}}
+	for _, user := range users {
+		if user.PurgedTime != "" {
+			continue
+		}
+		if jobs, err := store.FindDeletionJobsForUser(user.Id); err != nil {
+			return nil, err
+		} else if len(jobs) > 0 {
+			continue
+		}
+		if !dryRun {
+			if _, err := a.scheduleDeletionJob(store, user, nil, now); err != nil {
+				return nil, err
+			}
+		}
+		result.Migrated = append(result.Migrated, user.Id)
+	}
+	return result, nil
+}
+
+// migrateCustodians records the custodian of every custodial user that has none, as custodial users
+// created before custodians were recorded have, from the user's custodian permissions in gatekeeper,
+// so that they are listed and counted for their custodian. Users with no or several custodians are
+// reported as conflicts and left unchanged, to be transferred to one custodian.
+func (a *Api) migrateCustodians(store Storage, dryRun bool, now time.Time) (*MigrationResult, error) {
+	if a.perms == nil {
+		return nil, errors.New("Gatekeeper not configured")
+	}
+
+	deleted := false
+	users, err := searchAllUsers(store, &UserSearch{AccountType: USER_SEARCH_ACCOUNT_CUSTODIAL, Deleted: &deleted})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{Name: MIGRATION_CUSTODIANS, DryRun: dryRun, Migrated: []string{}}
+	for _, user := range users {
+		if user.CustodianUserID != "" {
+			continue
+		}
+		usersPermissions, err := a.perms.UsersInGroup(user.Id)
+		if err != nil {
+			return nil, err
+		}
+		custodianIDs := []string{}
+		for userID, permissions := range usersPermissions {
+			if _, ok := permissions["custodian"]; ok && userID != user.Id {
+				custodianIDs = append(custodianIDs, userID)
+			}
+		}
+		if len(custodianIDs) != 1 {
+			sort.Strings(custodianIDs)
+			result.Conflicts = append(result.Conflicts, &CustodianConflict{UserID: user.Id, CustodianUserIDs: custodianIDs})
+			continue
+		}
+		if !dryRun {
+			user.CustodianUserID = custodianIDs[0]
+			if err := store.UpsertUser(user); err != nil {
+				return nil, err
+			}
+		}
+		result.Migrated = append(result.Migrated, user.Id)
+	}
+	return result, nil
+}
+
+// migrateIdentities records the identities of users stored without them, as users stored before
+// identities were or by instances that did not yet record them are, so that the store rejects their
+// usernames and emails for other users. The usernames and emails shared by several users are reported
+// as conflicts and recorded for the suggested survivor of their merge. Run it with dryRun to review the
+// conflicts first, and again once every instance records identities.
+func (a *Api) migrateIdentities(store Storage, dryRun bool, now time.Time) (*MigrationResult, error) {
+	reports, err := a.findDuplicateReports(store)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrationResult{Name: MIGRATION_IDENTITIES, DryRun: dryRun}
+	ownerUserIDs := map[string]string{}
+	for _, report := range reports {
+		ownerUserIDs[NormalizeIdentityKey(report.Email)] = report.SurvivorUserID
+		result.Conflicts = append(result.Conflicts, report)
+	}
+
+	if result.Migrated, err = store.RecordIdentities(ownerUserIDs, dryRun); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// migrateConfirmations records the expiry time as a date of the confirmations stored without one, as
+// those stored before confirmations expired in the store are, so that the store removes them once they
+// expire
+func (a *Api) migrateConfirmations(store Storage, dryRun bool, now time.Time) (*MigrationResult, error) {
+	confirmationIDs, err := store.RecordConfirmationExpiries(dryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &MigrationResult{Name: MIGRATION_CONFIRMATIONS, DryRun: dryRun, Migrated: confirmationIDs}, nil
+}
+
+// searchAllUsers returns every user matching the search, reading the results a page at a time
+func searchAllUsers(store Storage, search *UserSearch) ([]*User, error) {
+	search.Sort = USER_SEARCH_SORT_CREATED_TIME
+	search.Limit = userSearchMaxLimit
+	search.Cursor = nil
+
+	all := []*User{}
+	for {
+		users, err := store.SearchUsers(search)
+		if err != nil {
+			return nil, err
+		}
+		more := len(users) > search.Limit
+		if more {
+			users = users[:search.Limit]
+		}
+		all = append(all, users...)
+		if !more {
+			return all, nil
+		}
+		search.Cursor = search.NextCursor(users)
+	}
+}
+
+// RunMigration runs the named migration, or with dryRun=true reports what it would change.
+// Migrations backfill records stored before a change, and are run once every instance runs
+// the version that needs them.
+// status: 200 MigrationResult
+// status: 400 STATUS_PARAMETER_UNKNOWN
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_MIGRATION_NOT_FOUND
+// status: 500 STATUS_ERR_MIGRATING
+func (a *Api) RunMigration(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	dryRun, dryRunErr := strconv.ParseBool(firstStringNotEmpty(req.URL.Query().Get("dryRun"), "false"))
+	tokenData := authorizedTokenData(req)
+	if migration, ok := migrations[vars["name"]]; !ok {
+		a.sendError(res, http.StatusNotFound, STATUS_MIGRATION_NOT_FOUND)
+
+	} else if dryRunErr != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_PARAMETER_UNKNOWN, dryRunErr)
+
+	} else if result, err := migration(a, a.Store.WithContext(req.Context()), dryRun, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_MIGRATING, err)
+
+	} else {
+		if !dryRun {
+			if event, err := NewAuditEvent(AUDIT_EVENT_MIGRATION_RUN, time.Now()); err != nil {
+				a.logger.Printf("Error creating %s audit event: %s", AUDIT_EVENT_MIGRATION_RUN, err)
+			} else {
+				event.ActorUserID = tokenData.UserId
+				event.Details = map[string]string{"name": result.Name, "migrated": strconv.Itoa(len(result.Migrated))}
+				a.audit(req, event)
+			}
+		}
+		a.logger.Printf("Migration %s migrated %d records (dry run %t)", result.Name, len(result.Migrated), dryRun)
+		sendModelAsRes(res, result)
+	}
+}
@@ -0,0 +1,95 @@
+package user
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+func Test_searchAllUsers(t *testing.T) {
+	page := []*User{}
+	for index := 0; index <= userSearchMaxLimit; index++ {
+		page = append(page, &User{Id: fmt.Sprintf("%010d", index), CreatedTime: "2016-01-01T00:00:00+00:00"})
+	}
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{page, nil}, {[]*User{{Id: "9999999999"}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	deleted := true
+	users, err := searchAllUsers(responsableStore, &UserSearch{Deleted: &deleted})
+	if err != nil || len(users) != userSearchMaxLimit+1 || users[userSearchMaxLimit].Id != "9999999999" {
+		t.Fatalf("Unexpected users: %d, %v", len(users), err)
+	}
+}
+
+func Test_MigrateCustodians(t *testing.T) {
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{
+		{Id: "1111111111", CustodianUserID: "0000000000"},
+		{Id: "2222222222"},
+		{Id: "3333333333"},
+	}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{
+		{clients.UsersPermissions{"2222222222": {"root": clients.Allowed}, "0000000000": {"custodian": clients.Allowed, "view": clients.Allowed}}, nil},
+		{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}, "4444444444": {"custodian": clients.Allowed}}, nil},
+	}
+	responsableStore.UpsertUserResponses = []error{nil}
+	defer expectResponsablesEmpty(t)
+
+	result, err := responsableShoreline.migrateCustodians(responsableStore, false, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(result.Migrated, []string{"2222222222"}) {
+		t.Fatalf("Unexpected migrated users: %v", result.Migrated)
+	}
+	if !reflect.DeepEqual(result.Conflicts, []interface{}{&CustodianConflict{UserID: "3333333333", CustodianUserIDs: []string{"0000000000", "4444444444"}}}) {
+		t.Fatalf("Unexpected conflicts: %v", result.Conflicts)
+	}
+}
+
+func Test_MigrateCustodians_DryRun(t *testing.T) {
+	responsableStore.SearchUsersResponses = []SearchUsersResponse{{[]*User{{Id: "2222222222"}}, nil}}
+	responsableGatekeeper.UsersInGroupResponses = []UsersPermissionsResponse{{clients.UsersPermissions{"0000000000": {"custodian": clients.Allowed}}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	result, err := responsableShoreline.migrateCustodians(responsableStore, true, time.Now())
+	if err != nil || !reflect.DeepEqual(result.Migrated, []string{"2222222222"}) || len(result.Conflicts) != 0 {
+		t.Fatalf("Unexpected result: %v, %v", result, err)
+	}
+}
+
+func Test_MigrateIdentities(t *testing.T) {
+	responsableStore.FindDuplicateEmailsResponses = []FindDuplicateEmailsResponse{{[]*DuplicateEmail{{Email: "a@z.co", UserIDs: []string{"1111111111", "2222222222"}}}, nil}}
+	responsableStore.FindUsersWithIdsResponses = []FindUsersWithIdsResponse{{[]*User{
+		{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}},
+		{Id: "2222222222", Username: "a@z.co", Emails: []string{"a@z.co"}, PwHash: "hash"},
+	}, nil}}
+	responsableStore.RecordIdentitiesResponses = []RecordIdentitiesResponse{{[]string{"1111111111", "2222222222"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	result, err := responsableShoreline.migrateIdentities(responsableStore, true, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if !reflect.DeepEqual(result.Migrated, []string{"1111111111", "2222222222"}) {
+		t.Fatalf("Unexpected migrated users: %v", result.Migrated)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].(*DuplicateReport).SurvivorUserID != "2222222222" {
+		t.Fatalf("Unexpected conflicts: %v", result.Conflicts)
+	}
+}
+
+func Test_MigrateConfirmations(t *testing.T) {
+	responsableStore.RecordConfirmationExpiriesResponses = []RecordConfirmationExpiriesResponse{{[]string{"abc"}, nil}}
+	defer expectResponsablesEmpty(t)
+
+	result, err := responsableShoreline.migrateConfirmations(responsableStore, false, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %#v", err)
+	}
+	if result.Name != MIGRATION_CONFIRMATIONS || !reflect.DeepEqual(result.Migrated, []string{"abc"}) {
+		t.Fatalf("Unexpected migration result: %#v", result)
+	}
+}
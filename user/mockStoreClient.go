@@ -3,6 +3,7 @@ package user
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 type MockStoreClient struct {
@@ -153,3 +154,234 @@ func (d MockStoreClient) RemoveTokenByID(id string) error {
 	}
 	return nil
 }
+
+func (d MockStoreClient) RemoveTokensForUser(userID string) error {
+	if d.doBad {
+		return errors.New("RemoveTokensForUser failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UpsertDeletionJob(job *DeletionJob) error {
+	if d.doBad {
+		return errors.New("UpsertDeletionJob failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindDeletionJobsForUser(userID string) ([]*DeletionJob, error) {
+	if d.doBad {
+		return nil, errors.New("FindDeletionJobsForUser failure")
+	}
+	return []*DeletionJob{}, nil
+}
+
+func (d MockStoreClient) ClaimDeletionJobDue(scheduledBefore time.Time, leaseOwner string, leaseExpires time.Time) (*DeletionJob, error) {
+	if d.doBad {
+		return nil, errors.New("ClaimDeletionJobDue failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) FindTokensForUser(userID string) ([]*SessionToken, error) {
+	if d.doBad {
+		return nil, errors.New("FindTokensForUser failure")
+	}
+	return []*SessionToken{}, nil
+}
+
+func (d MockStoreClient) AddConfirmation(confirmation *Confirmation) error {
+	if d.doBad {
+		return errors.New("AddConfirmation failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UseConfirmation(id string, usedTime time.Time) (*Confirmation, error) {
+	if d.doBad {
+		return nil, errors.New("UseConfirmation failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) FindConfirmationsForUser(userID string, confirmationType string) ([]*Confirmation, error) {
+	if d.doBad {
+		return nil, errors.New("FindConfirmationsForUser failure")
+	}
+	return []*Confirmation{}, nil
+}
+
+func (d MockStoreClient) SearchUsers(search *UserSearch) ([]*User, error) {
+	if d.doBad {
+		return nil, errors.New("SearchUsers failure")
+	}
+	return []*User{}, nil
+}
+
+func (d MockStoreClient) CountUsers(search *UserSearch) (int, error) {
+	if d.doBad {
+		return 0, errors.New("CountUsers failure")
+	}
+	return 0, nil
+}
+
+func (d MockStoreClient) FindUsersWithEmails(emails []string) ([]*User, error) {
+	if d.doBad {
+		return nil, errors.New("FindUsersWithEmails failure")
+	}
+	return []*User{}, nil
+}
+
+func (d MockStoreClient) AddAuditEvent(event *AuditEvent) error {
+	if d.doBad {
+		return errors.New("AddAuditEvent failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindAuditEvents(query *AuditQuery) ([]*AuditEvent, error) {
+	if d.doBad {
+		return nil, errors.New("FindAuditEvents failure")
+	}
+	return []*AuditEvent{}, nil
+}
+
+func (d MockStoreClient) AddConsentRecord(record *ConsentRecord) error {
+	if d.doBad {
+		return errors.New("AddConsentRecord failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindConsentRecords(userID string) ([]*ConsentRecord, error) {
+	if d.doBad {
+		return nil, errors.New("FindConsentRecords failure")
+	}
+	return []*ConsentRecord{}, nil
+}
+
+func (d MockStoreClient) FindUsersByCustodian(custodianUserID string) ([]*User, error) {
+	if d.doBad {
+		return nil, errors.New("FindUsersByCustodian failure")
+	}
+	return []*User{}, nil
+}
+
+func (d MockStoreClient) FindDuplicateEmails() ([]*DuplicateEmail, error) {
+	if d.doBad {
+		return nil, errors.New("FindDuplicateEmails failure")
+	}
+	return []*DuplicateEmail{}, nil
+}
+
+func (d MockStoreClient) AddSignupCode(code *SignupCode) error {
+	if d.doBad {
+		return errors.New("AddSignupCode failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindSignupCode(code string) (*SignupCode, error) {
+	if d.doBad {
+		return nil, errors.New("FindSignupCode failure")
+	}
+	return nil, nil
+}
+
+func (d MockStoreClient) FindSignupCodes() ([]*SignupCode, error) {
+	if d.doBad {
+		return nil, errors.New("FindSignupCodes failure")
+	}
+	return []*SignupCode{}, nil
+}
+
+func (d MockStoreClient) UseSignupCode(code string, usedTime time.Time) (*SignupCode, error) {
+	if d.doBad {
+		return nil, errors.New("UseSignupCode failure")
+	}
+	return &SignupCode{Code: code, Uses: 1}, nil
+}
+
+func (d MockStoreClient) ReleaseSignupCode(code string) error {
+	if d.doBad {
+		return errors.New("ReleaseSignupCode failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) RemoveSignupCode(code string) error {
+	if d.doBad {
+		return errors.New("RemoveSignupCode failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) UpsertOrganizationDomain(domain *OrganizationDomain) error {
+	if d.doBad {
+		return errors.New("UpsertOrganizationDomain failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) FindOrganizationDomains() ([]*OrganizationDomain, error) {
+	if d.doBad {
+		return nil, errors.New("FindOrganizationDomains failure")
+	}
+	return []*OrganizationDomain{}, nil
+}
+
+func (d MockStoreClient) RemoveOrganizationDomain(domain string) error {
+	if d.doBad {
+		return errors.New("RemoveOrganizationDomain failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) RecordIdentities(ownerUserIDs map[string]string, dryRun bool) ([]string, error) {
+	if d.doBad {
+		return nil, errors.New("RecordIdentities failure")
+	}
+	return []string{}, nil
+}
+
+func (d MockStoreClient) RemoveConfirmationsForUser(userID string) error {
+	if d.doBad {
+		return errors.New("RemoveConfirmationsForUser failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) RemoveConsentRecords(userID string) error {
+	if d.doBad {
+		return errors.New("RemoveConsentRecords failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) RemoveSignupCodesForEmails(emails []string) error {
+	if d.doBad {
+		return errors.New("RemoveSignupCodesForEmails failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) AnonymizeAuditEvents(userID string, emails []string) error {
+	if d.doBad {
+		return errors.New("AnonymizeAuditEvents failure")
+	}
+	return nil
+}
+
+func (d MockStoreClient) RecordConfirmationExpiries(dryRun bool) ([]string, error) {
+	if d.doBad {
+		return nil, errors.New("RecordConfirmationExpiries failure")
+	}
+	return []string{}, nil
+}
+
+func (d MockStoreClient) ReleaseDeletionJob(job *DeletionJob, leaseOwner string) error {
+	if d.doBad {
+		return errors.New("ReleaseDeletionJob failure")
+	}
+	return nil
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
+	"regexp"
 	"sort"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -14,9 +19,16 @@ import (
 )
 
 const (
-	usersCollectionName  = "users"
-	tokensCollectionName = "tokens"
-	userStoreAPIPrefix   = "api/user/store "
+	usersCollectionName         = "users"
+	tokensCollectionName        = "tokens"
+	deletionJobsCollectionName  = "deletionJobs"
+	confirmationsCollectionName = "confirmations"
+	auditEventsCollectionName   = "auditEvents"
+	consentsCollectionName      = "consents"
+	identitiesCollectionName    = "identities"
+	signupCodesCollectionName   = "signupCodes"
+	domainsCollectionName       = "organizationDomains"
+	userStoreAPIPrefix          = "api/user/store "
 )
 
 // Because the `users` collection already exists on all environments (especially `prd`),
@@ -87,6 +99,43 @@ func (msc *MongoStoreClient) EnsureIndexes() error {
 				SetCollation(usersCollation).
 				SetBackground(true),
 		},
+		{
+			Keys: bson.D{{Key: "canonicalEmails", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "createdTime", Value: 1}, {Key: "userid", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "modifiedTime", Value: 1}, {Key: "userid", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "userid", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "roles", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "custodianUserId", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetSparse(true).
+				SetBackground(true),
+		},
 	}
 
 	if _, err := usersCollection(msc).Indexes().CreateMany(context.Background(), usersIndexes); err != nil {
@@ -102,15 +151,117 @@ func (msc *MongoStoreClient) EnsureIndexes() error {
 				SetExpireAfterSeconds(0).
 				SetBackground(true),
 		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().
+				SetName("TokensByUser").
+				SetBackground(true),
+		},
 	}
 
 	if _, err := tokensCollection(msc).Indexes().CreateMany(context.Background(), tokenIndexes); err != nil {
 		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create token indexes: %s", err))
 	}
 
+	deletionJobIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+		{
+			Keys:    bson.D{{Key: "state", Value: 1}, {Key: "scheduledTime", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+	}
+
+	if _, err := deletionJobsCollection(msc).Indexes().CreateMany(context.Background(), deletionJobIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create deletion job indexes: %s", err))
+	}
+
+	confirmationIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "type", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+		{
+			Keys: bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().
+				SetName("ExpireConfirmations").
+				SetExpireAfterSeconds(0).
+				SetBackground(true),
+		},
+	}
+
+	if _, err := confirmationsCollection(msc).Indexes().CreateMany(context.Background(), confirmationIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create confirmation indexes: %s", err))
+	}
+
+	auditEventIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetBackground(true),
+		},
+		{
+			Keys:    bson.D{{Key: "actorUserId", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetBackground(true),
+		},
+		{
+			Keys:    bson.D{{Key: "targetUserId", Value: 1}, {Key: "time", Value: -1}},
+			Options: options.Index().SetBackground(true),
+		},
+	}
+
+	if _, err := auditEventsCollection(msc).Indexes().CreateMany(context.Background(), auditEventIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create audit event indexes: %s", err))
+	}
+
+	consentIndexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}, {Key: "time", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+	}
+
+	if _, err := consentsCollection(msc).Indexes().CreateMany(context.Background(), consentIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create consent indexes: %s", err))
+	}
+
+	identityIndexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().
+				SetCollation(usersCollation).
+				SetUnique(true).
+				SetBackground(true),
+		},
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().SetBackground(true),
+		},
+	}
+
+	if _, err := identitiesCollection(msc).Indexes().CreateMany(context.Background(), identityIndexes); err != nil {
+		log.Fatal(userStoreAPIPrefix, fmt.Sprintf("Unable to create identity indexes: %s", err))
+	}
+
 	return nil
 }
 
+// userOptionalFields are the bson names of the User fields that are omitted when empty.
+// UpsertUser removes any of these fields from the stored document when they are empty
+// on the given user, so that clearing a field (e.g. restoring a deleted user) persists.
+var userOptionalFields = func() []string {
+	fields := []string{}
+	userType := reflect.TypeOf(User{})
+	for index := 0; index < userType.NumField(); index++ {
+		tag := strings.Split(userType.Field(index).Tag.Get("bson"), ",")
+		if len(tag) > 1 && tag[0] != "userid" && tag[1] == "omitempty" {
+			fields = append(fields, tag[0])
+		}
+	}
+	return fields
+}()
+
 func usersCollection(msc *MongoStoreClient) *mongo.Collection {
 	return msc.client.Database(msc.database).Collection(usersCollectionName)
 }
@@ -119,6 +270,34 @@ func tokensCollection(msc *MongoStoreClient) *mongo.Collection {
 	return msc.client.Database(msc.database).Collection(tokensCollectionName)
 }
 
+func deletionJobsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(deletionJobsCollectionName)
+}
+
+func confirmationsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(confirmationsCollectionName)
+}
+
+func auditEventsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(auditEventsCollectionName)
+}
+
+func consentsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(consentsCollectionName)
+}
+
+func identitiesCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(identitiesCollectionName)
+}
+
+func signupCodesCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(signupCodesCollectionName)
+}
+
+func domainsCollection(msc *MongoStoreClient) *mongo.Collection {
+	return msc.client.Database(msc.database).Collection(domainsCollectionName)
+}
+
 // Ping the MongoDB database
 func (msc *MongoStoreClient) Ping() error {
 	// do we have a store session
@@ -131,25 +310,183 @@ func (msc *MongoStoreClient) Disconnect() error {
 }
 
 // UpsertUser - Update an existing user's details, or insert a new user if the user doesn't already exist.
+// The update only applies if the stored user has the given user's revision, otherwise ErrUserRevisionConflict
+// is returned. The user's username and emails are claimed as identities first, and ErrUserIdentityConflict
+// is returned if one belongs to another user; identities the user no longer has are released after.
+// On success the user's revision is incremented.
 func (msc *MongoStoreClient) UpsertUser(user *User) error {
 	if user.Roles != nil {
 		sort.Strings(user.Roles)
 	}
 
-	// if the user already exists we update otherwise we add
+	keys := user.IdentityKeys()
+	user.CanonicalEmails = keys
+	claimed, err := msc.claimIdentities(user.Id, keys)
+	if err != nil {
+		msc.releaseIdentities(user.Id, claimed)
+		return err
+	}
+	if err := msc.upsertUser(user); err != nil {
+		msc.releaseIdentities(user.Id, claimed)
+		return err
+	}
+	if _, err := identitiesCollection(msc).DeleteMany(msc.context, bson.M{"userId": user.Id, "key": bson.M{"$nin": keys}}); err != nil {
+		log.Printf("%sError releasing identities of user %s: %s", userStoreAPIPrefix, user.Id, err)
+	}
+	return nil
+}
+
+func (msc *MongoStoreClient) upsertUser(user *User) error {
+
+	set, err := bson.Marshal(user)
+	if err != nil {
+		return err
+	}
+	var setFields bson.M
+	if err = bson.Unmarshal(set, &setFields); err != nil {
+		return err
+	}
+	setFields["revision"] = user.Revision + 1
+	unsetFields := bson.M{}
+	for _, field := range userOptionalFields {
+		if _, ok := setFields[field]; !ok {
+			unsetFields[field] = ""
+		}
+	}
+
+	update := bson.D{{Key: "$set", Value: setFields}}
+	if len(unsetFields) > 0 {
+		update = append(update, bson.E{Key: "$unset", Value: unsetFields})
+	}
+
+	// users stored before revisions were introduced have no revision
+	filter := bson.M{"userid": user.Id, "revision": user.Revision}
+	if user.Revision == 0 {
+		filter["revision"] = bson.M{"$exists": false}
+	}
+
+	// if the user already exists we update otherwise we add; a user that exists with another
+	// revision fails to be added again with a duplicate key error
 	opts := options.FindOneAndUpdate().SetUpsert(true).SetCollation(usersCollation)
-	result := usersCollection(msc).FindOneAndUpdate(msc.context, bson.M{"userid": user.Id}, bson.D{{Key: "$set", Value: user}}, opts)
-	if result.Err() != mongo.ErrNoDocuments {
-		return result.Err()
+	result := usersCollection(msc).FindOneAndUpdate(msc.context, filter, update, opts)
+	if err := result.Err(); err != nil && err != mongo.ErrNoDocuments {
+		if isDuplicateKeyError(err) {
+			return ErrUserRevisionConflict
+		}
+		return err
 	}
+	user.Revision++
 	return nil
 }
 
+// claimIdentities claims the identity keys for the user and returns the keys newly claimed. A key
+// belonging to another user is only accepted if the stored user already has it, as users sharing an
+// email before identities were recorded do until they are merged.
+func (msc *MongoStoreClient) claimIdentities(userID string, keys []string) ([]string, error) {
+	claimed := []string{}
+	for _, key := range keys {
+		if _, err := identitiesCollection(msc).InsertOne(msc.context, &Identity{Key: key, UserID: userID}); err == nil {
+			claimed = append(claimed, key)
+			continue
+		} else if !isDuplicateKeyError(err) {
+			return claimed, err
+		}
+
+		var holder Identity
+		opts := options.FindOne().SetCollation(usersCollation)
+		if err := identitiesCollection(msc).FindOne(msc.context, bson.M{"key": key}, opts).Decode(&holder); err != nil {
+			return claimed, err
+		} else if holder.UserID == userID {
+			continue
+		}
+
+		filter := bson.M{"userid": userID, "$or": []bson.M{{"username": key}, {"emails": key}}}
+		if count, err := usersCollection(msc).CountDocuments(msc.context, filter, options.Count().SetCollation(usersCollation)); err != nil {
+			return claimed, err
+		} else if count == 0 {
+			return claimed, ErrUserIdentityConflict
+		}
+	}
+	return claimed, nil
+}
+
+// releaseIdentities releases identity keys claimed for the user by a failed update
+func (msc *MongoStoreClient) releaseIdentities(userID string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	if _, err := identitiesCollection(msc).DeleteMany(msc.context, bson.M{"userId": userID, "key": bson.M{"$in": keys}}); err != nil {
+		log.Printf("%sError releasing identities of user %s: %s", userStoreAPIPrefix, userID, err)
+	}
+}
+
+// RecordIdentities records the identities of the users stored without them, as users stored before
+// identities were or by instances that did not yet record them are, and returns the ids of the users
+// with identities newly recorded, or that would be with dryRun. A key in ownerUserIDs, such as one
+// shared by several users, is only recorded for its owner; the other users sharing it are still
+// accepted by UpsertUser until they are merged.
+func (msc *MongoStoreClient) RecordIdentities(ownerUserIDs map[string]string, dryRun bool) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"userid": 1, "username": 1, "emails": 1})
+	cursor, err := usersCollection(msc).Find(msc.context, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(msc.context)
+
+	userIDs := []string{}
+	for cursor.Next(msc.context) {
+		var user User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, err
+		}
+		recorded := false
+		for _, key := range user.IdentityKeys() {
+			if ownerUserID, ok := ownerUserIDs[key]; ok && ownerUserID != user.Id {
+				continue
+			}
+			if dryRun {
+				if count, err := identitiesCollection(msc).CountDocuments(msc.context, bson.M{"key": key}, options.Count().SetCollation(usersCollation)); err != nil {
+					return nil, err
+				} else if count == 0 {
+					recorded = true
+				}
+			} else if _, err := identitiesCollection(msc).InsertOne(msc.context, &Identity{Key: key, UserID: user.Id}); err == nil {
+				recorded = true
+			} else if !isDuplicateKeyError(err) {
+				return nil, err
+			}
+		}
+		if recorded {
+			userIDs = append(userIDs, user.Id)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return userIDs, nil
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.CommandError:
+		return e.Code == 11000
+	case mongo.WriteException:
+		for _, writeError := range e.WriteErrors {
+			if writeError.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // FindUser - find and return an existing user
 func (msc *MongoStoreClient) FindUser(user *User) (result *User, err error) {
 	if user.Id != "" {
 		opts := options.FindOne().SetCollation(usersCollation)
-		if err = usersCollection(msc).FindOne(msc.context, bson.M{"userid": user.Id}, opts).Decode(&result); err != nil {
+		if err = usersCollection(msc).FindOne(msc.context, bson.M{"userid": user.Id}, opts).Decode(&result); err == mongo.ErrNoDocuments {
+			return nil, nil
+		} else if err != nil {
 			return result, err
 		}
 	}
@@ -170,6 +507,9 @@ func (msc *MongoStoreClient) FindUsers(user *User) (results []*User, err error)
 	if len(user.Emails) > 0 {
 		fieldsToMatch = append(fieldsToMatch, bson.M{"emails": bson.M{"$in": user.Emails}})
 	}
+	if canonicalEmails := CanonicalEmails(append([]string{user.Username}, user.Emails...)); len(canonicalEmails) > 0 {
+		fieldsToMatch = append(fieldsToMatch, bson.M{"canonicalEmails": bson.M{"$in": canonicalEmails}})
+	}
 
 	if len(fieldsToMatch) == 0 {
 		return []*User{}, nil
@@ -213,6 +553,25 @@ func (msc *MongoStoreClient) FindUsersByRole(role string) (results []*User, err
 	return results, nil
 }
 
+// FindUsersByCustodian - find and return the custodial users of a custodian
+func (msc *MongoStoreClient) FindUsersByCustodian(custodianUserID string) (results []*User, err error) {
+	opts := options.Find().SetCollation(usersCollation)
+	cursor, err := usersCollection(msc).Find(msc.context, bson.M{"custodianUserId": custodianUserID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*User{}
+	}
+
+	return results, nil
+}
+
 // FindUsersWithIds - find and return multiple users by Tidepool User ID
 func (msc *MongoStoreClient) FindUsersWithIds(ids []string) (results []*User, err error) {
 	opts := options.Find().SetCollation(usersCollation)
@@ -233,14 +592,201 @@ func (msc *MongoStoreClient) FindUsersWithIds(ids []string) (results []*User, er
 	return results, nil
 }
 
+// FindUsersWithEmails - find and return multiple users by username or email
+func (msc *MongoStoreClient) FindUsersWithEmails(emails []string) (results []*User, err error) {
+	filter := bson.M{"$or": []bson.M{{"username": bson.M{"$in": emails}}, {"emails": bson.M{"$in": emails}}, {"canonicalEmails": bson.M{"$in": CanonicalEmails(emails)}}}}
+	opts := options.Find().SetCollation(usersCollation)
+	cursor, err := usersCollection(msc).Find(msc.context, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		log.Printf("no users found: query: emails: %v", emails)
+		results = []*User{}
+	}
+
+	return results, nil
+}
+
+// FindDuplicateEmails - find the usernames and emails shared by more than one user, compared by their
+// canonical forms, or for users stored before those were, with the users collation as logins compare them
+func (msc *MongoStoreClient) FindDuplicateEmails() (results []*DuplicateEmail, err error) {
+	pipeline := []bson.M{
+		{"$project": bson.M{
+			"userid": 1,
+			"addresses": bson.M{"$ifNull": []interface{}{"$canonicalEmails", bson.M{"$setUnion": []interface{}{
+				bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{"$username", nil}}, []interface{}{"$username"}, []interface{}{}}},
+				bson.M{"$ifNull": []interface{}{"$emails", []interface{}{}}},
+			}}}},
+		}},
+		{"$unwind": "$addresses"},
+		{"$group": bson.M{"_id": "$addresses", "userIds": bson.M{"$addToSet": "$userid"}}},
+		{"$match": bson.M{"userIds.1": bson.M{"$exists": true}}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+	opts := options.Aggregate().SetCollation(usersCollation).SetAllowDiskUse(true)
+	cursor, err := usersCollection(msc).Aggregate(msc.context, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*DuplicateEmail{}
+	}
+
+	return results, nil
+}
+
+// SearchUsers - find and return a page of users matching a search, one more than the search
+// limit so the caller can tell whether there is a next page
+func (msc *MongoStoreClient) SearchUsers(search *UserSearch) (results []*User, err error) {
+	filter := userSearchFilter(search)
+	if search.Cursor != nil {
+		filter = bson.M{"$and": []bson.M{filter, userSearchCursorFilter(search)}}
+	}
+
+	direction := 1
+	if search.Descending {
+		direction = -1
+	}
+	opts := options.Find().
+		SetCollation(usersCollation).
+		SetSort(bson.D{{Key: search.Sort, Value: direction}, {Key: "userid", Value: direction}}).
+		SetLimit(int64(search.Limit + 1))
+	cursor, err := usersCollection(msc).Find(msc.context, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*User{}
+	}
+
+	return results, nil
+}
+
+// CountUsers - count the users matching a search, ignoring its cursor and limit
+func (msc *MongoStoreClient) CountUsers(search *UserSearch) (int, error) {
+	opts := options.Count().SetCollation(usersCollation)
+	count, err := usersCollection(msc).CountDocuments(msc.context, userSearchFilter(search), opts)
+	return int(count), err
+}
+
+// userSearchFilter returns the query matching the search's filters
+func userSearchFilter(search *UserSearch) bson.M {
+	filters := []bson.M{}
+
+	if search.EmailPrefix != "" {
+		prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(search.EmailPrefix), Options: "i"}
+		filters = append(filters, bson.M{"$or": []bson.M{{"username": prefix}, {"emails": prefix}}})
+	}
+	if search.Role != "" {
+		filters = append(filters, bson.M{"roles": search.Role})
+	}
+	if search.EmailVerified != nil {
+		if *search.EmailVerified {
+			filters = append(filters, bson.M{"authenticated": true})
+		} else {
+			filters = append(filters, bson.M{"authenticated": bson.M{"$ne": true}})
+		}
+	}
+	if timeRange := userSearchTimeRange(search.CreatedFrom, search.CreatedTo); timeRange != nil {
+		filters = append(filters, bson.M{"createdTime": timeRange})
+	}
+	if timeRange := userSearchTimeRange(search.ModifiedFrom, search.ModifiedTo); timeRange != nil {
+		filters = append(filters, bson.M{"modifiedTime": timeRange})
+	}
+	switch search.AccountType {
+	case USER_SEARCH_ACCOUNT_CUSTODIAL:
+		filters = append(filters, bson.M{"pwhash": bson.M{"$in": bson.A{nil, ""}}})
+	case USER_SEARCH_ACCOUNT_PASSWORD:
+		filters = append(filters, bson.M{"pwhash": bson.M{"$nin": bson.A{nil, ""}}})
+	}
+	if search.Deleted != nil {
+		filters = append(filters, bson.M{"deletedTime": bson.M{"$exists": *search.Deleted}})
+	}
+	if search.Suspended != nil {
+		filters = append(filters, bson.M{"suspendedTime": bson.M{"$exists": *search.Suspended}})
+	}
+	if search.TermsAccepted != nil {
+		accepted := bson.M{"termsAcceptances.version": search.TermsVersion}
+		if search.TermsInitial {
+			// users who accepted the terms before versions were recorded accepted the initial version
+			legacy := bson.M{"termsAccepted": bson.M{"$nin": []interface{}{nil, ""}}, "termsAcceptances.0": bson.M{"$exists": false}}
+			accepted = bson.M{"$or": []bson.M{accepted, legacy}}
+		}
+		if *search.TermsAccepted {
+			filters = append(filters, accepted)
+		} else {
+			filters = append(filters, bson.M{"$nor": []bson.M{accepted}})
+		}
+	}
+
+	if len(filters) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": filters}
+}
+
+func userSearchTimeRange(from string, to string) bson.M {
+	if from == "" && to == "" {
+		return nil
+	}
+	timeRange := bson.M{}
+	if from != "" {
+		timeRange["$gte"] = from
+	}
+	if to != "" {
+		timeRange["$lt"] = to
+	}
+	return timeRange
+}
+
+// userSearchCursorFilter returns the query matching users after the search's cursor in the
+// search's order. Users without the sort field sort before all others in ascending order.
+func userSearchCursorFilter(search *UserSearch) bson.M {
+	after, userAfter := "$gt", "$gt"
+	if search.Descending {
+		after, userAfter = "$lt", "$lt"
+	}
+
+	var equal interface{} = search.Cursor.Value
+	if search.Cursor.Value == "" {
+		equal = bson.M{"$in": bson.A{nil, ""}}
+	}
+
+	conditions := []bson.M{
+		{search.Sort: bson.M{after: search.Cursor.Value}},
+		{search.Sort: equal, "userid": bson.M{userAfter: search.Cursor.UserID}},
+	}
+	if search.Descending && search.Cursor.Value != "" {
+		conditions = append(conditions, bson.M{search.Sort: nil})
+	}
+	return bson.M{"$or": conditions}
+}
+
 // RemoveUser - Remove a user from the database
 func (msc *MongoStoreClient) RemoveUser(user *User) (err error) {
 	opts := options.FindOneAndDelete().SetCollation(usersCollation)
 	result := usersCollection(msc).FindOneAndDelete(msc.context, bson.M{"userid": user.Id}, opts)
-	if result.Err() != mongo.ErrNoDocuments {
+	if result.Err() != nil && result.Err() != mongo.ErrNoDocuments {
 		return result.Err()
 	}
-	return nil
+	_, err = identitiesCollection(msc).DeleteMany(msc.context, bson.M{"userId": user.Id})
+	return err
 }
 
 // AddToken to the token collection
@@ -273,3 +819,387 @@ func (msc *MongoStoreClient) RemoveTokenByID(id string) (err error) {
 	}
 	return nil
 }
+
+// RemoveTokensForUser - delete all auth tokens belonging to a user
+func (msc *MongoStoreClient) RemoveTokensForUser(userID string) error {
+	_, err := tokensCollection(msc).DeleteMany(msc.context, bson.M{"userId": userID})
+	return err
+}
+
+// FindTokensForUser - find all session tokens for a user
+func (msc *MongoStoreClient) FindTokensForUser(userID string) (results []*SessionToken, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := tokensCollection(msc).Find(msc.context, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*SessionToken{}
+	}
+
+	return results, nil
+}
+
+// UpsertDeletionJob - Update an existing deletion job, or insert a new one if it doesn't already exist
+func (msc *MongoStoreClient) UpsertDeletionJob(job *DeletionJob) error {
+	opts := options.FindOneAndUpdate().SetUpsert(true)
+	result := deletionJobsCollection(msc).FindOneAndUpdate(msc.context, bson.M{"_id": job.ID}, bson.D{{Key: "$set", Value: job}}, opts)
+	if result.Err() != mongo.ErrNoDocuments {
+		return result.Err()
+	}
+	return nil
+}
+
+// FindDeletionJobsForUser - find all deletion jobs for a user, most recent first
+func (msc *MongoStoreClient) FindDeletionJobsForUser(userID string) (results []*DeletionJob, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdTime", Value: -1}})
+	cursor, err := deletionJobsCollection(msc).Find(msc.context, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*DeletionJob{}
+	}
+
+	return results, nil
+}
+
+// ClaimDeletionJobDue - atomically lease the earliest pending deletion job scheduled to run before the
+// given time that no other owner holds an unexpired lease on, and that leaseOwner has not released, to
+// leaseOwner until leaseExpires, returning the claimed job, or nil if there is none
+func (msc *MongoStoreClient) ClaimDeletionJobDue(scheduledBefore time.Time, leaseOwner string, leaseExpires time.Time) (*DeletionJob, error) {
+	var job DeletionJob
+	selector := bson.M{
+		"state":         DELETION_JOB_STATE_PENDING,
+		"scheduledTime": bson.M{"$lte": scheduledBefore.UTC().Format(TimestampFormat)},
+		"leaseOwner":    bson.M{"$ne": leaseOwner},
+		"$or": []bson.M{
+			{"leaseExpiresTime": bson.M{"$exists": false}},
+			{"leaseExpiresTime": bson.M{"$lte": time.Now().UTC().Format(TimestampFormat)}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"leaseOwner": leaseOwner, "leaseExpiresTime": leaseExpires.UTC().Format(TimestampFormat)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "scheduledTime", Value: 1}}).SetReturnDocument(options.After)
+	if err := deletionJobsCollection(msc).FindOneAndUpdate(msc.context, selector, update, opts).Decode(&job); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ReleaseDeletionJob - update a pending deletion job leased to leaseOwner and release its lease, keeping
+// leaseOwner so that the owner does not claim it again, or return ErrDeletionJobLeaseLost if the job
+// is no longer pending or leased to leaseOwner
+func (msc *MongoStoreClient) ReleaseDeletionJob(job *DeletionJob, leaseOwner string) error {
+	job.LeaseOwner = leaseOwner
+	job.LeaseExpiresTime = ""
+	selector := bson.M{"_id": job.ID, "state": DELETION_JOB_STATE_PENDING, "leaseOwner": leaseOwner}
+	update := bson.M{"$set": job, "$unset": bson.M{"leaseExpiresTime": ""}}
+	if result, err := deletionJobsCollection(msc).UpdateOne(msc.context, selector, update); err != nil {
+		return err
+	} else if result.MatchedCount == 0 {
+		return ErrDeletionJobLeaseLost
+	}
+	return nil
+}
+
+// AddConfirmation - Add a confirmation to the database
+func (msc *MongoStoreClient) AddConfirmation(confirmation *Confirmation) error {
+	_, err := confirmationsCollection(msc).InsertOne(msc.context, confirmation)
+	return err
+}
+
+// UseConfirmation - Mark an unused confirmation as used and return it, or nil if there is no unused confirmation with the id
+func (msc *MongoStoreClient) UseConfirmation(id string, usedTime time.Time) (*Confirmation, error) {
+	var confirmation Confirmation
+	selector := bson.M{"_id": id, "usedTime": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"usedTime": usedTime.UTC().Format(TimestampFormat)}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := confirmationsCollection(msc).FindOneAndUpdate(msc.context, selector, update, opts).Decode(&confirmation); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &confirmation, nil
+}
+
+// FindConfirmationsForUser - find all confirmations of a type for a user
+func (msc *MongoStoreClient) FindConfirmationsForUser(userID string, confirmationType string) (results []*Confirmation, err error) {
+	cursor, err := confirmationsCollection(msc).Find(msc.context, bson.M{"userId": userID, "type": confirmationType})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*Confirmation{}
+	}
+
+	return results, nil
+}
+
+// RecordConfirmationExpiries - record the expiry time as a date of the confirmations stored without
+// one, so that they expire, returning the ids of the confirmations recorded, or that would be with dryRun.
+// Confirmations whose expiry time cannot be parsed cannot be used, and expire at once.
+func (msc *MongoStoreClient) RecordConfirmationExpiries(dryRun bool) ([]string, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "expiresTime": 1})
+	cursor, err := confirmationsCollection(msc).Find(msc.context, bson.M{"expiresAt": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(msc.context)
+
+	ids := []string{}
+	for cursor.Next(msc.context) {
+		var confirmation Confirmation
+		if err := cursor.Decode(&confirmation); err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			expiresAt, err := time.Parse(TimestampFormat, confirmation.ExpiresTime)
+			if err != nil {
+				expiresAt = time.Now()
+			}
+			update := bson.M{"$set": bson.M{"expiresAt": expiresAt.UTC()}}
+			if _, err := confirmationsCollection(msc).UpdateOne(msc.context, bson.M{"_id": confirmation.ID}, update); err != nil {
+				return nil, err
+			}
+		}
+		ids = append(ids, confirmation.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// RemoveConfirmationsForUser - remove all confirmations of a user, used or not
+func (msc *MongoStoreClient) RemoveConfirmationsForUser(userID string) error {
+	_, err := confirmationsCollection(msc).DeleteMany(msc.context, bson.M{"userId": userID})
+	return err
+}
+
+// AddAuditEvent - Append an event to the audit log
+func (msc *MongoStoreClient) AddAuditEvent(event *AuditEvent) error {
+	_, err := auditEventsCollection(msc).InsertOne(msc.context, event)
+	return err
+}
+
+// AnonymizeAuditEvents - remove the IP, user agent and details of the audit events caused by or
+// about a user, or of failed logins with any of the emails as given, keeping the events themselves
+func (msc *MongoStoreClient) AnonymizeAuditEvents(userID string, emails []string) error {
+	selectors := []bson.M{{"actorUserId": userID}, {"targetUserId": userID}}
+	if len(emails) > 0 {
+		selectors = append(selectors, bson.M{"details.username": bson.M{"$in": emails}})
+	}
+	update := bson.M{"$unset": bson.M{"ip": "", "userAgent": "", "details": ""}}
+	_, err := auditEventsCollection(msc).UpdateMany(msc.context, bson.M{"$or": selectors}, update)
+	return err
+}
+
+// FindAuditEvents - find and return audit events matching a query, newest first, and one more
+// than the query limit so the caller can tell whether there is a next page
+func (msc *MongoStoreClient) FindAuditEvents(query *AuditQuery) (results []*AuditEvent, err error) {
+	filters := []bson.M{}
+	if len(query.Types) > 0 {
+		filters = append(filters, bson.M{"type": bson.M{"$in": query.Types}})
+	}
+	if query.ActorUserID != "" {
+		filters = append(filters, bson.M{"actorUserId": query.ActorUserID})
+	}
+	if query.TargetUserID != "" {
+		filters = append(filters, bson.M{"targetUserId": query.TargetUserID})
+	}
+	if query.UserID != "" {
+		filters = append(filters, bson.M{"$or": []bson.M{{"actorUserId": query.UserID}, {"targetUserId": query.UserID}}})
+	}
+	if timeRange := userSearchTimeRange(query.From, query.To); timeRange != nil {
+		filters = append(filters, bson.M{"time": timeRange})
+	}
+	if query.Cursor != nil {
+		filters = append(filters, bson.M{"$or": []bson.M{
+			{"time": bson.M{"$lt": query.Cursor.Time}},
+			{"time": query.Cursor.Time, "_id": bson.M{"$lt": query.Cursor.ID}},
+		}})
+	}
+
+	filter := bson.M{}
+	if len(filters) > 0 {
+		filter = bson.M{"$and": filters}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit + 1))
+	}
+	cursor, err := auditEventsCollection(msc).Find(msc.context, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*AuditEvent{}
+	}
+
+	return results, nil
+}
+
+// AddConsentRecord - Append a record to a user's consent ledger
+func (msc *MongoStoreClient) AddConsentRecord(record *ConsentRecord) error {
+	_, err := consentsCollection(msc).InsertOne(msc.context, record)
+	return err
+}
+
+// FindConsentRecords - find and return the consent records of a user in the order they were recorded
+func (msc *MongoStoreClient) FindConsentRecords(userID string) (results []*ConsentRecord, err error) {
+	// records stored before timeNanos was recorded have none, and sort first within their second
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "timeNanos", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := consentsCollection(msc).Find(msc.context, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*ConsentRecord{}
+	}
+
+	return results, nil
+}
+
+// RemoveConsentRecords - remove all consent records of a user
+func (msc *MongoStoreClient) RemoveConsentRecords(userID string) error {
+	_, err := consentsCollection(msc).DeleteMany(msc.context, bson.M{"userId": userID})
+	return err
+}
+
+// AddSignupCode - Add a signup code or invitation
+func (msc *MongoStoreClient) AddSignupCode(code *SignupCode) error {
+	_, err := signupCodesCollection(msc).InsertOne(msc.context, code)
+	return err
+}
+
+// FindSignupCode - find a signup code, or nil if there is none
+func (msc *MongoStoreClient) FindSignupCode(code string) (result *SignupCode, err error) {
+	if err = signupCodesCollection(msc).FindOne(msc.context, bson.M{"_id": code}).Decode(&result); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// FindSignupCodes - find and return all signup codes, most recently created first
+func (msc *MongoStoreClient) FindSignupCodes() (results []*SignupCode, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdTime", Value: -1}, {Key: "_id", Value: 1}})
+	cursor, err := signupCodesCollection(msc).Find(msc.context, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*SignupCode{}
+	}
+
+	return results, nil
+}
+
+// UseSignupCode - atomically count a use of a signup code that has not expired and has uses left,
+// returning the used code, or nil if the code cannot be used
+func (msc *MongoStoreClient) UseSignupCode(code string, usedTime time.Time) (*SignupCode, error) {
+	var signupCode SignupCode
+	selector := bson.M{
+		"_id":         code,
+		"expiresTime": bson.M{"$gt": usedTime.UTC().Format(TimestampFormat)},
+		"$or": []bson.M{
+			{"maxUses": 0},
+			{"$expr": bson.M{"$lt": []string{"$uses", "$maxUses"}}},
+		},
+	}
+	update := bson.M{"$inc": bson.M{"uses": 1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := signupCodesCollection(msc).FindOneAndUpdate(msc.context, selector, update, opts).Decode(&signupCode); err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &signupCode, nil
+}
+
+// ReleaseSignupCode - take back a use of a signup code by a signup that failed
+func (msc *MongoStoreClient) ReleaseSignupCode(code string) error {
+	_, err := signupCodesCollection(msc).UpdateOne(msc.context, bson.M{"_id": code, "uses": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"uses": -1}})
+	return err
+}
+
+// RemoveSignupCode - delete a signup code so that it can no longer be used
+func (msc *MongoStoreClient) RemoveSignupCode(code string) error {
+	_, err := signupCodesCollection(msc).DeleteOne(msc.context, bson.M{"_id": code})
+	return err
+}
+
+// RemoveSignupCodesForEmails - remove the invitations of any of the emails, ignoring case
+func (msc *MongoStoreClient) RemoveSignupCodesForEmails(emails []string) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	opts := options.Delete().SetCollation(usersCollation)
+	_, err := signupCodesCollection(msc).DeleteMany(msc.context, bson.M{"email": bson.M{"$in": emails}}, opts)
+	return err
+}
+
+// UpsertOrganizationDomain - Add or replace a verified organization domain
+func (msc *MongoStoreClient) UpsertOrganizationDomain(domain *OrganizationDomain) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := domainsCollection(msc).ReplaceOne(msc.context, bson.M{"_id": domain.Domain}, domain, opts)
+	return err
+}
+
+// FindOrganizationDomains - find and return all verified organization domains, in order
+func (msc *MongoStoreClient) FindOrganizationDomains() (results []*OrganizationDomain, err error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cursor, err := domainsCollection(msc).Find(msc.context, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cursor.All(msc.context, &results); err != nil {
+		return results, err
+	}
+
+	if results == nil {
+		results = []*OrganizationDomain{}
+	}
+
+	return results, nil
+}
+
+// RemoveOrganizationDomain - delete a verified organization domain
+func (msc *MongoStoreClient) RemoveOrganizationDomain(domain string) error {
+	_, err := domainsCollection(msc).DeleteOne(msc.context, bson.M{"_id": domain})
+	return err
+}
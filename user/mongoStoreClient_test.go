@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
+
 	tpMongo "github.com/tidepool-org/go-common/clients/mongo"
 )
 
@@ -324,6 +326,12 @@ xwIDAQAB
 		t.Fatalf("no token was returned when it should have been - err[%v]", err)
 	}
 
+	if found, err := mc.FindTokensForUser(testingTokenData.UserId); err != nil {
+		t.Fatalf("we could not find the tokens for the user %v", err)
+	} else if len(found) != 1 || found[0].ID != sessionToken.ID {
+		t.Fatalf("should only find token %s but found %v", sessionToken.ID, found)
+	}
+
 	if err := mc.RemoveTokenByID(sessionToken.ID); err != nil {
 		t.Fatalf("we could not remove the token %v", err)
 	}
@@ -335,3 +343,692 @@ xwIDAQAB
 	}
 
 }
+
+func TestMongoStore_RestoreUnsetsDeletedFields(t *testing.T) {
+
+	var (
+		testsFakeSalt = "some fake salt for the tests"
+		userName      = "test@foo.bar"
+		userPw        = "my0th3rT35t"
+		userDetail    = &NewUserDetails{Username: &userName, Emails: []string{userName}, Password: &userPw}
+	)
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	user, _ := NewUser(userDetail, testsFakeSalt)
+	user.MarkDeleted(user.Id, time.Now())
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not create the user %v", err)
+	}
+
+	// Restoring a user must remove the deleted fields from the stored document
+	user.Restore()
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not update the user %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if found.IsDeleted() {
+		t.Fatalf("the restored user is still marked deleted %v", found)
+	}
+}
+
+func TestMongoStoreDeletionJobOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	deletionJobsCollection(mc).Drop(context.Background())
+
+	/*
+	 * THE TESTS
+	 */
+	now := time.Now()
+	dueJob, _ := NewDeletionJob("1111111111", nil, now.Add(-time.Hour), now.Add(-2*time.Hour))
+	laterJob, _ := NewDeletionJob("2222222222", nil, now.Add(time.Hour), now)
+
+	if err := mc.UpsertDeletionJob(dueJob); err != nil {
+		t.Fatalf("we could not create the deletion job %v", err)
+	}
+	if err := mc.UpsertDeletionJob(laterJob); err != nil {
+		t.Fatalf("we could not create the deletion job %v", err)
+	}
+
+	leaseExpires := now.Add(deletionJobLeaseDuration)
+	if claimed, err := mc.ClaimDeletionJobDue(now, "first", leaseExpires); err != nil {
+		t.Fatalf("error claiming due deletion jobs %s", err.Error())
+	} else if claimed == nil || claimed.ID != dueJob.ID || claimed.LeaseOwner != "first" {
+		t.Fatalf("should only claim deletion job %s but claimed %v", dueJob.ID, claimed)
+	}
+
+	// A job leased to one run cannot be claimed by another until it is released
+	if claimed, err := mc.ClaimDeletionJobDue(now, "second", leaseExpires); err != nil || claimed != nil {
+		t.Fatalf("should not claim the leased deletion job but claimed %v, %v", claimed, err)
+	}
+	if err := mc.ReleaseDeletionJob(dueJob, "second"); err != ErrDeletionJobLeaseLost {
+		t.Fatalf("should not release a deletion job leased to another run but got %v", err)
+	}
+	if err := mc.ReleaseDeletionJob(dueJob, "first"); err != nil {
+		t.Fatalf("error releasing the deletion job %s", err.Error())
+	}
+
+	// The run that released a job does not claim it again
+	if claimed, err := mc.ClaimDeletionJobDue(now, "first", leaseExpires); err != nil || claimed != nil {
+		t.Fatalf("should not claim the released deletion job again but claimed %v, %v", claimed, err)
+	}
+	if claimed, err := mc.ClaimDeletionJobDue(now, "second", leaseExpires); err != nil || claimed == nil || claimed.ID != dueJob.ID {
+		t.Fatalf("should claim the released deletion job but claimed %v, %v", claimed, err)
+	}
+
+	// A job cancelled while it is leased is not updated when the lease is released
+	cancelled := *dueJob
+	cancelled.Cancel(now)
+	if err := mc.UpsertDeletionJob(&cancelled); err != nil {
+		t.Fatalf("we could not update the deletion job %v", err)
+	}
+	if err := mc.ReleaseDeletionJob(dueJob, "second"); err != ErrDeletionJobLeaseLost {
+		t.Fatalf("should not release the cancelled deletion job but got %v", err)
+	}
+
+	// A job whose lease expired can be claimed again
+	if _, err := deletionJobsCollection(mc).UpdateOne(context.Background(), bson.M{"_id": laterJob.ID}, bson.M{"$set": bson.M{"leaseOwner": "first", "leaseExpiresTime": now.Add(-time.Minute).UTC().Format(TimestampFormat)}}); err != nil {
+		t.Fatalf("we could not expire the deletion job lease %v", err)
+	}
+	if claimed, err := mc.ClaimDeletionJobDue(now.Add(2*time.Hour), "third", leaseExpires); err != nil || claimed == nil || claimed.ID != laterJob.ID {
+		t.Fatalf("should claim the deletion job with an expired lease but claimed %v, %v", claimed, err)
+	}
+
+	if found, err := mc.FindDeletionJobsForUser("1111111111"); err != nil {
+		t.Fatalf("error finding deletion jobs %s", err.Error())
+	} else if len(found) != 1 || found[0].State != DELETION_JOB_STATE_CANCELLED {
+		t.Fatalf("should find the cancelled deletion job but found %v", found)
+	}
+}
+
+func TestMongoStoreConfirmationOperations(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	confirmationsCollection(mc).Drop(context.Background())
+	mc.EnsureIndexes()
+
+	/*
+	 * THE TESTS
+	 */
+	var indexes []bson.M
+	if cursor, err := confirmationsCollection(mc).Indexes().List(context.Background()); err != nil {
+		t.Fatalf("error listing confirmation indexes %s", err.Error())
+	} else if err := cursor.All(context.Background(), &indexes); err != nil || len(indexes) != 3 || indexes[1]["name"] != "userId_1_type_1" {
+		t.Fatalf("should index confirmations by user and type but found %v, %v", indexes, err)
+	} else if indexes[2]["name"] != "ExpireConfirmations" || indexes[2]["expireAfterSeconds"] != int32(0) {
+		t.Fatalf("should expire confirmations at their expiry but found %v", indexes[2])
+	}
+
+	// a confirmation stored before expiry dates were, which the store does not remove until one is recorded
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	legacy := bson.M{"_id": "legacy", "type": CONFIRMATION_TYPE_EMAIL_VERIFICATION, "userId": "2222222222", "email": "test@foo.bar", "expiresTime": expiresAt.Format(TimestampFormat)}
+	if _, err := confirmationsCollection(mc).InsertOne(context.Background(), legacy); err != nil {
+		t.Fatalf("we could not add the legacy confirmation %v", err)
+	}
+	if ids, err := mc.RecordConfirmationExpiries(true); err != nil || len(ids) != 1 || ids[0] != "legacy" {
+		t.Fatalf("should report the confirmation without an expiry date but found %v, %v", ids, err)
+	} else if ids, err := mc.RecordConfirmationExpiries(false); err != nil || len(ids) != 1 {
+		t.Fatalf("should record the expiry date of the confirmation but found %v, %v", ids, err)
+	} else if found, err := mc.FindConfirmationsForUser("2222222222", CONFIRMATION_TYPE_EMAIL_VERIFICATION); err != nil || len(found) != 1 || !found[0].ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("should find the recorded expiry date but found %v, %v", found, err)
+	} else if ids, err := mc.RecordConfirmationExpiries(false); err != nil || len(ids) != 0 {
+		t.Fatalf("should not record the expiry date again but found %v, %v", ids, err)
+	}
+
+	confirmation, _ := NewConfirmation(CONFIRMATION_TYPE_EMAIL_VERIFICATION, "1111111111", "test@foo.bar", time.Hour, time.Now())
+	if err := mc.AddConfirmation(confirmation); err != nil {
+		t.Fatalf("we could not add the confirmation %v", err)
+	}
+
+	if found, err := mc.FindConfirmationsForUser("1111111111", CONFIRMATION_TYPE_EMAIL_VERIFICATION); err != nil {
+		t.Fatalf("error finding confirmations %s", err.Error())
+	} else if len(found) != 1 || found[0].ID != confirmation.ID {
+		t.Fatalf("should only find confirmation %s but found %v", confirmation.ID, found)
+	}
+
+	if used, err := mc.UseConfirmation(confirmation.ID, time.Now()); err != nil {
+		t.Fatalf("we could not use the confirmation %v", err)
+	} else if used == nil || used.UsedTime == "" {
+		t.Fatalf("the confirmation was not marked used %v", used)
+	}
+
+	// A confirmation may only be used once
+	if used, err := mc.UseConfirmation(confirmation.ID, time.Now()); err != nil {
+		t.Fatalf("error using the confirmation again %v", err)
+	} else if used != nil {
+		t.Fatalf("the confirmation should not be used twice %v", used)
+	}
+
+	if err := mc.RemoveConfirmationsForUser("1111111111"); err != nil {
+		t.Fatalf("error removing confirmations %s", err.Error())
+	} else if found, err := mc.FindConfirmationsForUser("1111111111", CONFIRMATION_TYPE_EMAIL_VERIFICATION); err != nil || len(found) != 0 {
+		t.Fatalf("should not find removed confirmations but found %v, %v", found, err)
+	}
+}
+
+func TestMongoStore_SearchUsers(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	users := []*User{
+		{Id: "1111111111", Username: "clinic@foo.bar", Roles: []string{"clinic"}, PwHash: "xyz", EmailVerified: true, CreatedTime: "2016-01-01T00:00:00+00:00"},
+		{Id: "2222222222", Username: "Patient@foo.bar", PwHash: "xyz", CreatedTime: "2016-01-02T00:00:00+00:00"},
+		{Id: "3333333333", Username: "patient.two@foo.bar", CreatedTime: "2016-01-02T00:00:00+00:00"},
+		{Id: "4444444444", Username: "patient.three@foo.bar", PwHash: "xyz", DeletedTime: "2016-02-01T00:00:00+00:00"},
+	}
+	for _, user := range users {
+		if err := mc.UpsertUser(user); err != nil {
+			t.Fatalf("we could not create the user %v", err)
+		}
+	}
+
+	search := &UserSearch{EmailPrefix: "PATIENT", Sort: USER_SEARCH_SORT_CREATED_TIME, Limit: 2}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 3 || found[0].Id != "4444444444" || found[1].Id != "2222222222" {
+		t.Fatalf("unexpected first page %v", found)
+	} else {
+		search.Cursor = search.NextCursor(found[:2])
+	}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 1 || found[0].Id != "3333333333" {
+		t.Fatalf("unexpected second page %v", found)
+	}
+	if count, err := mc.CountUsers(search); err != nil || count != 3 {
+		t.Fatalf("unexpected count %d %v", count, err)
+	}
+
+	deleted := false
+	search = &UserSearch{AccountType: USER_SEARCH_ACCOUNT_PASSWORD, Deleted: &deleted, Sort: USER_SEARCH_SORT_USERNAME, Descending: true, Limit: 10}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 2 || found[0].Id != "2222222222" || found[1].Id != "1111111111" {
+		t.Fatalf("unexpected password users %v", found)
+	}
+
+	search = &UserSearch{Role: "clinic", CreatedFrom: "2016-01-01T00:00:00+00:00", CreatedTo: "2016-01-02T00:00:00+00:00", Sort: USER_SEARCH_SORT_CREATED_TIME, Limit: 10}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 1 || found[0].Id != "1111111111" {
+		t.Fatalf("unexpected clinic users %v", found)
+	}
+}
+
+func TestMongoStore_FindUsersWithEmails(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	for _, user := range []*User{
+		{Id: "1111111111", Username: "one@foo.bar"},
+		{Id: "2222222222", Username: "two@foo.bar", Emails: []string{"two@foo.bar", "shared@foo.bar"}},
+		{Id: "3333333333", Username: "three@foo.bar"},
+	} {
+		if err := mc.UpsertUser(user); err != nil {
+			t.Fatalf("we could not create the user %v", err)
+		}
+	}
+
+	if found, err := mc.FindUsersWithEmails([]string{"ONE@foo.bar", "shared@foo.bar"}); err != nil {
+		t.Fatalf("error finding users by emails %s", err.Error())
+	} else if len(found) != 2 {
+		t.Fatalf("should only find users with the emails but found %v", found)
+	}
+}
+
+func TestMongoStore_UpsertUserRevisions(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	user := &User{Id: "1111111111", Username: "test@foo.bar"}
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not create the user %v", err)
+	} else if user.Revision != 1 {
+		t.Fatalf("the created user has revision %d", user.Revision)
+	}
+
+	stale, err := mc.FindUser(&User{Id: user.Id})
+	if err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	}
+	user.Username = "first@foo.bar"
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not update the user %v", err)
+	}
+	stale.Username = "second@foo.bar"
+	if err := mc.UpsertUser(stale); err != ErrUserRevisionConflict {
+		t.Fatalf("updating a stale user should conflict but got %v", err)
+	}
+	if found, err := mc.FindUser(&User{Id: user.Id}); err != nil {
+		t.Fatalf("we could not find the user %v", err)
+	} else if found.Username != "first@foo.bar" || found.Revision != 2 {
+		t.Fatalf("the stale update should not apply %v", found)
+	}
+}
+
+func TestMongoStore_AuditEvents(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	for _, event := range []*AuditEvent{
+		{ID: "1", Type: AUDIT_EVENT_LOGIN, Time: "2016-01-01T00:00:00+00:00", ActorUserID: "1111111111", TargetUserID: "1111111111"},
+		{ID: "2", Type: AUDIT_EVENT_USER_UPDATED, Time: "2016-01-02T00:00:00+00:00", ActorUserID: "shoreline", TargetUserID: "1111111111"},
+		{ID: "3", Type: AUDIT_EVENT_LOGIN, Time: "2016-01-02T00:00:00+00:00", ActorUserID: "2222222222", TargetUserID: "2222222222"},
+		{ID: "4", Type: AUDIT_EVENT_LOGIN, Time: "2016-01-03T00:00:00+00:00", ActorUserID: "1111111111", TargetUserID: "1111111111"},
+	} {
+		if err := mc.AddAuditEvent(event); err != nil {
+			t.Fatalf("we could not add the audit event %v", err)
+		}
+	}
+
+	if found, err := mc.FindAuditEvents(&AuditQuery{UserID: "1111111111", Limit: 1}); err != nil {
+		t.Fatalf("error finding audit events %s", err.Error())
+	} else if len(found) != 2 || found[0].ID != "4" || found[1].ID != "2" {
+		t.Fatalf("should find the newest events for the user and one more but found %v", found)
+	}
+
+	cursor := &AuditCursor{Time: "2016-01-02T00:00:00+00:00", ID: "3"}
+	if found, err := mc.FindAuditEvents(&AuditQuery{Types: []string{AUDIT_EVENT_LOGIN, AUDIT_EVENT_USER_UPDATED}, Cursor: cursor}); err != nil {
+		t.Fatalf("error finding audit events %s", err.Error())
+	} else if len(found) != 2 || found[0].ID != "2" || found[1].ID != "1" {
+		t.Fatalf("should find the events after the cursor but found %v", found)
+	}
+
+	if found, err := mc.FindAuditEvents(&AuditQuery{ActorUserID: "shoreline", From: "2016-01-03T00:00:00+00:00"}); err != nil {
+		t.Fatalf("error finding audit events %s", err.Error())
+	} else if len(found) != 0 {
+		t.Fatalf("should not find events before the time range but found %v", found)
+	}
+
+	failed := &AuditEvent{ID: "5", Type: AUDIT_EVENT_LOGIN_FAILED, Time: "2016-01-04T00:00:00+00:00", IP: "10.0.0.1", Details: map[string]string{"username": "test@foo.bar"}}
+	if err := mc.AddAuditEvent(failed); err != nil {
+		t.Fatalf("we could not add the audit event %v", err)
+	}
+	if err := mc.AnonymizeAuditEvents("2222222222", []string{"test@foo.bar"}); err != nil {
+		t.Fatalf("error anonymizing audit events %s", err.Error())
+	} else if found, err := mc.FindAuditEvents(&AuditQuery{Types: []string{AUDIT_EVENT_LOGIN_FAILED}}); err != nil {
+		t.Fatalf("error finding audit events %s", err.Error())
+	} else if len(found) != 1 || found[0].IP != "" || found[0].Details != nil {
+		t.Fatalf("should anonymize the failed login with the user's email but found %v", found)
+	}
+}
+
+func TestMongoStore_SearchUsersTermsAccepted(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	for _, user := range []*User{
+		{Id: "1111111111", Username: "current@foo.bar", CreatedTime: "2016-01-01T00:00:00+00:00", TermsAcceptances: []*TermsAcceptance{{Version: "1", AcceptedTime: "2016-01-01T00:00:00+00:00"}, {Version: "2", AcceptedTime: "2017-01-01T00:00:00+00:00"}}},
+		{Id: "2222222222", Username: "previous@foo.bar", CreatedTime: "2016-01-02T00:00:00+00:00", TermsAcceptances: []*TermsAcceptance{{Version: "1", AcceptedTime: "2016-01-01T00:00:00+00:00"}}},
+		{Id: "3333333333", Username: "none@foo.bar", CreatedTime: "2016-01-03T00:00:00+00:00"},
+		{Id: "4444444444", Username: "legacy@foo.bar", CreatedTime: "2016-01-04T00:00:00+00:00", TermsAccepted: "2015-06-01T00:00:00+00:00"},
+	} {
+		if err := mc.UpsertUser(user); err != nil {
+			t.Fatalf("we could not create the user %v", err)
+		}
+	}
+
+	accepted := false
+	search := &UserSearch{Sort: USER_SEARCH_SORT_CREATED_TIME, Limit: 10, TermsAccepted: &accepted, TermsVersion: "2"}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 3 || found[0].Id != "2222222222" || found[1].Id != "3333333333" || found[2].Id != "4444444444" {
+		t.Fatalf("should find the users who have not accepted the terms but found %v", found)
+	}
+
+	accepted = true
+	search = &UserSearch{Sort: USER_SEARCH_SORT_CREATED_TIME, Limit: 10, TermsAccepted: &accepted, TermsVersion: "1", TermsInitial: true}
+	if found, err := mc.SearchUsers(search); err != nil {
+		t.Fatalf("error searching users %s", err.Error())
+	} else if len(found) != 3 || found[0].Id != "1111111111" || found[1].Id != "2222222222" || found[2].Id != "4444444444" {
+		t.Fatalf("should find the users who accepted the initial terms but found %v", found)
+	}
+}
+
+func TestMongoStore_ConsentRecords(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	consentsCollection(mc).Drop(context.Background())
+
+	/*
+	 * THE TESTS
+	 */
+	for _, record := range []*ConsentRecord{
+		{ID: "2", UserID: "1111111111", Type: "research", Version: "1", Granted: false, Time: "2016-01-02T00:00:00+00:00"},
+		{ID: "1", UserID: "1111111111", Type: "research", Version: "1", Granted: true, Time: "2016-01-01T00:00:00+00:00"},
+		{ID: "3", UserID: "2222222222", Type: "research", Version: "1", Granted: true, Time: "2016-01-01T00:00:00+00:00"},
+		// a grant and then a revoke in the same second, whose ids sort the other way
+		{ID: "5", UserID: "1111111111", Type: "marketing", Version: "1", Granted: true, Time: "2016-01-03T00:00:00+00:00", TimeNanos: 1451779200100000000},
+		{ID: "4", UserID: "1111111111", Type: "marketing", Version: "1", Granted: false, Time: "2016-01-03T00:00:00+00:00", TimeNanos: 1451779200200000000},
+	} {
+		if err := mc.AddConsentRecord(record); err != nil {
+			t.Fatalf("we could not add the consent record %v", err)
+		}
+	}
+
+	if found, err := mc.FindConsentRecords("1111111111"); err != nil {
+		t.Fatalf("error finding consent records %s", err.Error())
+	} else if len(found) != 4 || found[0].ID != "1" || found[1].ID != "2" || found[2].ID != "5" || found[3].ID != "4" {
+		t.Fatalf("should find the user's consent records in order but found %v", found)
+	} else if current := CurrentConsents(found); current["marketing"].Granted {
+		t.Fatalf("should find the revoke after the grant in the same second but found %v", current["marketing"])
+	}
+
+	if found, err := mc.FindConsentRecords("3333333333"); err != nil {
+		t.Fatalf("error finding consent records %s", err.Error())
+	} else if len(found) != 0 {
+		t.Fatalf("should not find consent records for another user but found %v", found)
+	}
+
+	if err := mc.RemoveConsentRecords("1111111111"); err != nil {
+		t.Fatalf("error removing consent records %s", err.Error())
+	} else if found, err := mc.FindConsentRecords("1111111111"); err != nil || len(found) != 0 {
+		t.Fatalf("should not find removed consent records but found %v, %v", found, err)
+	} else if found, err := mc.FindConsentRecords("2222222222"); err != nil || len(found) != 1 {
+		t.Fatalf("should keep the consent records of other users but found %v, %v", found, err)
+	}
+}
+
+func TestMongoStore_FindUsersByCustodian(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	for _, user := range []*User{
+		{Id: "2222222222", CustodianUserID: "1111111111"},
+		{Id: "3333333333", CustodianUserID: "0000000000"},
+		{Id: "4444444444", Username: "a@z.co", PwHash: "hash"},
+	} {
+		if err := mc.UpsertUser(user); err != nil {
+			t.Fatalf("we could not save the user %v", err)
+		}
+	}
+
+	if found, err := mc.FindUsersByCustodian("1111111111"); err != nil {
+		t.Fatalf("error finding users by custodian %s", err.Error())
+	} else if len(found) != 1 || found[0].Id != "2222222222" {
+		t.Fatalf("should find the custodial user of the custodian but found %v", found)
+	}
+}
+
+func TestMongoStore_FindDuplicateEmails(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	for _, user := range []*User{
+		{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}},
+		{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co", "A@z.co"}},
+		{Id: "3333333333", Username: "c@z.co", Emails: []string{"c@z.co"}},
+	} {
+		if err := mc.UpsertUser(user); err != nil {
+			t.Fatalf("we could not save the user %v", err)
+		}
+	}
+
+	if found, err := mc.FindDuplicateEmails(); err != nil {
+		t.Fatalf("error finding duplicate emails %s", err.Error())
+	} else if len(found) != 1 || !strings.EqualFold(found[0].Email, "a@z.co") || len(found[0].UserIDs) != 2 {
+		t.Fatalf("should find the email shared by two users but found %v", found)
+	}
+}
+
+func TestMongoStore_UpsertUser_IdentityConflict(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	identitiesCollection(mc).Drop(context.Background())
+	defer identitiesCollection(mc).Drop(context.Background())
+	mc.EnsureIndexes()
+
+	/*
+	 * THE TESTS
+	 */
+	if err := mc.UpsertUser(&User{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}}); err != nil {
+		t.Fatalf("we could not save the user %v", err)
+	}
+
+	other := &User{Id: "2222222222", Username: "A@z.co", Emails: []string{"A@z.co"}}
+	if err := mc.UpsertUser(other); err != ErrUserIdentityConflict {
+		t.Fatalf("should reject the email of another user but got %v", err)
+	} else if found, err := mc.FindUser(&User{Id: "2222222222"}); err != nil || found != nil {
+		t.Fatalf("should not save the rejected user but found %v, %v", found, err)
+	}
+
+	user := &User{Id: "1111111111", Username: "b@z.co", Emails: []string{"b@z.co"}, Revision: 1}
+	if err := mc.UpsertUser(user); err != nil {
+		t.Fatalf("we could not update the user %v", err)
+	} else if err := mc.UpsertUser(other); err != nil {
+		t.Fatalf("should accept the email released by the user but got %v", err)
+	}
+}
+
+func TestMongoStore_RecordIdentities(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	identitiesCollection(mc).Drop(context.Background())
+	defer identitiesCollection(mc).Drop(context.Background())
+	mc.EnsureIndexes()
+
+	/*
+	 * THE TESTS
+	 */
+	for _, user := range []*User{
+		{Id: "1111111111", Username: "a@z.co", Emails: []string{"a@z.co"}},
+		{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co", "A@z.co"}},
+	} {
+		if _, err := usersCollection(mc).InsertOne(context.Background(), user); err != nil {
+			t.Fatalf("we could not save the user %v", err)
+		}
+	}
+	ownerUserIDs := map[string]string{"a@z.co": "1111111111"}
+
+	if userIDs, err := mc.RecordIdentities(ownerUserIDs, true); err != nil {
+		t.Fatalf("error recording identities %s", err.Error())
+	} else if len(userIDs) != 2 {
+		t.Fatalf("should report both users but found %v", userIDs)
+	} else if count, _ := identitiesCollection(mc).CountDocuments(context.Background(), bson.M{}); count != 0 {
+		t.Fatalf("should not record identities on a dry run but found %d", count)
+	}
+
+	if userIDs, err := mc.RecordIdentities(ownerUserIDs, false); err != nil {
+		t.Fatalf("error recording identities %s", err.Error())
+	} else if len(userIDs) != 2 {
+		t.Fatalf("should record the identities of both users but found %v", userIDs)
+	} else if userIDs, err := mc.RecordIdentities(ownerUserIDs, false); err != nil || len(userIDs) != 0 {
+		t.Fatalf("should record no identities again but found %v, %v", userIDs, err)
+	}
+
+	if err := mc.UpsertUser(&User{Id: "3333333333", Username: "b@z.co", Emails: []string{"b@z.co"}}); err != ErrUserIdentityConflict {
+		t.Fatalf("should reject the recorded email of another user but got %v", err)
+	} else if err := mc.UpsertUser(&User{Id: "4444444444", Username: "a@z.co", Emails: []string{"a@z.co"}}); err != ErrUserIdentityConflict {
+		t.Fatalf("should reject the shared email recorded for its owner but got %v", err)
+	} else if err := mc.UpsertUser(&User{Id: "2222222222", Username: "b@z.co", Emails: []string{"b@z.co", "A@z.co"}}); err != nil {
+		t.Fatalf("should accept the shared email of a user that has it but got %v", err)
+	}
+}
+
+func TestMongoStore_FindUsers_CanonicalEmail(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+
+	/*
+	 * THE TESTS
+	 */
+	if err := mc.UpsertUser(&User{Id: "1111111111", Username: "a@bücher.de", Emails: []string{"a@bücher.de"}}); err != nil {
+		t.Fatalf("we could not save the user %v", err)
+	}
+
+	if found, err := mc.FindUsers(&User{Username: "A@xn--bcher-kva.de", Emails: []string{"A@xn--bcher-kva.de"}}); err != nil {
+		t.Fatalf("error finding users %s", err.Error())
+	} else if len(found) != 1 || found[0].Id != "1111111111" {
+		t.Fatalf("should find the user by the punycode form of its email but found %v", found)
+	}
+	identitiesCollection(mc).Drop(context.Background())
+}
+
+func TestMongoStore_SignupCodes(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	signupCodesCollection(mc).Drop(context.Background())
+
+	/*
+	 * THE TESTS
+	 */
+	now := time.Now()
+	expiresTime := now.Add(time.Hour).UTC().Format(TimestampFormat)
+	for _, signupCode := range []*SignupCode{
+		{Code: "limited", MaxUses: 1, CreatedTime: "2016-01-01T00:00:00+00:00", ExpiresTime: expiresTime},
+		{Code: "unlimited", CreatedTime: "2016-01-02T00:00:00+00:00", ExpiresTime: expiresTime},
+		{Code: "expired", CreatedTime: "2016-01-03T00:00:00+00:00", ExpiresTime: "2016-01-04T00:00:00+00:00"},
+	} {
+		if err := mc.AddSignupCode(signupCode); err != nil {
+			t.Fatalf("we could not add the signup code %v", err)
+		}
+	}
+
+	if found, err := mc.FindSignupCodes(); err != nil {
+		t.Fatalf("error finding signup codes %s", err.Error())
+	} else if len(found) != 3 || found[0].Code != "expired" || found[2].Code != "limited" {
+		t.Fatalf("should find the signup codes most recent first but found %v", found)
+	}
+
+	if used, err := mc.UseSignupCode("limited", now); err != nil || used == nil || used.Uses != 1 {
+		t.Fatalf("should use the limited signup code but found %v, %v", used, err)
+	}
+	if used, err := mc.UseSignupCode("limited", now); err != nil || used != nil {
+		t.Fatalf("should not use the used up signup code but found %v, %v", used, err)
+	}
+	if err := mc.ReleaseSignupCode("limited"); err != nil {
+		t.Fatalf("error releasing signup code %s", err.Error())
+	} else if used, err := mc.UseSignupCode("limited", now); err != nil || used == nil {
+		t.Fatalf("should use the released signup code but found %v, %v", used, err)
+	}
+
+	for index := 1; index <= 2; index++ {
+		if used, err := mc.UseSignupCode("unlimited", now); err != nil || used == nil || used.Uses != index {
+			t.Fatalf("should use the unlimited signup code but found %v, %v", used, err)
+		}
+	}
+	if used, err := mc.UseSignupCode("expired", now); err != nil || used != nil {
+		t.Fatalf("should not use the expired signup code but found %v, %v", used, err)
+	}
+
+	if err := mc.RemoveSignupCode("unlimited"); err != nil {
+		t.Fatalf("error removing signup code %s", err.Error())
+	} else if found, err := mc.FindSignupCode("unlimited"); err != nil || found != nil {
+		t.Fatalf("should not find the removed signup code but found %v, %v", found, err)
+	}
+
+	if err := mc.AddSignupCode(&SignupCode{Code: "invitation", Email: "Test@Foo.bar", MaxUses: 1, ExpiresTime: expiresTime}); err != nil {
+		t.Fatalf("we could not add the signup code %v", err)
+	} else if err := mc.RemoveSignupCodesForEmails([]string{"test@foo.bar"}); err != nil {
+		t.Fatalf("error removing signup codes %s", err.Error())
+	} else if found, err := mc.FindSignupCode("invitation"); err != nil || found != nil {
+		t.Fatalf("should not find the removed invitation but found %v, %v", found, err)
+	} else if found, err := mc.FindSignupCode("limited"); err != nil || found == nil {
+		t.Fatalf("should keep signup codes without the email but found %v, %v", found, err)
+	}
+}
+
+func TestMongoStore_OrganizationDomains(t *testing.T) {
+
+	mc, err := mongoTestSetup()
+	if err != nil {
+		t.Fatalf("we could not initialise the test store %s", err.Error())
+	}
+	domainsCollection(mc).Drop(context.Background())
+
+	/*
+	 * THE TESTS
+	 */
+	for _, domain := range []*OrganizationDomain{
+		{Domain: "z.co", Roles: []string{"clinic"}, ModifiedTime: "2016-01-01T00:00:00+00:00"},
+		{Domain: "y.co", Roles: []string{"clinic"}, ModifiedTime: "2016-01-02T00:00:00+00:00"},
+		{Domain: "z.co", Organization: "Z Clinic", Roles: []string{"clinic", "custodian"}, ModifiedTime: "2016-01-03T00:00:00+00:00"},
+	} {
+		if err := mc.UpsertOrganizationDomain(domain); err != nil {
+			t.Fatalf("we could not upsert the organization domain %v", err)
+		}
+	}
+
+	if found, err := mc.FindOrganizationDomains(); err != nil {
+		t.Fatalf("error finding organization domains %s", err.Error())
+	} else if len(found) != 2 || found[0].Domain != "y.co" || found[1].Organization != "Z Clinic" || len(found[1].Roles) != 2 {
+		t.Fatalf("should find the replaced organization domains in order but found %v", found)
+	}
+
+	if err := mc.RemoveOrganizationDomain("y.co"); err != nil {
+		t.Fatalf("error removing organization domain %s", err.Error())
+	} else if found, err := mc.FindOrganizationDomains(); err != nil || len(found) != 1 || found[0].Domain != "z.co" {
+		t.Fatalf("should not find the removed organization domain but found %v, %v", found, err)
+	}
+}
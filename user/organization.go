@@ -0,0 +1,200 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidepool-org/go-common/clients"
+)
+
+// OrganizationDomain is a verified email domain of an organization, such as a clinic. Users who verify
+// an email on the domain, or on one of its subdomains, are granted its roles.
+type OrganizationDomain struct {
+	Domain         string   `json:"domain" bson:"_id"` // in lower case Punycode
+	Organization   string   `json:"organization,omitempty" bson:"organization,omitempty"`
+	Roles          []string `json:"roles" bson:"roles"`
+	ModifiedTime   string   `json:"modifiedTime" bson:"modifiedTime"`
+	ModifiedUserID string   `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"` // the token user, or server name, that last updated the domain
+}
+
+var (
+	OrganizationDomain_error_domain_invalid = errors.New("Organization domain is invalid")
+	OrganizationDomain_error_roles_missing  = errors.New("Organization domain roles are missing")
+	OrganizationDomain_error_role_unknown   = errors.New("Organization domain has an unknown role")
+)
+
+// ParseOrganizationDomain parses the organization and roles of a domain from a JSON body
+func ParseOrganizationDomain(domain string, reader io.Reader) (*OrganizationDomain, error) {
+	organizationDomain := &OrganizationDomain{}
+	if reader != nil {
+		if err := json.NewDecoder(reader).Decode(organizationDomain); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	organizationDomain.Domain = emailDomain("a@" + domain)
+	organizationDomain.Organization = strings.TrimSpace(organizationDomain.Organization)
+	return organizationDomain, nil
+}
+
+// Validate checks that the domain is valid and that it has roles, all of which are defined
+func (d *OrganizationDomain) Validate(registry RoleRegistry) error {
+	if d.Domain == "" || !IsValidEmail("a@"+d.Domain) {
+		return OrganizationDomain_error_domain_invalid
+	} else if len(d.Roles) == 0 {
+		return OrganizationDomain_error_roles_missing
+	}
+	for _, role := range d.Roles {
+		if !registry.IsValid(role) {
+			return OrganizationDomain_error_role_unknown
+		}
+	}
+	return nil
+}
+
+// MatchOrganizationDomains returns the domains that the email is on, directly or through a subdomain
+func MatchOrganizationDomains(domains []*OrganizationDomain, email string) []*OrganizationDomain {
+	matched := []*OrganizationDomain{}
+	domain := emailDomain(email)
+	for _, organizationDomain := range domains {
+		if matchesDomain(domain, []string{organizationDomain.Domain}) {
+			matched = append(matched, organizationDomain)
+		}
+	}
+	return matched
+}
+
+// grantOrganizationRoles grants the user the roles of the organization domains of a verified email, and
+// returns the domain names if this granted the user any roles. Failing to find the domains is logged, but
+// does not fail the verification.
+func (a *Api) grantOrganizationRoles(store Storage, user *User, email string) []string {
+	domains, err := store.FindOrganizationDomains()
+	if err != nil {
+		a.logger.Printf("Error finding organization domains for user %s: %s", user.Id, err)
+		return nil
+	}
+
+	names := []string{}
+	roles := append([]string{}, user.Roles...)
+	for _, domain := range MatchOrganizationDomains(domains, email) {
+		for _, role := range domain.Roles {
+			if !containsString(roles, role) {
+				roles = append(roles, role)
+				if !containsString(names, domain.Domain) {
+					names = append(names, domain.Domain)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	user.Roles = a.ApiConfig.RoleRegistry().Expand(roles)
+	user.ReviewRoles = removeStrings(user.ReviewRoles, user.Roles)
+	return names
+}
+
+// auditOrganizationRoles records the roles a user was granted by the organization domains of a verified email
+func (a *Api) auditOrganizationRoles(req *http.Request, actorUserID string, originalRoles []string, user *User, domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	if event, err := NewAuditEvent(AUDIT_EVENT_ROLES_CHANGED, time.Now()); err != nil {
+		a.logger.Printf("Error creating %s audit event: %s", AUDIT_EVENT_ROLES_CHANGED, err)
+	} else {
+		event.ActorUserID = actorUserID
+		event.TargetUserID = user.Id
+		event.Details = map[string]string{"from": strings.Join(originalRoles, ","), "to": strings.Join(user.Roles, ","), "domains": strings.Join(domains, ",")}
+		a.audit(req, event)
+	}
+}
+
+// shareClinicDemo gives a clinic user view permission of the clinic demo user once it is a clinic with
+// a verified email, either because it verified its email or because it became a clinic. Failing to share
+// is logged, but does not fail the request that made it a verified clinic.
+func (a *Api) shareClinicDemo(originalUser *User, user *User) {
+	if a.ApiConfig.ClinicDemoUserID == "" || !user.IsClinic() || !user.EmailVerified {
+		return
+	} else if originalUser != nil && originalUser.IsClinic() && originalUser.EmailVerified {
+		return
+	}
+	if _, err := a.perms.SetPermissions(user.Id, a.ApiConfig.ClinicDemoUserID, clients.Permissions{"view": clients.Allowed}); err != nil {
+		a.logger.Printf("Error sharing clinic demo user with user %s: %s", user.Id, err)
+	}
+}
+
+// GetOrganizationDomains returns the verified organization domains
+// status: 200 []OrganizationDomain
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_DOMAINS
+func (a *Api) GetOrganizationDomains(res http.ResponseWriter, req *http.Request) {
+	if domains, err := a.Store.WithContext(req.Context()).FindOrganizationDomains(); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_DOMAINS, err)
+
+	} else {
+		sendModelAsRes(res, domains)
+	}
+}
+
+// UpdateOrganizationDomain adds a verified organization domain, or replaces its organization and roles.
+// Users who already verified an email on the domain are not granted the roles.
+// status: 200 OrganizationDomain
+// status: 400 STATUS_INVALID_DOMAIN_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_UPDATING_DOMAINS
+func (a *Api) UpdateOrganizationDomain(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	tokenData := authorizedTokenData(req)
+	if domain, err := ParseOrganizationDomain(vars["domain"], req.Body); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_DOMAIN_DETAILS, err)
+
+	} else if err := domain.Validate(a.ApiConfig.RoleRegistry()); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_DOMAIN_DETAILS, err)
+
+	} else {
+		domain.ModifiedTime = time.Now().UTC().Format(TimestampFormat)
+		domain.ModifiedUserID = tokenData.UserId
+		if err := a.Store.WithContext(req.Context()).UpsertOrganizationDomain(domain); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_DOMAINS, err)
+			return
+		}
+
+		a.auditEvent(req, AUDIT_EVENT_DOMAIN_UPDATED, tokenData.UserId, "")
+		sendModelAsRes(res, domain)
+	}
+}
+
+// RemoveOrganizationDomain removes a verified organization domain. Users already granted its roles keep them.
+// status: 200 OrganizationDomain
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_DOMAIN_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_DOMAINS, STATUS_ERR_UPDATING_DOMAINS
+func (a *Api) RemoveOrganizationDomain(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	domainName := emailDomain("a@" + vars["domain"])
+	tokenData := authorizedTokenData(req)
+	if domains, err := a.Store.WithContext(req.Context()).FindOrganizationDomains(); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_DOMAINS, err)
+
+	} else if domain := findOrganizationDomain(domains, domainName); domain == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_DOMAIN_NOT_FOUND)
+
+	} else if err := a.Store.WithContext(req.Context()).RemoveOrganizationDomain(domain.Domain); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_UPDATING_DOMAINS, err)
+
+	} else {
+		a.auditEvent(req, AUDIT_EVENT_DOMAIN_REMOVED, tokenData.UserId, "")
+		sendModelAsRes(res, domain)
+	}
+}
+
+func findOrganizationDomain(domains []*OrganizationDomain, domainName string) *OrganizationDomain {
+	for _, domain := range domains {
+		if domainName != "" && domain.Domain == domainName {
+			return domain
+		}
+	}
+	return nil
+}
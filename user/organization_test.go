@@ -0,0 +1,54 @@
+package user
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseOrganizationDomain(t *testing.T) {
+	if domain, err := ParseOrganizationDomain("Z.CO", nil); err != nil || !reflect.DeepEqual(domain, &OrganizationDomain{Domain: "z.co"}) {
+		t.Fatalf("Unexpected domain without body: %#v, %v", domain, err)
+	}
+	if _, err := ParseOrganizationDomain("z.co", strings.NewReader("{")); err == nil {
+		t.Fatalf("Expected error for malformed body")
+	}
+	domain, err := ParseOrganizationDomain("XN--BCHER-KVA.DE", strings.NewReader("{\"domain\": \"y.co\", \"organization\": \" Bücher Clinic \", \"roles\": [\"clinic\"]}"))
+	if err != nil || !reflect.DeepEqual(domain, &OrganizationDomain{Domain: "xn--bcher-kva.de", Organization: "Bücher Clinic", Roles: []string{"clinic"}}) {
+		t.Fatalf("Unexpected domain: %#v, %v", domain, err)
+	}
+}
+
+func Test_OrganizationDomain_Validate(t *testing.T) {
+	for _, test := range []struct {
+		domain OrganizationDomain
+		err    error
+	}{
+		{OrganizationDomain{Domain: "z.co", Roles: []string{"clinic"}}, nil},
+		{OrganizationDomain{Roles: []string{"clinic"}}, OrganizationDomain_error_domain_invalid},
+		{OrganizationDomain{Domain: "z", Roles: []string{"clinic"}}, OrganizationDomain_error_domain_invalid},
+		{OrganizationDomain{Domain: "z.co"}, OrganizationDomain_error_roles_missing},
+		{OrganizationDomain{Domain: "z.co", Roles: []string{"unknown"}}, OrganizationDomain_error_role_unknown},
+	} {
+		if err := test.domain.Validate(DefaultRoleRegistry()); err != test.err {
+			t.Fatalf("Unexpected error for %#v: %v", test.domain, err)
+		}
+	}
+}
+
+func Test_MatchOrganizationDomains(t *testing.T) {
+	domains := []*OrganizationDomain{{Domain: "z.co"}, {Domain: "clinic.y.co"}, {Domain: "xn--bcher-kva.de"}}
+	for email, expected := range map[string][]*OrganizationDomain{
+		"a@z.co":           {domains[0]},
+		"a@Mail.Z.CO":      {domains[0]},
+		"a@clinic.y.co":    {domains[1]},
+		"a@y.co":           {},
+		"a@notz.co":        {},
+		"a@BÜCHER.de":      {domains[2]},
+		"a@mail.bücher.de": {domains[2]},
+	} {
+		if matched := MatchOrganizationDomains(domains, email); !reflect.DeepEqual(matched, expected) {
+			t.Fatalf("Unexpected domains for %s: %#v", email, matched)
+		}
+	}
+}
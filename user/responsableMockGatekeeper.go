@@ -12,10 +12,17 @@ type UsersPermissionsResponse struct {
 	Error            error
 }
 
+type SetPermissionsCall struct {
+	UserID      string
+	GroupID     string
+	Permissions clients.Permissions
+}
+
 type ResponsableMockGatekeeper struct {
 	UserInGroupResponses    []PermissionsResponse
 	UsersInGroupResponses   []UsersPermissionsResponse
 	SetPermissionsResponses []PermissionsResponse
+	SetPermissionsCalls     []SetPermissionsCall
 }
 
 func NewResponsableMockGatekeeper() *ResponsableMockGatekeeper {
@@ -32,6 +39,7 @@ func (c *ResponsableMockGatekeeper) Reset() {
 	c.UserInGroupResponses = nil
 	c.UsersInGroupResponses = nil
 	c.SetPermissionsResponses = nil
+	c.SetPermissionsCalls = nil
 }
 
 func (c *ResponsableMockGatekeeper) UserInGroup(userID, groupID string) (clients.Permissions, error) {
@@ -54,6 +62,7 @@ func (c *ResponsableMockGatekeeper) UsersInGroup(groupID string) (clients.UsersP
 
 func (c *ResponsableMockGatekeeper) SetPermissions(userID, groupID string, permissions clients.Permissions) (clients.Permissions, error) {
 	if len(c.SetPermissionsResponses) > 0 {
+		c.SetPermissionsCalls = append(c.SetPermissionsCalls, SetPermissionsCall{userID, groupID, permissions})
 		var response PermissionsResponse
 		response, c.SetPermissionsResponses = c.SetPermissionsResponses[0], c.SetPermissionsResponses[1:]
 		return response.Permissions, response.Error
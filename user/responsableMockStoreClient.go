@@ -1,6 +1,9 @@
 package user
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type FindUsersResponse struct {
 	Users []*User
@@ -17,6 +20,51 @@ type FindUsersWithIdsResponse struct {
 	Error error
 }
 
+type SearchUsersResponse struct {
+	Users []*User
+	Error error
+}
+
+type CountUsersResponse struct {
+	Count int
+	Error error
+}
+
+type FindAuditEventsResponse struct {
+	AuditEvents []*AuditEvent
+	Error       error
+}
+
+type FindConsentRecordsResponse struct {
+	ConsentRecords []*ConsentRecord
+	Error          error
+}
+
+type FindDuplicateEmailsResponse struct {
+	DuplicateEmails []*DuplicateEmail
+	Error           error
+}
+
+type FindOrganizationDomainsResponse struct {
+	OrganizationDomains []*OrganizationDomain
+	Error               error
+}
+
+type FindSignupCodeResponse struct {
+	SignupCode *SignupCode
+	Error      error
+}
+
+type FindSignupCodesResponse struct {
+	SignupCodes []*SignupCode
+	Error       error
+}
+
+type UseSignupCodeResponse struct {
+	SignupCode *SignupCode
+	Error      error
+}
+
 type FindUserResponse struct {
 	User  *User
 	Error error
@@ -27,17 +75,85 @@ type FindTokenByIDResponse struct {
 	Error        error
 }
 
+type FindTokensResponse struct {
+	SessionTokens []*SessionToken
+	Error         error
+}
+
+type FindConfirmationResponse struct {
+	Confirmation *Confirmation
+	Error        error
+}
+
+type FindConfirmationsResponse struct {
+	Confirmations []*Confirmation
+	Error         error
+}
+
+type FindDeletionJobsResponse struct {
+	DeletionJobs []*DeletionJob
+	Error        error
+}
+
+type ClaimDeletionJobResponse struct {
+	DeletionJob *DeletionJob
+	Error       error
+}
+
+type RecordIdentitiesResponse struct {
+	UserIDs []string
+	Error   error
+}
+
+type RecordConfirmationExpiriesResponse struct {
+	ConfirmationIDs []string
+	Error           error
+}
+
 type ResponsableMockStoreClient struct {
-	PingResponses             []error
-	UpsertUserResponses       []error
-	FindUsersResponses        []FindUsersResponse
-	FindUsersByRoleResponses  []FindUsersByRoleResponse
-	FindUsersWithIdsResponses []FindUsersWithIdsResponse
-	FindUserResponses         []FindUserResponse
-	RemoveUserResponses       []error
-	AddTokenResponses         []error
-	FindTokenByIDResponses    []FindTokenByIDResponse
-	RemoveTokenByIDResponses  []error
+	PingResponses                       []error
+	UpsertUserResponses                 []error
+	FindUsersResponses                  []FindUsersResponse
+	FindUsersByRoleResponses            []FindUsersByRoleResponse
+	FindUsersWithIdsResponses           []FindUsersWithIdsResponse
+	FindUserResponses                   []FindUserResponse
+	RemoveUserResponses                 []error
+	AddTokenResponses                   []error
+	FindTokenByIDResponses              []FindTokenByIDResponse
+	RemoveTokenByIDResponses            []error
+	RemoveTokensForUserResponses        []error
+	UpsertDeletionJobResponses          []error
+	FindDeletionJobsForUserResponses    []FindDeletionJobsResponse
+	ClaimDeletionJobDueResponses        []ClaimDeletionJobResponse
+	FindTokensForUserResponses          []FindTokensResponse
+	AddConfirmationResponses            []error
+	UseConfirmationResponses            []FindConfirmationResponse
+	FindConfirmationsForUserResponses   []FindConfirmationsResponse
+	SearchUsersResponses                []SearchUsersResponse
+	CountUsersResponses                 []CountUsersResponse
+	FindUsersWithEmailsResponses        []FindUsersResponse
+	AuditEvents                         []*AuditEvent // recorded rather than scripted, as every request may add audit events
+	FindAuditEventsResponses            []FindAuditEventsResponse
+	AddConsentRecordResponses           []error
+	FindConsentRecordsResponses         []FindConsentRecordsResponse
+	FindUsersByCustodianResponses       []FindUsersResponse
+	FindDuplicateEmailsResponses        []FindDuplicateEmailsResponse
+	AddSignupCodeResponses              []error
+	FindSignupCodeResponses             []FindSignupCodeResponse
+	FindSignupCodesResponses            []FindSignupCodesResponse
+	UseSignupCodeResponses              []UseSignupCodeResponse
+	ReleaseSignupCodeResponses          []error
+	RemoveSignupCodeResponses           []error
+	UpsertOrganizationDomainResponses   []error
+	FindOrganizationDomainsResponses    []FindOrganizationDomainsResponse
+	RemoveOrganizationDomainResponses   []error
+	RecordIdentitiesResponses           []RecordIdentitiesResponse
+	RemoveConfirmationsForUserResponses []error
+	RemoveConsentRecordsResponses       []error
+	RemoveSignupCodesForEmailsResponses []error
+	AnonymizeAuditEventsResponses       []error
+	RecordConfirmationExpiriesResponses []RecordConfirmationExpiriesResponse
+	ReleaseDeletionJobResponses         []error
 }
 
 func NewResponsableMockStoreClient() *ResponsableMockStoreClient {
@@ -54,7 +170,39 @@ func (r *ResponsableMockStoreClient) HasResponses() bool {
 		len(r.RemoveUserResponses) > 0 ||
 		len(r.AddTokenResponses) > 0 ||
 		len(r.FindTokenByIDResponses) > 0 ||
-		len(r.RemoveTokenByIDResponses) > 0
+		len(r.RemoveTokenByIDResponses) > 0 ||
+		len(r.RemoveTokensForUserResponses) > 0 ||
+		len(r.UpsertDeletionJobResponses) > 0 ||
+		len(r.FindDeletionJobsForUserResponses) > 0 ||
+		len(r.ClaimDeletionJobDueResponses) > 0 ||
+		len(r.FindTokensForUserResponses) > 0 ||
+		len(r.AddConfirmationResponses) > 0 ||
+		len(r.UseConfirmationResponses) > 0 ||
+		len(r.FindConfirmationsForUserResponses) > 0 ||
+		len(r.SearchUsersResponses) > 0 ||
+		len(r.CountUsersResponses) > 0 ||
+		len(r.FindUsersWithEmailsResponses) > 0 ||
+		len(r.FindAuditEventsResponses) > 0 ||
+		len(r.AddConsentRecordResponses) > 0 ||
+		len(r.FindConsentRecordsResponses) > 0 ||
+		len(r.FindUsersByCustodianResponses) > 0 ||
+		len(r.FindDuplicateEmailsResponses) > 0 ||
+		len(r.AddSignupCodeResponses) > 0 ||
+		len(r.FindSignupCodeResponses) > 0 ||
+		len(r.FindSignupCodesResponses) > 0 ||
+		len(r.UseSignupCodeResponses) > 0 ||
+		len(r.ReleaseSignupCodeResponses) > 0 ||
+		len(r.RemoveSignupCodeResponses) > 0 ||
+		len(r.UpsertOrganizationDomainResponses) > 0 ||
+		len(r.FindOrganizationDomainsResponses) > 0 ||
+		len(r.RemoveOrganizationDomainResponses) > 0 ||
+		len(r.RecordIdentitiesResponses) > 0 ||
+		len(r.RemoveConfirmationsForUserResponses) > 0 ||
+		len(r.RemoveConsentRecordsResponses) > 0 ||
+		len(r.RemoveSignupCodesForEmailsResponses) > 0 ||
+		len(r.AnonymizeAuditEventsResponses) > 0 ||
+		len(r.RecordConfirmationExpiriesResponses) > 0 ||
+		len(r.ReleaseDeletionJobResponses) > 0
 }
 
 func (r *ResponsableMockStoreClient) Reset() {
@@ -68,6 +216,39 @@ func (r *ResponsableMockStoreClient) Reset() {
 	r.AddTokenResponses = nil
 	r.FindTokenByIDResponses = nil
 	r.RemoveTokenByIDResponses = nil
+	r.RemoveTokensForUserResponses = nil
+	r.UpsertDeletionJobResponses = nil
+	r.FindDeletionJobsForUserResponses = nil
+	r.ClaimDeletionJobDueResponses = nil
+	r.FindTokensForUserResponses = nil
+	r.AddConfirmationResponses = nil
+	r.UseConfirmationResponses = nil
+	r.FindConfirmationsForUserResponses = nil
+	r.SearchUsersResponses = nil
+	r.CountUsersResponses = nil
+	r.FindUsersWithEmailsResponses = nil
+	r.AuditEvents = nil
+	r.FindAuditEventsResponses = nil
+	r.AddConsentRecordResponses = nil
+	r.FindConsentRecordsResponses = nil
+	r.FindUsersByCustodianResponses = nil
+	r.FindDuplicateEmailsResponses = nil
+	r.AddSignupCodeResponses = nil
+	r.FindSignupCodeResponses = nil
+	r.FindSignupCodesResponses = nil
+	r.UseSignupCodeResponses = nil
+	r.ReleaseSignupCodeResponses = nil
+	r.RemoveSignupCodeResponses = nil
+	r.UpsertOrganizationDomainResponses = nil
+	r.FindOrganizationDomainsResponses = nil
+	r.RemoveOrganizationDomainResponses = nil
+	r.RecordIdentitiesResponses = nil
+	r.RemoveConfirmationsForUserResponses = nil
+	r.RemoveConsentRecordsResponses = nil
+	r.RemoveSignupCodesForEmailsResponses = nil
+	r.AnonymizeAuditEventsResponses = nil
+	r.RecordConfirmationExpiriesResponses = nil
+	r.ReleaseDeletionJobResponses = nil
 }
 
 func (r *ResponsableMockStoreClient) EnsureIndexes() error { return nil }
@@ -162,3 +343,282 @@ func (r *ResponsableMockStoreClient) RemoveTokenByID(id string) (err error) {
 	}
 	panic("RemoveTokenByIDResponses unavailable")
 }
+
+func (r *ResponsableMockStoreClient) RemoveTokensForUser(userID string) (err error) {
+	if len(r.RemoveTokensForUserResponses) > 0 {
+		err, r.RemoveTokensForUserResponses = r.RemoveTokensForUserResponses[0], r.RemoveTokensForUserResponses[1:]
+		return err
+	}
+	panic("RemoveTokensForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UpsertDeletionJob(job *DeletionJob) (err error) {
+	if len(r.UpsertDeletionJobResponses) > 0 {
+		err, r.UpsertDeletionJobResponses = r.UpsertDeletionJobResponses[0], r.UpsertDeletionJobResponses[1:]
+		return err
+	}
+	panic("UpsertDeletionJobResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindDeletionJobsForUser(userID string) ([]*DeletionJob, error) {
+	if len(r.FindDeletionJobsForUserResponses) > 0 {
+		var response FindDeletionJobsResponse
+		response, r.FindDeletionJobsForUserResponses = r.FindDeletionJobsForUserResponses[0], r.FindDeletionJobsForUserResponses[1:]
+		return response.DeletionJobs, response.Error
+	}
+	panic("FindDeletionJobsForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ClaimDeletionJobDue(scheduledBefore time.Time, leaseOwner string, leaseExpires time.Time) (*DeletionJob, error) {
+	if len(r.ClaimDeletionJobDueResponses) > 0 {
+		var response ClaimDeletionJobResponse
+		response, r.ClaimDeletionJobDueResponses = r.ClaimDeletionJobDueResponses[0], r.ClaimDeletionJobDueResponses[1:]
+		return response.DeletionJob, response.Error
+	}
+	panic("ClaimDeletionJobDueResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindTokensForUser(userID string) ([]*SessionToken, error) {
+	if len(r.FindTokensForUserResponses) > 0 {
+		var response FindTokensResponse
+		response, r.FindTokensForUserResponses = r.FindTokensForUserResponses[0], r.FindTokensForUserResponses[1:]
+		return response.SessionTokens, response.Error
+	}
+	panic("FindTokensForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddConfirmation(confirmation *Confirmation) (err error) {
+	if len(r.AddConfirmationResponses) > 0 {
+		err, r.AddConfirmationResponses = r.AddConfirmationResponses[0], r.AddConfirmationResponses[1:]
+		return err
+	}
+	panic("AddConfirmationResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UseConfirmation(id string, usedTime time.Time) (*Confirmation, error) {
+	if len(r.UseConfirmationResponses) > 0 {
+		var response FindConfirmationResponse
+		response, r.UseConfirmationResponses = r.UseConfirmationResponses[0], r.UseConfirmationResponses[1:]
+		return response.Confirmation, response.Error
+	}
+	panic("UseConfirmationResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindConfirmationsForUser(userID string, confirmationType string) ([]*Confirmation, error) {
+	if len(r.FindConfirmationsForUserResponses) > 0 {
+		var response FindConfirmationsResponse
+		response, r.FindConfirmationsForUserResponses = r.FindConfirmationsForUserResponses[0], r.FindConfirmationsForUserResponses[1:]
+		return response.Confirmations, response.Error
+	}
+	panic("FindConfirmationsForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) SearchUsers(search *UserSearch) ([]*User, error) {
+	if len(r.SearchUsersResponses) > 0 {
+		var response SearchUsersResponse
+		response, r.SearchUsersResponses = r.SearchUsersResponses[0], r.SearchUsersResponses[1:]
+		return response.Users, response.Error
+	}
+	panic("SearchUsersResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) CountUsers(search *UserSearch) (int, error) {
+	if len(r.CountUsersResponses) > 0 {
+		var response CountUsersResponse
+		response, r.CountUsersResponses = r.CountUsersResponses[0], r.CountUsersResponses[1:]
+		return response.Count, response.Error
+	}
+	panic("CountUsersResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindUsersWithEmails(emails []string) ([]*User, error) {
+	if len(r.FindUsersWithEmailsResponses) > 0 {
+		var response FindUsersResponse
+		response, r.FindUsersWithEmailsResponses = r.FindUsersWithEmailsResponses[0], r.FindUsersWithEmailsResponses[1:]
+		return response.Users, response.Error
+	}
+	panic("FindUsersWithEmailsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddAuditEvent(event *AuditEvent) error {
+	r.AuditEvents = append(r.AuditEvents, event)
+	return nil
+}
+
+func (r *ResponsableMockStoreClient) FindAuditEvents(query *AuditQuery) ([]*AuditEvent, error) {
+	if len(r.FindAuditEventsResponses) > 0 {
+		var response FindAuditEventsResponse
+		response, r.FindAuditEventsResponses = r.FindAuditEventsResponses[0], r.FindAuditEventsResponses[1:]
+		return response.AuditEvents, response.Error
+	}
+	panic("FindAuditEventsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddConsentRecord(record *ConsentRecord) (err error) {
+	if len(r.AddConsentRecordResponses) > 0 {
+		err, r.AddConsentRecordResponses = r.AddConsentRecordResponses[0], r.AddConsentRecordResponses[1:]
+		return err
+	}
+	panic("AddConsentRecordResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindConsentRecords(userID string) ([]*ConsentRecord, error) {
+	if len(r.FindConsentRecordsResponses) > 0 {
+		var response FindConsentRecordsResponse
+		response, r.FindConsentRecordsResponses = r.FindConsentRecordsResponses[0], r.FindConsentRecordsResponses[1:]
+		return response.ConsentRecords, response.Error
+	}
+	panic("FindConsentRecordsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindUsersByCustodian(custodianUserID string) ([]*User, error) {
+	if len(r.FindUsersByCustodianResponses) > 0 {
+		var response FindUsersResponse
+		response, r.FindUsersByCustodianResponses = r.FindUsersByCustodianResponses[0], r.FindUsersByCustodianResponses[1:]
+		return response.Users, response.Error
+	}
+	panic("FindUsersByCustodianResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindDuplicateEmails() ([]*DuplicateEmail, error) {
+	if len(r.FindDuplicateEmailsResponses) > 0 {
+		var response FindDuplicateEmailsResponse
+		response, r.FindDuplicateEmailsResponses = r.FindDuplicateEmailsResponses[0], r.FindDuplicateEmailsResponses[1:]
+		return response.DuplicateEmails, response.Error
+	}
+	panic("FindDuplicateEmailsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AddSignupCode(code *SignupCode) (err error) {
+	if len(r.AddSignupCodeResponses) > 0 {
+		err, r.AddSignupCodeResponses = r.AddSignupCodeResponses[0], r.AddSignupCodeResponses[1:]
+		return err
+	}
+	panic("AddSignupCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindSignupCode(code string) (*SignupCode, error) {
+	if len(r.FindSignupCodeResponses) > 0 {
+		var response FindSignupCodeResponse
+		response, r.FindSignupCodeResponses = r.FindSignupCodeResponses[0], r.FindSignupCodeResponses[1:]
+		return response.SignupCode, response.Error
+	}
+	panic("FindSignupCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindSignupCodes() ([]*SignupCode, error) {
+	if len(r.FindSignupCodesResponses) > 0 {
+		var response FindSignupCodesResponse
+		response, r.FindSignupCodesResponses = r.FindSignupCodesResponses[0], r.FindSignupCodesResponses[1:]
+		return response.SignupCodes, response.Error
+	}
+	panic("FindSignupCodesResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UseSignupCode(code string, usedTime time.Time) (*SignupCode, error) {
+	if len(r.UseSignupCodeResponses) > 0 {
+		var response UseSignupCodeResponse
+		response, r.UseSignupCodeResponses = r.UseSignupCodeResponses[0], r.UseSignupCodeResponses[1:]
+		return response.SignupCode, response.Error
+	}
+	panic("UseSignupCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ReleaseSignupCode(code string) (err error) {
+	if len(r.ReleaseSignupCodeResponses) > 0 {
+		err, r.ReleaseSignupCodeResponses = r.ReleaseSignupCodeResponses[0], r.ReleaseSignupCodeResponses[1:]
+		return err
+	}
+	panic("ReleaseSignupCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveSignupCode(code string) (err error) {
+	if len(r.RemoveSignupCodeResponses) > 0 {
+		err, r.RemoveSignupCodeResponses = r.RemoveSignupCodeResponses[0], r.RemoveSignupCodeResponses[1:]
+		return err
+	}
+	panic("RemoveSignupCodeResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) UpsertOrganizationDomain(domain *OrganizationDomain) (err error) {
+	if len(r.UpsertOrganizationDomainResponses) > 0 {
+		err, r.UpsertOrganizationDomainResponses = r.UpsertOrganizationDomainResponses[0], r.UpsertOrganizationDomainResponses[1:]
+		return err
+	}
+	panic("UpsertOrganizationDomainResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) FindOrganizationDomains() ([]*OrganizationDomain, error) {
+	if len(r.FindOrganizationDomainsResponses) > 0 {
+		var response FindOrganizationDomainsResponse
+		response, r.FindOrganizationDomainsResponses = r.FindOrganizationDomainsResponses[0], r.FindOrganizationDomainsResponses[1:]
+		return response.OrganizationDomains, response.Error
+	}
+	panic("FindOrganizationDomainsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveOrganizationDomain(domain string) (err error) {
+	if len(r.RemoveOrganizationDomainResponses) > 0 {
+		err, r.RemoveOrganizationDomainResponses = r.RemoveOrganizationDomainResponses[0], r.RemoveOrganizationDomainResponses[1:]
+		return err
+	}
+	panic("RemoveOrganizationDomainResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RecordIdentities(ownerUserIDs map[string]string, dryRun bool) ([]string, error) {
+	if len(r.RecordIdentitiesResponses) > 0 {
+		var response RecordIdentitiesResponse
+		response, r.RecordIdentitiesResponses = r.RecordIdentitiesResponses[0], r.RecordIdentitiesResponses[1:]
+		return response.UserIDs, response.Error
+	}
+	panic("RecordIdentitiesResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveConfirmationsForUser(userID string) (err error) {
+	if len(r.RemoveConfirmationsForUserResponses) > 0 {
+		err, r.RemoveConfirmationsForUserResponses = r.RemoveConfirmationsForUserResponses[0], r.RemoveConfirmationsForUserResponses[1:]
+		return err
+	}
+	panic("RemoveConfirmationsForUserResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveConsentRecords(userID string) (err error) {
+	if len(r.RemoveConsentRecordsResponses) > 0 {
+		err, r.RemoveConsentRecordsResponses = r.RemoveConsentRecordsResponses[0], r.RemoveConsentRecordsResponses[1:]
+		return err
+	}
+	panic("RemoveConsentRecordsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RemoveSignupCodesForEmails(emails []string) (err error) {
+	if len(r.RemoveSignupCodesForEmailsResponses) > 0 {
+		err, r.RemoveSignupCodesForEmailsResponses = r.RemoveSignupCodesForEmailsResponses[0], r.RemoveSignupCodesForEmailsResponses[1:]
+		return err
+	}
+	panic("RemoveSignupCodesForEmailsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) AnonymizeAuditEvents(userID string, emails []string) (err error) {
+	if len(r.AnonymizeAuditEventsResponses) > 0 {
+		err, r.AnonymizeAuditEventsResponses = r.AnonymizeAuditEventsResponses[0], r.AnonymizeAuditEventsResponses[1:]
+		return err
+	}
+	panic("AnonymizeAuditEventsResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) RecordConfirmationExpiries(dryRun bool) ([]string, error) {
+	if len(r.RecordConfirmationExpiriesResponses) > 0 {
+		var response RecordConfirmationExpiriesResponse
+		response, r.RecordConfirmationExpiriesResponses = r.RecordConfirmationExpiriesResponses[0], r.RecordConfirmationExpiriesResponses[1:]
+		return response.ConfirmationIDs, response.Error
+	}
+	panic("RecordConfirmationExpiriesResponses unavailable")
+}
+
+func (r *ResponsableMockStoreClient) ReleaseDeletionJob(job *DeletionJob, leaseOwner string) (err error) {
+	if len(r.ReleaseDeletionJobResponses) > 0 {
+		err, r.ReleaseDeletionJobResponses = r.ReleaseDeletionJobResponses[0], r.ReleaseDeletionJobResponses[1:]
+		return err
+	}
+	panic("ReleaseDeletionJobResponses unavailable")
+}
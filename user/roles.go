@@ -0,0 +1,235 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Administrative permissions, which server tokens always have and users have through their roles
+const (
+	PERMISSION_EDIT_ROLES    = "editRoles"    // change the roles of any user
+	PERMISSION_VERIFY_EMAIL  = "verifyEmail"  // change whether any user's email is verified
+	PERMISSION_SUSPEND_USERS = "suspendUsers" // suspend and unsuspend users
+	PERMISSION_SEARCH_USERS  = "searchUsers"  // search all users
+)
+
+// Role is a role that may be assigned to users
+type Role struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description,omitempty"`
+	SelfAssignable bool     `json:"selfAssignable"`        // whether a user may request the role at signup
+	Implies        []string `json:"implies,omitempty"`     // roles assigned along with this role
+	Permissions    []string `json:"permissions,omitempty"` // administrative permissions of users with this role
+}
+
+// RoleRegistry is the set of roles users may have
+type RoleRegistry []Role
+
+var (
+	RoleRegistry_error_name_invalid       = errors.New("Role name is invalid")
+	RoleRegistry_error_name_duplicate     = errors.New("Role name is defined more than once")
+	RoleRegistry_error_implies_unknown    = errors.New("Role implies an unknown role")
+	RoleRegistry_error_permission_unknown = errors.New("Role has an unknown permission")
+)
+
+// IsValidPermission returns whether the permission is one of the administrative permissions
+func IsValidPermission(permission string) bool {
+	switch permission {
+	case PERMISSION_EDIT_ROLES, PERMISSION_VERIFY_EMAIL, PERMISSION_SUSPEND_USERS, PERMISSION_SEARCH_USERS:
+		return true
+	default:
+		return false
+	}
+}
+
+// DefaultRoleRegistry returns the roles used when none are configured
+func DefaultRoleRegistry() RoleRegistry {
+	return RoleRegistry{
+		{Name: "clinic", Description: "Clinic or clinician account", SelfAssignable: true},
+	}
+}
+
+// RoleRegistry returns the configured roles, or the default roles if none are configured
+func (c ApiConfig) RoleRegistry() RoleRegistry {
+	if len(c.Roles) == 0 {
+		return DefaultRoleRegistry()
+	}
+	return c.Roles
+}
+
+// Validate checks that role names are valid and unique, and that implied roles are defined
+func (r RoleRegistry) Validate() error {
+	names := map[string]bool{}
+	for _, role := range r {
+		if !IsValidRoleName(role.Name) {
+			return RoleRegistry_error_name_invalid
+		} else if names[role.Name] {
+			return RoleRegistry_error_name_duplicate
+		}
+		names[role.Name] = true
+	}
+	for _, role := range r {
+		for _, implied := range role.Implies {
+			if !names[implied] {
+				return RoleRegistry_error_implies_unknown
+			}
+		}
+		for _, permission := range role.Permissions {
+			if !IsValidPermission(permission) {
+				return RoleRegistry_error_permission_unknown
+			}
+		}
+	}
+	return nil
+}
+
+// Find returns the role with the given name, or nil if there is none
+func (r RoleRegistry) Find(name string) *Role {
+	for index := range r {
+		if r[index].Name == name {
+			return &r[index]
+		}
+	}
+	return nil
+}
+
+// IsValid returns whether the role is defined
+func (r RoleRegistry) IsValid(name string) bool {
+	return r.Find(name) != nil
+}
+
+// Expand returns the roles along with all of the roles they imply, without duplicates
+func (r RoleRegistry) Expand(roles []string) []string {
+	if roles == nil {
+		return nil
+	}
+	expanded := []string{}
+	seen := map[string]bool{}
+	var expand func(name string)
+	expand = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		expanded = append(expanded, name)
+		if role := r.Find(name); role != nil {
+			for _, implied := range role.Implies {
+				expand(implied)
+			}
+		}
+	}
+	for _, name := range roles {
+		expand(name)
+	}
+	return expanded
+}
+
+// Grants returns whether any of the roles grants the permission
+func (r RoleRegistry) Grants(roles []string, permission string) bool {
+	for _, name := range roles {
+		if role := r.Find(name); role != nil {
+			for _, granted := range role.Permissions {
+				if granted == permission {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Granted returns whether any role grants the permission, so that users need not be looked up to
+// find that none of them has it
+func (r RoleRegistry) Granted(permission string) bool {
+	for _, role := range r {
+		if r.Grants([]string{role.Name}, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions of the roles and of the roles they imply, without duplicates
+func (r RoleRegistry) Permissions(roles []string) []string {
+	permissions := []string{}
+	for _, name := range r.Expand(roles) {
+		if role := r.Find(name); role != nil {
+			for _, permission := range role.Permissions {
+				if !containsString(permissions, permission) {
+					permissions = append(permissions, permission)
+				}
+			}
+		}
+	}
+	return permissions
+}
+
+// tokenDataKey is the request context key of the token authorized by requirePermissions
+type tokenDataKey struct{}
+
+// requirePermissions authorizes requests to an administrative handler: only server tokens and users
+// authorized for all of the permissions reach the handler, and with no permissions only server
+// tokens do. The handler reads the authorized token with authorizedTokenData.
+func (a *Api) requirePermissions(handler http.Handler, permissions ...string) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if tokenData, err := a.authenticateSessionToken(req.Context(), req.Header.Get(TP_SESSION_TOKEN)); err != nil {
+			a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED, err)
+
+		} else if !tokenData.IsServer && len(permissions) == 0 {
+			a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
+
+		} else if authorized, err := a.authorize(req.Context(), tokenData, permissions...); err != nil {
+			a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_USR, err)
+
+		} else if !authorized {
+			a.sendError(res, http.StatusUnauthorized, STATUS_UNAUTHORIZED)
+
+		} else {
+			handler.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), tokenDataKey{}, tokenData)))
+		}
+	})
+}
+
+// authorizedTokenData returns the token of a request authorized by requirePermissions
+func authorizedTokenData(req *http.Request) *TokenData {
+	tokenData, _ := req.Context().Value(tokenDataKey{}).(*TokenData)
+	return tokenData
+}
+
+// authorize returns whether the token may perform operations requiring all of the permissions:
+// server tokens may perform any operation, and users may if their roles grant the permissions and
+// they are neither deleted nor suspended. All administrative operations are authorized here, by
+// requirePermissions in front of the administrative handlers, or by UpdateUser, whose permissions
+// depend on the updates.
+func (a *Api) authorize(ctx context.Context, tokenData *TokenData, permissions ...string) (bool, error) {
+	if tokenData.IsServer || len(permissions) == 0 {
+		return true, nil
+	}
+
+	registry := a.ApiConfig.RoleRegistry()
+	for _, permission := range permissions {
+		if !registry.Granted(permission) {
+			return false, nil
+		}
+	}
+
+	user, err := a.Store.WithContext(ctx).FindUser(&User{Id: tokenData.UserId})
+	if err != nil {
+		return false, err
+	} else if user == nil || user.IsDeleted() || user.IsSuspended() {
+		return false, nil
+	}
+	for _, permission := range permissions {
+		if !registry.Grants(user.Roles, permission) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// GetRoles returns the roles users may have
+// status: 200 RoleRegistry
+func (a *Api) GetRoles(res http.ResponseWriter, req *http.Request) {
+	sendModelAsRes(res, a.ApiConfig.RoleRegistry())
+}
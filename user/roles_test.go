@@ -0,0 +1,71 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_RoleRegistry_Default(t *testing.T) {
+	registry := ApiConfig{}.RoleRegistry()
+	if err := registry.Validate(); err != nil {
+		t.Fatalf("Unexpected error for default roles: %#v", err)
+	}
+	if role := registry.Find("clinic"); role == nil || !role.SelfAssignable {
+		t.Fatalf("Unexpected default clinic role: %#v", role)
+	}
+	if registry.IsValid("support") {
+		t.Fatalf("Unexpected default support role")
+	}
+}
+
+func Test_RoleRegistry_Validate(t *testing.T) {
+	for _, test := range []struct {
+		registry RoleRegistry
+		err      error
+	}{
+		{RoleRegistry{{Name: "clinic"}, {Name: "clinician", Implies: []string{"clinic"}}}, nil},
+		{RoleRegistry{{Name: "Clinic"}}, RoleRegistry_error_name_invalid},
+		{RoleRegistry{{Name: "clinic"}, {Name: "clinic"}}, RoleRegistry_error_name_duplicate},
+		{RoleRegistry{{Name: "clinician", Implies: []string{"clinic"}}}, RoleRegistry_error_implies_unknown},
+		{RoleRegistry{{Name: "admin", Permissions: []string{PERMISSION_EDIT_ROLES, "deleteUsers"}}}, RoleRegistry_error_permission_unknown},
+	} {
+		if err := test.registry.Validate(); err != test.err {
+			t.Fatalf("Unexpected error for %#v: %#v", test.registry, err)
+		}
+	}
+}
+
+func Test_RoleRegistry_Expand(t *testing.T) {
+	registry := RoleRegistry{
+		{Name: "clinic"},
+		{Name: "clinician", Implies: []string{"clinic"}},
+		{Name: "support", Implies: []string{"clinician", "researcher"}},
+		{Name: "researcher", Implies: []string{"support"}},
+	}
+	if roles := registry.Expand(nil); roles != nil {
+		t.Fatalf("Unexpected expansion of nil roles: %v", roles)
+	}
+	if roles := registry.Expand([]string{}); roles == nil || len(roles) != 0 {
+		t.Fatalf("Unexpected expansion of empty roles: %v", roles)
+	}
+	if roles := registry.Expand([]string{"clinic", "support"}); !reflect.DeepEqual(roles, []string{"clinic", "support", "clinician", "researcher"}) {
+		t.Fatalf("Unexpected expanded roles: %v", roles)
+	}
+}
+
+func Test_RoleRegistry_Grants(t *testing.T) {
+	registry := RoleRegistry{
+		{Name: "clinic"},
+		{Name: "support", Permissions: []string{PERMISSION_SEARCH_USERS}},
+		{Name: "admin", Permissions: []string{PERMISSION_EDIT_ROLES, PERMISSION_SEARCH_USERS}},
+	}
+	if !registry.Grants([]string{"clinic", "support"}, PERMISSION_SEARCH_USERS) {
+		t.Fatalf("Support role unexpectedly does not grant search")
+	}
+	if registry.Grants([]string{"clinic", "support"}, PERMISSION_EDIT_ROLES) || registry.Grants([]string{"unknown"}, PERMISSION_SEARCH_USERS) {
+		t.Fatalf("Roles unexpectedly grant permission")
+	}
+	if !registry.Granted(PERMISSION_EDIT_ROLES) || registry.Granted(PERMISSION_SUSPEND_USERS) {
+		t.Fatalf("Unexpected granted permissions")
+	}
+}
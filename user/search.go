@@ -0,0 +1,224 @@
+package user
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	USER_SEARCH_SORT_CREATED_TIME  = "createdTime"
+	USER_SEARCH_SORT_MODIFIED_TIME = "modifiedTime"
+	USER_SEARCH_SORT_USERNAME      = "username"
+
+	USER_SEARCH_ACCOUNT_CUSTODIAL = "custodial"
+	USER_SEARCH_ACCOUNT_PASSWORD  = "password"
+
+	userSearchDefaultLimit = 100
+	userSearchMaxLimit     = 1000
+)
+
+// UserSearch is a server search of users. All given filters must match. Results are ordered by
+// Sort, then by user id, and are paged by passing the cursor of the previous page.
+type UserSearch struct {
+	EmailPrefix   string // matches the start of the username or any email, ignoring case
+	Role          string
+	EmailVerified *bool
+	CreatedFrom   string // timestamps are inclusive lower and exclusive upper bounds
+	CreatedTo     string
+	ModifiedFrom  string
+	ModifiedTo    string
+	AccountType   string // one of "custodial" (no password) or "password"
+	Deleted       *bool
+	Suspended     *bool
+	TermsAccepted *bool  // whether users accepted TermsVersion
+	TermsVersion  string // the current terms version, resolved by ResolveTerms
+	TermsInitial  bool   // whether TermsVersion is the initial version, accepted by users with only termsAccepted
+	Sort          string // one of "createdTime" (default), "modifiedTime" or "username"
+	Descending    bool
+	Limit         int
+	Cursor        *UserSearchCursor
+}
+
+// UserSearchCursor is the position after the last user of a page of search results
+type UserSearchCursor struct {
+	Sort   string `json:"s"`
+	Value  string `json:"v"`
+	UserID string `json:"u"`
+}
+
+// UserSearchResults is a page of search results, along with the total number of matching users
+type UserSearchResults struct {
+	Users      []interface{} `json:"users"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+var (
+	UserSearch_error_parameter_unknown  = errors.New("Unknown search parameter")
+	UserSearch_error_role_invalid       = errors.New("Role is invalid")
+	UserSearch_error_bool_invalid       = errors.New("emailVerified, deleted, suspended and termsAccepted must be true or false")
+	UserSearch_error_time_invalid       = errors.New("Time ranges must be timestamps")
+	UserSearch_error_account_invalid    = errors.New("Account type must be custodial or password")
+	UserSearch_error_sort_invalid       = errors.New("Sort must be createdTime, modifiedTime or username, optionally prefixed with -")
+	UserSearch_error_limit_invalid      = errors.New("Limit must be between 1 and 1000")
+	UserSearch_error_cursor_invalid     = errors.New("Cursor is invalid")
+	UserSearch_error_terms_unconfigured = errors.New("termsAccepted requires current terms")
+)
+
+// ParseUserSearch parses a UserSearch from query parameters
+func ParseUserSearch(query url.Values) (*UserSearch, error) {
+	search := &UserSearch{Sort: USER_SEARCH_SORT_CREATED_TIME, Limit: userSearchDefaultLimit}
+	for key := range query {
+		value := strings.TrimSpace(query.Get(key))
+		switch key {
+		case "email":
+			search.EmailPrefix = value
+		case "role":
+			if !IsValidRoleName(value) {
+				return nil, UserSearch_error_role_invalid
+			}
+			search.Role = value
+		case "emailVerified", "deleted", "suspended", "termsAccepted":
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, UserSearch_error_bool_invalid
+			}
+			switch key {
+			case "emailVerified":
+				search.EmailVerified = &parsed
+			case "deleted":
+				search.Deleted = &parsed
+			case "suspended":
+				search.Suspended = &parsed
+			case "termsAccepted":
+				search.TermsAccepted = &parsed
+			}
+		case "createdFrom", "createdTo", "modifiedFrom", "modifiedTo":
+			parsed, err := parseSearchTime(value)
+			if err != nil {
+				return nil, UserSearch_error_time_invalid
+			}
+			switch key {
+			case "createdFrom":
+				search.CreatedFrom = parsed
+			case "createdTo":
+				search.CreatedTo = parsed
+			case "modifiedFrom":
+				search.ModifiedFrom = parsed
+			case "modifiedTo":
+				search.ModifiedTo = parsed
+			}
+		case "accountType":
+			if value != USER_SEARCH_ACCOUNT_CUSTODIAL && value != USER_SEARCH_ACCOUNT_PASSWORD {
+				return nil, UserSearch_error_account_invalid
+			}
+			search.AccountType = value
+		case "sort":
+			search.Descending = strings.HasPrefix(value, "-")
+			search.Sort = strings.TrimPrefix(value, "-")
+			if search.Sort != USER_SEARCH_SORT_CREATED_TIME && search.Sort != USER_SEARCH_SORT_MODIFIED_TIME && search.Sort != USER_SEARCH_SORT_USERNAME {
+				return nil, UserSearch_error_sort_invalid
+			}
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 1 || limit > userSearchMaxLimit {
+				return nil, UserSearch_error_limit_invalid
+			}
+			search.Limit = limit
+		case "cursor":
+		default:
+			return nil, UserSearch_error_parameter_unknown
+		}
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := DecodeUserSearchCursor(value)
+		if err != nil || cursor.Sort != search.SortKey() {
+			return nil, UserSearch_error_cursor_invalid
+		}
+		search.Cursor = cursor
+	}
+
+	return search, nil
+}
+
+// ResolveTerms sets the terms version a termsAccepted search filters by to the current version
+func (s *UserSearch) ResolveTerms(documents TermsDocuments, now time.Time) error {
+	if s.TermsAccepted != nil {
+		current := documents.Current(now)
+		if current == nil {
+			return UserSearch_error_terms_unconfigured
+		}
+		s.TermsVersion = current.Version
+		s.TermsInitial = documents.Initial().Version == current.Version
+	}
+	return nil
+}
+
+// parseSearchTime accepts RFC 3339 timestamps, as well as TimestampFormat, and returns them in
+// TimestampFormat in UTC so they compare with stored timestamps
+func parseSearchTime(value string) (string, error) {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if parsed, err = time.Parse(TimestampFormat, value); err != nil {
+			return "", err
+		}
+	}
+	return parsed.UTC().Format(TimestampFormat), nil
+}
+
+// SortKey identifies the search's order, so that a cursor is only used with the order it came from
+func (s *UserSearch) SortKey() string {
+	if s.Descending {
+		return "-" + s.Sort
+	}
+	return s.Sort
+}
+
+// SortValue returns the value of the search's sort field for the user
+func (s *UserSearch) SortValue(user *User) string {
+	switch s.Sort {
+	case USER_SEARCH_SORT_MODIFIED_TIME:
+		return user.ModifiedTime
+	case USER_SEARCH_SORT_USERNAME:
+		return user.Username
+	default:
+		return user.CreatedTime
+	}
+}
+
+// NextCursor returns the cursor of the page after the given users, which are the current page
+func (s *UserSearch) NextCursor(users []*User) *UserSearchCursor {
+	if len(users) == 0 {
+		return nil
+	}
+	last := users[len(users)-1]
+	return &UserSearchCursor{Sort: s.SortKey(), Value: s.SortValue(last), UserID: last.Id}
+}
+
+// Encode returns the cursor as an opaque string
+func (c *UserSearchCursor) Encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// DecodeUserSearchCursor decodes a cursor returned by Encode
+func DecodeUserSearchCursor(value string) (*UserSearchCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &UserSearchCursor{}
+	if err := json.Unmarshal(decoded, cursor); err != nil {
+		return nil, err
+	}
+	if cursor.UserID == "" {
+		return nil, UserSearch_error_cursor_invalid
+	}
+	return cursor, nil
+}
@@ -0,0 +1,93 @@
+package user
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_ParseUserSearch_Defaults(t *testing.T) {
+	search, err := ParseUserSearch(url.Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if search.Sort != USER_SEARCH_SORT_CREATED_TIME || search.Descending || search.Limit != userSearchDefaultLimit || search.Cursor != nil {
+		t.Fatalf("Unexpected search defaults: %#v", search)
+	}
+}
+
+func Test_ParseUserSearch_Filters(t *testing.T) {
+	query := url.Values{
+		"email":         {"pat"},
+		"role":          {"clinic"},
+		"emailVerified": {"false"},
+		"createdFrom":   {"2016-01-01T01:00:00-08:00"},
+		"accountType":   {"custodial"},
+		"deleted":       {"true"},
+		"sort":          {"-username"},
+		"limit":         {"10"},
+	}
+	search, err := ParseUserSearch(query)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if search.EmailPrefix != "pat" || search.Role != "clinic" || search.EmailVerified == nil || *search.EmailVerified || search.Deleted == nil || !*search.Deleted {
+		t.Fatalf("Unexpected search filters: %#v", search)
+	}
+	if search.CreatedFrom != "2016-01-01T09:00:00+00:00" || search.AccountType != USER_SEARCH_ACCOUNT_CUSTODIAL {
+		t.Fatalf("Unexpected search filters: %#v", search)
+	}
+	if search.Sort != USER_SEARCH_SORT_USERNAME || !search.Descending || search.Limit != 10 {
+		t.Fatalf("Unexpected search order: %#v", search)
+	}
+}
+
+func Test_ParseUserSearch_Errors(t *testing.T) {
+	for query, expected := range map[string]error{
+		"unknown=1":            UserSearch_error_parameter_unknown,
+		"role=Admin":           UserSearch_error_role_invalid,
+		"deleted=maybe":        UserSearch_error_bool_invalid,
+		"modifiedTo=yesterday": UserSearch_error_time_invalid,
+		"accountType=oauth":    UserSearch_error_account_invalid,
+		"sort=id":              UserSearch_error_sort_invalid,
+		"limit=0":              UserSearch_error_limit_invalid,
+		"cursor=not-a-cursor":  UserSearch_error_cursor_invalid,
+		"sort=-createdTime&cursor=" + (&UserSearchCursor{Sort: "createdTime", UserID: "1111111111"}).Encode(): UserSearch_error_cursor_invalid,
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseUserSearch(values); err != expected {
+			t.Fatalf("Unexpected error for %s: %v", query, err)
+		}
+	}
+}
+
+func Test_UserSearch_NextCursor(t *testing.T) {
+	search := &UserSearch{Sort: USER_SEARCH_SORT_USERNAME, Descending: true}
+	cursor := search.NextCursor([]*User{{Id: "1111111111", Username: "a@b.co"}, {Id: "2222222222", Username: "c@d.co"}})
+	decoded, err := DecodeUserSearchCursor(cursor.Encode())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if *decoded != (UserSearchCursor{Sort: "-username", Value: "c@d.co", UserID: "2222222222"}) {
+		t.Fatalf("Unexpected cursor: %#v", decoded)
+	}
+}
+
+func Test_UserSearch_ResolveTerms(t *testing.T) {
+	accepted := false
+	search := &UserSearch{TermsAccepted: &accepted}
+	if err := search.ResolveTerms(TermsDocuments{}, time.Now()); err != UserSearch_error_terms_unconfigured {
+		t.Fatalf("Unexpected error without terms: %v", err)
+	}
+	documents := TermsDocuments{{Version: "1", EffectiveTime: "2016-01-01T00:00:00Z"}}
+	if err := search.ResolveTerms(documents, time.Now()); err != nil || search.TermsVersion != "1" || !search.TermsInitial {
+		t.Fatalf("Unexpected resolved terms: %v %#v", err, search)
+	}
+	documents = append(documents, TermsDocument{Version: "2", EffectiveTime: "2017-01-01T00:00:00Z"})
+	if err := search.ResolveTerms(documents, time.Now()); err != nil || search.TermsVersion != "2" || search.TermsInitial {
+		t.Fatalf("Unexpected resolved terms: %v %#v", err, search)
+	}
+	if err := (&UserSearch{}).ResolveTerms(TermsDocuments{}, time.Now()); err != nil {
+		t.Fatalf("Unexpected error without termsAccepted: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+package user
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tidepool-org/shoreline/user/mailer"
+)
+
+const (
+	REGISTRATION_MODE_OPEN       = "open"       // anyone may sign up, with or without a signup code
+	REGISTRATION_MODE_INVITATION = "invitation" // only the invited email may sign up, with the code of its invitation
+	REGISTRATION_MODE_CODE       = "code"       // signups need a signup code
+
+	defaultSignupCodeDurationHours = 7 * 24
+	signupCodeBytes                = 16 // 128 random bits, as a code is a credential bypassing the signup policy
+
+	// the type of the link in invitation emails, which are {confirmationUrl}/signup/{code}
+	signupInvitationLinkType = "signup"
+)
+
+// SignupCode lets users sign up when registration is not open, and grants them its roles. A code
+// with an email is an invitation, which only a signup with that username may use.
+type SignupCode struct {
+	Code          string   `json:"code" bson:"_id"`
+	Email         string   `json:"email,omitempty" bson:"email,omitempty"`
+	Roles         []string `json:"roles,omitempty" bson:"roles,omitempty"` // granted to the users signing up with the code
+	MaxUses       int      `json:"maxUses" bson:"maxUses"`                 // 0 for no limit
+	Uses          int      `json:"uses" bson:"uses"`
+	CreatedTime   string   `json:"createdTime" bson:"createdTime"`
+	CreatedUserID string   `json:"createdUserId,omitempty" bson:"createdUserId,omitempty"` // the token user, or server name, that created the code
+	ExpiresTime   string   `json:"expiresTime" bson:"expiresTime"`
+}
+
+// SignupCodeRequest are the details of a new signup code. MaxUses defaults to 1 for invitations
+// and to no limit for other codes.
+type SignupCodeRequest struct {
+	Email         string   `json:"email"`
+	Roles         []string `json:"roles"`
+	MaxUses       *int     `json:"maxUses"`
+	DurationHours int      `json:"durationHours"` // defaults to a week
+}
+
+var (
+	SignupCode_error_email_invalid    = errors.New("Signup code email is invalid")
+	SignupCode_error_role_unknown     = errors.New("Signup code has an unknown role")
+	SignupCode_error_max_uses_invalid = errors.New("Signup code max uses must not be negative")
+	SignupCode_error_duration_invalid = errors.New("Signup code duration must not be negative")
+	SignupCode_error_email_required   = errors.New("Signup code email is required for invitation only registration")
+
+	ApiConfig_error_registration_mode_invalid = errors.New("Registration mode must be open, invitation or code")
+)
+
+// ValidateRegistrationMode checks that the registration mode is known
+func (c ApiConfig) ValidateRegistrationMode() error {
+	switch c.RegistrationMode {
+	case "", REGISTRATION_MODE_OPEN, REGISTRATION_MODE_INVITATION, REGISTRATION_MODE_CODE:
+		return nil
+	}
+	return ApiConfig_error_registration_mode_invalid
+}
+
+// IsRegistrationOpen returns whether users may sign up without a signup code
+func (c ApiConfig) IsRegistrationOpen() bool {
+	return c.RegistrationMode == "" || c.RegistrationMode == REGISTRATION_MODE_OPEN
+}
+
+// ParseSignupCodeRequest parses a SignupCodeRequest from a JSON body, normalizing its email
+func ParseSignupCodeRequest(reader io.Reader) (*SignupCodeRequest, error) {
+	request := &SignupCodeRequest{}
+	if reader == nil {
+		return request, nil
+	} else if err := json.NewDecoder(reader).Decode(request); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if request.Email != "" {
+		request.Email = NormalizeEmail(request.Email)
+	}
+	return request, nil
+}
+
+// Validate checks that the email, if any, is valid, that the roles are defined and that the limits are
+// not negative. Codes for invitation only registration must have an email.
+func (r *SignupCodeRequest) Validate(registry RoleRegistry, registrationMode string) error {
+	if r.Email != "" && !IsValidEmail(r.Email) {
+		return SignupCode_error_email_invalid
+	} else if r.Email == "" && registrationMode == REGISTRATION_MODE_INVITATION {
+		return SignupCode_error_email_required
+	} else if r.MaxUses != nil && *r.MaxUses < 0 {
+		return SignupCode_error_max_uses_invalid
+	} else if r.DurationHours < 0 {
+		return SignupCode_error_duration_invalid
+	}
+	for _, role := range r.Roles {
+		if !registry.IsValid(role) {
+			return SignupCode_error_role_unknown
+		}
+	}
+	return nil
+}
+
+// generateSignupCode returns signupCodeBytes random bytes from crypto/rand, base32 encoded without padding
+func generateSignupCode() (string, error) {
+	code := make([]byte, signupCodeBytes)
+	if _, err := rand.Read(code); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(code), nil
+}
+
+// NewSignupCode returns a signup code for the request with a random code
+func NewSignupCode(request *SignupCodeRequest, createdUserID string, now time.Time) (*SignupCode, error) {
+	code, err := generateSignupCode()
+	if err != nil {
+		return nil, err
+	}
+
+	maxUses := 0
+	if request.MaxUses != nil {
+		maxUses = *request.MaxUses
+	} else if request.Email != "" {
+		maxUses = 1
+	}
+	durationHours := request.DurationHours
+	if durationHours == 0 {
+		durationHours = defaultSignupCodeDurationHours
+	}
+
+	return &SignupCode{
+		Code:          code,
+		Email:         request.Email,
+		Roles:         request.Roles,
+		MaxUses:       maxUses,
+		CreatedTime:   now.UTC().Format(TimestampFormat),
+		CreatedUserID: createdUserID,
+		ExpiresTime:   now.Add(time.Duration(durationHours) * time.Hour).UTC().Format(TimestampFormat),
+	}, nil
+}
+
+// IsUsable returns whether the code has not expired and has uses left
+func (c *SignupCode) IsUsable(now time.Time) bool {
+	return c.ExpiresTime > now.UTC().Format(TimestampFormat) && (c.MaxUses == 0 || c.Uses < c.MaxUses)
+}
+
+// AllowsUsername returns whether a signup with the username may use the code
+func (c *SignupCode) AllowsUsername(username string) bool {
+	return c.Email == "" || SameEmail(c.Email, username)
+}
+
+// findSignupCode finds the signup code given to a signup, if any, and checks that the signup may use
+// it. It sends an error and returns false if the registration mode requires a code that was not given,
+// or if the code may not be used.
+func (a *Api) findSignupCode(res http.ResponseWriter, req *http.Request, details *NewUserDetails) (*SignupCode, bool) {
+	if details.SignupCode == nil || *details.SignupCode == "" {
+		if !a.ApiConfig.IsRegistrationOpen() {
+			a.sendError(res, http.StatusForbidden, STATUS_SIGNUP_CODE_REQUIRED)
+			return nil, false
+		}
+		return nil, true
+	}
+
+	signupCode, err := a.Store.WithContext(req.Context()).FindSignupCode(*details.SignupCode)
+	if err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_SIGNUP_CODE, err)
+		return nil, false
+	} else if signupCode == nil || !signupCode.IsUsable(time.Now()) || !signupCode.AllowsUsername(*details.Username) ||
+		(a.ApiConfig.RegistrationMode == REGISTRATION_MODE_INVITATION && signupCode.Email == "") {
+		a.sendError(res, http.StatusForbidden, STATUS_SIGNUP_CODE_INVALID)
+		return nil, false
+	}
+	return signupCode, true
+}
+
+// releaseSignupCode takes back the use of a signup code by a signup that failed. Failing to release
+// it is logged, leaving the code with one less use.
+func (a *Api) releaseSignupCode(store Storage, signupCode *SignupCode) {
+	if signupCode == nil {
+		return
+	}
+	if err := store.ReleaseSignupCode(signupCode.Code); err != nil {
+		a.logger.Printf("Error releasing signup code %s: %s", signupCode.Code, err)
+	}
+}
+
+// sendSignupInvitation emails an invitation with its code to the invited email. It does nothing when no
+// mailer is attached, in which case the invitation is left to other services.
+func (a *Api) sendSignupInvitation(signupCode *SignupCode) error {
+	if a.mailer == nil || signupCode.Email == "" {
+		return nil
+	}
+
+	return a.mailer.Send(&mailer.Message{
+		To:      signupCode.Email,
+		Subject: "You are invited to sign up",
+		Body: fmt.Sprintf("You are invited to create an account. Sign up by following this link:\n\n%s\n\nor by giving the signup code %s. The invitation expires on %s.",
+			a.confirmationLink(signupInvitationLinkType, signupCode.Code), signupCode.Code, signupCode.ExpiresTime),
+	})
+}
+
+// CreateSignupCode creates a signup code, or an invitation if it is given an email, which is emailed
+// the code when a mailer is configured
+// status: 201 SignupCode
+// status: 400 STATUS_INVALID_CODE_DETAILS
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_ADDING_SIGNUP_CODE
+func (a *Api) CreateSignupCode(res http.ResponseWriter, req *http.Request) {
+	tokenData := authorizedTokenData(req)
+	if request, err := ParseSignupCodeRequest(req.Body); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CODE_DETAILS, err)
+
+	} else if err := request.Validate(a.ApiConfig.RoleRegistry(), a.ApiConfig.RegistrationMode); err != nil {
+		a.sendError(res, http.StatusBadRequest, STATUS_INVALID_CODE_DETAILS, err)
+
+	} else if signupCode, err := NewSignupCode(request, tokenData.UserId, time.Now()); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_ADDING_SIGNUP_CODE, err)
+
+	} else if err := a.Store.WithContext(req.Context()).AddSignupCode(signupCode); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_ADDING_SIGNUP_CODE, err)
+
+	} else {
+		// The code is returned to the caller, so a failure to email it does not fail the request
+		if err := a.sendSignupInvitation(signupCode); err != nil {
+			a.logger.Printf("Error sending signup invitation to %s: %s", signupCode.Email, err)
+		}
+		a.auditEvent(req, AUDIT_EVENT_SIGNUP_CODE_CREATED, tokenData.UserId, "")
+		sendModelAsResWithStatus(res, signupCode, http.StatusCreated)
+	}
+}
+
+// GetSignupCodes returns all signup codes and invitations, most recently created first
+// status: 200 []SignupCode
+// status: 401 STATUS_UNAUTHORIZED
+// status: 500 STATUS_ERR_FINDING_SIGNUP_CODE
+func (a *Api) GetSignupCodes(res http.ResponseWriter, req *http.Request) {
+	if signupCodes, err := a.Store.WithContext(req.Context()).FindSignupCodes(); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_SIGNUP_CODE, err)
+
+	} else {
+		sendModelAsRes(res, signupCodes)
+	}
+}
+
+// RemoveSignupCode removes a signup code or invitation so that it can no longer be used
+// status: 200 SignupCode
+// status: 401 STATUS_UNAUTHORIZED
+// status: 404 STATUS_SIGNUP_CODE_NOT_FOUND
+// status: 500 STATUS_ERR_FINDING_SIGNUP_CODE, STATUS_ERR_REMOVING_CODE
+func (a *Api) RemoveSignupCode(res http.ResponseWriter, req *http.Request, vars map[string]string) {
+	tokenData := authorizedTokenData(req)
+	if signupCode, err := a.Store.WithContext(req.Context()).FindSignupCode(vars["code"]); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_FINDING_SIGNUP_CODE, err)
+
+	} else if signupCode == nil {
+		a.sendError(res, http.StatusNotFound, STATUS_SIGNUP_CODE_NOT_FOUND)
+
+	} else if err := a.Store.WithContext(req.Context()).RemoveSignupCode(signupCode.Code); err != nil {
+		a.sendError(res, http.StatusInternalServerError, STATUS_ERR_REMOVING_CODE, err)
+
+	} else {
+		a.auditEvent(req, AUDIT_EVENT_SIGNUP_CODE_REMOVED, tokenData.UserId, "")
+		sendModelAsRes(res, signupCode)
+	}
+}
@@ -0,0 +1,105 @@
+package user
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ApiConfig_ValidateRegistrationMode(t *testing.T) {
+	for _, mode := range []string{"", REGISTRATION_MODE_OPEN, REGISTRATION_MODE_INVITATION, REGISTRATION_MODE_CODE} {
+		if err := (ApiConfig{RegistrationMode: mode}).ValidateRegistrationMode(); err != nil {
+			t.Fatalf("Unexpected error for registration mode %q: %v", mode, err)
+		}
+	}
+	if err := (ApiConfig{RegistrationMode: "closed"}).ValidateRegistrationMode(); err != ApiConfig_error_registration_mode_invalid {
+		t.Fatalf("Unexpected error for unknown registration mode: %v", err)
+	}
+	if !(ApiConfig{}).IsRegistrationOpen() || (ApiConfig{RegistrationMode: REGISTRATION_MODE_CODE}).IsRegistrationOpen() {
+		t.Fatalf("Unexpected open registration")
+	}
+}
+
+func Test_ParseSignupCodeRequest(t *testing.T) {
+	if request, err := ParseSignupCodeRequest(strings.NewReader("")); err != nil || !reflect.DeepEqual(request, &SignupCodeRequest{}) {
+		t.Fatalf("Unexpected request for empty body: %#v, %v", request, err)
+	}
+	if _, err := ParseSignupCodeRequest(strings.NewReader("{")); err == nil {
+		t.Fatalf("Expected error for malformed body")
+	}
+	request, err := ParseSignupCodeRequest(strings.NewReader("{\"email\": \" a@XN--BCHER-KVA.DE \", \"roles\": [\"clinic\"], \"maxUses\": 0, \"durationHours\": 24}"))
+	if err != nil || request.Email != "a@bücher.de" || !reflect.DeepEqual(request.Roles, []string{"clinic"}) || request.MaxUses == nil || *request.MaxUses != 0 || request.DurationHours != 24 {
+		t.Fatalf("Unexpected request: %#v, %v", request, err)
+	}
+}
+
+func Test_SignupCodeRequest_Validate(t *testing.T) {
+	negative := -1
+	for _, test := range []struct {
+		request SignupCodeRequest
+		mode    string
+		err     error
+	}{
+		{SignupCodeRequest{}, "", nil},
+		{SignupCodeRequest{Email: "a@z.co", Roles: []string{"clinic"}}, REGISTRATION_MODE_INVITATION, nil},
+		{SignupCodeRequest{Email: "a"}, "", SignupCode_error_email_invalid},
+		{SignupCodeRequest{}, REGISTRATION_MODE_INVITATION, SignupCode_error_email_required},
+		{SignupCodeRequest{MaxUses: &negative}, "", SignupCode_error_max_uses_invalid},
+		{SignupCodeRequest{DurationHours: -1}, "", SignupCode_error_duration_invalid},
+		{SignupCodeRequest{Roles: []string{"unknown"}}, "", SignupCode_error_role_unknown},
+	} {
+		if err := test.request.Validate(DefaultRoleRegistry(), test.mode); err != test.err {
+			t.Fatalf("Unexpected error for %#v: %v", test.request, err)
+		}
+	}
+}
+
+func Test_NewSignupCode(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	signupCode, err := NewSignupCode(&SignupCodeRequest{Email: "a@z.co", Roles: []string{"clinic"}}, "0000000000", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(signupCode.Code) != 26 || signupCode.Email != "a@z.co" || !reflect.DeepEqual(signupCode.Roles, []string{"clinic"}) || signupCode.MaxUses != 1 ||
+		signupCode.CreatedUserID != "0000000000" || signupCode.CreatedTime != "2020-01-02T03:04:05+00:00" || signupCode.ExpiresTime != "2020-01-09T03:04:05+00:00" {
+		t.Fatalf("Unexpected invitation: %#v", signupCode)
+	}
+
+	maxUses := 5
+	if signupCode, err = NewSignupCode(&SignupCodeRequest{MaxUses: &maxUses, DurationHours: 1}, "0000000000", now); err != nil || signupCode.MaxUses != 5 || signupCode.ExpiresTime != "2020-01-02T04:04:05+00:00" {
+		t.Fatalf("Unexpected signup code: %#v, %v", signupCode, err)
+	}
+	if signupCode, err = NewSignupCode(&SignupCodeRequest{}, "0000000000", now); err != nil || signupCode.MaxUses != 0 {
+		t.Fatalf("Unexpected unlimited signup code: %#v, %v", signupCode, err)
+	}
+	if other, err := NewSignupCode(&SignupCodeRequest{}, "0000000000", now); err != nil || other.Code == signupCode.Code {
+		t.Fatalf("Unexpected signup code for the same request: %#v, %v", other, err)
+	}
+}
+
+func Test_SignupCode_IsUsable(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		signupCode SignupCode
+		usable     bool
+	}{
+		{SignupCode{ExpiresTime: "2020-01-03T00:00:00+00:00"}, true},
+		{SignupCode{ExpiresTime: "2020-01-03T00:00:00+00:00", MaxUses: 2, Uses: 1}, true},
+		{SignupCode{ExpiresTime: "2020-01-03T00:00:00+00:00", MaxUses: 2, Uses: 2}, false},
+		{SignupCode{ExpiresTime: "2020-01-01T00:00:00+00:00"}, false},
+	} {
+		if usable := test.signupCode.IsUsable(now); usable != test.usable {
+			t.Fatalf("Unexpected usable %v for %#v", usable, test.signupCode)
+		}
+	}
+}
+
+func Test_SignupCode_AllowsUsername(t *testing.T) {
+	if !(&SignupCode{}).AllowsUsername("a@z.co") {
+		t.Fatalf("Expected code without email to allow any username")
+	}
+	if signupCode := (&SignupCode{Email: "a@z.co"}); !signupCode.AllowsUsername("A@Z.co") || signupCode.AllowsUsername("b@z.co") {
+		t.Fatalf("Unexpected usernames allowed by invitation")
+	}
+}
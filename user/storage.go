@@ -1,6 +1,14 @@
 package user
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrUserRevisionConflict is returned by UpsertUser when the stored user was updated since the
+// given user was read
+var ErrUserRevisionConflict = errors.New("User was modified concurrently")
 
 // Storage interface
 type Storage interface {
@@ -16,4 +24,37 @@ type Storage interface {
 	AddToken(token *SessionToken) error
 	FindTokenByID(id string) (*SessionToken, error)
 	RemoveTokenByID(id string) error
+	RemoveTokensForUser(userID string) error
+	UpsertDeletionJob(job *DeletionJob) error
+	FindDeletionJobsForUser(userID string) ([]*DeletionJob, error)
+	ClaimDeletionJobDue(scheduledBefore time.Time, leaseOwner string, leaseExpires time.Time) (*DeletionJob, error)
+	FindTokensForUser(userID string) ([]*SessionToken, error)
+	AddConfirmation(confirmation *Confirmation) error
+	UseConfirmation(id string, usedTime time.Time) (*Confirmation, error)
+	FindConfirmationsForUser(userID string, confirmationType string) ([]*Confirmation, error)
+	SearchUsers(search *UserSearch) ([]*User, error)
+	CountUsers(search *UserSearch) (int, error)
+	FindUsersWithEmails(emails []string) ([]*User, error)
+	AddAuditEvent(event *AuditEvent) error
+	FindAuditEvents(query *AuditQuery) ([]*AuditEvent, error)
+	AddConsentRecord(record *ConsentRecord) error
+	FindConsentRecords(userID string) ([]*ConsentRecord, error)
+	FindUsersByCustodian(custodianUserID string) ([]*User, error)
+	FindDuplicateEmails() ([]*DuplicateEmail, error)
+	AddSignupCode(code *SignupCode) error
+	FindSignupCode(code string) (*SignupCode, error)
+	FindSignupCodes() ([]*SignupCode, error)
+	UseSignupCode(code string, usedTime time.Time) (*SignupCode, error)
+	ReleaseSignupCode(code string) error
+	RemoveSignupCode(code string) error
+	UpsertOrganizationDomain(domain *OrganizationDomain) error
+	FindOrganizationDomains() ([]*OrganizationDomain, error)
+	RemoveOrganizationDomain(domain string) error
+	RecordIdentities(ownerUserIDs map[string]string, dryRun bool) ([]string, error)
+	RemoveConfirmationsForUser(userID string) error
+	RemoveConsentRecords(userID string) error
+	RemoveSignupCodesForEmails(emails []string) error
+	AnonymizeAuditEvents(userID string, emails []string) error
+	RecordConfirmationExpiries(dryRun bool) ([]string, error)
+	ReleaseDeletionJob(job *DeletionJob, leaseOwner string) error
 }
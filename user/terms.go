@@ -0,0 +1,142 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// TermsDocument is a version of the terms of service, which users must accept once it takes effect
+type TermsDocument struct {
+	Version       string `json:"version"`
+	URL           string `json:"url,omitempty"`
+	EffectiveTime string `json:"effectiveTime"` // RFC 3339 timestamp
+}
+
+// TermsDocuments are the versions of the terms of service
+type TermsDocuments []TermsDocument
+
+// TermsAcceptance records when a user accepted a version of the terms of service
+type TermsAcceptance struct {
+	Version      string `json:"version" bson:"version"`
+	AcceptedTime string `json:"acceptedTime" bson:"acceptedTime"`
+}
+
+// TermsResults are the versions of the terms of service, along with the current version
+type TermsResults struct {
+	Current   *TermsDocument `json:"current,omitempty"`
+	Documents TermsDocuments `json:"documents"`
+}
+
+var (
+	TermsDocuments_error_version_invalid   = errors.New("Terms version is missing")
+	TermsDocuments_error_version_duplicate = errors.New("Terms version is defined more than once")
+	TermsDocuments_error_time_invalid      = errors.New("Terms effective time is invalid")
+)
+
+// Validate checks that versions are unique and effective times are valid
+func (d TermsDocuments) Validate() error {
+	versions := map[string]bool{}
+	for _, document := range d {
+		if document.Version == "" {
+			return TermsDocuments_error_version_invalid
+		} else if versions[document.Version] {
+			return TermsDocuments_error_version_duplicate
+		} else if _, err := time.Parse(time.RFC3339, document.EffectiveTime); err != nil {
+			return TermsDocuments_error_time_invalid
+		}
+		versions[document.Version] = true
+	}
+	return nil
+}
+
+// Find returns the document with the given version, or nil if there is none
+func (d TermsDocuments) Find(version string) *TermsDocument {
+	for index := range d {
+		if d[index].Version == version {
+			return &d[index]
+		}
+	}
+	return nil
+}
+
+// Current returns the document that most recently took effect before now, or nil if none has
+func (d TermsDocuments) Current(now time.Time) *TermsDocument {
+	var current *TermsDocument
+	var currentTime time.Time
+	for index := range d {
+		effectiveTime, err := time.Parse(time.RFC3339, d[index].EffectiveTime)
+		if err != nil || effectiveTime.After(now) {
+			continue
+		}
+		if current == nil || effectiveTime.After(currentTime) {
+			current, currentTime = &d[index], effectiveTime
+		}
+	}
+	return current
+}
+
+// Sorted returns the documents in order of effective time
+func (d TermsDocuments) Sorted() TermsDocuments {
+	sorted := append(TermsDocuments{}, d...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iTime, _ := time.Parse(time.RFC3339, sorted[i].EffectiveTime)
+		jTime, _ := time.Parse(time.RFC3339, sorted[j].EffectiveTime)
+		return iTime.Before(jTime)
+	})
+	return sorted
+}
+
+// Initial returns the document that took effect first, or nil if there are none. Users who accepted
+// the terms before versions were recorded, with termsAccepted but no termsAcceptances, accepted it.
+func (d TermsDocuments) Initial() *TermsDocument {
+	if sorted := d.Sorted(); len(sorted) > 0 {
+		return &sorted[0]
+	}
+	return nil
+}
+
+// AcceptTerms records that the user accepted the version of the terms at acceptedTime,
+// replacing any earlier acceptance of the same version
+func (u *User) AcceptTerms(version string, acceptedTime string) {
+	for _, acceptance := range u.TermsAcceptances {
+		if acceptance.Version == version {
+			acceptance.AcceptedTime = acceptedTime
+			return
+		}
+	}
+	u.TermsAcceptances = append(u.TermsAcceptances, &TermsAcceptance{Version: version, AcceptedTime: acceptedTime})
+}
+
+// HasAcceptedTerms returns whether the user accepted the version of the terms. A user who accepted the
+// terms before versions were recorded accepted only the initial version.
+func (u *User) HasAcceptedTerms(version string, initialVersion string) bool {
+	if len(u.TermsAcceptances) == 0 && u.TermsAccepted != "" {
+		return version == initialVersion
+	}
+	for _, acceptance := range u.TermsAcceptances {
+		if acceptance.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredTerms returns the current terms if the user has not accepted them, otherwise nil
+func (a *Api) requiredTerms(user *User, now time.Time) *TermsDocument {
+	if current := a.ApiConfig.Terms.Current(now); current != nil && !user.HasAcceptedTerms(current.Version, a.ApiConfig.Terms.Initial().Version) {
+		return current
+	}
+	return nil
+}
+
+// GetTerms returns the versions of the terms of service in order of effective time, along with
+// the current version
+// status: 200 TermsResults
+func (a *Api) GetTerms(res http.ResponseWriter, req *http.Request) {
+	sendModelAsRes(res, &TermsResults{
+		Current:   a.ApiConfig.Terms.Current(time.Now()),
+		Documents: a.ApiConfig.Terms.Sorted(),
+	})
+}
@@ -0,0 +1,90 @@
+package user
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var termsDocuments = TermsDocuments{
+	{Version: "2", URL: "https://example.com/terms/2", EffectiveTime: "2017-01-01T00:00:00Z"},
+	{Version: "1", URL: "https://example.com/terms/1", EffectiveTime: "2016-01-01T00:00:00Z"},
+	{Version: "3", URL: "https://example.com/terms/3", EffectiveTime: "2099-01-01T00:00:00Z"},
+}
+
+func Test_TermsDocuments_Validate(t *testing.T) {
+	for _, test := range []struct {
+		documents TermsDocuments
+		err       error
+	}{
+		{termsDocuments, nil},
+		{TermsDocuments{{EffectiveTime: "2016-01-01T00:00:00Z"}}, TermsDocuments_error_version_invalid},
+		{TermsDocuments{{Version: "1", EffectiveTime: "2016-01-01T00:00:00Z"}, {Version: "1", EffectiveTime: "2017-01-01T00:00:00Z"}}, TermsDocuments_error_version_duplicate},
+		{TermsDocuments{{Version: "1", EffectiveTime: "2016-01-01"}}, TermsDocuments_error_time_invalid},
+	} {
+		if err := test.documents.Validate(); err != test.err {
+			t.Fatalf("Unexpected error for %#v: %#v", test.documents, err)
+		}
+	}
+}
+
+func Test_TermsDocuments_Current(t *testing.T) {
+	if current := termsDocuments.Current(time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)); current == nil || current.Version != "2" {
+		t.Fatalf("Unexpected current terms: %#v", current)
+	}
+	if current := termsDocuments.Current(time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)); current == nil || current.Version != "1" {
+		t.Fatalf("Unexpected current terms: %#v", current)
+	}
+	if current := termsDocuments.Current(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)); current != nil {
+		t.Fatalf("Unexpected current terms before any took effect: %#v", current)
+	}
+	if current := (TermsDocuments{}).Current(time.Now()); current != nil {
+		t.Fatalf("Unexpected current terms without documents: %#v", current)
+	}
+}
+
+func Test_TermsDocuments_Sorted(t *testing.T) {
+	versions := []string{}
+	for _, document := range termsDocuments.Sorted() {
+		versions = append(versions, document.Version)
+	}
+	if !reflect.DeepEqual(versions, []string{"1", "2", "3"}) || termsDocuments[0].Version != "2" {
+		t.Fatalf("Unexpected sorted terms: %v", versions)
+	}
+}
+
+func Test_TermsDocuments_Initial(t *testing.T) {
+	if initial := termsDocuments.Initial(); initial == nil || initial.Version != "1" {
+		t.Fatalf("Unexpected initial terms: %#v", initial)
+	}
+	if initial := (TermsDocuments{}).Initial(); initial != nil {
+		t.Fatalf("Unexpected initial terms without documents: %#v", initial)
+	}
+}
+
+func Test_User_HasAcceptedTerms_Legacy(t *testing.T) {
+	user := &User{TermsAccepted: "2015-06-01T00:00:00+00:00"}
+	if !user.HasAcceptedTerms("1", "1") || user.HasAcceptedTerms("2", "1") {
+		t.Fatalf("Unexpected accepted terms for legacy acceptance: %#v", user)
+	}
+	user.AcceptTerms("2", "2017-01-01T00:00:00+00:00")
+	if user.HasAcceptedTerms("1", "1") || !user.HasAcceptedTerms("2", "1") {
+		t.Fatalf("Unexpected accepted terms: %#v", user.TermsAcceptances)
+	}
+}
+
+func Test_User_AcceptTerms(t *testing.T) {
+	user := &User{}
+	if user.HasAcceptedTerms("1", "1") {
+		t.Fatalf("User unexpectedly accepted terms")
+	}
+	user.AcceptTerms("1", "2016-01-01T00:00:00+00:00")
+	user.AcceptTerms("2", "2017-01-01T00:00:00+00:00")
+	user.AcceptTerms("1", "2017-06-01T00:00:00+00:00")
+	if !user.HasAcceptedTerms("1", "1") || !user.HasAcceptedTerms("2", "1") || user.HasAcceptedTerms("3", "1") {
+		t.Fatalf("Unexpected accepted terms: %#v", user.TermsAcceptances)
+	}
+	if len(user.TermsAcceptances) != 2 || user.TermsAcceptances[0].AcceptedTime != "2017-06-01T00:00:00+00:00" {
+		t.Fatalf("Unexpected terms acceptances: %#v", user.TermsAcceptances)
+	}
+}
@@ -10,31 +10,47 @@ import (
 )
 
 type User struct {
-	Id             string                 `json:"userid,omitempty" bson:"userid,omitempty"` // map userid to id
-	Username       string                 `json:"username,omitempty" bson:"username,omitempty"`
-	Emails         []string               `json:"emails,omitempty" bson:"emails,omitempty"`
-	Roles          []string               `json:"roles,omitempty" bson:"roles,omitempty"`
-	TermsAccepted  string                 `json:"termsAccepted,omitempty" bson:"termsAccepted,omitempty"`
-	EmailVerified  bool                   `json:"emailVerified" bson:"authenticated"` //tag is name `authenticated` for historical reasons
-	PwHash         string                 `json:"-" bson:"pwhash,omitempty"`
-	Hash           string                 `json:"-" bson:"userhash,omitempty"`
-	Private        map[string]*IdHashPair `json:"-" bson:"private"`
-	CreatedTime    string                 `json:"createdTime,omitempty" bson:"createdTime,omitempty"`
-	CreatedUserID  string                 `json:"createdUserId,omitempty" bson:"createdUserId,omitempty"`
-	ModifiedTime   string                 `json:"modifiedTime,omitempty" bson:"modifiedTime,omitempty"`
-	ModifiedUserID string                 `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"`
-	DeletedTime    string                 `json:"deletedTime,omitempty" bson:"deletedTime,omitempty"`
-	DeletedUserID  string                 `json:"deletedUserId,omitempty" bson:"deletedUserId,omitempty"`
-}
+	Id               string                 `json:"userid,omitempty" bson:"userid,omitempty"` // map userid to id
+	Username         string                 `json:"username,omitempty" bson:"username,omitempty"`
+	Emails           []string               `json:"emails,omitempty" bson:"emails,omitempty"`
+	CanonicalEmails  []string               `json:"-" bson:"canonicalEmails,omitempty"` // the canonical forms of the username and emails, set when stored
+	Roles            []string               `json:"roles,omitempty" bson:"roles,omitempty"`
+	ReviewRoles      []string               `json:"reviewRoles,omitempty" bson:"reviewRoles,omitempty"` // roles requested at signup that are withheld pending review
+	TermsAccepted    string                 `json:"termsAccepted,omitempty" bson:"termsAccepted,omitempty"`
+	EmailVerified    bool                   `json:"emailVerified" bson:"authenticated"` //tag is name `authenticated` for historical reasons
+	PwHash           string                 `json:"-" bson:"pwhash,omitempty"`
+	Hash             string                 `json:"-" bson:"userhash,omitempty"`
+	Private          map[string]*IdHashPair `json:"-" bson:"private"`
+	CreatedTime      string                 `json:"createdTime,omitempty" bson:"createdTime,omitempty"`
+	CreatedUserID    string                 `json:"createdUserId,omitempty" bson:"createdUserId,omitempty"`
+	ModifiedTime     string                 `json:"modifiedTime,omitempty" bson:"modifiedTime,omitempty"`
+	ModifiedUserID   string                 `json:"modifiedUserId,omitempty" bson:"modifiedUserId,omitempty"`
+	DeletedTime      string                 `json:"deletedTime,omitempty" bson:"deletedTime,omitempty"`
+	DeletedUserID    string                 `json:"deletedUserId,omitempty" bson:"deletedUserId,omitempty"`
+	PurgedTime       string                 `json:"purgedTime,omitempty" bson:"purgedTime,omitempty"`
+	PendingEmail     string                 `json:"pendingEmail,omitempty" bson:"pendingEmail,omitempty"`
+	VerifiedEmails   []string               `json:"verifiedEmails,omitempty" bson:"verifiedEmails,omitempty"` // verified emails other than the username
+	SuspendedTime    string                 `json:"suspendedTime,omitempty" bson:"suspendedTime,omitempty"`
+	SuspendedUserID  string                 `json:"suspendedUserId,omitempty" bson:"suspendedUserId,omitempty"`
+	TermsAcceptances []*TermsAcceptance     `json:"termsAcceptances,omitempty" bson:"termsAcceptances,omitempty"`
+	CustodianUserID  string                 `json:"custodianUserId,omitempty" bson:"custodianUserId,omitempty"` // the custodian of a custodial user
+	MergedTime       string                 `json:"mergedTime,omitempty" bson:"mergedTime,omitempty"`
+	MergedUserID     string                 `json:"mergedUserId,omitempty" bson:"mergedUserId,omitempty"` // the survivor a merged user was merged into
+	Revision         int                    `json:"revision,omitempty" bson:"revision,omitempty"`         // incremented by every update, for optimistic concurrency
+}
+
+// TimestampFormat is the format of all timestamps stored on a User
+const TimestampFormat = "2006-01-02T15:04:05-07:00"
 
 /*
  * Incoming user details used to create or update a `User`
  */
 type NewUserDetails struct {
-	Username *string
-	Emails   []string
-	Password *string
-	Roles    []string
+	Username   *string
+	Emails     []string
+	Password   *string
+	Roles      []string
+	SignupCode *string
 }
 
 type NewCustodialUserDetails struct {
@@ -48,6 +64,7 @@ type UpdateUserDetails struct {
 	Password      *string
 	Roles         []string
 	TermsAccepted *string
+	TermsVersion  *string // the version of the terms accepted, defaults to the current version
 	EmailVerified *bool
 }
 
@@ -60,7 +77,9 @@ var (
 	User_error_password_missing       = errors.New("Password is missing")
 	User_error_password_invalid       = errors.New("Password is invalid")
 	User_error_roles_invalid          = errors.New("Roles are invalid")
+	User_error_signup_code_invalid    = errors.New("Signup code is invalid")
 	User_error_terms_accepted_invalid = errors.New("Terms accepted is invalid")
+	User_error_terms_version_invalid  = errors.New("Terms version is invalid")
 	User_error_email_verified_invalid = errors.New("Email verified is invalid")
 )
 
@@ -126,23 +145,16 @@ func ExtractStringMap(data map[string]interface{}, key string) (map[string]inter
 	}
 }
 
-func IsValidEmail(email string) bool {
-	ok, _ := regexp.MatchString(`\A(?i)([^@\s]+)@((?:[-a-z0-9]+\.)+[a-z]{2,})\z`, email)
-	return ok
-}
-
 func IsValidPassword(password string) bool {
 	ok, _ := regexp.MatchString(`\A\S{8,72}\z`, password)
 	return ok
 }
 
-func IsValidRole(role string) bool {
-	switch role {
-	case "clinic":
-		return true
-	default:
-		return false
-	}
+// IsValidRoleName returns whether the role is a well-formed role name. Whether the role exists
+// is determined by the RoleRegistry.
+func IsValidRoleName(role string) bool {
+	ok, _ := regexp.MatchString(`\A[a-z][a-z0-9_-]{0,63}\z`, role)
+	return ok
 }
 
 func IsValidDate(date string) bool {
@@ -151,7 +163,7 @@ func IsValidDate(date string) bool {
 }
 
 func IsValidTimestamp(timestamp string) bool {
-	_, err := time.Parse("2006-01-02T15:04:05-07:00", timestamp)
+	_, err := time.Parse(TimestampFormat, timestamp)
 	return err == nil
 }
 
@@ -166,11 +178,12 @@ func (details *NewUserDetails) ExtractFromJSON(reader io.Reader) error {
 	}
 
 	var (
-		username *string
-		emails   []string
-		password *string
-		roles    []string
-		ok       bool
+		username   *string
+		emails     []string
+		password   *string
+		roles      []string
+		signupCode *string
+		ok         bool
 	)
 
 	if username, ok = ExtractString(decoded, "username"); !ok {
@@ -185,11 +198,15 @@ func (details *NewUserDetails) ExtractFromJSON(reader io.Reader) error {
 	if roles, ok = ExtractStringArray(decoded, "roles"); !ok {
 		return User_error_roles_invalid
 	}
+	if signupCode, ok = ExtractString(decoded, "signupCode"); !ok {
+		return User_error_signup_code_invalid
+	}
 
-	details.Username = username
-	details.Emails = emails
+	details.Username = normalizeEmailPointer(username)
+	details.Emails = normalizeEmails(emails)
 	details.Password = password
 	details.Roles = roles
+	details.SignupCode = signupCode
 	return nil
 }
 
@@ -218,7 +235,7 @@ func (details *NewUserDetails) Validate() error {
 
 	if details.Roles != nil {
 		for _, role := range details.Roles {
-			if !IsValidRole(role) {
+			if !IsValidRoleName(role) {
 				return User_error_roles_invalid
 			}
 		}
@@ -227,6 +244,16 @@ func (details *NewUserDetails) Validate() error {
 	return nil
 }
 
+// ValidateRoles checks that the roles are defined and may be requested at signup
+func (details *NewUserDetails) ValidateRoles(registry RoleRegistry) error {
+	for _, name := range details.Roles {
+		if role := registry.Find(name); role == nil || !role.SelfAssignable {
+			return User_error_roles_invalid
+		}
+	}
+	return nil
+}
+
 func ParseNewUserDetails(reader io.Reader) (*NewUserDetails, error) {
 	details := &NewUserDetails{}
 	if err := details.ExtractFromJSON(reader); err != nil {
@@ -282,8 +309,8 @@ func (details *NewCustodialUserDetails) ExtractFromJSON(reader io.Reader) error
 		return User_error_emails_invalid
 	}
 
-	details.Username = username
-	details.Emails = emails
+	details.Username = normalizeEmailPointer(username)
+	details.Emails = normalizeEmails(emails)
 	return nil
 }
 
@@ -354,6 +381,7 @@ func (details *UpdateUserDetails) ExtractFromJSON(reader io.Reader) error {
 		password      *string
 		roles         []string
 		termsAccepted *string
+		termsVersion  *string
 		emailVerified *bool
 		ok            bool
 	)
@@ -378,15 +406,19 @@ func (details *UpdateUserDetails) ExtractFromJSON(reader io.Reader) error {
 	if termsAccepted, ok = ExtractString(decoded, "termsAccepted"); !ok {
 		return User_error_terms_accepted_invalid
 	}
+	if termsVersion, ok = ExtractString(decoded, "termsVersion"); !ok {
+		return User_error_terms_version_invalid
+	}
 	if emailVerified, ok = ExtractBool(decoded, "emailVerified"); !ok {
 		return User_error_email_verified_invalid
 	}
 
-	details.Username = username
-	details.Emails = emails
+	details.Username = normalizeEmailPointer(username)
+	details.Emails = normalizeEmails(emails)
 	details.Password = password
 	details.Roles = roles
 	details.TermsAccepted = termsAccepted
+	details.TermsVersion = termsVersion
 	details.EmailVerified = emailVerified
 	return nil
 }
@@ -414,7 +446,7 @@ func (details *UpdateUserDetails) Validate() error {
 
 	if details.Roles != nil {
 		for _, role := range details.Roles {
-			if !IsValidRole(role) {
+			if !IsValidRoleName(role) {
 				return User_error_roles_invalid
 			}
 		}
@@ -426,9 +458,55 @@ func (details *UpdateUserDetails) Validate() error {
 		}
 	}
 
+	if details.TermsVersion != nil {
+		if *details.TermsVersion == "" || details.TermsAccepted == nil {
+			return User_error_terms_version_invalid
+		}
+	}
+
 	return nil
 }
 
+// ValidateRoles checks that the roles are defined
+func (details *UpdateUserDetails) ValidateRoles(registry RoleRegistry) error {
+	for _, name := range details.Roles {
+		if !registry.IsValid(name) {
+			return User_error_roles_invalid
+		}
+	}
+	return nil
+}
+
+// AdministrativePermissions returns the permissions required to make the updates to any user with the
+// original roles. Granting a role also requires all of its permissions, so that users cannot grant
+// permissions they do not have, such as the admin role.
+func (details *UpdateUserDetails) AdministrativePermissions(registry RoleRegistry, originalRoles []string) []string {
+	permissions := []string{}
+	if details.Roles != nil {
+		permissions = append(permissions, PERMISSION_EDIT_ROLES)
+		granted := []string{}
+		for _, name := range registry.Expand(details.Roles) {
+			if !containsString(originalRoles, name) {
+				granted = append(granted, name)
+			}
+		}
+		for _, permission := range registry.Permissions(granted) {
+			if !containsString(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	if details.EmailVerified != nil && !containsString(permissions, PERMISSION_VERIFY_EMAIL) {
+		permissions = append(permissions, PERMISSION_VERIFY_EMAIL)
+	}
+	return permissions
+}
+
+// IsAdministrative returns whether the details only make updates requiring administrative permissions
+func (details *UpdateUserDetails) IsAdministrative() bool {
+	return (details.Roles != nil || details.EmailVerified != nil) && details.Username == nil && details.Emails == nil && details.Password == nil && details.TermsAccepted == nil
+}
+
 func ParseUpdateUserDetails(reader io.Reader) (*UpdateUserDetails, error) {
 	details := &UpdateUserDetails{}
 	if err := details.ExtractFromJSON(reader); err != nil {
@@ -442,10 +520,178 @@ func (u *User) IsDeleted() bool {
 	return u.DeletedTime != ""
 }
 
+// MarkCreated records that the user was created by createdUserID at now
+func (u *User) MarkCreated(createdUserID string, now time.Time) {
+	u.CreatedTime = now.UTC().Format(TimestampFormat)
+	u.CreatedUserID = createdUserID
+	u.MarkModified(createdUserID, now)
+}
+
+// MarkModified records that the user was last modified by modifiedUserID at now
+func (u *User) MarkModified(modifiedUserID string, now time.Time) {
+	u.ModifiedTime = now.UTC().Format(TimestampFormat)
+	u.ModifiedUserID = modifiedUserID
+}
+
+// MarkDeleted flags the user as deleted by deletedUserID at the given time. The user
+// document is retained until it is purged at the end of the deletion grace period.
+func (u *User) MarkDeleted(deletedUserID string, now time.Time) {
+	u.DeletedTime = now.UTC().Format(TimestampFormat)
+	u.DeletedUserID = deletedUserID
+}
+
+// Restore clears the deleted flag from a user that has not yet been purged
+func (u *User) Restore() {
+	u.DeletedTime = ""
+	u.DeletedUserID = ""
+}
+
+// IsRestorable returns true if the user is deleted and still within the grace period
+func (u *User) IsRestorable(gracePeriod time.Duration, now time.Time) bool {
+	if !u.IsDeleted() || u.PurgedTime != "" {
+		return false
+	} else if deletedTime, err := time.Parse(TimestampFormat, u.DeletedTime); err != nil {
+		return false
+	} else {
+		return now.Before(deletedTime.Add(gracePeriod))
+	}
+}
+
+// Anonymized returns a copy of the user stripped of everything but the id, revision and
+// deletion details, suitable to be kept as a tombstone after the user is purged
+func (u *User) Anonymized(now time.Time) *User {
+	return &User{
+		Id:            u.Id,
+		Revision:      u.Revision,
+		DeletedTime:   u.DeletedTime,
+		DeletedUserID: u.DeletedUserID,
+		PurgedTime:    now.UTC().Format(TimestampFormat),
+	}
+}
+
+func (u *User) IsSuspended() bool {
+	return u.SuspendedTime != ""
+}
+
+// MarkSuspended records that the user was suspended by suspendedUserID at now
+func (u *User) MarkSuspended(suspendedUserID string, now time.Time) {
+	u.SuspendedTime = now.UTC().Format(TimestampFormat)
+	u.SuspendedUserID = suspendedUserID
+}
+
+// Unsuspend clears the suspended flag from a user
+func (u *User) Unsuspend() {
+	u.SuspendedTime = ""
+	u.SuspendedUserID = ""
+}
+
 func (u *User) Email() string {
 	return u.Username
 }
 
+// ChangeEmail makes email the user's username, replacing the previous username in its
+// emails, and clears any pending email change
+func (u *User) ChangeEmail(email string) {
+	previous := u.Username
+	emails := []string{email}
+	for _, existing := range u.Emails {
+		if !SameEmail(existing, previous) && !SameEmail(existing, email) {
+			emails = append(emails, existing)
+		}
+	}
+	u.Username = email
+	u.Emails = emails
+	u.VerifiedEmails = removeEmail(u.VerifiedEmails, email)
+	u.PendingEmail = ""
+}
+
+// HasEmail reports whether email is the user's username or one of its emails
+func (u *User) HasEmail(email string) bool {
+	return SameEmail(u.Username, email) || containsEmail(u.Emails, email)
+}
+
+// IsPrimaryEmail reports whether email is the user's username, which is its primary email
+func (u *User) IsPrimaryEmail(email string) bool {
+	return u.Username != "" && SameEmail(u.Username, email)
+}
+
+// HasVerifiedEmail reports whether the user has verified email
+func (u *User) HasVerifiedEmail(email string) bool {
+	if u.IsPrimaryEmail(email) {
+		return u.EmailVerified
+	}
+	return containsEmail(u.VerifiedEmails, email)
+}
+
+// AddEmail adds email to the user's emails as an unverified secondary email
+func (u *User) AddEmail(email string) {
+	if !u.HasEmail(email) {
+		u.Emails = append(u.Emails, email)
+	}
+}
+
+// RemoveEmail removes a secondary email from the user's emails
+func (u *User) RemoveEmail(email string) {
+	u.Emails = removeEmail(u.Emails, email)
+	u.VerifiedEmails = removeEmail(u.VerifiedEmails, email)
+}
+
+// MarkEmailVerified records that the user has verified email
+func (u *User) MarkEmailVerified(email string) {
+	if u.IsPrimaryEmail(email) {
+		u.EmailVerified = true
+	} else if !containsEmail(u.VerifiedEmails, email) {
+		u.VerifiedEmails = append(u.VerifiedEmails, email)
+	}
+}
+
+// SetPrimaryEmail makes one of the user's secondary emails its username, keeping the previous
+// username as a secondary email along with its verification state
+func (u *User) SetPrimaryEmail(email string) {
+	previous, previousVerified := u.Username, u.EmailVerified
+	u.EmailVerified = u.HasVerifiedEmail(email)
+	u.VerifiedEmails = removeEmail(u.VerifiedEmails, email)
+	if previous != "" && previousVerified {
+		u.VerifiedEmails = append(u.VerifiedEmails, previous)
+	}
+	emails := []string{email}
+	if previous != "" && !containsEmail(u.Emails, previous) {
+		emails = append(emails, previous)
+	}
+	u.Emails = append(emails, removeEmail(u.Emails, email)...)
+	u.Username = email
+}
+
+// PruneVerifiedEmails drops verified emails the user no longer has
+func (u *User) PruneVerifiedEmails() {
+	var verifiedEmails []string
+	for _, email := range u.VerifiedEmails {
+		if u.HasEmail(email) && !u.IsPrimaryEmail(email) {
+			verifiedEmails = append(verifiedEmails, email)
+		}
+	}
+	u.VerifiedEmails = verifiedEmails
+}
+
+func containsEmail(emails []string, email string) bool {
+	for _, existing := range emails {
+		if SameEmail(existing, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeEmail(emails []string, email string) []string {
+	var remaining []string
+	for _, existing := range emails {
+		if !SameEmail(existing, email) {
+			remaining = append(remaining, existing)
+		}
+	}
+	return remaining
+}
+
 func (u *User) HasRole(role string) bool {
 	for _, userRole := range u.Roles {
 		if userRole == role {
@@ -492,28 +738,50 @@ func (u *User) IsEmailVerified(secret string) bool {
 	return u.EmailVerified
 }
 
-func (u *User) DeepClone() *User {
-	clonedUser := &User{
-		Id:            u.Id,
-		Username:      u.Username,
-		TermsAccepted: u.TermsAccepted,
-		EmailVerified: u.EmailVerified,
-		PwHash:        u.PwHash,
-		Hash:          u.Hash,
+// WithholdRoles removes the roles from the user's roles and records them as pending review
+func (u *User) WithholdRoles(roles []string) {
+	u.Roles = removeStrings(u.Roles, roles)
+	for _, role := range roles {
+		if !containsString(u.ReviewRoles, role) {
+			u.ReviewRoles = append(u.ReviewRoles, role)
+		}
 	}
+}
+
+func (u *User) DeepClone() *User {
+	clonedUser := *u
 	if u.Emails != nil {
 		clonedUser.Emails = make([]string, len(u.Emails))
 		copy(clonedUser.Emails, u.Emails)
 	}
+	if u.CanonicalEmails != nil {
+		clonedUser.CanonicalEmails = make([]string, len(u.CanonicalEmails))
+		copy(clonedUser.CanonicalEmails, u.CanonicalEmails)
+	}
 	if u.Roles != nil {
 		clonedUser.Roles = make([]string, len(u.Roles))
 		copy(clonedUser.Roles, u.Roles)
 	}
+	if u.ReviewRoles != nil {
+		clonedUser.ReviewRoles = make([]string, len(u.ReviewRoles))
+		copy(clonedUser.ReviewRoles, u.ReviewRoles)
+	}
+	if u.VerifiedEmails != nil {
+		clonedUser.VerifiedEmails = make([]string, len(u.VerifiedEmails))
+		copy(clonedUser.VerifiedEmails, u.VerifiedEmails)
+	}
+	if u.TermsAcceptances != nil {
+		clonedUser.TermsAcceptances = make([]*TermsAcceptance, len(u.TermsAcceptances))
+		for index, acceptance := range u.TermsAcceptances {
+			clonedAcceptance := *acceptance
+			clonedUser.TermsAcceptances[index] = &clonedAcceptance
+		}
+	}
 	if u.Private != nil {
 		clonedUser.Private = make(map[string]*IdHashPair)
 		for k, v := range u.Private {
 			clonedUser.Private[k] = &IdHashPair{Id: v.Id, Hash: v.Hash}
 		}
 	}
-	return clonedUser
+	return &clonedUser
 }
@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_ExtractBool_Missing(t *testing.T) {
@@ -144,19 +145,19 @@ func Test_IsValidEmail_Valid(t *testing.T) {
 	}
 }
 
-func Test_IsValidRole_Invalid(t *testing.T) {
-	invalidRoles := []string{"", "abcdefg"}
+func Test_IsValidRoleName_Invalid(t *testing.T) {
+	invalidRoles := []string{"", "Clinic", "1clinic", "clinic role"}
 	for _, invalidRole := range invalidRoles {
-		if IsValidRole(invalidRole) {
+		if IsValidRoleName(invalidRole) {
 			t.Fatalf("Invalid role %s is unexpectedly valid", invalidRole)
 		}
 	}
 }
 
-func Test_IsValidRole_Valid(t *testing.T) {
-	validRoles := []string{"clinic"}
+func Test_IsValidRoleName_Valid(t *testing.T) {
+	validRoles := []string{"clinic", "clinician", "data-steward"}
 	for _, validRole := range validRoles {
-		if !IsValidRole(validRole) {
+		if !IsValidRoleName(validRole) {
 			t.Fatalf("Valid role %s is unexpectedly invalid", validRole)
 		}
 	}
@@ -276,14 +277,25 @@ func Test_NewUserDetails_ExtractFromJSON_InvalidRoles(t *testing.T) {
 	}
 }
 
+func Test_NewUserDetails_ExtractFromJSON_InvalidSignupCode(t *testing.T) {
+	source := "{\"username\": \"a@z.co\", \"emails\": [\"b@y.co\"], \"password\": \"12345678\", \"signupCode\": 1}"
+	details := &NewUserDetails{}
+	if err := details.ExtractFromJSON(strings.NewReader(source)); err != User_error_signup_code_invalid {
+		t.Fatalf("Unexpected error for invalid signup code: %#v", err)
+	}
+	if details.Username != nil || details.SignupCode != nil {
+		t.Fatalf("Unexpected fields present on error for invalid signup code")
+	}
+}
+
 func Test_NewUserDetails_ExtractFromJSON_ValidAll(t *testing.T) {
-	source := "{\"username\": \"a@z.co\", \"emails\": [\"b@y.co\"], \"password\": \"12345678\", \"roles\": [\"clinic\"], \"ignored\": true}"
+	source := "{\"username\": \"a@z.co\", \"emails\": [\"b@y.co\"], \"password\": \"12345678\", \"roles\": [\"clinic\"], \"signupCode\": \"code\", \"ignored\": true}"
 	details := &NewUserDetails{}
 	err := details.ExtractFromJSON(strings.NewReader(source))
 	if err != nil {
 		t.Fatalf("Unexpected error for valid with all: %#v", err)
 	}
-	if *details.Username != "a@z.co" || !reflect.DeepEqual(details.Emails, []string{"b@y.co"}) || *details.Password != "12345678" || !reflect.DeepEqual(details.Roles, []string{"clinic"}) {
+	if *details.Username != "a@z.co" || !reflect.DeepEqual(details.Emails, []string{"b@y.co"}) || *details.Password != "12345678" || !reflect.DeepEqual(details.Roles, []string{"clinic"}) || *details.SignupCode != "code" {
 		t.Fatalf("Missing fields that should be present on success with all")
 	}
 }
@@ -397,13 +409,27 @@ func Test_NewUserDetails_Validate_Password_Invalid(t *testing.T) {
 func Test_NewUserDetails_Validate_Roles_Invalid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
-	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"invalid"}}
+	details := &NewUserDetails{Username: &username, Emails: []string{"b@y.co", "c@x.co"}, Password: &password, Roles: []string{"In Valid"}}
 	err := details.Validate()
 	if err != User_error_roles_invalid {
 		t.Fatalf("Unexpected error for roles invalid: %#v", err)
 	}
 }
 
+func Test_NewUserDetails_ValidateRoles(t *testing.T) {
+	registry := RoleRegistry{{Name: "clinic", SelfAssignable: true}, {Name: "support"}}
+	for roles, expected := range map[string]error{
+		"clinic":  nil,
+		"support": User_error_roles_invalid,
+		"invalid": User_error_roles_invalid,
+	} {
+		details := &NewUserDetails{Roles: []string{roles}}
+		if err := details.ValidateRoles(registry); err != expected {
+			t.Fatalf("Unexpected error for roles %s: %#v", roles, err)
+		}
+	}
+}
+
 func Test_NewUserDetails_Validate_Valid(t *testing.T) {
 	username := "a@z.co"
 	password := "12345678"
@@ -1067,6 +1093,79 @@ func Test_UpdateUserDetails_Validate_Valid(t *testing.T) {
 	}
 }
 
+func Test_UpdateUserDetails_Validate_TermsVersion(t *testing.T) {
+	termsAccepted := "2016-01-01T12:00:00-08:00"
+	termsVersion := "1"
+	emptyVersion := ""
+	for _, test := range []struct {
+		details *UpdateUserDetails
+		err     error
+	}{
+		{&UpdateUserDetails{TermsAccepted: &termsAccepted, TermsVersion: &termsVersion}, nil},
+		{&UpdateUserDetails{TermsVersion: &termsVersion}, User_error_terms_version_invalid},
+		{&UpdateUserDetails{TermsAccepted: &termsAccepted, TermsVersion: &emptyVersion}, User_error_terms_version_invalid},
+	} {
+		if err := test.details.Validate(); err != test.err {
+			t.Fatalf("Unexpected error for %#v: %#v", test.details, err)
+		}
+	}
+}
+
+func Test_UpdateUserDetails_ExtractFromJSON_TermsVersion(t *testing.T) {
+	details := &UpdateUserDetails{}
+	if err := details.ExtractFromJSON(strings.NewReader("{\"updates\": {\"termsVersion\": 1}}")); err != User_error_terms_version_invalid {
+		t.Fatalf("Unexpected error for invalid terms version: %#v", err)
+	}
+	if err := details.ExtractFromJSON(strings.NewReader("{\"updates\": {\"termsAccepted\": \"2016-01-01T12:00:00-08:00\", \"termsVersion\": \"1\"}}")); err != nil {
+		t.Fatalf("Unexpected error for terms version: %#v", err)
+	} else if details.TermsVersion == nil || *details.TermsVersion != "1" {
+		t.Fatalf("Unexpected terms version: %#v", details.TermsVersion)
+	}
+}
+
+func Test_UpdateUserDetails_ValidateRoles(t *testing.T) {
+	registry := RoleRegistry{{Name: "clinic", SelfAssignable: true}, {Name: "support"}}
+	details := &UpdateUserDetails{Roles: []string{"clinic", "support"}}
+	if err := details.ValidateRoles(registry); err != nil {
+		t.Fatalf("Unexpected error for valid roles: %#v", err)
+	}
+	details.Roles = append(details.Roles, "invalid")
+	if err := details.ValidateRoles(registry); err != User_error_roles_invalid {
+		t.Fatalf("Unexpected error for invalid roles: %#v", err)
+	}
+}
+
+func Test_UpdateUserDetails_AdministrativePermissions(t *testing.T) {
+	username := "a@z.co"
+	emailVerified := true
+	registry := RoleRegistry{
+		{Name: "clinic"},
+		{Name: "support", Permissions: []string{PERMISSION_SEARCH_USERS}},
+		{Name: "admin", Permissions: []string{PERMISSION_SUSPEND_USERS}, Implies: []string{"support"}},
+	}
+	details := &UpdateUserDetails{Roles: []string{"clinic"}, EmailVerified: &emailVerified}
+	if permissions := details.AdministrativePermissions(registry, nil); !reflect.DeepEqual(permissions, []string{PERMISSION_EDIT_ROLES, PERMISSION_VERIFY_EMAIL}) {
+		t.Fatalf("Unexpected administrative permissions: %v", permissions)
+	}
+	granting := &UpdateUserDetails{Roles: []string{"clinic", "admin"}}
+	if permissions := granting.AdministrativePermissions(registry, []string{"clinic"}); !reflect.DeepEqual(permissions, []string{PERMISSION_EDIT_ROLES, PERMISSION_SUSPEND_USERS, PERMISSION_SEARCH_USERS}) {
+		t.Fatalf("Unexpected administrative permissions granting roles: %v", permissions)
+	}
+	if permissions := granting.AdministrativePermissions(registry, []string{"clinic", "admin", "support"}); !reflect.DeepEqual(permissions, []string{PERMISSION_EDIT_ROLES}) {
+		t.Fatalf("Unexpected administrative permissions keeping roles: %v", permissions)
+	}
+	if !details.IsAdministrative() {
+		t.Fatalf("Details are unexpectedly not administrative")
+	}
+	details.Username = &username
+	if details.IsAdministrative() {
+		t.Fatalf("Details are unexpectedly administrative")
+	}
+	if permissions := (&UpdateUserDetails{Username: &username}).AdministrativePermissions(registry, nil); len(permissions) != 0 {
+		t.Fatalf("Unexpected administrative permissions: %v", permissions)
+	}
+}
+
 func Test_ParseUpdateUserDetails_InvalidJSON(t *testing.T) {
 	source := ""
 	details, err := ParseUpdateUserDetails(strings.NewReader(source))
@@ -1293,3 +1392,116 @@ func Test_User_DeepClone(t *testing.T) {
 		t.Fatalf("The clone user is not exactly equal to the original user")
 	}
 }
+
+func Test_User_MarkDeleted(t *testing.T) {
+	user := &User{Id: "1234567890"}
+	user.MarkDeleted("0987654321", time.Date(2016, 1, 1, 1, 23, 45, 0, time.UTC))
+	if !user.IsDeleted() || user.DeletedTime != "2016-01-01T01:23:45+00:00" || user.DeletedUserID != "0987654321" {
+		t.Fatalf("User was not marked deleted as expected: %#v", user)
+	}
+}
+
+func Test_User_Restore(t *testing.T) {
+	user := &User{Id: "1234567890", DeletedTime: "2016-01-01T01:23:45+00:00", DeletedUserID: "0987654321"}
+	user.Restore()
+	if user.IsDeleted() || user.DeletedUserID != "" {
+		t.Fatalf("User was not restored as expected: %#v", user)
+	}
+}
+
+func Test_User_IsRestorable(t *testing.T) {
+	now := time.Date(2016, 1, 10, 0, 0, 0, 0, time.UTC)
+	gracePeriod := 7 * 24 * time.Hour
+	if (&User{}).IsRestorable(gracePeriod, now) {
+		t.Fatalf("User that is not deleted should not be restorable")
+	}
+	if !(&User{DeletedTime: "2016-01-05T00:00:00+00:00"}).IsRestorable(gracePeriod, now) {
+		t.Fatalf("User deleted within the grace period should be restorable")
+	}
+	if (&User{DeletedTime: "2016-01-01T00:00:00+00:00"}).IsRestorable(gracePeriod, now) {
+		t.Fatalf("User deleted before the grace period should not be restorable")
+	}
+	if (&User{DeletedTime: "2016-01-05T00:00:00+00:00", PurgedTime: "2016-01-06T00:00:00+00:00"}).IsRestorable(gracePeriod, now) {
+		t.Fatalf("User that is purged should not be restorable")
+	}
+}
+
+func Test_User_Anonymized(t *testing.T) {
+	user := &User{Id: "1234567890", Username: "a@b.co", Emails: []string{"a@b.co"}, PwHash: "xyz", DeletedTime: "2016-01-01T01:23:45+00:00", DeletedUserID: "1234567890"}
+	anonymized := user.Anonymized(time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC))
+	expected := &User{Id: "1234567890", DeletedTime: "2016-01-01T01:23:45+00:00", DeletedUserID: "1234567890", PurgedTime: "2016-02-01T00:00:00+00:00"}
+	if !reflect.DeepEqual(anonymized, expected) {
+		t.Fatalf("Anonymized user %#v does not match expected %#v", anonymized, expected)
+	}
+}
+
+func Test_User_ChangeEmail(t *testing.T) {
+	user := &User{Id: "1234567890", Username: "a@b.co", Emails: []string{"a@b.co", "c@d.co", "E@F.co"}, PendingEmail: "e@f.co"}
+	user.ChangeEmail("e@f.co")
+	expected := &User{Id: "1234567890", Username: "e@f.co", Emails: []string{"e@f.co", "c@d.co"}}
+	if !reflect.DeepEqual(user, expected) {
+		t.Fatalf("Changed user %#v does not match expected %#v", user, expected)
+	}
+}
+
+func Test_User_MarkEmailVerified(t *testing.T) {
+	user := &User{Username: "a@b.co", Emails: []string{"a@b.co", "c@d.co"}}
+	user.MarkEmailVerified("c@d.co")
+	if user.EmailVerified || !user.HasVerifiedEmail("C@D.co") {
+		t.Fatalf("Secondary email was not verified as expected: %#v", user)
+	}
+	user.MarkEmailVerified("a@b.co")
+	if !user.EmailVerified || !user.HasVerifiedEmail("a@b.co") {
+		t.Fatalf("Primary email was not verified as expected: %#v", user)
+	}
+}
+
+func Test_User_SetPrimaryEmail(t *testing.T) {
+	user := &User{Username: "a@b.co", Emails: []string{"a@b.co", "c@d.co", "e@f.co"}, EmailVerified: true, VerifiedEmails: []string{"c@d.co"}}
+	user.SetPrimaryEmail("c@d.co")
+	expected := &User{Username: "c@d.co", Emails: []string{"c@d.co", "a@b.co", "e@f.co"}, EmailVerified: true, VerifiedEmails: []string{"a@b.co"}}
+	if !reflect.DeepEqual(user, expected) {
+		t.Fatalf("User %#v does not match expected %#v", user, expected)
+	}
+	user.SetPrimaryEmail("e@f.co")
+	expected = &User{Username: "e@f.co", Emails: []string{"e@f.co", "c@d.co", "a@b.co"}, EmailVerified: false, VerifiedEmails: []string{"a@b.co", "c@d.co"}}
+	if !reflect.DeepEqual(user, expected) {
+		t.Fatalf("User %#v does not match expected %#v", user, expected)
+	}
+}
+
+func Test_User_RemoveEmail(t *testing.T) {
+	user := &User{Username: "a@b.co", Emails: []string{"a@b.co", "c@d.co"}, VerifiedEmails: []string{"c@d.co"}}
+	user.RemoveEmail("C@D.co")
+	if user.HasEmail("c@d.co") || len(user.VerifiedEmails) != 0 {
+		t.Fatalf("Email was not removed as expected: %#v", user)
+	}
+}
+
+func Test_User_PruneVerifiedEmails(t *testing.T) {
+	user := &User{Username: "a@b.co", Emails: []string{"a@b.co", "c@d.co"}, VerifiedEmails: []string{"a@b.co", "c@d.co", "e@f.co"}}
+	user.PruneVerifiedEmails()
+	if !reflect.DeepEqual(user.VerifiedEmails, []string{"c@d.co"}) {
+		t.Fatalf("Verified emails were not pruned as expected: %#v", user.VerifiedEmails)
+	}
+}
+
+func Test_User_MarkCreated(t *testing.T) {
+	user := &User{Id: "1234567890"}
+	user.MarkCreated("0987654321", time.Date(2016, 1, 1, 1, 23, 45, 0, time.FixedZone("PST", -8*60*60)))
+	if user.CreatedTime != "2016-01-01T09:23:45+00:00" || user.CreatedUserID != "0987654321" || user.ModifiedTime != user.CreatedTime || user.ModifiedUserID != "0987654321" {
+		t.Fatalf("User was not marked created as expected: %#v", user)
+	}
+}
+
+func Test_User_MarkSuspended(t *testing.T) {
+	user := &User{Id: "1111111111"}
+	user.MarkSuspended("0000000000", time.Date(2016, 1, 1, 1, 0, 0, 0, time.FixedZone("", -8*60*60)))
+	if !user.IsSuspended() || user.SuspendedTime != "2016-01-01T09:00:00+00:00" || user.SuspendedUserID != "0000000000" {
+		t.Fatalf("Unexpected suspended user: %#v", user)
+	}
+	user.Unsuspend()
+	if user.IsSuspended() || user.SuspendedUserID != "" {
+		t.Fatalf("Unexpected unsuspended user: %#v", user)
+	}
+}